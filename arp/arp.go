@@ -0,0 +1,78 @@
+/*
+Package arp はIPv4とイーサネットのARPのパケットをパースしたりバイト列にしたりする
+*/
+package arp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const PACKET_LEN = 28
+
+const (
+	OPERATION_CODE_REQUEST uint16 = 1
+	OPERATION_CODE_REPLY   uint16 = 2
+)
+
+const HTYPE_ETHERNET uint16 = 0x0001
+const PTYPE_IPV4 uint16 = 0x0800
+const HARDWARE_LEN_ETHERNET uint8 = 6
+const PROTOCOL_LEN_IPV4 uint8 = 4
+
+type Packet struct {
+	HardwareType       uint16   // ハードウェアタイプ
+	ProtocolType       uint16   // プロトコルタイプ
+	HardwareLen        uint8    // ハードウェアアドレス長
+	ProtocolLen        uint8    // プロトコルアドレス長
+	Opcode             uint16   // オペレーションコード
+	SenderHardwareAddr [6]uint8 // 送信元のMACアドレス
+	SenderIPAddr       uint32   // 送信者のIPアドレス
+	TargetHardwareAddr [6]uint8 // ターゲットのMACアドレス
+	TargetIPAddr       uint32   // ターゲットのIPアドレス
+}
+
+/*
+IPv4とイーサネットのARPのパケットとして解釈する
+アドレス長が6byteと4byteでなければアドレスの位置が変わるのでエラーにする
+*/
+func Parse(packet []byte) (Packet, error) {
+	if len(packet) < PACKET_LEN {
+		return Packet{}, fmt.Errorf("arp packet length %d is shorter than %d", len(packet), PACKET_LEN)
+	}
+	arp := Packet{
+		HardwareType: binary.BigEndian.Uint16(packet[0:2]),
+		ProtocolType: binary.BigEndian.Uint16(packet[2:4]),
+		HardwareLen:  packet[4],
+		ProtocolLen:  packet[5],
+		Opcode:       binary.BigEndian.Uint16(packet[6:8]),
+		SenderIPAddr: binary.BigEndian.Uint32(packet[14:18]),
+		TargetIPAddr: binary.BigEndian.Uint32(packet[24:28]),
+	}
+	if arp.HardwareLen != HARDWARE_LEN_ETHERNET || arp.ProtocolLen != PROTOCOL_LEN_IPV4 {
+		return Packet{}, fmt.Errorf("arp address length %d/%d is not supported", arp.HardwareLen, arp.ProtocolLen)
+	}
+	copy(arp.SenderHardwareAddr[:], packet[8:14])
+	copy(arp.TargetHardwareAddr[:], packet[18:24])
+	return arp, nil
+}
+
+/*
+ARPのパケットをバイト列にする
+*/
+func (arp Packet) Marshal() ([]byte, error) {
+	if arp.HardwareLen != HARDWARE_LEN_ETHERNET || arp.ProtocolLen != PROTOCOL_LEN_IPV4 {
+		return nil, fmt.Errorf("arp address length %d/%d is not supported", arp.HardwareLen, arp.ProtocolLen)
+	}
+	packet := make([]byte, PACKET_LEN)
+	binary.BigEndian.PutUint16(packet[0:2], arp.HardwareType)
+	binary.BigEndian.PutUint16(packet[2:4], arp.ProtocolType)
+	packet[4] = arp.HardwareLen
+	packet[5] = arp.ProtocolLen
+	binary.BigEndian.PutUint16(packet[6:8], arp.Opcode)
+	copy(packet[8:14], arp.SenderHardwareAddr[:])
+	binary.BigEndian.PutUint32(packet[14:18], arp.SenderIPAddr)
+	copy(packet[18:24], arp.TargetHardwareAddr[:])
+	binary.BigEndian.PutUint32(packet[24:28], arp.TargetIPAddr)
+	return packet, nil
+}
@@ -0,0 +1,78 @@
+package arp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testPacket() Packet {
+	return Packet{
+		HardwareType:       HTYPE_ETHERNET,
+		ProtocolType:       PTYPE_IPV4,
+		HardwareLen:        HARDWARE_LEN_ETHERNET,
+		ProtocolLen:        PROTOCOL_LEN_IPV4,
+		Opcode:             OPERATION_CODE_REQUEST,
+		SenderHardwareAddr: [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+		SenderIPAddr:       0xc0a80101,
+		TargetIPAddr:       0xc0a80102,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	arp := testPacket()
+	packet, err := arp.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01,
+		0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0xc0, 0xa8, 0x01, 0x01,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xc0, 0xa8, 0x01, 0x02}
+	if !bytes.Equal(packet, want) {
+		t.Fatalf("marshaled packet is %x, want %x", packet, want)
+	}
+	parsed, err := Parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != arp {
+		t.Fatalf("parsed %+v, want %+v", parsed, arp)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	packet, _ := testPacket().Marshal()
+	for n := 0; n < PACKET_LEN; n++ {
+		if _, err := Parse(packet[:n]); err == nil {
+			t.Fatalf("parse %d bytes packet is not err", n)
+		}
+	}
+	// イーサネットの後ろにパディングがついていてもパースできる
+	if _, err := Parse(append(packet, make([]byte, 18)...)); err != nil {
+		t.Fatalf("parse padded packet err : %s", err)
+	}
+	packet[4] = 8
+	if _, err := Parse(packet); err == nil {
+		t.Fatal("parse packet with hardware address length 8 is not err")
+	}
+	arp := testPacket()
+	arp.ProtocolLen = 16
+	if _, err := arp.Marshal(); err == nil {
+		t.Fatal("marshal packet with protocol address length 16 is not err")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	packet, _ := testPacket().Marshal()
+	f.Add(packet)
+	f.Add(packet[:PACKET_LEN-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		arp, err := Parse(data)
+		if err != nil {
+			return
+		}
+		packet, err := arp.Marshal()
+		if err != nil || !bytes.Equal(packet, data[:PACKET_LEN]) {
+			t.Fatalf("packet %x is marshaled to %x, %v", data, packet, err)
+		}
+	})
+}
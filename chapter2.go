@@ -1,120 +1,120 @@
 package main
 
 import (
-	"fmt"
 	"log"
-	"net"
-	"syscall"
+
+	"github.com/sat0ken/go-curo/curo"
 )
 
-// Global変数でルーティングテーブルを宣言
-var iproute radixTreeNode
+// 引数で指定するルータの設定
+type chapter2Config struct {
+	nat            curo.NatOptions // ch5で使う
+	vlans          []string
+	bridges        []string
+	bonds          []string
+	taps           []string
+	tuns           []string
+	rstp           bool
+	rstpPriority   uint16
+	lldp           bool
+	lldpSystemName string
+	lldpNeighbors  string
+	capture        curo.CaptureOptions // Pathが空ならキャプチャしない
+	drivers        []string            // 空ならAF_PACKETのソケットを使う
+}
 
-// Global変数で宣言
-var netDeviceList []*netDevice
+func runChapter2(mode string, conf chapter2Config) {
+	router := newChapter2Router(mode, conf)
+	runRouter(router)
+}
 
-func runChapter2(mode string) {
+/*
+pcapngのファイルのフレームをmodeのルータに受信させ、送信したフレームをoutputに書き出す
+*/
+func runReplay(mode, input, output string, conf chapter2Config) {
+	if input == "" || output == "" {
+		log.Fatalf("replay needs -replay and -replay-output")
+	}
+	router := newChapter2Router(mode, conf)
+	if err := router.Replay(input, output); err != nil {
+		log.Fatalf("replay err : %s", err)
+	}
+	if err := router.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// 直接接続ではないhost2へのルーティングを登録する
-	routeEntryTohost2 := ipRouteEntry{
-		iptype:  network,
-		nexthop: 0xc0a80002,
+/*
+引数の設定でルータを作る
+*/
+func newChapter2Router(mode string, conf chapter2Config) *curo.Router {
+	router := curo.NewRouter(mode)
+	for _, rule := range conf.drivers {
+		if err := router.SetDriver(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := router.AddInterfaces(); err != nil {
+		log.Fatal(err)
 	}
-	// 192.168.2.0/24の経路の登録
-	iproute.radixTreeAdd(0xc0a80202&0xffffff00, 24, routeEntryTohost2)
 
-	// epoll作成
-	events := make([]syscall.EpollEvent, 10)
-	epfd, err := syscall.EpollCreate1(0)
-	if err != nil {
-		log.Fatalf("epoll create err : %s", err)
+	// 直接接続ではないhost2へのルーティングを登録する
+	// 192.168.2.0/24の経路の登録
+	if err := router.AddRoute("192.168.2.0/24", "192.168.0.2"); err != nil {
+		log.Fatal(err)
 	}
 
-	// ネットワークインターフェイスの情報を取得
-	interfaces, _ := net.Interfaces()
-	for _, netif := range interfaces {
-		// 無視するインターフェイスか確認
-		if !isIgnoreInterfaces(netif.Name) {
-			// socketをオープン
-			sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
-			if err != nil {
-				log.Fatalf("create socket err : %s", err)
-			}
-			// socketにインターフェイスをbindする
-			addr := syscall.SockaddrLinklayer{
-				Protocol: htons(syscall.ETH_P_ALL),
-				Ifindex:  netif.Index,
-			}
-			err = syscall.Bind(sock, &addr)
-			if err != nil {
-				log.Fatalf("bind err : %s", err)
-			}
-			fmt.Printf("Created device %s socket %d adddress %s\n",
-				netif.Name, sock, netif.HardwareAddr.String())
-			// socketをepollの監視対象として登録
-			err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, sock, &syscall.EpollEvent{
-				Events: syscall.EPOLLIN,
-				Fd:     int32(sock),
-			})
-			// ノンブロッキングに設定←epollを使うのでしない
-			//err = syscall.SetNonblock(sock, true)
-			//if err != nil {
-			//	log.Fatalf("set non block is err : %s", err)
-			//}
-			netaddrs, err := netif.Addrs()
-			if err != nil {
-				log.Fatalf("get ip addr from nic interface is err : %s", err)
-			}
+	// TUN/TAPのデバイスを作ってカーネルのネットワークスタックとつなぐ
+	for _, rule := range conf.taps {
+		if err := router.AddTap(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, rule := range conf.tuns {
+		if err := router.AddTun(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-			netdev := netDevice{
-				name:     netif.Name,
-				macaddr:  setMacAddr(netif.HardwareAddr),
-				socket:   sock,
-				sockaddr: addr,
-				ipdev:    getIPdevice(netaddrs),
-			}
+	// bondの論理デバイスを作ってメンバーのデバイスをまとめる
+	for _, rule := range conf.bonds {
+		if err := router.AddBond(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-			// 直接接続ネットワークの経路をルートテーブルのエントリに設定
-			routeEntry := ipRouteEntry{
-				iptype: connected,
-				netdev: &netdev,
-			}
-			prefixLen := subnetToPrefixLen(netdev.ipdev.netmask)
-			iproute.radixTreeAdd(netdev.ipdev.address&netdev.ipdev.netmask, prefixLen, routeEntry)
-			fmt.Printf("Set directly connected route %s/%d via %s\n",
-				printIPAddr(netdev.ipdev.address&netdev.ipdev.netmask), prefixLen, netdev.name)
+	// VLANのサブインターフェイスを親のデバイスの上に作る
+	for _, rule := range conf.vlans {
+		if err := router.AddVlan(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-			// netDevice構造体を作成
-			// net_deviceの連結リストに連結させる
-			netDeviceList = append(netDeviceList, &netdev)
+	// ブリッジを作ってポートのデバイスを所属させる
+	for _, rule := range conf.bridges {
+		if err := router.AddBridge(rule, conf.rstp, conf.rstpPriority); err != nil {
+			log.Fatal(err)
 		}
 	}
 
 	// 5章で追加
 	// chapter5のNW構成で動作させるときは、NATの設定の投入
 	if mode == "ch5" {
-		configureIPNat("router1-br0", getnetDeviceByName("router1-router2").ipdev.address)
+		if err := router.ConfigureNat("router1-br0", "router1-router2", conf.nat); err != nil {
+			log.Fatalf("configure nat err : %s", err)
+		}
 	}
 
-	fmt.Printf("mode is %s start router...\n", mode)
+	// 全てのデバイスを作ってからLLDPで隣接機器に知らせる
+	if conf.lldp {
+		router.EnableLldp(conf.lldpSystemName, conf.lldpNeighbors)
+	}
 
-	for {
-		// epoll_waitでパケットの受信を待つ
-		nfds, err := syscall.EpollWait(epfd, events, -1)
-		if err != nil {
-			log.Fatalf("epoll wait err : %s", err)
-		}
-		for i := 0; i < nfds; i++ {
-			// デバイスから通信を受信
-			for _, netdev := range netDeviceList {
-				// イベントがあったソケットとマッチしたらパケットを読み込む処理を実行
-				if events[i].Fd == int32(netdev.socket) {
-					err := netdev.netDevicePoll(mode)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-			}
+	// ルータが送受信するフレームをファイルに書き出す
+	if conf.capture.Path != "" {
+		if err := router.EnableCapture(conf.capture); err != nil {
+			log.Fatalf("enable capture err : %s", err)
 		}
 	}
+	return router
 }
@@ -0,0 +1,89 @@
+/*
+Package checksum はIP, ICMP, TCP, UDPのインターネットチェックサムを計算する
+*/
+package checksum
+
+/*
+16ビットごとの1の補数和を取る
+長さが奇数なら最後の1byteの後ろを0で埋めて足す
+*/
+func sum(b []byte, initial uint32) uint32 {
+	s := initial
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// あふれた桁を足して16bitに収める
+func fold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+/*
+チェックサムを計算する
+チェックサムのフィールドを0にしたデータから計算した値をセットし、
+セットしたデータから計算すると0になる
+*/
+func Checksum(b []byte) uint16 {
+	return ^fold(sum(b, 0))
+}
+
+/*
+IPv4の疑似ヘッダを含めてTCPやUDPのチェックサムを計算する
+*/
+func Transport(srcAddr, destAddr uint32, protocol uint8, segment []byte) uint16 {
+	s := srcAddr>>16 + srcAddr&0xffff + destAddr>>16 + destAddr&0xffff
+	s += uint32(protocol) + uint32(len(segment))
+	return ^fold(sum(segment, s))
+}
+
+/*
+16bitの値をoldからnewに書き換えたときのチェックサムを差分だけで計算し直す
+RFC 1624の式3 HC' = ~(~HC + ~m + m') を使うので、全体を計算し直すChecksumと同じ値になる
+*/
+func Adjust(checksum, old, new uint16) uint16 {
+	return ^fold(uint32(^checksum) + uint32(^old) + uint32(new))
+}
+
+/*
+IPアドレスのような32bitの値を書き換えたときのチェックサムを計算し直す
+*/
+func Adjust32(checksum uint16, old, new uint32) uint16 {
+	checksum = Adjust(checksum, uint16(old>>16), uint16(new>>16))
+	return Adjust(checksum, uint16(old), uint16(new))
+}
+
+/*
+UDPのチェックサムを計算し直す
+0はチェックサムを使っていないという意味なのでそのままにして、計算結果が0なら0xffffにする
+*/
+func AdjustUDP(checksum, old, new uint16) uint16 {
+	if checksum == 0 {
+		return 0
+	}
+	if checksum = Adjust(checksum, old, new); checksum == 0 {
+		return 0xffff
+	}
+	return checksum
+}
+
+/*
+Adjust32のUDP版で、32bitの値を書き換えたときのUDPのチェックサムを計算し直す
+AdjustUDPと同じく0はそのままにして、計算結果が0なら0xffffにする
+*/
+func AdjustUDP32(checksum uint16, old, new uint32) uint16 {
+	if checksum == 0 {
+		return 0
+	}
+	if checksum = Adjust32(checksum, old, new); checksum == 0 {
+		return 0xffff
+	}
+	return checksum
+}
@@ -0,0 +1,108 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"testing"
+	"testing/quick"
+)
+
+func TestChecksum(t *testing.T) {
+	// RFC 1071の例
+	data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got := Checksum(data); got != ^uint16(0xddf2) {
+		t.Fatalf("checksum is %04x", got)
+	}
+	// IPv4ヘッダのチェックサムを入れると0になる
+	header := []byte{0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+		0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7}
+	sum := Checksum(header)
+	if sum != 0xb861 {
+		t.Fatalf("ipv4 header checksum is %04x", sum)
+	}
+	header[10], header[11] = uint8(sum>>8), uint8(sum)
+	if Checksum(header) != 0 {
+		t.Fatal("checksum of header with checksum is not 0")
+	}
+	// 奇数の長さ
+	if Checksum([]byte{0x01}) != ^uint16(0x0100) {
+		t.Fatal("checksum of odd length data is wrong")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	segment := []byte{0x04, 0xd2, 0x00, 0x35, 0x00, 0x0c, 0x00, 0x00, 'a', 'b', 'c', 'd'}
+	sum := Transport(0xc0a80102, 0xc0a80202, 17, segment)
+	segment[6], segment[7] = uint8(sum>>8), uint8(sum)
+	if Transport(0xc0a80102, 0xc0a80202, 17, segment) != 0 {
+		t.Fatal("transport checksum of segment with checksum is not 0")
+	}
+}
+
+// 16bitの位置を書き換えてから全体を計算し直したチェックサムと差分で計算したものを比べる
+func TestAdjustMatchesChecksum(t *testing.T) {
+	property := func(data []byte, offset uint8, value uint16) bool {
+		// すべて0のデータはチェックサムが0xffffになるので除く
+		data = append(data, 0x01, 0x02)
+		if len(data)%2 != 0 {
+			data = append(data, 0)
+		}
+		pos := int(offset) % (len(data) / 2) * 2
+		sum := Checksum(data)
+
+		old := binary.BigEndian.Uint16(data[pos:])
+		binary.BigEndian.PutUint16(data[pos:], value)
+		return Adjust(sum, old, value) == Checksum(data)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdjust32MatchesChecksum(t *testing.T) {
+	property := func(header [20]byte, addr uint32, dest bool) bool {
+		header[0] = 0x45
+		pos := 12
+		if dest {
+			pos = 16
+		}
+		header[10], header[11] = 0, 0
+		binary.BigEndian.PutUint16(header[10:12], Checksum(header[:]))
+
+		old := binary.BigEndian.Uint32(header[pos:])
+		binary.BigEndian.PutUint32(header[pos:], addr)
+		adjusted := Adjust32(binary.BigEndian.Uint16(header[10:12]), old, addr)
+		header[10], header[11] = 0, 0
+		return adjusted == Checksum(header[:])
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdjustUDP(t *testing.T) {
+	// チェックサムを使っていないUDPは0のまま
+	if sum := AdjustUDP32(0, 0xc0a80102, 0xc0a80001); sum != 0 {
+		t.Fatalf("unused udp checksum is adjusted to %x", sum)
+	}
+	if sum := AdjustUDP(0, 5000, 20000); sum != 0 {
+		t.Fatalf("unused udp checksum is adjusted to %x", sum)
+	}
+	// 計算結果が0になるときは0xffffにする
+	if sum := AdjustUDP(0x0001, 0x0000, 0x0001); sum != 0xffff {
+		t.Fatalf("zero udp checksum is %x", sum)
+	}
+	if sum := AdjustUDP32(0x0001, 0x00000000, 0x00000001); sum != 0xffff {
+		t.Fatalf("zero udp checksum is %x", sum)
+	}
+
+	// UDPのデータグラムのアドレスとポートを書き換えてもチェックサムが合う
+	segment := []byte{0x13, 0x88, 0x00, 0x35, 0x00, 0x0c, 0x00, 0x00, 'a', 'b', 'c', 'd'}
+	sum := Transport(0xc0a80102, 0x08080808, 17, segment)
+	sum = AdjustUDP32(sum, 0xc0a80102, 0xc0a80001)
+	sum = AdjustUDP(sum, 5000, 20000)
+	binary.BigEndian.PutUint16(segment[0:2], 20000)
+	binary.BigEndian.PutUint16(segment[6:8], sum)
+	if Transport(0xc0a80001, 0x08080808, 17, segment) != 0 {
+		t.Fatal("adjusted udp checksum is invalid")
+	}
+}
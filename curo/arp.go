@@ -1,20 +1,15 @@
-package main
+package curo
 
 import (
-	"bytes"
 	"fmt"
+
+	"github.com/sat0ken/go-curo/arp"
 )
 
 const ARP_OPERATION_CODE_REQUEST = 1
 const ARP_OPERATION_CODE_REPLY = 2
 const ARP_HTYPE_ETHERNET uint16 = 0001
 
-/**
- * ARPテーブル
- * グローバル変数にテーブルを保持
- */
-var ArpTableEntryList []arpTableEntry
-
 type arpIPToEthernet struct {
 	hardwareType        uint16   // ハードウェアタイプ
 	protocolType        uint16   // プロトコルタイプ
@@ -34,19 +29,42 @@ type arpTableEntry struct {
 }
 
 func (arpmsg arpIPToEthernet) ToPacket() []byte {
-	var b bytes.Buffer
-
-	b.Write(uint16ToByte(arpmsg.hardwareType))
-	b.Write(uint16ToByte(arpmsg.protocolType))
-	b.Write([]byte{arpmsg.hardwareLen})
-	b.Write([]byte{arpmsg.protocolLen})
-	b.Write(uint16ToByte(arpmsg.opcode))
-	b.Write(macToByte(arpmsg.senderHardwareAddr))
-	b.Write(uint32ToByte(arpmsg.senderIPAddr))
-	b.Write(macToByte(arpmsg.targetHardwareAddrr))
-	b.Write(uint32ToByte(arpmsg.targetIPAddr))
-
-	return b.Bytes()
+	packet, err := arp.Packet{
+		HardwareType:       arpmsg.hardwareType,
+		ProtocolType:       arpmsg.protocolType,
+		HardwareLen:        arpmsg.hardwareLen,
+		ProtocolLen:        arpmsg.protocolLen,
+		Opcode:             arpmsg.opcode,
+		SenderHardwareAddr: arpmsg.senderHardwareAddr,
+		SenderIPAddr:       arpmsg.senderIPAddr,
+		TargetHardwareAddr: arpmsg.targetHardwareAddrr,
+		TargetIPAddr:       arpmsg.targetIPAddr,
+	}.Marshal()
+	if err != nil {
+		fmt.Printf("marshal arp packet err : %s\n", err)
+	}
+	return packet
+}
+
+/*
+ARPパケットを構造体にセットする
+*/
+func parseArpPacket(packet []byte) (arpIPToEthernet, error) {
+	parsed, err := arp.Parse(packet)
+	if err != nil {
+		return arpIPToEthernet{}, err
+	}
+	return arpIPToEthernet{
+		hardwareType:        parsed.HardwareType,
+		protocolType:        parsed.ProtocolType,
+		hardwareLen:         parsed.HardwareLen,
+		protocolLen:         parsed.ProtocolLen,
+		opcode:              parsed.Opcode,
+		senderHardwareAddr:  parsed.SenderHardwareAddr,
+		senderIPAddr:        parsed.SenderIPAddr,
+		targetHardwareAddrr: parsed.TargetHardwareAddr,
+		targetIPAddr:        parsed.TargetIPAddr,
+	}, nil
 }
 
 /*
@@ -54,38 +72,15 @@ ARPパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L139
 */
 func arpInput(netdev *netDevice, packet []byte) {
-	// ARPパケットの規定より短かったら
-	if len(packet) < 28 {
-		fmt.Printf("received ARP Packet is too short")
+	// ARPパケットの規定より短いときやアドレス長が違うときはドロップ
+	arpMsg, err := parseArpPacket(packet)
+	if err != nil {
+		fmt.Printf("received ARP Packet is invalid : %s\n", err)
 		return
 	}
 
-	// 構造体にセット
-	arpMsg := arpIPToEthernet{
-		hardwareType:        byteToUint16(packet[0:2]),
-		protocolType:        byteToUint16(packet[2:4]),
-		hardwareLen:         packet[4],
-		protocolLen:         packet[5],
-		opcode:              byteToUint16(packet[6:8]),
-		senderHardwareAddr:  setMacAddr(packet[8:14]),
-		senderIPAddr:        byteToUint32(packet[14:18]),
-		targetHardwareAddrr: setMacAddr(packet[18:24]),
-		targetIPAddr:        byteToUint32(packet[24:28]),
-	}
-
 	switch arpMsg.protocolType {
 	case ETHER_TYPE_IP:
-
-		if arpMsg.hardwareLen != ETHERNET_ADDRES_LEN {
-			fmt.Println("Illegal hardware address length")
-			return
-		}
-
-		if arpMsg.protocolLen != IP_ADDRESS_LEN {
-			fmt.Println("Illegal protocol address length")
-			return
-		}
-
 		// オペレーションコードによって分岐
 		if arpMsg.opcode == ARP_OPERATION_CODE_REQUEST {
 			// ARPリクエストの受信
@@ -106,37 +101,35 @@ https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L2
 func addArpTableEntry(netdev *netDevice, ipaddr uint32, macaddr [6]uint8) {
 
 	// 既存のARPテーブルの更新が必要か確認
-	if len(ArpTableEntryList) != 0 {
-		for _, arpTable := range ArpTableEntryList {
-			// IPアドレスは同じだがMacアドレスが異なる場合は更新
-			if arpTable.ipAddr == ipaddr && arpTable.macAddr != macaddr {
-				arpTable.macAddr = macaddr
-			}
-			// Macアドレスは同じだがIPアドレスが変わった場合は更新
-			if arpTable.macAddr == macaddr && arpTable.ipAddr != ipaddr {
-				arpTable.ipAddr = ipaddr
-			}
-			// 既に存在する場合はreturnする
-			if arpTable.macAddr == macaddr && arpTable.ipAddr == ipaddr {
-				return
-			}
+	// ルータの先のホストは全て同じMACアドレスになるので、IPアドレスごとにエントリを持つ
+	router := netdev.router
+	for i, arpTable := range router.arpTable {
+		// VLANのサブインターフェイスごとに別のARPテーブルとして扱う
+		if arpTable.netdev != netdev || arpTable.ipAddr != ipaddr {
+			continue
+		}
+		// IPアドレスは同じだがMacアドレスが異なる場合は更新
+		if arpTable.macAddr != macaddr {
+			router.arpTable[i].macAddr = macaddr
 		}
+		// 既に存在する場合はreturnする
+		return
 	}
 
-	ArpTableEntryList = append(ArpTableEntryList, arpTableEntry{
+	router.arpTable = append(router.arpTable, arpTableEntry{
 		macAddr: macaddr,
 		ipAddr:  ipaddr,
 		netdev:  netdev,
 	})
-	//fmt.Printf("ARP TABEL is %+v\n", ArpTableEntryList)
+	//fmt.Printf("ARP TABEL is %+v\n", router.arpTable)
 }
 
 /*
 ARPテーブルの検索
 */
-func searchArpTableEntry(ipaddr uint32) ([6]uint8, *netDevice) {
-	if len(ArpTableEntryList) != 0 {
-		for _, arpTable := range ArpTableEntryList {
+func (router *Router) searchArpTableEntry(ipaddr uint32) ([6]uint8, *netDevice) {
+	if len(router.arpTable) != 0 {
+		for _, arpTable := range router.arpTable {
 			if arpTable.ipAddr == ipaddr {
 				return arpTable.macAddr, arpTable.netdev
 			}
@@ -145,13 +138,26 @@ func searchArpTableEntry(ipaddr uint32) ([6]uint8, *netDevice) {
 	return [6]uint8{}, nil
 }
 
+/*
+デバイスのARPテーブルの検索
+*/
+func searchArpTableEntryOnDevice(netdev *netDevice, ipaddr uint32) [6]uint8 {
+	for _, arpTable := range netdev.router.arpTable {
+		if arpTable.netdev == netdev && arpTable.ipAddr == ipaddr {
+			return arpTable.macAddr
+		}
+	}
+	return [6]uint8{}
+}
+
 /*
 ARPリクエストパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L181
 */
 func arpRequestArrives(netdev *netDevice, arp arpIPToEthernet) {
 	// IPアドレスが設定されているデバイスからの受信かつ要求されているアドレスが自分の物だったら
-	if netdev.ipdev.address != 00000000 && netdev.ipdev.address == arp.targetIPAddr {
+	// 5章で追加: このデバイスのネットワークにあるNATの外側のアドレスのプールにも応答する
+	if netdev.ipdev.address != 00000000 && (netdev.ipdev.address == arp.targetIPAddr || isNatPoolAddrOnDevice(netdev, arp.targetIPAddr)) {
 		fmt.Printf("Sending arp reply to %s\n", printIPAddr(arp.targetIPAddr))
 		// APRリプライのパケットを作成
 		arpPacket := arpIPToEthernet{
@@ -161,7 +167,7 @@ func arpRequestArrives(netdev *netDevice, arp arpIPToEthernet) {
 			protocolLen:         IP_ADDRESS_LEN,
 			opcode:              ARP_OPERATION_CODE_REPLY,
 			senderHardwareAddr:  netdev.macaddr,
-			senderIPAddr:        netdev.ipdev.address,
+			senderIPAddr:        arp.targetIPAddr,
 			targetHardwareAddrr: arp.senderHardwareAddr,
 			targetIPAddr:        arp.senderIPAddr,
 		}.ToPacket()
@@ -171,6 +177,21 @@ func arpRequestArrives(netdev *netDevice, arp arpIPToEthernet) {
 	}
 }
 
+/*
+NATの外側のアドレスのプールのうち、デバイスのネットワークにあるアドレスか確認する
+*/
+func isNatPoolAddrOnDevice(netdev *netDevice, ipaddr uint32) bool {
+	if ipaddr&netdev.ipdev.netmask != netdev.ipdev.address&netdev.ipdev.netmask {
+		return false
+	}
+	for _, dev := range netdev.router.devices {
+		if dev.ipdev.natdev != (natDevice{}) && dev.ipdev.natdev.isOutsideAddr(ipaddr) {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 ARPリプライパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/arp.cpp#L213
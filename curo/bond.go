@@ -0,0 +1,429 @@
+package curo
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"time"
+)
+
+const ETHER_TYPE_SLOW_PROTOCOLS uint16 = 0x8809
+
+const (
+	LACP_SUBTYPE                 uint8  = 1
+	LACP_VERSION                 uint8  = 1
+	LACPDU_LEN                          = 110
+	LACP_DEFAULT_SYSTEM_PRIORITY uint16 = 65535
+	LACP_DEFAULT_PORT_PRIORITY   uint16 = 255
+	LACP_FAST_PERIODIC_TIME             = 1 * time.Second
+	LACP_SHORT_TIMEOUT_TIME             = 3 * time.Second // 対向からLACPDUが届かなければメンバーから外すまでの時間
+)
+
+// LACPDUの宛先のMACアドレス
+var LACP_MAC_ADDRESS = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x02}
+
+// LACPのポートの状態のビット
+const (
+	LACP_STATE_ACTIVITY        uint8 = 0x01
+	LACP_STATE_TIMEOUT         uint8 = 0x02 // 短いタイムアウト
+	LACP_STATE_AGGREGATION     uint8 = 0x04
+	LACP_STATE_SYNCHRONIZATION uint8 = 0x08
+	LACP_STATE_COLLECTING      uint8 = 0x10
+	LACP_STATE_DISTRIBUTING    uint8 = 0x20
+	LACP_STATE_DEFAULTED       uint8 = 0x40
+	LACP_STATE_EXPIRED         uint8 = 0x80
+)
+
+// bondの設定
+type bondConfig struct {
+	name    string
+	members []string
+	address uint32 // bondのインターフェイスのアドレス, 0ならアドレスをつけない
+	netmask uint32
+}
+
+// LACPDUのActorとPartnerの情報
+type lacpInfo struct {
+	systemPriority uint16
+	system         [6]uint8
+	key            uint16
+	portPriority   uint16
+	port           uint16
+	state          uint8
+}
+
+type lacpdu struct {
+	actor             lacpInfo
+	partner           lacpInfo
+	collectorMaxDelay uint16
+}
+
+// bondのメンバーのポート
+type bondMember struct {
+	netdev       *netDevice
+	port         uint16
+	state        uint8    // 自分のActorの状態
+	partner      lacpInfo // 対向のポートの情報
+	currentWhile time.Time
+	linkUp       bool
+	selected     bool // 集約するポートとして選ばれているか
+	active       bool // フレームの送受信に使っているか
+	lastTx       time.Time
+}
+
+// 複数のポートをまとめたbond
+type bondDevice struct {
+	name    string
+	netdev  *netDevice // bondの論理デバイス
+	members []*bondMember
+	key     uint16
+}
+
+/*
+bondの設定をパースする
+"router1-bond0=router1-r2a+router1-r2b@192.168.0.1/24" の形で指定する
+@以降を省略するとアドレスのないbondになり、ブリッジのポートなどに使える
+*/
+func parseBondConfig(rule string) (bondConfig, error) {
+	fields := strings.Split(rule, "=")
+	if len(fields) != 2 || fields[0] == "" {
+		return bondConfig{}, fmt.Errorf("invalid bond rule %q, format is name=member+member[@addr/prefix]", rule)
+	}
+	conf := bondConfig{name: fields[0]}
+	members := fields[1]
+	if at := strings.Index(members, "@"); at != -1 {
+		ip, ipnet, err := net.ParseCIDR(members[at+1:])
+		if err != nil || ip.To4() == nil {
+			return bondConfig{}, fmt.Errorf("invalid bond ip addr %q", members[at+1:])
+		}
+		conf.address = byteToUint32(ip.To4())
+		conf.netmask = byteToUint32(ipnet.Mask)
+		members = members[:at]
+	}
+	for _, member := range strings.Split(members, "+") {
+		if member == "" {
+			return bondConfig{}, fmt.Errorf("invalid bond member in %q", rule)
+		}
+		conf.members = append(conf.members, member)
+	}
+	return conf, nil
+}
+
+/*
+bondの論理デバイスを作ってメンバーのデバイスを所属させる
+論理デバイスのMACアドレスは最初のメンバーのものを使い、全てのメンバーから送信する
+*/
+func newBondDevice(conf bondConfig, members []*netDevice) *bondDevice {
+	bond := &bondDevice{
+		name: conf.name,
+		key:  1,
+	}
+	for i, member := range members {
+		member.bond = bond
+		bond.members = append(bond.members, &bondMember{
+			netdev: member,
+			port:   uint16(i + 1),
+			state:  LACP_STATE_ACTIVITY | LACP_STATE_TIMEOUT | LACP_STATE_AGGREGATION | LACP_STATE_DEFAULTED,
+		})
+	}
+	bond.netdev = &netDevice{
+		name:       conf.name,
+		macaddr:    members[0].macaddr,
+		aggregator: bond,
+	}
+	if conf.address != 0 {
+		bond.netdev.ipdev = ipDevice{
+			address:   conf.address,
+			netmask:   conf.netmask,
+			broadcast: conf.address | ^conf.netmask,
+		}
+	}
+	return bond
+}
+
+/*
+ActorまたはPartnerのTLVを書き込む
+*/
+func (info lacpInfo) writeTlv(b *bytes.Buffer, tlvType uint8) {
+	b.Write([]byte{tlvType, 20})
+	b.Write(uint16ToByte(info.systemPriority))
+	b.Write(macToByte(info.system))
+	b.Write(uint16ToByte(info.key))
+	b.Write(uint16ToByte(info.portPriority))
+	b.Write(uint16ToByte(info.port))
+	b.Write([]byte{info.state, 0, 0, 0})
+}
+
+func parseLacpInfo(tlv []byte) lacpInfo {
+	return lacpInfo{
+		systemPriority: byteToUint16(tlv[2:4]),
+		system:         setMacAddr(tlv[4:10]),
+		key:            byteToUint16(tlv[10:12]),
+		portPriority:   byteToUint16(tlv[12:14]),
+		port:           byteToUint16(tlv[14:16]),
+		state:          tlv[16],
+	}
+}
+
+func (pdu lacpdu) ToPacket() []byte {
+	var b bytes.Buffer
+	b.Write([]byte{LACP_SUBTYPE, LACP_VERSION})
+	pdu.actor.writeTlv(&b, 1)
+	pdu.partner.writeTlv(&b, 2)
+	// Collector Information
+	b.Write([]byte{3, 16})
+	b.Write(uint16ToByte(pdu.collectorMaxDelay))
+	b.Write(make([]byte, 12))
+	// Terminator
+	b.Write([]byte{0, 0})
+	b.Write(make([]byte, 50))
+	return b.Bytes()
+}
+
+/*
+イーサネットヘッダの後ろのLACPDUをパースする
+*/
+func parseLacpdu(packet []byte) (lacpdu, error) {
+	if len(packet) < LACPDU_LEN {
+		return lacpdu{}, fmt.Errorf("lacpdu is too short")
+	}
+	if packet[0] != LACP_SUBTYPE {
+		return lacpdu{}, fmt.Errorf("unknown slow protocol subtype %d", packet[0])
+	}
+	if packet[2] != 1 || packet[3] != 20 || packet[22] != 2 || packet[23] != 20 || packet[42] != 3 || packet[43] != 16 {
+		return lacpdu{}, fmt.Errorf("invalid lacpdu tlv")
+	}
+	return lacpdu{
+		actor:             parseLacpInfo(packet[2:22]),
+		partner:           parseLacpInfo(packet[22:42]),
+		collectorMaxDelay: byteToUint16(packet[44:46]),
+	}, nil
+}
+
+/*
+メンバーのポートのActorの情報
+*/
+func (bond *bondDevice) actorInfo(member *bondMember) lacpInfo {
+	return lacpInfo{
+		systemPriority: LACP_DEFAULT_SYSTEM_PRIORITY,
+		system:         bond.netdev.macaddr,
+		key:            bond.key,
+		portPriority:   LACP_DEFAULT_PORT_PRIORITY,
+		port:           member.port,
+		state:          member.state,
+	}
+}
+
+/*
+メンバーのポートがフレームの送受信に使えるか
+自分と対向の両方が集約に合意して受信を始めていれば使う
+*/
+func (member *bondMember) distributing() bool {
+	return member.selected && member.linkUp &&
+		member.state&LACP_STATE_DISTRIBUTING != 0 && member.partner.state&LACP_STATE_COLLECTING != 0
+}
+
+/*
+メンバーのポートからLACPDUを送信する
+*/
+func (bond *bondDevice) sendLacpdu(member *bondMember, now time.Time) {
+	frame := ethernetHeader{
+		destAddr:  LACP_MAC_ADDRESS,
+		srcAddr:   member.netdev.macaddr,
+		etherType: ETHER_TYPE_SLOW_PROTOCOLS,
+	}.ToPacket()
+	frame = append(frame, lacpdu{
+		actor:   bond.actorInfo(member),
+		partner: member.partner,
+	}.ToPacket()...)
+	member.lastTx = now
+	if err := member.netdev.netDeviceTransmit(frame); err != nil {
+		fmt.Printf("bond %s: send lacpdu to %s err : %s\n", bond.name, member.netdev.name, err)
+	}
+}
+
+/*
+集約するポートを選び直して、各ポートの状態を更新する
+最初に対向の情報を受け取ったポートと同じシステムとキーのポートだけを集約する
+状態が変わったポートにはすぐにLACPDUを送る
+*/
+func (bond *bondDevice) updateMembers(now time.Time) {
+	var aggregator *lacpInfo
+	for _, member := range bond.members {
+		if member.state&LACP_STATE_DEFAULTED != 0 || !member.linkUp || member.partner.state&LACP_STATE_AGGREGATION == 0 {
+			member.selected = false
+			continue
+		}
+		if aggregator == nil {
+			aggregator = &member.partner
+		}
+		member.selected = member.partner.system == aggregator.system && member.partner.key == aggregator.key
+	}
+	for _, member := range bond.members {
+		state := member.state &^ (LACP_STATE_SYNCHRONIZATION | LACP_STATE_COLLECTING | LACP_STATE_DISTRIBUTING)
+		if member.selected {
+			state |= LACP_STATE_SYNCHRONIZATION
+			// 対向も同期したら受信と送信を始める
+			if member.partner.state&LACP_STATE_SYNCHRONIZATION != 0 {
+				state |= LACP_STATE_COLLECTING | LACP_STATE_DISTRIBUTING
+			}
+		}
+		changed := state != member.state
+		member.state = state
+		if member.distributing() != member.active {
+			member.active = member.distributing()
+			fmt.Printf("bond %s: member %s distributing %v\n", bond.name, member.netdev.name, member.active)
+		}
+		if changed && member.linkUp {
+			bond.sendLacpdu(member, now)
+		}
+	}
+}
+
+/*
+メンバーのポートでLACPDUを受信したときの処理
+*/
+func (bond *bondDevice) lacpInput(inport *netDevice, packet []byte, now time.Time) {
+	var member *bondMember
+	for _, m := range bond.members {
+		if m.netdev == inport {
+			member = m
+		}
+	}
+	if member == nil {
+		return
+	}
+	pdu, err := parseLacpdu(packet)
+	if err != nil {
+		fmt.Printf("bond %s: invalid lacpdu from %s : %s\n", bond.name, inport.name, err)
+		return
+	}
+	if member.state&LACP_STATE_DEFAULTED != 0 {
+		fmt.Printf("bond %s: partner %s port %d found on %s\n", bond.name, printMacAddr(pdu.actor.system), pdu.actor.port, inport.name)
+	}
+	// LACPDUが届いたらリンクは使えている
+	member.linkUp = true
+	member.partner = pdu.actor
+	member.state &^= LACP_STATE_DEFAULTED | LACP_STATE_EXPIRED
+	// 対向が自分の情報を正しく受け取っていなければ同期していないとみなす
+	actor := bond.actorInfo(member)
+	if pdu.partner.system != actor.system || pdu.partner.port != actor.port || pdu.partner.key != actor.key {
+		member.partner.state &^= LACP_STATE_SYNCHRONIZATION
+	}
+	timeout := LACP_SHORT_TIMEOUT_TIME
+	if pdu.actor.state&LACP_STATE_TIMEOUT == 0 {
+		timeout = 30 * LACP_SHORT_TIMEOUT_TIME
+	}
+	member.currentWhile = now.Add(timeout)
+	bond.updateMembers(now)
+}
+
+/*
+bondのタイマーを進める
+リンクのダウンと対向の情報の期限切れを検出してメンバーから外し、定期的にLACPDUを送る
+*/
+func (bond *bondDevice) lacpTick(now time.Time) {
+	for _, member := range bond.members {
+		up := linkIsUp(member.netdev)
+		if up != member.linkUp {
+			fmt.Printf("bond %s: member %s link up %v\n", bond.name, member.netdev.name, up)
+			member.linkUp = up
+		}
+		if member.state&LACP_STATE_DEFAULTED == 0 && (!up || now.After(member.currentWhile)) {
+			fmt.Printf("bond %s: partner on %s is expired\n", bond.name, member.netdev.name)
+			member.partner = lacpInfo{}
+			member.state |= LACP_STATE_DEFAULTED | LACP_STATE_EXPIRED
+		}
+	}
+	bond.updateMembers(now)
+	for _, member := range bond.members {
+		if member.linkUp && now.Sub(member.lastTx) >= LACP_FAST_PERIODIC_TIME {
+			bond.sendLacpdu(member, now)
+		}
+	}
+}
+
+/*
+デバイスのリンクが上がっているかドライバに確認する
+*/
+func linkIsUp(netdev *netDevice) bool {
+	return netdev.driver != nil && netdev.driver.linkUp()
+}
+
+/*
+フローごとに送信するメンバーを決めるためのハッシュ値を計算する
+IPv4とIPv6はアドレスとTCP/UDPのポート番号、それ以外はMACアドレスから計算する
+*/
+func bondFlowHash(frame []byte) uint32 {
+	hash := fnv.New32a()
+	offset := 12
+	etherType := byteToUint16(frame[offset : offset+2])
+	if etherType == ETHER_TYPE_VLAN && len(frame) >= 14+VLAN_TAG_LEN {
+		offset += VLAN_TAG_LEN
+		etherType = byteToUint16(frame[offset : offset+2])
+	}
+	payload := frame[offset+2:]
+	var protocol uint8
+	var l4 []byte
+	switch {
+	case etherType == ETHER_TYPE_IP && len(payload) >= 20:
+		ihl := int(payload[0]&0x0f) * 4
+		protocol = payload[9]
+		hash.Write(payload[12:20])
+		// フラグメントされたパケットはポート番号を使わない
+		if byteToUint16(payload[6:8])&0x3fff == 0 && len(payload) >= ihl+4 {
+			l4 = payload[ihl:]
+		}
+	case etherType == ETHER_TYPE_IPV6 && len(payload) >= 40:
+		protocol = payload[6]
+		hash.Write(payload[8:40])
+		l4 = payload[40:]
+	default:
+		hash.Write(frame[0:12])
+		return hash.Sum32()
+	}
+	hash.Write([]byte{protocol})
+	if (protocol == IP_PROTOCOL_NUM_TCP || protocol == IP_PROTOCOL_NUM_UDP) && len(l4) >= 4 {
+		hash.Write(l4[0:4])
+	}
+	return hash.Sum32()
+}
+
+/*
+bondの論理デバイスからフレームを送信する
+フローのハッシュ値で送信中のメンバーを選ぶので、同じフローのパケットの順番は入れ替わらない
+*/
+func (bond *bondDevice) transmit(frame []byte) error {
+	var active []*bondMember
+	for _, member := range bond.members {
+		if member.active {
+			active = append(active, member)
+		}
+	}
+	if len(active) == 0 {
+		fmt.Printf("bond %s: no distributing member, drop frame\n", bond.name)
+		return nil
+	}
+	member := active[bondFlowHash(frame)%uint32(len(active))]
+	return member.netdev.netDeviceTransmit(frame)
+}
+
+/*
+bondのメンバーのポートで受信したフレームの処理
+LACPDUはLACPで処理し、それ以外は受信中のメンバーなら論理デバイスで受信する
+*/
+func bondInput(inport *netDevice, frame []byte) {
+	bond := inport.bond
+	if byteToUint16(frame[12:14]) == ETHER_TYPE_SLOW_PROTOCOLS {
+		bond.lacpInput(inport, frame[14:], inport.router.now())
+		return
+	}
+	for _, member := range bond.members {
+		if member.netdev == inport && member.selected && member.state&LACP_STATE_COLLECTING != 0 {
+			ethernetInput(bond.netdev, frame)
+			return
+		}
+	}
+}
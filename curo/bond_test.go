@@ -0,0 +1,146 @@
+package curo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBondConfig(t *testing.T) {
+	conf, err := parseBondConfig("router1-bond0=router1-r2a+router1-r2b@192.168.0.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.name != "router1-bond0" || len(conf.members) != 2 || conf.members[1] != "router1-r2b" ||
+		conf.address != 0xc0a80001 || conf.netmask != 0xffffff00 {
+		t.Fatalf("bond config is %+v", conf)
+	}
+	for _, invalid := range []string{"bond0", "=eth0+eth1", "bond0=eth0++eth1", "bond0=eth0+eth1@192.168.0.1"} {
+		if _, err := parseBondConfig(invalid); err == nil {
+			t.Errorf("parseBondConfig(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestLacpduPacket(t *testing.T) {
+	pdu := lacpdu{
+		actor: lacpInfo{
+			systemPriority: LACP_DEFAULT_SYSTEM_PRIORITY,
+			system:         [6]uint8{0x02, 0, 0, 0, 0, 0x01},
+			key:            1,
+			portPriority:   LACP_DEFAULT_PORT_PRIORITY,
+			port:           2,
+			state:          LACP_STATE_ACTIVITY | LACP_STATE_AGGREGATION | LACP_STATE_SYNCHRONIZATION,
+		},
+		partner: lacpInfo{system: [6]uint8{0x02, 0, 0, 0, 0, 0x02}, key: 3, port: 4},
+	}
+	packet := pdu.ToPacket()
+	if len(packet) != LACPDU_LEN {
+		t.Fatalf("lacpdu length is %d", len(packet))
+	}
+	parsed, err := parseLacpdu(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != pdu {
+		t.Fatalf("parsed lacpdu is %+v, want %+v", parsed, pdu)
+	}
+	if _, err := parseLacpdu(packet[:60]); err == nil {
+		t.Fatal("short lacpdu is parsed")
+	}
+}
+
+/*
+2つのbondのメンバー同士でLACPDUをやり取りさせる
+送信はドライバがないので失敗するが、受信側には作ったLACPDUを直接渡す
+*/
+func newTestBond(name string, mac uint8) *bondDevice {
+	return newBondDevice(bondConfig{name: name}, []*netDevice{
+		{name: name + "-a", macaddr: [6]uint8{0x02, 0, 0, 0, mac, 0x01}},
+		{name: name + "-b", macaddr: [6]uint8{0x02, 0, 0, 0, mac, 0x02}},
+	})
+}
+
+func exchangeLacpdu(from, to *bondDevice, i int, now time.Time) {
+	member := from.members[i]
+	to.lacpInput(to.members[i].netdev, lacpdu{actor: from.actorInfo(member), partner: member.partner}.ToPacket(), now)
+}
+
+func TestLacpNegotiation(t *testing.T) {
+	now := time.Now()
+	bond1 := newTestBond("bond1", 0x0a)
+	bond2 := newTestBond("bond2", 0x0b)
+	if err := bond1.transmit(make([]byte, 60)); err != nil {
+		t.Fatal(err)
+	}
+	// 相手の情報を受け取って同期し、相手も同期したら送受信を始める
+	for round := 0; round < 3; round++ {
+		for i := range bond1.members {
+			exchangeLacpdu(bond1, bond2, i, now)
+			exchangeLacpdu(bond2, bond1, i, now)
+		}
+	}
+	for _, bond := range []*bondDevice{bond1, bond2} {
+		for _, member := range bond.members {
+			if !member.selected || !member.active || member.state&LACP_STATE_DEFAULTED != 0 {
+				t.Fatalf("member %s is not active, state %#x partner %+v", member.netdev.name, member.state, member.partner)
+			}
+		}
+	}
+	if bond1.members[0].partner.system != bond2.netdev.macaddr || bond1.members[1].partner.port != 2 {
+		t.Fatalf("partner of bond1 is %+v", bond1.members[0].partner)
+	}
+
+	// 別のシステムから届いたポートは集約しない
+	other := newTestBond("other", 0x0c)
+	other.members[1].partner = bond1.members[1].partner
+	exchangeLacpdu(other, bond1, 1, now)
+	if bond1.members[1].selected || bond1.members[1].active || !bond1.members[0].active {
+		t.Fatal("member connected to other system is selected")
+	}
+
+	// リンクが使えなくなったメンバーは外れる, テストのデバイスはドライバがないのでダウンしている
+	bond2.lacpTick(now.Add(time.Second))
+	for _, member := range bond2.members {
+		if member.active || member.state&LACP_STATE_DEFAULTED == 0 {
+			t.Fatalf("member %s of link down is active", member.netdev.name)
+		}
+	}
+	// 対向からLACPDUが届かなくなったら期限切れになる
+	bond1.members[0].currentWhile = now
+	bond1.lacpTick(now.Add(LACP_SHORT_TIMEOUT_TIME))
+	if bond1.members[0].active || bond1.members[0].state&LACP_STATE_EXPIRED == 0 {
+		t.Fatal("expired member is active")
+	}
+}
+
+func TestBondFlowHash(t *testing.T) {
+	udpFrame := func(srcPort uint16) []byte {
+		frame := ethernetHeader{destAddr: [6]uint8{0x02, 0, 0, 0, 0, 0x01}, srcAddr: [6]uint8{0x02, 0, 0, 0, 0, 0x02}, etherType: ETHER_TYPE_IP}.ToPacket()
+		header := make([]byte, 20)
+		header[0] = 0x45
+		header[9] = IP_PROTOCOL_NUM_UDP
+		copy(header[12:16], uint32ToByte(0xc0a80102))
+		copy(header[16:20], uint32ToByte(0xc0a80003))
+		frame = append(frame, header...)
+		frame = append(frame, uint16ToByte(srcPort)...)
+		frame = append(frame, uint16ToByte(9000)...)
+		return append(frame, make([]byte, 4)...)
+	}
+	// 同じフローは同じハッシュ値になる
+	if bondFlowHash(udpFrame(5000)) != bondFlowHash(udpFrame(5000)) {
+		t.Fatal("hash of same flow differs")
+	}
+	// ポート番号の違うフローは2つのメンバーに分散する
+	counts := make([]int, 2)
+	for port := uint16(5000); port < 5100; port++ {
+		counts[bondFlowHash(udpFrame(port))%2]++
+	}
+	if counts[0] < 20 || counts[1] < 20 {
+		t.Fatalf("flows are not distributed, %v", counts)
+	}
+	// IP以外はMACアドレスで決める
+	arp := ethernetHeader{destAddr: ETHERNET_ADDRESS_BROADCAST, srcAddr: [6]uint8{0x02, 0, 0, 0, 0, 0x02}, etherType: ETHER_TYPE_ARP}.ToPacket()
+	if bondFlowHash(arp) != bondFlowHash(append(arp, 0x01)) {
+		t.Fatal("hash of arp depends on payload")
+	}
+}
@@ -0,0 +1,162 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// bpfのシステムコールのコマンド
+const (
+	BPF_MAP_CREATE      = 0
+	BPF_MAP_UPDATE_ELEM = 2
+	BPF_PROG_LOAD       = 5
+	BPF_LINK_CREATE     = 28
+)
+
+// マップとプログラムとアタッチの種類
+const (
+	BPF_MAP_TYPE_XSKMAP = 17
+	BPF_PROG_TYPE_XDP   = 6
+	BPF_XDP             = 37
+)
+
+// union bpf_attrの大きさ, 使わないところは0にして渡す
+const BPF_ATTR_SIZE = 128
+
+// XDPのプログラムのライセンス
+var bpfLicense = []byte("Dual MIT/GPL\x00")
+
+// XDPのプログラムで使う値
+const (
+	BPF_FUNC_REDIRECT_MAP = 51
+	BPF_PSEUDO_MAP_FD     = 1
+	XDP_PASS              = 2
+	XDP_MD_RX_QUEUE_INDEX = 16 // struct xdp_mdのrx_queue_indexのオフセット
+	XDP_FLAGS_SKB_MODE    = 1 << 1
+)
+
+// struct bpf_insnの命令
+const (
+	BPF_LDX_MEM_W   = 0x61 // BPF_LDX | BPF_MEM | BPF_W
+	BPF_LD_IMM_DW   = 0x18 // BPF_LD | BPF_IMM | BPF_DW
+	BPF_ALU64_MOV_K = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+	BPF_JMP_CALL    = 0x85 // BPF_JMP | BPF_CALL
+	BPF_JMP_EXIT    = 0x95 // BPF_JMP | BPF_EXIT
+)
+
+/*
+bpfのシステムコールを呼ぶ
+attrはunion bpf_attrのコマンドで使う先頭の部分
+*/
+func bpfCall(cmd int, attr []byte) (int, error) {
+	buf := make([]byte, BPF_ATTR_SIZE)
+	copy(buf, attr)
+	fd, _, errno := syscall.Syscall(SYS_BPF, uintptr(cmd), uintptr(unsafe.Pointer(&buf[0])), BPF_ATTR_SIZE)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+/*
+AF_XDPのソケットを登録するXSKMAPを作る, キーはインターフェイスの受信キューの番号
+*/
+func bpfCreateXskMap(entries int) (int, error) {
+	attr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(attr[0:4], BPF_MAP_TYPE_XSKMAP)
+	binary.LittleEndian.PutUint32(attr[4:8], 4)
+	binary.LittleEndian.PutUint32(attr[8:12], 4)
+	binary.LittleEndian.PutUint32(attr[12:16], uint32(entries))
+	fd, err := bpfCall(BPF_MAP_CREATE, attr)
+	if err != nil {
+		return -1, fmt.Errorf("create xskmap err : %s", err)
+	}
+	return fd, nil
+}
+
+/*
+マップのkeyにvalueを登録する
+attrに書いたポインタはスタックが伸びても書き換わらないので、指す先はappendでヒープに作る
+*/
+func bpfMapUpdate(mapFd int, key, value uint32) error {
+	keyBuf := binary.LittleEndian.AppendUint32(nil, key)
+	valueBuf := binary.LittleEndian.AppendUint32(nil, value)
+	attr := make([]byte, 32)
+	binary.LittleEndian.PutUint32(attr[0:4], uint32(mapFd))
+	binary.LittleEndian.PutUint64(attr[8:16], uint64(uintptr(unsafe.Pointer(&keyBuf[0]))))
+	binary.LittleEndian.PutUint64(attr[16:24], uint64(uintptr(unsafe.Pointer(&valueBuf[0]))))
+	_, err := bpfCall(BPF_MAP_UPDATE_ELEM, attr)
+	runtime.KeepAlive(keyBuf)
+	runtime.KeepAlive(valueBuf)
+	if err != nil {
+		return fmt.Errorf("update map err : %s", err)
+	}
+	return nil
+}
+
+// struct bpf_insnを1つ作る, レジスタは下位4ビットがdst, 上位4ビットがsrc
+func bpfInsn(code, dst, src uint8, off int16, imm int32) []byte {
+	insn := []byte{code, dst | src<<4}
+	insn = binary.LittleEndian.AppendUint16(insn, uint16(off))
+	return binary.LittleEndian.AppendUint32(insn, uint32(imm))
+}
+
+/*
+受信したフレームを受信キューの番号でXSKMAPのAF_XDPのソケットにリダイレクトするXDPのプログラム
+ソケットが登録されていないキューのフレームはXDP_PASSでカーネルに渡す
+
+	r2 = ctx->rx_queue_index
+	r1 = xskmap
+	r3 = XDP_PASS
+	return bpf_redirect_map(r1, r2, r3)
+*/
+func xdpRedirectProgram(mapFd int) []byte {
+	var insns []byte
+	insns = append(insns, bpfInsn(BPF_LDX_MEM_W, 2, 1, XDP_MD_RX_QUEUE_INDEX, 0)...)
+	// 64ビットの即値は2命令を使う
+	insns = append(insns, bpfInsn(BPF_LD_IMM_DW, 1, BPF_PSEUDO_MAP_FD, 0, int32(mapFd))...)
+	insns = append(insns, bpfInsn(0, 0, 0, 0, 0)...)
+	insns = append(insns, bpfInsn(BPF_ALU64_MOV_K, 3, 0, 0, XDP_PASS)...)
+	insns = append(insns, bpfInsn(BPF_JMP_CALL, 0, 0, 0, BPF_FUNC_REDIRECT_MAP)...)
+	insns = append(insns, bpfInsn(BPF_JMP_EXIT, 0, 0, 0, 0)...)
+	return insns
+}
+
+/*
+XDPのプログラムをロードする
+*/
+func bpfLoadXdpProgram(insns []byte) (int, error) {
+	attr := make([]byte, 72)
+	binary.LittleEndian.PutUint32(attr[0:4], BPF_PROG_TYPE_XDP)
+	binary.LittleEndian.PutUint32(attr[4:8], uint32(len(insns)/8))
+	binary.LittleEndian.PutUint64(attr[8:16], uint64(uintptr(unsafe.Pointer(&insns[0]))))
+	binary.LittleEndian.PutUint64(attr[16:24], uint64(uintptr(unsafe.Pointer(&bpfLicense[0]))))
+	copy(attr[48:64], "curo_xsk")
+	binary.LittleEndian.PutUint32(attr[68:72], BPF_XDP)
+	fd, err := bpfCall(BPF_PROG_LOAD, attr)
+	runtime.KeepAlive(insns)
+	if err != nil {
+		return -1, fmt.Errorf("load xdp program err : %s", err)
+	}
+	return fd, nil
+}
+
+/*
+XDPのプログラムをインターフェイスにアタッチする
+どのドライバでも動くようにSKBモードにし、返したリンクのfdを閉じるとデタッチされる
+*/
+func bpfAttachXdp(progFd, ifindex int) (int, error) {
+	attr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(attr[0:4], uint32(progFd))
+	binary.LittleEndian.PutUint32(attr[4:8], uint32(ifindex))
+	binary.LittleEndian.PutUint32(attr[8:12], BPF_XDP)
+	binary.LittleEndian.PutUint32(attr[12:16], XDP_FLAGS_SKB_MODE)
+	fd, err := bpfCall(BPF_LINK_CREATE, attr)
+	if err != nil {
+		return -1, fmt.Errorf("attach xdp program err : %s", err)
+	}
+	return fd, nil
+}
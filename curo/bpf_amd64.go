@@ -0,0 +1,10 @@
+package curo
+
+import "syscall"
+
+// bpfとAF_XDPのソケットで使うシステムコールの番号
+const (
+	SYS_BPF        = 321
+	SYS_BIND       = syscall.SYS_BIND
+	SYS_GETSOCKOPT = syscall.SYS_GETSOCKOPT
+)
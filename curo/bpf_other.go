@@ -0,0 +1,10 @@
+//go:build !amd64 && !arm64
+
+package curo
+
+// 番号を持っていないアーキテクチャではAF_XDPを使わずにAF_PACKETのドライバにする
+const (
+	SYS_BPF        = 0
+	SYS_BIND       = 0
+	SYS_GETSOCKOPT = 0
+)
@@ -0,0 +1,254 @@
+package curo
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// 学習したMACアドレスを忘れるまでの時間
+	BRIDGE_FDB_AGING_TIME = 300 * time.Second
+	// 学習できるMACアドレスの数, いっぱいになったら学習せずにフラッディングする
+	BRIDGE_FDB_MAX_ENTRIES = 4096
+)
+
+// ブリッジの設定
+type bridgeConfig struct {
+	name    string
+	members []string
+	address uint32 // IRBのインターフェイスのアドレス, 0ならIRBを作らない
+	netmask uint32
+	rstp    bool // RSTPでループを防ぐ
+
+	rstpPriority uint16 // 小さいほどルートブリッジに選ばれやすい
+}
+
+// MACアドレスを学習したポートと時刻
+type bridgeFdbEntry struct {
+	port     *netDevice
+	lastSeen time.Time
+}
+
+// ブリッジドメイン
+type bridgeDomain struct {
+	name    string
+	members []*netDevice
+	fdb     map[[6]uint8]*bridgeFdbEntry
+	irb     *netDevice  // ブリッジとルータをつなぐインターフェイス
+	rstp    *rstpBridge // RSTPを使わなければnil
+}
+
+/*
+ブリッジの設定をパースする
+"router1-br0=router1-host0+router1-host1@192.168.1.1/24" の形で指定する
+@以降を省略するとIRBのインターフェイスを作らずにブリッジだけ動作する
+*/
+func parseBridgeConfig(rule string) (bridgeConfig, error) {
+	fields := strings.Split(rule, "=")
+	if len(fields) != 2 || fields[0] == "" {
+		return bridgeConfig{}, fmt.Errorf("invalid bridge rule %q, format is name=member+member[@addr/prefix]", rule)
+	}
+	conf := bridgeConfig{name: fields[0]}
+	members := fields[1]
+	if at := strings.Index(members, "@"); at != -1 {
+		ip, ipnet, err := net.ParseCIDR(members[at+1:])
+		if err != nil || ip.To4() == nil {
+			return bridgeConfig{}, fmt.Errorf("invalid bridge ip addr %q", members[at+1:])
+		}
+		conf.address = byteToUint32(ip.To4())
+		conf.netmask = byteToUint32(ipnet.Mask)
+		members = members[:at]
+	}
+	for _, member := range strings.Split(members, "+") {
+		if member == "" {
+			return bridgeConfig{}, fmt.Errorf("invalid bridge member in %q", rule)
+		}
+		conf.members = append(conf.members, member)
+	}
+	return conf, nil
+}
+
+/*
+ブリッジドメインを作成してポートのデバイスを所属させる
+アドレスが指定されていればIRBのインターフェイスを作って返す
+*/
+func newBridgeDomain(conf bridgeConfig, members []*netDevice) (*bridgeDomain, *netDevice) {
+	bridge := &bridgeDomain{
+		name:    conf.name,
+		members: members,
+		fdb:     make(map[[6]uint8]*bridgeFdbEntry),
+	}
+	for _, member := range members {
+		member.bridge = bridge
+	}
+	if conf.rstp {
+		newRstpBridge(bridge, conf.rstpPriority)
+	}
+	if conf.address == 0 {
+		return bridge, nil
+	}
+	// IRBのMACアドレスは最初のポートのものを使う
+	bridge.irb = &netDevice{
+		name:    conf.name,
+		macaddr: members[0].macaddr,
+		irb:     bridge,
+		ipdev: ipDevice{
+			address:   conf.address,
+			netmask:   conf.netmask,
+			broadcast: conf.address | ^conf.netmask,
+		},
+	}
+	return bridge, bridge.irb
+}
+
+/*
+MACアドレスを学習したポートを探す
+エージングの時間を過ぎたエントリは削除する
+*/
+func (bridge *bridgeDomain) lookupFdb(macaddr [6]uint8) *netDevice {
+	entry, ok := bridge.fdb[macaddr]
+	if !ok {
+		return nil
+	}
+	// 学習した時と同じルータの時刻で比べる, リプレイではフレームのタイムスタンプになる
+	if entry.port.router.now().Sub(entry.lastSeen) > BRIDGE_FDB_AGING_TIME {
+		delete(bridge.fdb, macaddr)
+		return nil
+	}
+	return entry.port
+}
+
+/*
+送信元のMACアドレスと受信したポートを学習する
+*/
+func (bridge *bridgeDomain) learn(port *netDevice, macaddr [6]uint8) {
+	// マルチキャストのアドレスは送信元にならないので学習しない
+	if macaddr[0]&0x01 == 0x01 {
+		return
+	}
+	entry, ok := bridge.fdb[macaddr]
+	if !ok {
+		// いっぱいなら古いエントリを消してから学習する
+		if len(bridge.fdb) >= BRIDGE_FDB_MAX_ENTRIES && bridge.ageFdb(port.router.now()) == 0 {
+			return
+		}
+		bridge.fdb[macaddr] = &bridgeFdbEntry{port: port, lastSeen: port.router.now()}
+		return
+	}
+	if entry.port != port {
+		fmt.Printf("bridge %s: %s moved from %s to %s\n", bridge.name, printMacAddr(macaddr), entry.port.name, port.name)
+		entry.port = port
+	}
+	entry.lastSeen = port.router.now()
+}
+
+/*
+エージングの時間を過ぎたエントリを削除する
+ルータのタイマーから定期的に呼び、削除したエントリの数を返す
+*/
+func (bridge *bridgeDomain) ageFdb(now time.Time) int {
+	count := 0
+	for macaddr, entry := range bridge.fdb {
+		if now.Sub(entry.lastSeen) > BRIDGE_FDB_AGING_TIME {
+			delete(bridge.fdb, macaddr)
+			count++
+		}
+	}
+	return count
+}
+
+/*
+学習したアドレスを消す
+onlyがtrueならportで学習したものだけ, falseならport以外で学習したものを消す
+*/
+func (bridge *bridgeDomain) flushFdb(port *netDevice, only bool) {
+	for macaddr, entry := range bridge.fdb {
+		if (entry.port == port) == only {
+			delete(bridge.fdb, macaddr)
+		}
+	}
+}
+
+/*
+受信したポート以外のフォワーディング状態の全てのポートにフレームを送る
+*/
+func (bridge *bridgeDomain) flood(inport *netDevice, frame []byte) {
+	for _, port := range bridge.members {
+		if port == inport || bridge.portState(port) != rstpForwarding {
+			continue
+		}
+		if err := port.netDeviceTransmit(frame); err != nil {
+			fmt.Printf("bridge %s: transmit to %s err : %s\n", bridge.name, port.name, err)
+		}
+	}
+}
+
+/*
+ブリッジのポートで受信したフレームの処理
+送信元を学習し、IRB宛てならルータで受信、それ以外は宛先のポートに転送する
+宛先が分からないユニキャストとブロードキャスト, マルチキャストはフラッディングする
+RSTPを使う場合、BPDUはポートの状態に関係なく受信し、破棄状態のポートでは学習も転送もしない
+*/
+func bridgeInput(inport *netDevice, frame []byte) {
+	bridge := inport.bridge
+	destAddr := setMacAddr(frame[0:6])
+	srcAddr := setMacAddr(frame[6:12])
+
+	if bridge.rstp != nil && destAddr == RSTP_BPDU_MAC_ADDRESS {
+		bridge.rstp.rstpInput(inport, frame[14:], inport.router.now())
+		return
+	}
+	state := bridge.portState(inport)
+	if state == rstpDiscarding {
+		return
+	}
+	bridge.learn(inport, srcAddr)
+	// 学習状態のポートでは学習だけ行う
+	if state == rstpLearning {
+		return
+	}
+
+	if bridge.irb != nil && destAddr == bridge.irb.macaddr {
+		ethernetInput(bridge.irb, frame)
+		return
+	}
+	if destAddr[0]&0x01 == 0x01 {
+		bridge.flood(inport, frame)
+		// ブロードキャストとマルチキャストはルータでも受信する
+		if bridge.irb != nil {
+			ethernetInput(bridge.irb, frame)
+		}
+		return
+	}
+	outport := bridge.lookupFdb(destAddr)
+	if outport == nil {
+		bridge.flood(inport, frame)
+		return
+	}
+	// 同じポートの先にいる宛先と、フォワーディング状態でないポートへは転送しない
+	if outport == inport || bridge.portState(outport) != rstpForwarding {
+		return
+	}
+	if err := outport.netDeviceTransmit(frame); err != nil {
+		fmt.Printf("bridge %s: transmit to %s err : %s\n", bridge.name, outport.name, err)
+	}
+}
+
+/*
+IRBのインターフェイスからブリッジにフレームを送信する
+*/
+func (bridge *bridgeDomain) irbTransmit(frame []byte) error {
+	destAddr := setMacAddr(frame[0:6])
+	if destAddr[0]&0x01 == 0 {
+		if port := bridge.lookupFdb(destAddr); port != nil {
+			if bridge.portState(port) != rstpForwarding {
+				return nil
+			}
+			return port.netDeviceTransmit(frame)
+		}
+	}
+	bridge.flood(nil, frame)
+	return nil
+}
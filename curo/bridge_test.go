@@ -0,0 +1,112 @@
+package curo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBridgeConfig(t *testing.T) {
+	conf, err := parseBridgeConfig("router1-br0=router1-host0+router1-host1@192.168.1.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.name != "router1-br0" || len(conf.members) != 2 || conf.members[1] != "router1-host1" ||
+		conf.address != 0xc0a80101 || conf.netmask != 0xffffff00 {
+		t.Fatalf("bridge config is %+v", conf)
+	}
+	// IRBなしのブリッジ
+	conf, err = parseBridgeConfig("br1=eth0+eth1")
+	if err != nil || conf.address != 0 || len(conf.members) != 2 {
+		t.Fatalf("bridge config without irb is %+v, err is %v", conf, err)
+	}
+	for _, invalid := range []string{"br0", "=eth0+eth1", "br0=eth0++eth1", "br0=eth0+eth1@192.168.1.1"} {
+		if _, err := parseBridgeConfig(invalid); err == nil {
+			t.Errorf("parseBridgeConfig(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestBridgeLearning(t *testing.T) {
+	port0 := &netDevice{name: "port0", macaddr: [6]uint8{0x02, 0, 0, 0, 0, 0x01}}
+	port1 := &netDevice{name: "port1", macaddr: [6]uint8{0x02, 0, 0, 0, 0, 0x02}}
+	bridge, irb := newBridgeDomain(bridgeConfig{name: "br0", address: 0xc0a80101, netmask: 0xffffff00},
+		[]*netDevice{port0, port1})
+	if port0.bridge != bridge || port1.bridge != bridge {
+		t.Fatal("ports are not members of bridge")
+	}
+	if irb == nil || irb.irb != bridge || irb.macaddr != port0.macaddr || irb.ipdev.broadcast != 0xc0a801ff {
+		t.Fatalf("irb is %+v", irb)
+	}
+
+	host := [6]uint8{0x02, 0, 0, 0, 0, 0x10}
+	if bridge.lookupFdb(host) != nil {
+		t.Fatal("unknown mac addr is found")
+	}
+	bridge.learn(port0, host)
+	if bridge.lookupFdb(host) != port0 {
+		t.Fatal("mac addr is not learned")
+	}
+	// ホストが別のポートに移動したら学習し直す
+	bridge.learn(port1, host)
+	if bridge.lookupFdb(host) != port1 {
+		t.Fatal("moved mac addr is not learned")
+	}
+	// マルチキャストは学習しない
+	bridge.learn(port0, [6]uint8{0x01, 0x00, 0x5e, 0, 0, 0x01})
+	if len(bridge.fdb) != 1 {
+		t.Fatalf("fdb has %d entries", len(bridge.fdb))
+	}
+	// エージングの時間を過ぎたら忘れる
+	bridge.fdb[host].lastSeen = time.Now().Add(-BRIDGE_FDB_AGING_TIME - time.Second)
+	if bridge.lookupFdb(host) != nil || len(bridge.fdb) != 0 {
+		t.Fatal("aged mac addr is found")
+	}
+}
+
+/*
+学習したアドレスはルータの時刻で定期的に忘れ、
+FDBがいっぱいの時は新しいアドレスを学習しない
+*/
+func TestBridgeFdbAgingAndLimit(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	router := NewRouter("ch2")
+	router.clock = func() time.Time { return now }
+	port0 := &netDevice{name: "port0", router: router}
+	port1 := &netDevice{name: "port1", router: router}
+	bridge, _ := newBridgeDomain(bridgeConfig{name: "br0"}, []*netDevice{port0, port1})
+	router.bridges = append(router.bridges, bridge)
+
+	for i := 0; i < BRIDGE_FDB_MAX_ENTRIES; i++ {
+		bridge.learn(port0, [6]uint8{0x02, 0, 0, 0, uint8(i >> 8), uint8(i)})
+	}
+	// 半分は後から通信があって新しくなる
+	now = now.Add(BRIDGE_FDB_AGING_TIME / 2)
+	for i := 0; i < BRIDGE_FDB_MAX_ENTRIES/2; i++ {
+		bridge.learn(port0, [6]uint8{0x02, 0, 0, 0, uint8(i >> 8), uint8(i)})
+	}
+	host := [6]uint8{0x02, 0, 0, 1, 0, 0}
+	bridge.learn(port1, host)
+	if len(bridge.fdb) != BRIDGE_FDB_MAX_ENTRIES || bridge.lookupFdb(host) != nil {
+		t.Fatalf("mac addr is learned in full fdb, fdb has %d entries", len(bridge.fdb))
+	}
+
+	// タイマーで古いエントリだけ忘れる
+	now = now.Add(BRIDGE_FDB_AGING_TIME/2 + time.Second)
+	router.tick(now)
+	if len(bridge.fdb) != BRIDGE_FDB_MAX_ENTRIES/2 {
+		t.Fatalf("fdb has %d entries after aging", len(bridge.fdb))
+	}
+	bridge.learn(port1, host)
+	if bridge.fdb[host] == nil || bridge.fdb[host].port != port1 {
+		t.Fatal("mac addr is not learned after aging")
+	}
+	// タイマーの前でも探す時にルータの時刻でエージングする
+	now = now.Add(BRIDGE_FDB_AGING_TIME + time.Second)
+	if bridge.lookupFdb(host) != nil {
+		t.Fatal("aged mac addr is found by router clock")
+	}
+	router.tick(now)
+	if len(bridge.fdb) != 0 {
+		t.Fatalf("fdb has %d entries after aging time", len(bridge.fdb))
+	}
+}
@@ -0,0 +1,216 @@
+package curo
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// キャプチャするフレームの向き
+type captureDirection uint8
+
+const (
+	captureInbound captureDirection = iota + 1
+	captureOutbound
+)
+
+/*
+ルータが送受信するフレームのキャプチャの設定
+*/
+type CaptureOptions struct {
+	Path         string // 書き出すファイル, PerInterfaceならファイルを作るディレクトリ
+	Format       string // pcapかpcapng, 空ならpcapng
+	PerInterface bool   // インターフェイスごとに別のファイルに書く
+	Filter       string // tcpdumpのようなフィルタの式, 空なら全てのフレーム
+	RotateSize   int64  // ファイルがこのバイト数を超えたら次のファイルに切り替える, 0なら切り替えない
+}
+
+/*
+ルータが送受信するフレームのキャプチャ
+AF_PACKETなどのドライバで実際に送受信するフレームを書くので、VLANのタグもついたまま書く
+*/
+type packetCapture struct {
+	conf   CaptureOptions
+	pcapng bool
+	filter captureFilter // nilなら全てのフレーム
+	files  map[string]*captureFile
+	now    func() time.Time
+}
+
+/*
+キャプチャを書き出しているファイル
+pcapngでは1つのファイルに複数のインターフェイスを書くので、ファイルごとにインターフェイスのIDを振る
+*/
+type captureFile struct {
+	path       string // ローテーションする前のファイルのパス
+	seq        int    // ローテーションした回数
+	writer     io.WriteCloser
+	size       int64
+	interfaces map[string]uint32
+}
+
+/*
+キャプチャを作る
+書き出すファイルは最初のフレームをキャプチャした時に作る
+*/
+func newPacketCapture(conf CaptureOptions) (*packetCapture, error) {
+	if conf.Path == "" {
+		return nil, fmt.Errorf("capture path is empty")
+	}
+	capture := &packetCapture{conf: conf, files: make(map[string]*captureFile), now: time.Now}
+	switch conf.Format {
+	case "", "pcapng":
+		capture.pcapng = true
+	case "pcap":
+	default:
+		return nil, fmt.Errorf("unknown capture format %q, pcap or pcapng", conf.Format)
+	}
+	if conf.RotateSize < 0 {
+		return nil, fmt.Errorf("capture rotate size %d is negative", conf.RotateSize)
+	}
+	filter, err := parseCaptureFilter(conf.Filter)
+	if err != nil {
+		return nil, err
+	}
+	capture.filter = filter
+	if conf.PerInterface {
+		if err := os.MkdirAll(conf.Path, 0755); err != nil {
+			return nil, fmt.Errorf("create capture dir err : %s", err)
+		}
+	}
+	return capture, nil
+}
+
+// ファイルの拡張子
+func (capture *packetCapture) extension() string {
+	if capture.pcapng {
+		return ".pcapng"
+	}
+	return ".pcap"
+}
+
+/*
+デバイスのフレームを書くファイルを探す
+インターフェイスごとでなければ全てのデバイスで同じファイルに書く
+*/
+func (capture *packetCapture) fileFor(name string) *captureFile {
+	key, path := "", capture.conf.Path
+	if capture.conf.PerInterface {
+		key = name
+		path = filepath.Join(capture.conf.Path, name+capture.extension())
+	}
+	file, ok := capture.files[key]
+	if !ok {
+		file = &captureFile{path: path}
+		capture.files[key] = file
+	}
+	return file
+}
+
+/*
+フレームをキャプチャする
+書き出しに失敗してもパケットの処理は止めない
+*/
+func (capture *packetCapture) captureFrame(name string, frame []byte, direction captureDirection) {
+	if capture.filter != nil && !capture.filter(decodeCapturePacket(frame, direction)) {
+		return
+	}
+	if err := capture.writeFrame(name, frame, direction); err != nil {
+		fmt.Printf("capture frame on %s err : %s\n", name, err)
+	}
+}
+
+func (capture *packetCapture) writeFrame(name string, frame []byte, direction captureDirection) error {
+	file := capture.fileFor(name)
+	if err := capture.rotate(file); err != nil {
+		return err
+	}
+	now := capture.now()
+	var record []byte
+	if capture.pcapng {
+		// ファイルで初めてのインターフェイスならIDを振って記述ブロックを先に書く
+		interfaceId, ok := file.interfaces[name]
+		if !ok {
+			interfaceId = uint32(len(file.interfaces))
+			file.interfaces[name] = interfaceId
+			record = pcapngInterfaceBlock(name)
+		}
+		flags := PCAPNG_EPB_FLAG_INBOUND
+		if direction == captureOutbound {
+			flags = PCAPNG_EPB_FLAG_OUTBOUND
+		}
+		record = append(record, pcapngPacketBlock(interfaceId, now, frame, flags)...)
+	} else {
+		record = pcapRecord(now, frame)
+	}
+	n, err := file.writer.Write(record)
+	file.size += int64(n)
+	return err
+}
+
+/*
+ファイルがなければ作り、ローテーションのサイズを超えていたら次のファイルに切り替える
+tcpdumpの-Cと同じくフレームを書く前に確認するので、1つのファイルには少なくとも1つのフレームを書く
+*/
+func (capture *packetCapture) rotate(file *captureFile) error {
+	if file.writer != nil {
+		if capture.conf.RotateSize == 0 || file.size < capture.conf.RotateSize {
+			return nil
+		}
+		file.writer.Close()
+		file.writer = nil
+		file.seq++
+	}
+	path := rotatedCapturePath(file.path, file.seq)
+	writer, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create capture file err : %s", err)
+	}
+	header := pcapFileHeader()
+	if capture.pcapng {
+		header = pcapngSectionHeader()
+	}
+	n, err := writer.Write(header)
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("write capture header err : %s", err)
+	}
+	// 新しいファイルではpcapngのインターフェイスのIDを振り直す
+	file.writer = writer
+	file.size = int64(n)
+	file.interfaces = make(map[string]uint32)
+	fmt.Printf("Start capture to %s\n", path)
+	return nil
+}
+
+/*
+ローテーションした回数をファイル名の拡張子の前に入れる
+1つ目のファイルはそのままのパスにする
+*/
+func rotatedCapturePath(path string, seq int) string {
+	if seq == 0 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(path, ext), seq, ext)
+}
+
+/*
+全てのキャプチャのファイルを閉じる
+*/
+func (capture *packetCapture) close() error {
+	var closeErr error
+	for _, file := range capture.files {
+		if file.writer == nil {
+			continue
+		}
+		if err := file.writer.Close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("close capture file err : %s", err)
+		}
+		file.writer = nil
+	}
+	return closeErr
+}
@@ -0,0 +1,381 @@
+package curo
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sat0ken/go-curo/arp"
+	"github.com/sat0ken/go-curo/ethernet"
+	"github.com/sat0ken/go-curo/ipv4"
+)
+
+/*
+キャプチャするフレームを選ぶフィルタ
+tcpdumpのフィルタの式のうちよく使うものだけを解釈する
+
+	arp, ip, ip6, icmp, icmp6, tcp, udp, lldp, lacp
+	vlan [VLAN ID]
+	[src|dst] host アドレス       (IPv4, IPv6)
+	[src|dst] net アドレス/プレフィックス長
+	[tcp|udp] [src|dst] port 番号
+	ether [src|dst|host] MACアドレス
+	inbound, outbound
+	not, and, or と括弧 (!, &&, || も使える)
+*/
+type captureFilter func(packet *capturePacket) bool
+
+// フィルタで見るためにデコードしたフレーム
+type capturePacket struct {
+	direction captureDirection
+	srcMac    [6]uint8
+	destMac   [6]uint8
+	tagged    bool
+	vlanId    uint16
+	etherType uint16 // VLANのタグの後ろのイーサタイプ
+	srcAddr   net.IP // IPv4, IPv6の送信元アドレスかARPの送信元のアドレス
+	destAddr  net.IP
+	protocol  uint8 // IPv4のプロトコル番号かIPv6の次のヘッダ
+	hasPorts  bool
+	srcPort   uint16
+	destPort  uint16
+}
+
+/*
+フレームをフィルタで見るためにデコードする
+途中で切れているフレームは分かるところまで埋める
+*/
+func decodeCapturePacket(frame []byte, direction captureDirection) *capturePacket {
+	packet := &capturePacket{direction: direction}
+	header, payload, err := ethernet.Parse(frame)
+	if err != nil {
+		return packet
+	}
+	packet.srcMac, packet.destMac, packet.etherType = header.Src, header.Dest, header.Type
+	if header.Type == ethernet.TYPE_VLAN && len(payload) >= VLAN_TAG_LEN {
+		packet.tagged = true
+		packet.vlanId = byteToUint16(payload[0:2]) & 0x0fff
+		packet.etherType = byteToUint16(payload[2:4])
+		payload = payload[VLAN_TAG_LEN:]
+	}
+	var transport []byte
+	switch packet.etherType {
+	case ethernet.TYPE_IPV4:
+		ipheader, data, err := ipv4.Parse(payload)
+		if err != nil {
+			return packet
+		}
+		packet.srcAddr, packet.destAddr = net.IP(uint32ToByte(ipheader.SrcAddr)), net.IP(uint32ToByte(ipheader.DestAddr))
+		packet.protocol = ipheader.Protocol
+		// 先頭以外のフラグメントにはポート番号がない
+		if ipheader.FragOffset&0x1fff == 0 {
+			transport = data
+		}
+	case ethernet.TYPE_IPV6:
+		var ipv6header ipv6Header
+		ipv6header, err := ipv6header.ParsePacket(payload)
+		if err != nil {
+			return packet
+		}
+		packet.srcAddr, packet.destAddr = net.IP(ipv6header.srcAddr[:]), net.IP(ipv6header.destAddr[:])
+		packet.protocol = ipv6header.nextHeader
+		transport = payload[IPV6_HEADER_LEN:]
+	case ethernet.TYPE_ARP:
+		if len(payload) >= arp.PACKET_LEN {
+			packet.srcAddr, packet.destAddr = net.IP(payload[14:18]), net.IP(payload[24:28])
+		}
+	}
+	if (packet.protocol == IP_PROTOCOL_NUM_TCP || packet.protocol == IP_PROTOCOL_NUM_UDP) && len(transport) >= 4 {
+		packet.hasPorts = true
+		packet.srcPort, packet.destPort = byteToUint16(transport[0:2]), byteToUint16(transport[2:4])
+	}
+	return packet
+}
+
+// フィルタの式のパーサ
+type captureFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+/*
+フィルタの式をパースする
+空の式ならnilを返して全てのフレームをキャプチャする
+*/
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	parser := &captureFilterParser{tokens: tokenizeCaptureFilter(expr)}
+	if len(parser.tokens) == 0 {
+		return nil, nil
+	}
+	filter, err := parser.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("parse capture filter %q err : %s", expr, err)
+	}
+	if parser.pos != len(parser.tokens) {
+		return nil, fmt.Errorf("parse capture filter %q err : unexpected %q", expr, parser.tokens[parser.pos])
+	}
+	return filter, nil
+}
+
+// 括弧と!を区切って空白で分ける
+func tokenizeCaptureFilter(expr string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)) {
+		for strings.HasPrefix(field, "!") && field != "!" {
+			tokens = append(tokens, "!")
+			field = field[1:]
+		}
+		tokens = append(tokens, field)
+	}
+	return tokens
+}
+
+func (parser *captureFilterParser) peek() string {
+	if parser.pos < len(parser.tokens) {
+		return parser.tokens[parser.pos]
+	}
+	return ""
+}
+
+func (parser *captureFilterParser) next() (string, error) {
+	if parser.pos >= len(parser.tokens) {
+		return "", fmt.Errorf("unexpected end of expression")
+	}
+	parser.pos++
+	return parser.tokens[parser.pos-1], nil
+}
+
+func (parser *captureFilterParser) parseOr() (captureFilter, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "or" || parser.peek() == "||" {
+		parser.pos++
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(packet *capturePacket) bool { return l(packet) || right(packet) }
+	}
+	return left, nil
+}
+
+func (parser *captureFilterParser) parseAnd() (captureFilter, error) {
+	left, err := parser.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "and" || parser.peek() == "&&" {
+		parser.pos++
+		right, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(packet *capturePacket) bool { return l(packet) && right(packet) }
+	}
+	return left, nil
+}
+
+func (parser *captureFilterParser) parseNot() (captureFilter, error) {
+	switch parser.peek() {
+	case "not", "!":
+		parser.pos++
+		filter, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(packet *capturePacket) bool { return !filter(packet) }, nil
+	case "(":
+		parser.pos++
+		filter, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if token, _ := parser.next(); token != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return filter, nil
+	}
+	return parser.parsePrimitive()
+}
+
+// プロトコルの名前とイーサタイプ, IPのプロトコル番号
+var captureFilterProtocols = map[string]captureFilter{
+	"arp":  func(packet *capturePacket) bool { return packet.etherType == ethernet.TYPE_ARP },
+	"ip":   func(packet *capturePacket) bool { return packet.etherType == ethernet.TYPE_IPV4 },
+	"ip6":  func(packet *capturePacket) bool { return packet.etherType == ethernet.TYPE_IPV6 },
+	"lldp": func(packet *capturePacket) bool { return packet.etherType == ethernet.TYPE_LLDP },
+	"lacp": func(packet *capturePacket) bool { return packet.etherType == ethernet.TYPE_LACP },
+	"icmp": func(packet *capturePacket) bool {
+		return packet.etherType == ethernet.TYPE_IPV4 && packet.protocol == IP_PROTOCOL_NUM_ICMP
+	},
+	"icmp6": func(packet *capturePacket) bool {
+		return packet.etherType == ethernet.TYPE_IPV6 && packet.protocol == IP_PROTOCOL_NUM_ICMPV6
+	},
+	"tcp": func(packet *capturePacket) bool {
+		return packet.protocol == IP_PROTOCOL_NUM_TCP
+	},
+	"udp": func(packet *capturePacket) bool {
+		return packet.protocol == IP_PROTOCOL_NUM_UDP
+	},
+}
+
+func (parser *captureFilterParser) parsePrimitive() (captureFilter, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "inbound":
+		return func(packet *capturePacket) bool { return packet.direction == captureInbound }, nil
+	case "outbound":
+		return func(packet *capturePacket) bool { return packet.direction == captureOutbound }, nil
+	case "vlan":
+		// VLAN IDを省略したらタグのついたフレーム全て
+		vlanId, err := strconv.ParseUint(parser.peek(), 10, 12)
+		if err != nil {
+			return func(packet *capturePacket) bool { return packet.tagged }, nil
+		}
+		parser.pos++
+		return func(packet *capturePacket) bool { return packet.tagged && packet.vlanId == uint16(vlanId) }, nil
+	case "ether":
+		return parser.parseEther()
+	case "tcp", "udp":
+		// tcp port 80 のようにプロトコルでポートを絞る
+		proto := captureFilterProtocols[token]
+		if next := parser.peek(); next != "port" && next != "src" && next != "dst" {
+			return proto, nil
+		}
+		dir, err := parser.parseDirection()
+		if err != nil {
+			return nil, err
+		}
+		if keyword, _ := parser.next(); keyword != "port" {
+			return nil, fmt.Errorf("%s %s must be followed by port", token, dir)
+		}
+		port, err := parser.parsePort(dir)
+		if err != nil {
+			return nil, err
+		}
+		return func(packet *capturePacket) bool { return proto(packet) && port(packet) }, nil
+	case "src", "dst", "host", "net", "port":
+		parser.pos--
+		dir, err := parser.parseDirection()
+		if err != nil {
+			return nil, err
+		}
+		keyword, err := parser.next()
+		if err != nil {
+			return nil, err
+		}
+		switch keyword {
+		case "host":
+			return parser.parseHost(dir)
+		case "net":
+			return parser.parseNet(dir)
+		case "port":
+			return parser.parsePort(dir)
+		}
+		return nil, fmt.Errorf("%s must be followed by host, net or port", dir)
+	}
+	if proto, ok := captureFilterProtocols[token]; ok {
+		return proto, nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", token)
+}
+
+// src, dstがあれば読む, なければどちらでもよい
+func (parser *captureFilterParser) parseDirection() (string, error) {
+	switch parser.peek() {
+	case "src", "dst":
+		return parser.next()
+	}
+	return "", nil
+}
+
+// 送信元と宛先のどちらかが条件を満たすか
+func matchCaptureDirection(dir string, src, dest func(packet *capturePacket) bool) captureFilter {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dest
+	}
+	return func(packet *capturePacket) bool { return src(packet) || dest(packet) }
+}
+
+func (parser *captureFilterParser) parseHost(dir string) (captureFilter, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	addr := net.ParseIP(token)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid host address %q", token)
+	}
+	return matchCaptureDirection(dir,
+		func(packet *capturePacket) bool { return packet.srcAddr != nil && packet.srcAddr.Equal(addr) },
+		func(packet *capturePacket) bool { return packet.destAddr != nil && packet.destAddr.Equal(addr) }), nil
+}
+
+func (parser *captureFilterParser) parseNet(dir string) (captureFilter, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	_, ipnet, err := net.ParseCIDR(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid net %q", token)
+	}
+	return matchCaptureDirection(dir,
+		func(packet *capturePacket) bool { return packet.srcAddr != nil && ipnet.Contains(packet.srcAddr) },
+		func(packet *capturePacket) bool { return packet.destAddr != nil && ipnet.Contains(packet.destAddr) }), nil
+}
+
+func (parser *captureFilterParser) parsePort(dir string) (captureFilter, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(token, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", token)
+	}
+	return matchCaptureDirection(dir,
+		func(packet *capturePacket) bool { return packet.hasPorts && packet.srcPort == uint16(port) },
+		func(packet *capturePacket) bool { return packet.hasPorts && packet.destPort == uint16(port) }), nil
+}
+
+func (parser *captureFilterParser) parseEther() (captureFilter, error) {
+	dir, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	switch dir {
+	case "host":
+		dir = ""
+	case "src", "dst":
+		// ether src host のようにhostをつけてもよい
+		if parser.peek() == "host" {
+			parser.pos++
+		}
+	default:
+		return nil, fmt.Errorf("ether must be followed by src, dst or host")
+	}
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	hwaddr, err := net.ParseMAC(token)
+	if err != nil || len(hwaddr) != 6 {
+		return nil, fmt.Errorf("invalid mac address %q", token)
+	}
+	macaddr := setMacAddr(hwaddr)
+	return matchCaptureDirection(dir,
+		func(packet *capturePacket) bool { return packet.srcMac == macaddr },
+		func(packet *capturePacket) bool { return packet.destMac == macaddr }), nil
+}
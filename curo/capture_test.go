@@ -0,0 +1,302 @@
+package curo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// テスト用に読んだpcapngの拡張パケットブロック
+type testPcapngPacket struct {
+	ifname string
+	ts     time.Time
+	flags  uint32
+	frame  []byte
+}
+
+/*
+テスト用にpcapngのファイルを読む
+セクションヘッダ, インターフェイス記述, 拡張パケットのブロックだけを見る
+*/
+func readTestPcapng(t *testing.T, path string) []testPcapngPacket {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ifnames []string
+	var packets []testPcapngPacket
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block %x", data)
+		}
+		blockType, totalLen := binary.LittleEndian.Uint32(data[0:4]), binary.LittleEndian.Uint32(data[4:8])
+		if totalLen%4 != 0 || int(totalLen) > len(data) || binary.LittleEndian.Uint32(data[totalLen-4:totalLen]) != totalLen {
+			t.Fatalf("block length %d is invalid", totalLen)
+		}
+		body := data[8 : totalLen-4]
+		switch blockType {
+		case PCAPNG_BLOCK_SECTION_HEADER:
+			if binary.LittleEndian.Uint32(body[0:4]) != PCAPNG_BYTE_ORDER_MAGIC {
+				t.Fatalf("byte order magic is %x", body[0:4])
+			}
+		case PCAPNG_BLOCK_INTERFACE:
+			// 最初のオプションがif_name
+			nameLen := binary.LittleEndian.Uint16(body[10:12])
+			if binary.LittleEndian.Uint16(body[8:10]) != PCAPNG_OPTION_IF_NAME {
+				t.Fatalf("first option of interface block is %x", body[8:])
+			}
+			ifnames = append(ifnames, string(body[12:12+nameLen]))
+		case PCAPNG_BLOCK_ENHANCED_PACKET:
+			interfaceId := binary.LittleEndian.Uint32(body[0:4])
+			if int(interfaceId) >= len(ifnames) {
+				t.Fatalf("interface id %d is not described", interfaceId)
+			}
+			nano := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:12]))
+			capLen := binary.LittleEndian.Uint32(body[12:16])
+			options := body[20+capLen+uint32(pcapngPadLen(int(capLen))):]
+			var flags uint32
+			if len(options) >= 8 && binary.LittleEndian.Uint16(options[0:2]) == PCAPNG_OPTION_EPB_FLAGS {
+				flags = binary.LittleEndian.Uint32(options[4:8])
+			}
+			packets = append(packets, testPcapngPacket{
+				ifname: ifnames[interfaceId],
+				ts:     time.Unix(0, int64(nano)),
+				flags:  flags,
+				frame:  body[20 : 20+capLen],
+			})
+		default:
+			t.Fatalf("unexpected block type %x", blockType)
+		}
+		data = data[totalLen:]
+	}
+	return packets
+}
+
+func TestCaptureFilter(t *testing.T) {
+	macA, macB := [6]uint8{0x02, 0, 0, 0, 0, 0x0a}, [6]uint8{0x02, 0, 0, 0, 0, 0x0b}
+	ethernetFrame := func(etherType uint16, payload []byte) []byte {
+		return append(ethernetHeader{destAddr: macB, srcAddr: macA, etherType: etherType}.ToPacket(), payload...)
+	}
+	ipPacket := func(protocol uint8, src, dest uint32, payload []byte) []byte {
+		header := ipHeader{version: 4, headerLen: 5, totalLen: uint16(20 + len(payload)), ttl: 64,
+			protocol: protocol, srcAddr: src, destAddr: dest}
+		return append(header.ToPacket(true), payload...)
+	}
+	echo := ethernetFrame(ETHER_TYPE_IP, ipPacket(IP_PROTOCOL_NUM_ICMP, 0xc0a80103, 0xc0a80202,
+		[]byte{ICMP_TYPE_ECHO_REQUEST, 0, 0, 0, 0, 1, 0, 1}))
+	http := vlanTag(ethernetFrame(ETHER_TYPE_IP, ipPacket(IP_PROTOCOL_NUM_TCP, 0xc0a80a02, 0xc0a80202,
+		(&tcpHeader{srcPort: 40000, destPort: 80, offset: 0x50, window: 1024}).ToPacket())), 10)
+	dns := ethernetFrame(ETHER_TYPE_IP, ipPacket(IP_PROTOCOL_NUM_UDP, 0xc0a80103, 0x08080808,
+		(&udpHeader{srcPort: 5000, destPort: 53, length: 8}).ToPacket()))
+	arp := ethernetFrame(ETHER_TYPE_ARP, arpIPToEthernet{
+		hardwareType: ARP_HTYPE_ETHERNET, protocolType: ETHER_TYPE_IP, hardwareLen: ETHERNET_ADDRES_LEN,
+		protocolLen: IP_ADDRESS_LEN, opcode: ARP_OPERATION_CODE_REQUEST, senderHardwareAddr: macA,
+		senderIPAddr: 0xc0a80103, targetIPAddr: 0xc0a80101,
+	}.ToPacket())
+	frames := map[string][]byte{"echo": echo, "http": http, "dns": dns, "arp": arp, "truncated": echo[:20]}
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"icmp", []string{"echo"}},
+		{"ip", []string{"echo", "http", "dns", "truncated"}},
+		{"tcp port 80", []string{"http"}},
+		{"udp dst port 53 or tcp src port 40000", []string{"http", "dns"}},
+		{"port 53 and not tcp", []string{"dns"}},
+		{"vlan 10", []string{"http"}},
+		{"vlan 20", nil},
+		{"!vlan && (host 192.168.1.3)", []string{"echo", "dns", "arp"}},
+		{"src net 192.168.0.0/16 and dst host 192.168.2.2", []string{"echo", "http"}},
+		{"arp and dst host 192.168.1.1", []string{"arp"}},
+		{"ether src 02:00:00:00:00:0a and inbound", []string{"echo", "http", "dns", "arp", "truncated"}},
+		{"ether dst host 02:00:00:00:00:0a or outbound", nil},
+	}
+	for _, tt := range tests {
+		filter, err := parseCaptureFilter(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, name := range []string{"echo", "http", "dns", "arp", "truncated"} {
+			if filter(decodeCapturePacket(frames[name], captureInbound)) {
+				got = append(got, name)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("filter %q matches %v, want %v", tt.expr, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("filter %q matches %v, want %v", tt.expr, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if filter, err := parseCaptureFilter("  "); filter != nil || err != nil {
+		t.Fatalf("empty filter is %v, err is %v", filter, err)
+	}
+	for _, invalid := range []string{"tcp port", "host 192.168.1", "(icmp", "icmp)", "icmp and", "ether 02:00:00:00:00:0a", "src icmp", "foo"} {
+		if _, err := parseCaptureFilter(invalid); err == nil {
+			t.Errorf("invalid filter %q is parsed", invalid)
+		}
+	}
+}
+
+/*
+1つのpcapngのファイルに両方のインターフェイスで送受信したフレームを向きをつけて書く
+*/
+func TestCapturePcapng(t *testing.T) {
+	sim, router1, _, hosts := newChapter5Simulator(nil)
+	// 先にARPを解決しておく
+	if !sim.ping(hosts[0], "192.168.2.2") {
+		t.Fatal("ping from host0 to host2 failed")
+	}
+	path := filepath.Join(t.TempDir(), "router1.pcapng")
+	if err := router1.router.EnableCapture(CaptureOptions{Path: path, Filter: "icmp"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1700000000, 123456789)
+	now := start
+	router1.router.capture.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+	if !sim.ping(hosts[0], "192.168.2.2") {
+		t.Fatal("ping from host0 to host2 failed")
+	}
+	if err := router1.router.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readTestPcapng(t, path)
+	// pingのリクエストと応答がそれぞれ2つのインターフェイスを通る
+	var requests, replies []testPcapngPacket
+	for _, packet := range packets {
+		decoded := decodeCapturePacket(packet.frame, captureInbound)
+		if decoded.protocol != IP_PROTOCOL_NUM_ICMP {
+			t.Fatalf("captured frame is not icmp %x", packet.frame)
+		}
+		if decoded.destAddr.String() == "192.168.2.2" {
+			requests = append(requests, packet)
+		} else {
+			replies = append(replies, packet)
+		}
+	}
+	if len(requests) != 2 || len(replies) != 2 {
+		t.Fatalf("captured %d requests and %d replies", len(requests), len(replies))
+	}
+	if requests[0].ifname != "router1-br0" || requests[0].flags != PCAPNG_EPB_FLAG_INBOUND ||
+		requests[1].ifname != "router1-router2" || requests[1].flags != PCAPNG_EPB_FLAG_OUTBOUND {
+		t.Fatalf("echo request is captured on %s %d, %s %d", requests[0].ifname, requests[0].flags, requests[1].ifname, requests[1].flags)
+	}
+	if replies[0].ifname != "router1-router2" || replies[0].flags != PCAPNG_EPB_FLAG_INBOUND ||
+		replies[1].ifname != "router1-br0" || replies[1].flags != PCAPNG_EPB_FLAG_OUTBOUND {
+		t.Fatalf("echo reply is captured on %s %d, %s %d", replies[0].ifname, replies[0].flags, replies[1].ifname, replies[1].flags)
+	}
+	// 送信した時にはTTLが減っている
+	if requests[0].frame[22]-1 != requests[1].frame[22] {
+		t.Fatalf("ttl of forwarded request is %d -> %d", requests[0].frame[22], requests[1].frame[22])
+	}
+	for i, packet := range packets {
+		if !packet.ts.Equal(start.Add(time.Duration(i+1) * time.Millisecond)) {
+			t.Fatalf("timestamp of packet %d is %s", i, packet.ts)
+		}
+	}
+
+	// リプレイで使うreadPcapngもテストのパーサと同じように読む
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	read, err := readPcapng(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(packets) {
+		t.Fatalf("readPcapng read %d packets, want %d", len(read), len(packets))
+	}
+	for i, packet := range packets {
+		if read[i].ifname != packet.ifname || !read[i].ts.Equal(packet.ts) || read[i].flags != packet.flags || !bytes.Equal(read[i].frame, packet.frame) {
+			t.Fatalf("readPcapng packet %d is %+v, want %+v", i, read[i], packet)
+		}
+	}
+}
+
+/*
+インターフェイスごとのpcapのファイルをサイズでローテーションする
+*/
+func TestCapturePerInterfaceRotate(t *testing.T) {
+	sim, router1, _, hosts := newChapter5Simulator(nil)
+	dir := filepath.Join(t.TempDir(), "capture")
+	// 1つのファイルにフレームが2つ入ったら次のファイルに切り替える
+	rotateSize := int64(PCAP_HEADER_LEN + PCAP_RECORD_LEN + 1)
+	err := router1.router.EnableCapture(CaptureOptions{Path: dir, Format: "pcap", PerInterface: true, RotateSize: rotateSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !sim.ping(hosts[0], "192.168.1.1") {
+			t.Fatal("ping from host0 to router1 failed")
+		}
+	}
+	if err := router1.router.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// router1-router2では何も送受信していない
+	if _, err := os.Stat(filepath.Join(dir, "router1-router2.pcap")); !os.IsNotExist(err) {
+		t.Fatalf("capture file of idle interface err is %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "router1-br0*.pcap"))
+	if err != nil || len(files) < 2 {
+		t.Fatalf("capture files are %v", files)
+	}
+	total := 0
+	for seq := 0; seq < len(files); seq++ {
+		file, err := os.Open(rotatedCapturePath(filepath.Join(dir, "router1-br0.pcap"), seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := newPcapDriver(file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for reader.buffered() {
+			frame, err := reader.receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame != nil {
+				count++
+			}
+		}
+		reader.close()
+		if count == 0 || count > 2 {
+			t.Fatalf("capture file %d has %d frames", seq, count)
+		}
+		total += count
+	}
+	// ARPの要求と応答, 3回のpingの要求と応答
+	if total != 8 {
+		t.Fatalf("captured %d frames", total)
+	}
+
+	if rotatedCapturePath("/tmp/router1.pcapng", 2) != "/tmp/router1.2.pcapng" || rotatedCapturePath("/tmp/router1", 1) != "/tmp/router1.1" {
+		t.Fatal("rotated capture path is invalid")
+	}
+	if _, err := newPacketCapture(CaptureOptions{Path: dir, Format: "erf"}); err == nil {
+		t.Fatal("unknown capture format is accepted")
+	}
+	if !bytes.Equal(pcapFileHeader()[0:4], []byte{0xd4, 0xc3, 0xb2, 0xa1}) {
+		t.Fatalf("pcap magic is %x", pcapFileHeader()[0:4])
+	}
+}
@@ -0,0 +1,97 @@
+package curo
+
+import (
+	"testing"
+	"testing/quick"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+// TTLを減らしたIPヘッダのチェックサムが正しいか確認する
+func TestTtlDecrementChecksum(t *testing.T) {
+	property := func(ttl uint8, protocol uint8, srcAddr, destAddr uint32, identify uint16) bool {
+		if ttl == 0 {
+			ttl = 1
+		}
+		ipheader := ipHeader{version: 4, headerLen: 5, totalLen: 40, identify: identify, ttl: ttl, protocol: protocol, srcAddr: srcAddr, destAddr: destAddr}
+		ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+
+		oldTtl := uint16(ipheader.ttl)<<8 | uint16(ipheader.protocol)
+		ipheader.ttl -= 1
+		ipheader.headerChecksum = checksum.Adjust(ipheader.headerChecksum, oldTtl, uint16(ipheader.ttl)<<8|uint16(ipheader.protocol))
+		return byteToUint16(calcChecksum(ipheader.ToPacket(false))) == 0
+	}
+	if err := quick.Check(property, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// NATで書き換えたUDPのポートとチェックサムが正しいか確認する
+func TestNatExecUdpChecksum(t *testing.T) {
+	natdev := newTestNatDevice()
+	remote := uint32(0x08080808)
+	payload := []byte("checksum")
+
+	datagram := (&udpHeader{srcPort: 5000, destPort: 53, length: uint16(8 + len(payload))}).ToPacket()
+	datagram = append(datagram, payload...)
+	copy(datagram[6:8], uint16ToByte(calcTransportChecksum(testNatLocalAddr, remote, IP_PROTOCOL_NUM_UDP, datagram)))
+	ipheader := ipHeader{version: 4, headerLen: 5, totalLen: uint16(20 + len(datagram)), ttl: 64, protocol: IP_PROTOCOL_NUM_UDP, srcAddr: testNatLocalAddr, destAddr: remote}
+	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+
+	translated, err := natExec(&ipheader, natPacketHeader{packet: datagram}, natdev, udp, outgoing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := natdev.natEntry.getNatEntryByLocal(udp, testNatLocalAddr, 5000, remote, 53)
+	if byteToUint16(translated[0:2]) != entry.globalPort || string(translated[8:]) != string(payload) {
+		t.Fatalf("translated udp is %x", translated)
+	}
+	if calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, IP_PROTOCOL_NUM_UDP, translated) != 0 {
+		t.Fatal("udp checksum of outgoing packet is invalid")
+	}
+	if byteToUint16(calcChecksum(ipheader.ToPacket(false))) != 0 {
+		t.Fatal("ip checksum of outgoing packet is invalid")
+	}
+
+	// 外側からの応答の宛先を内側のホストに戻す
+	reply := (&udpHeader{srcPort: 53, destPort: entry.globalPort, length: uint16(8 + len(payload))}).ToPacket()
+	reply = append(reply, payload...)
+	copy(reply[6:8], uint16ToByte(calcTransportChecksum(remote, testNatOutsideAddr, IP_PROTOCOL_NUM_UDP, reply)))
+	ipheader = ipHeader{version: 4, headerLen: 5, totalLen: uint16(20 + len(reply)), ttl: 64, protocol: IP_PROTOCOL_NUM_UDP, srcAddr: remote, destAddr: testNatOutsideAddr}
+	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+
+	translated, err = natExec(&ipheader, natPacketHeader{packet: reply}, natdev, udp, incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byteToUint16(translated[2:4]) != 5000 || ipheader.destAddr != testNatLocalAddr {
+		t.Fatalf("translated udp reply is %x", translated)
+	}
+	if calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, IP_PROTOCOL_NUM_UDP, translated) != 0 {
+		t.Fatal("udp checksum of incoming packet is invalid")
+	}
+	if byteToUint16(calcChecksum(ipheader.ToPacket(false))) != 0 {
+		t.Fatal("ip checksum of incoming packet is invalid")
+	}
+}
+
+// ポート番号の差が負になるTCPの変換でもチェックサムが正しいか確認する
+func TestNatExecTcpChecksum(t *testing.T) {
+	natdev := newTestNatDevice()
+	segment := tcpHeader{srcPort: 65000, destPort: 80, seq: 1, offset: 5 << 4, tcpflag: TCP_FLAG_SYN, window: 1024, tcpdata: []byte("syn")}
+	segment.checksum = calcTransportChecksum(testNatLocalAddr, 0x08080808, IP_PROTOCOL_NUM_TCP, segment.ToPacket())
+	packet := segment.ToPacket()
+	ipheader := ipHeader{version: 4, headerLen: 5, totalLen: uint16(20 + len(packet)), ttl: 64, protocol: IP_PROTOCOL_NUM_TCP, srcAddr: testNatLocalAddr, destAddr: 0x08080808}
+	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+
+	translated, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, tcp, outgoing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, IP_PROTOCOL_NUM_TCP, translated) != 0 {
+		t.Fatal("tcp checksum of outgoing packet is invalid")
+	}
+	if byteToUint16(calcChecksum(ipheader.ToPacket(false))) != 0 {
+		t.Fatal("ip checksum of outgoing packet is invalid")
+	}
+}
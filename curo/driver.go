@@ -0,0 +1,102 @@
+package curo
+
+import (
+	"fmt"
+)
+
+/*
+リンク層のドライバ
+netDeviceはドライバを通してフレームを送受信するので、AF_PACKET以外にも
+TUN/TAPやpcapファイル、メモリ上のチャネルの上でも同じルータが動く
+*/
+type netDeviceDriver interface {
+	// epollで受信を待つファイルディスクリプタ, epollで待てなければ-1
+	fd() int
+	// フレームを1つ受信する, 受信するフレームがなければnilを返す
+	receive() ([]byte, error)
+	transmit(frame []byte) error
+	linkUp() bool
+	// 自分宛て以外のフレームも受信する
+	setPromiscuous() error
+	close() error
+}
+
+/*
+epollで待てずにフレームを内部にためておくドライバ
+ためているフレームはepoll_waitから戻るたびに受信する
+*/
+type bufferedDriver interface {
+	buffered() bool
+}
+
+/*
+送信するフレームをためておくドライバ
+ためているフレームはepoll_waitから戻って受信を処理するたびにまとめて送信する
+*/
+type flushDriver interface {
+	flush() error
+}
+
+// メモリ上のチャネルでつながったドライバ, テストやシミュレータで使う
+type chanDriver struct {
+	rx   chan []byte
+	peer *chanDriver
+	up   bool
+}
+
+/*
+お互いにつながったチャネルのドライバのペアを作る
+片方から送信したフレームはもう片方で受信できる
+*/
+func newChanDriverPair(queueLen int) (*chanDriver, *chanDriver) {
+	a := &chanDriver{rx: make(chan []byte, queueLen), up: true}
+	b := &chanDriver{rx: make(chan []byte, queueLen), up: true, peer: a}
+	a.peer = b
+	return a, b
+}
+
+func (driver *chanDriver) fd() int {
+	return -1
+}
+
+func (driver *chanDriver) receive() ([]byte, error) {
+	select {
+	case frame := <-driver.rx:
+		return frame, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (driver *chanDriver) transmit(frame []byte) error {
+	if !driver.linkUp() {
+		return fmt.Errorf("link is down")
+	}
+	// 送信した側がスライスを使い回しても影響しないようにコピーする
+	data := make([]byte, len(frame))
+	copy(data, frame)
+	select {
+	case driver.peer.rx <- data:
+		return nil
+	default:
+		return fmt.Errorf("rx queue of peer is full")
+	}
+}
+
+// 両端が上がっていればリンクが上がっている
+func (driver *chanDriver) linkUp() bool {
+	return driver.up && driver.peer.up
+}
+
+func (driver *chanDriver) setPromiscuous() error {
+	return nil
+}
+
+func (driver *chanDriver) close() error {
+	driver.up = false
+	return nil
+}
+
+func (driver *chanDriver) buffered() bool {
+	return len(driver.rx) != 0
+}
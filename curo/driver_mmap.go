@@ -0,0 +1,280 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// PACKET_MMAPのソケットオプション
+const (
+	PACKET_RX_RING      = 5
+	PACKET_VERSION      = 10
+	PACKET_TX_RING      = 13
+	PACKET_QDISC_BYPASS = 20
+	TPACKET_V3          = 2
+)
+
+// TPACKET_V3のリングのステータス
+const (
+	TP_STATUS_KERNEL       = 0x0
+	TP_STATUS_USER         = 0x1
+	TP_STATUS_AVAILABLE    = 0x0
+	TP_STATUS_SEND_REQUEST = 0x1
+	TP_STATUS_WRONG_FORMAT = 0x4
+)
+
+// リングの大きさ
+// 受信はブロックが埋まるかMMAP_RX_BLOCK_TIMEOUTミリ秒たつとまとめてユーザーに渡される
+const (
+	MMAP_RX_BLOCK_SIZE    = 1 << 20
+	MMAP_RX_BLOCK_NR      = 16
+	MMAP_RX_FRAME_SIZE    = 1 << 11
+	MMAP_RX_BLOCK_TIMEOUT = 1
+	MMAP_TX_BLOCK_SIZE    = 1 << 20
+	MMAP_TX_BLOCK_NR      = 4
+	MMAP_TX_FRAME_SIZE    = 1 << 14 // ジャンボフレームも1つのフレームに収まる
+	MMAP_TX_BATCH         = 64      // この数だけ送信リングにためたらカーネルに送信させる
+)
+
+// struct tpacket_block_desc と struct tpacket3_hdr のオフセット
+const (
+	TPACKET_BLOCK_STATUS     = 8
+	TPACKET_BLOCK_NUM_PKTS   = 12
+	TPACKET_BLOCK_FIRST_PKT  = 16
+	TPACKET3_HDR_NEXT_OFFSET = 0
+	TPACKET3_HDR_SNAPLEN     = 12
+	TPACKET3_HDR_LEN         = 16
+	TPACKET3_HDR_STATUS      = 20
+	TPACKET3_HDR_MAC         = 24
+	TPACKET3_HDR_VLAN_TCI    = 32
+	TPACKET3_HDR_SIZE        = 48
+	TPACKET3_TX_DATA_OFFSET  = TPACKET3_HDR_SIZE // TPACKET3_HDRLEN - sizeof(struct sockaddr_ll)
+)
+
+/*
+PACKET_MMAPのTPACKET_V3のリングでフレームを送受信するドライバ
+受信はカーネルがブロックにまとめて書いたフレームを、コピーせずにリングのスライスのまま返す
+返したフレームは次にreceiveを呼ぶまで有効で、ブロックの全てのフレームを処理したらカーネルに返す
+送信はリングにフレームを書いてためておき、flushでまとめてカーネルに送信させる
+*/
+type mmapDriver struct {
+	name      string
+	socket    int
+	sockaddr  syscall.SockaddrLinklayer
+	ring      []byte // 受信リングの後ろに送信リングが続く
+	rxBlock   int    // 処理しているブロック
+	rxPkt     uint32 // ブロックの中で処理したフレームの数
+	rxOffset  int    // ブロックの中の次のフレームの位置
+	txOffset  int    // 送信リングの先頭
+	txHead    int    // 次に書く送信リングのフレーム
+	txPending int    // 送信を要求してまだカーネルに送信させていないフレームの数
+}
+
+// struct tpacket_req3 をバイト列にする
+func tpacketReq3(blockSize, blockNr, frameSize, timeout int) string {
+	req := make([]byte, 28)
+	binary.LittleEndian.PutUint32(req[0:4], uint32(blockSize))
+	binary.LittleEndian.PutUint32(req[4:8], uint32(blockNr))
+	binary.LittleEndian.PutUint32(req[8:12], uint32(frameSize))
+	binary.LittleEndian.PutUint32(req[12:16], uint32(blockSize/frameSize*blockNr))
+	binary.LittleEndian.PutUint32(req[16:20], uint32(timeout))
+	return string(req)
+}
+
+/*
+インターフェイスにbindしたTPACKET_V3のリングのソケットを作る
+他のインターフェイスのフレームがリングに入らないように、プロトコルを0で作ってbindする時にETH_P_ALLにする
+*/
+func newMmapDriver(netif net.Interface) (*mmapDriver, error) {
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create socket err : %s", err)
+	}
+	driver := &mmapDriver{name: netif.Name, socket: sock}
+	if err := driver.setupRing(); err != nil {
+		syscall.Close(sock)
+		return nil, err
+	}
+	driver.sockaddr = syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  netif.Index,
+	}
+	if err := syscall.Bind(sock, &driver.sockaddr); err != nil {
+		driver.close()
+		return nil, fmt.Errorf("bind err : %s", err)
+	}
+	return driver, nil
+}
+
+/*
+TPACKET_V3の受信と送信のリングを作ってmmapする
+送信はqdiscを通さずにドライバに渡す
+*/
+func (driver *mmapDriver) setupRing() error {
+	if err := syscall.SetsockoptInt(driver.socket, syscall.SOL_PACKET, PACKET_VERSION, TPACKET_V3); err != nil {
+		return fmt.Errorf("set tpacket v3 err : %s", err)
+	}
+	if err := syscall.SetsockoptInt(driver.socket, syscall.SOL_PACKET, PACKET_QDISC_BYPASS, 1); err != nil {
+		return fmt.Errorf("set qdisc bypass err : %s", err)
+	}
+	err := syscall.SetsockoptString(driver.socket, syscall.SOL_PACKET, PACKET_RX_RING,
+		tpacketReq3(MMAP_RX_BLOCK_SIZE, MMAP_RX_BLOCK_NR, MMAP_RX_FRAME_SIZE, MMAP_RX_BLOCK_TIMEOUT))
+	if err != nil {
+		return fmt.Errorf("set rx ring err : %s", err)
+	}
+	err = syscall.SetsockoptString(driver.socket, syscall.SOL_PACKET, PACKET_TX_RING,
+		tpacketReq3(MMAP_TX_BLOCK_SIZE, MMAP_TX_BLOCK_NR, MMAP_TX_FRAME_SIZE, 0))
+	if err != nil {
+		return fmt.Errorf("set tx ring err : %s", err)
+	}
+	driver.txOffset = MMAP_RX_BLOCK_SIZE * MMAP_RX_BLOCK_NR
+	ring, err := syscall.Mmap(driver.socket, 0, driver.txOffset+MMAP_TX_BLOCK_SIZE*MMAP_TX_BLOCK_NR,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap ring err : %s", err)
+	}
+	driver.ring = ring
+	return nil
+}
+
+// カーネルと共有しているステータスを読み書きする
+func (driver *mmapDriver) loadStatus(offset int) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&driver.ring[offset])))
+}
+
+func (driver *mmapDriver) storeStatus(offset int, status uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&driver.ring[offset])), status)
+}
+
+func (driver *mmapDriver) fd() int {
+	return driver.socket
+}
+
+/*
+受信リングから次のフレームを取り出す
+ブロックの全てのフレームを返したらブロックをカーネルに返して次のブロックを見る
+*/
+func (driver *mmapDriver) receive() ([]byte, error) {
+	for {
+		blockStart := driver.rxBlock * MMAP_RX_BLOCK_SIZE
+		if driver.loadStatus(blockStart+TPACKET_BLOCK_STATUS)&TP_STATUS_USER == 0 {
+			return nil, nil
+		}
+		block := driver.ring[blockStart : blockStart+MMAP_RX_BLOCK_SIZE]
+		if driver.rxPkt == 0 {
+			driver.rxOffset = int(binary.LittleEndian.Uint32(block[TPACKET_BLOCK_FIRST_PKT:]))
+		}
+		if driver.rxPkt >= binary.LittleEndian.Uint32(block[TPACKET_BLOCK_NUM_PKTS:]) {
+			driver.storeStatus(blockStart+TPACKET_BLOCK_STATUS, TP_STATUS_KERNEL)
+			driver.rxBlock = (driver.rxBlock + 1) % MMAP_RX_BLOCK_NR
+			driver.rxPkt = 0
+			continue
+		}
+		if driver.rxOffset+TPACKET3_HDR_SIZE > len(block) {
+			return nil, fmt.Errorf("rx ring frame offset %d is out of block", driver.rxOffset)
+		}
+		hdr := block[driver.rxOffset:]
+		mac := int(binary.LittleEndian.Uint16(hdr[TPACKET3_HDR_MAC:]))
+		snaplen := int(binary.LittleEndian.Uint32(hdr[TPACKET3_HDR_SNAPLEN:]))
+		if mac+snaplen > len(hdr) {
+			return nil, fmt.Errorf("rx ring frame length %d is out of block", snaplen)
+		}
+		// ルータがappendしても次のフレームを上書きしないように容量を切る
+		frame := hdr[mac : mac+snaplen : mac+snaplen]
+		status := binary.LittleEndian.Uint32(hdr[TPACKET3_HDR_STATUS:])
+		vlanTci := binary.LittleEndian.Uint32(hdr[TPACKET3_HDR_VLAN_TCI:])
+		driver.rxPkt++
+		driver.rxOffset += int(binary.LittleEndian.Uint32(hdr[TPACKET3_HDR_NEXT_OFFSET:]))
+		// カーネルがVLANのタグを外していたらフレームに戻す
+		if status&TP_STATUS_VLAN_VALID != 0 && len(frame) >= 14 {
+			frame = vlanTag(frame, uint16(vlanTci))
+		}
+		return frame, nil
+	}
+}
+
+/*
+受信リングにユーザーに渡されたブロックがあるか
+*/
+func (driver *mmapDriver) buffered() bool {
+	return driver.loadStatus(driver.rxBlock*MMAP_RX_BLOCK_SIZE+TPACKET_BLOCK_STATUS)&TP_STATUS_USER != 0
+}
+
+/*
+送信リングにフレームを書いて送信を要求する
+空きがなければためているフレームを送信させてから書く
+*/
+func (driver *mmapDriver) transmit(frame []byte) error {
+	if len(frame) > MMAP_TX_FRAME_SIZE-TPACKET3_TX_DATA_OFFSET {
+		return fmt.Errorf("frame length %d is too long for tx ring", len(frame))
+	}
+	slot := driver.txOffset + driver.txHead*MMAP_TX_FRAME_SIZE
+	// 送信できなかったフレームは上書きする
+	if status := driver.loadStatus(slot + TPACKET3_HDR_STATUS); status != TP_STATUS_AVAILABLE && status&TP_STATUS_WRONG_FORMAT == 0 {
+		if err := driver.sendRing(); err != nil {
+			return err
+		}
+		if driver.loadStatus(slot+TPACKET3_HDR_STATUS) != TP_STATUS_AVAILABLE {
+			return fmt.Errorf("tx ring is full")
+		}
+	}
+	hdr := driver.ring[slot : slot+MMAP_TX_FRAME_SIZE]
+	binary.LittleEndian.PutUint32(hdr[TPACKET3_HDR_NEXT_OFFSET:], 0)
+	binary.LittleEndian.PutUint32(hdr[TPACKET3_HDR_SNAPLEN:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(hdr[TPACKET3_HDR_LEN:], uint32(len(frame)))
+	copy(hdr[TPACKET3_TX_DATA_OFFSET:], frame)
+	driver.storeStatus(slot+TPACKET3_HDR_STATUS, TP_STATUS_SEND_REQUEST)
+	driver.txHead = (driver.txHead + 1) % (MMAP_TX_BLOCK_SIZE / MMAP_TX_FRAME_SIZE * MMAP_TX_BLOCK_NR)
+	driver.txPending++
+	if driver.txPending >= MMAP_TX_BATCH {
+		return driver.flush()
+	}
+	return nil
+}
+
+/*
+送信リングにためたフレームをカーネルに送信させる
+*/
+func (driver *mmapDriver) flush() error {
+	if driver.txPending == 0 {
+		return nil
+	}
+	return driver.sendRing()
+}
+
+// 送信を要求した全てのフレームをカーネルに送信させる
+func (driver *mmapDriver) sendRing() error {
+	driver.txPending = 0
+	err := syscall.Sendto(driver.socket, nil, syscall.MSG_DONTWAIT, nil)
+	if err != nil && err != syscall.EAGAIN {
+		return fmt.Errorf("send tx ring err : %s", err)
+	}
+	return nil
+}
+
+/*
+インターフェイスのリンクが上がっているかSIOCGIFFLAGSで確認する
+*/
+func (driver *mmapDriver) linkUp() bool {
+	return (&packetDriver{name: driver.name, socket: driver.socket}).linkUp()
+}
+
+/*
+インターフェイスをプロミスキャスモードにする
+*/
+func (driver *mmapDriver) setPromiscuous() error {
+	return (&packetDriver{socket: driver.socket, sockaddr: driver.sockaddr}).setPromiscuous()
+}
+
+func (driver *mmapDriver) close() error {
+	driver.flush()
+	if driver.ring != nil {
+		syscall.Munmap(driver.ring)
+		driver.ring = nil
+	}
+	return syscall.Close(driver.socket)
+}
@@ -0,0 +1,267 @@
+package curo
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// テストのフレームのイーサタイプ, IEEE 802のローカルな実験用
+const testEtherType = 0x88b5
+
+var testVethSeq uint32
+
+/*
+テスト用にvethのペアを作ってリンクを上げる
+rootでないか、vethを作れない環境ではスキップする
+*/
+func newTestVethPair(tb testing.TB, mtu int) (net.Interface, net.Interface) {
+	tb.Helper()
+	if os.Geteuid() != 0 {
+		tb.Skip("veth test needs root")
+	}
+	seq := atomic.AddUint32(&testVethSeq, 1)
+	names := []string{fmt.Sprintf("curo%d-%da", os.Getpid()%10000, seq), fmt.Sprintf("curo%d-%db", os.Getpid()%10000, seq)}
+	if out, err := exec.Command("ip", "link", "add", names[0], "type", "veth", "peer", "name", names[1]).CombinedOutput(); err != nil {
+		tb.Skipf("create veth err : %s %s", err, out)
+	}
+	tb.Cleanup(func() {
+		exec.Command("ip", "link", "del", names[0]).Run()
+	})
+	var netifs []net.Interface
+	for _, name := range names {
+		// IPv6のルータ要請などが流れないようにする
+		os.WriteFile("/proc/sys/net/ipv6/conf/"+name+"/disable_ipv6", []byte("1"), 0644)
+		if out, err := exec.Command("ip", "link", "set", name, "mtu", fmt.Sprint(mtu), "up").CombinedOutput(); err != nil {
+			tb.Fatalf("set veth up err : %s %s", err, out)
+		}
+		netif, err := net.InterfaceByName(name)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		netifs = append(netifs, *netif)
+	}
+	return netifs[0], netifs[1]
+}
+
+// テスト用にドライバを選んで作る
+func newTestDriver(tb testing.TB, kind string, netif net.Interface) netDeviceDriver {
+	tb.Helper()
+	router := NewRouter("ch2")
+	if err := router.SetDriver(kind); err != nil {
+		tb.Fatal(err)
+	}
+	driver, created, err := router.newInterfaceDriver(netif)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		driver.close()
+	})
+	// AF_XDPが使えずにAF_PACKETになったら理由をつけてスキップする
+	if created != kind {
+		tb.Skipf("%s driver is not available on %s : %v", kind, netif.Name, router.fallbacks[netif.Name])
+	}
+	return driver
+}
+
+// テスト用にドライバのソケットを登録したepollを作る
+func newTestEpoll(tb testing.TB, driver netDeviceDriver) int {
+	tb.Helper()
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		syscall.Close(epfd)
+	})
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, driver.fd(), &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(driver.fd())})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return epfd
+}
+
+/*
+epollでドライバの受信を待って、テストのイーサタイプのフレームを受信する
+timeoutまでに受信できなければnilを返す
+*/
+func receiveTestFrame(tb testing.TB, driver netDeviceDriver, epfd int, timeout time.Duration) []byte {
+	tb.Helper()
+	events := make([]syscall.EpollEvent, 1)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		// リングに残っているフレームはepollを待たずに受信する
+		if buffered, ok := driver.(bufferedDriver); !ok || !buffered.buffered() {
+			n, err := syscall.EpollWait(epfd, events, 10)
+			if err != nil && err != syscall.EINTR {
+				tb.Fatal(err)
+			}
+			if n <= 0 {
+				continue
+			}
+		}
+		frame, err := driver.receive()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if len(frame) >= 14 && (byteToUint16(frame[12:14]) == testEtherType || byteToUint16(frame[12:14]) == ETHER_TYPE_VLAN) {
+			return append([]byte{}, frame...)
+		}
+	}
+	return nil
+}
+
+// テストのイーサタイプのフレームを作る
+func testDriverFrame(src net.Interface, size int, seq byte) []byte {
+	frame := ethernetHeader{
+		destAddr:  ETHERNET_ADDRESS_BROADCAST,
+		srcAddr:   setMacAddr(src.HardwareAddr),
+		etherType: testEtherType,
+	}.ToPacket()
+	return append(frame, bytes.Repeat([]byte{seq}, size-len(frame))...)
+}
+
+func TestSetDriver(t *testing.T) {
+	router := NewRouter("ch2")
+	for _, rule := range []string{"mmap", "router1-br0=packet", "router1-router2=xdp"} {
+		if err := router.SetDriver(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if router.drivers[""] != DRIVER_MMAP || router.drivers["router1-br0"] != DRIVER_PACKET || router.drivers["router1-router2"] != DRIVER_XDP {
+		t.Fatalf("drivers are %v", router.drivers)
+	}
+	for _, invalid := range []string{"", "ring", "router1-br0=ring", "a=b=mmap"} {
+		if err := router.SetDriver(invalid); err == nil {
+			t.Errorf("invalid driver rule %q is accepted", invalid)
+		}
+	}
+}
+
+/*
+vethの上でリングからジャンボフレームやVLANのタグのついたフレームを送受信する
+*/
+func TestMmapDriverVeth(t *testing.T) {
+	local, peer := newTestVethPair(t, 9000)
+	receiver := newTestDriver(t, DRIVER_MMAP, local)
+	epfd := newTestEpoll(t, receiver)
+	sender := newTestDriver(t, DRIVER_MMAP, peer).(*mmapDriver)
+
+	frames := [][]byte{
+		testDriverFrame(peer, 60, 1),
+		testDriverFrame(peer, 9014, 2),
+		vlanTag(testDriverFrame(peer, 60, 3), 10),
+	}
+	for _, frame := range frames {
+		if err := sender.transmit(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// flushするまでは送信しない
+	if frame := receiveTestFrame(t, receiver, epfd, 20*time.Millisecond); frame != nil {
+		t.Fatalf("frame is sent before flush %x", frame[:14])
+	}
+	if err := sender.flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range frames {
+		frame := receiveTestFrame(t, receiver, epfd, time.Second)
+		if !bytes.Equal(frame, want) {
+			t.Fatalf("received frame %d is %d bytes, want %d bytes", i, len(frame), len(want))
+		}
+	}
+
+	// 送信リングを何周もしてもフレームを落とさない
+	count := MMAP_TX_BLOCK_SIZE / MMAP_TX_FRAME_SIZE * MMAP_TX_BLOCK_NR * 3
+	for i := 0; i < count; i++ {
+		if err := sender.transmit(testDriverFrame(peer, 60, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender.flush()
+	for i := 0; i < count; i++ {
+		frame := receiveTestFrame(t, receiver, epfd, time.Second)
+		if frame == nil || frame[14] != byte(i) {
+			t.Fatalf("received frame %d is %x", i, frame)
+		}
+	}
+	if !receiver.linkUp() {
+		t.Fatal("link of veth is down")
+	}
+}
+
+/*
+vethの反対側からフレームを送り続けて、AF_PACKETのrecvmsgとTPACKET_V3のリング, AF_XDPで1秒あたりに受信できるフレームの数を比べる
+*/
+func BenchmarkDriverReceive(b *testing.B) {
+	for _, kind := range []string{DRIVER_PACKET, DRIVER_MMAP, DRIVER_XDP} {
+		b.Run(kind, func(b *testing.B) {
+			local, peer := newTestVethPair(b, 1500)
+			receiver := newTestDriver(b, kind, local)
+			epfd := newTestEpoll(b, receiver)
+			sender := newTestDriver(b, DRIVER_MMAP, peer).(*mmapDriver)
+			frame := testDriverFrame(peer, 60, 0)
+			done := make(chan struct{})
+			b.ResetTimer()
+			go func() {
+				defer close(done)
+				for i := 0; i < b.N; i++ {
+					for sender.transmit(frame) != nil {
+						runtime.Gosched()
+					}
+				}
+				sender.flush()
+			}()
+			received := 0
+			for received < b.N {
+				if receiveTestFrame(b, receiver, epfd, 100*time.Millisecond) != nil {
+					received++
+					continue
+				}
+				// 送り終わってから100ミリ秒受信できなければ残りは落ちている
+				select {
+				case <-done:
+				default:
+					continue
+				}
+				break
+			}
+			b.StopTimer()
+			<-done
+			b.ReportMetric(float64(received)/b.Elapsed().Seconds(), "pps")
+			b.ReportMetric(float64(b.N-received)*100/float64(b.N), "drop%")
+		})
+	}
+}
+
+/*
+AF_PACKETのsendtoとTPACKET_V3のリング, AF_XDPで1秒あたりに送信できるフレームの数を比べる
+*/
+func BenchmarkDriverTransmit(b *testing.B) {
+	for _, kind := range []string{DRIVER_PACKET, DRIVER_MMAP, DRIVER_XDP} {
+		b.Run(kind, func(b *testing.B) {
+			local, _ := newTestVethPair(b, 1500)
+			sender := newTestDriver(b, kind, local)
+			frame := testDriverFrame(local, 60, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for sender.transmit(frame) != nil {
+					runtime.Gosched()
+				}
+			}
+			if driver, ok := sender.(flushDriver); ok {
+				driver.flush()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pps")
+		})
+	}
+}
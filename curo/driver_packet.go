@@ -0,0 +1,101 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// AF_PACKETのソケットでインターフェイスのフレームを送受信するドライバ
+type packetDriver struct {
+	name     string
+	socket   int
+	sockaddr syscall.SockaddrLinklayer
+}
+
+/*
+インターフェイスにbindしたAF_PACKETのソケットを作る
+*/
+func newPacketDriver(netif net.Interface) (*packetDriver, error) {
+	// socketをオープン
+	sock, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return nil, fmt.Errorf("create socket err : %s", err)
+	}
+	// socketにインターフェイスをbindする
+	addr := syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  netif.Index,
+	}
+	err = syscall.Bind(sock, &addr)
+	if err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("bind err : %s", err)
+	}
+	// カーネルが受信時に外したVLANのタグを受け取る
+	err = syscall.SetsockoptInt(sock, syscall.SOL_PACKET, PACKET_AUXDATA, 1)
+	if err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("set packet auxdata err : %s", err)
+	}
+	return &packetDriver{name: netif.Name, socket: sock, sockaddr: addr}, nil
+}
+
+func (driver *packetDriver) fd() int {
+	return driver.socket
+}
+
+func (driver *packetDriver) receive() ([]byte, error) {
+	// VLANのタグの分も受け取れるようにする
+	recvbuffer := make([]byte, 1500+VLAN_TAG_LEN)
+	oob := make([]byte, syscall.CmsgSpace(20))
+	n, oobn, _, _, err := syscall.Recvmsg(driver.socket, recvbuffer, oob, 0)
+	if err != nil {
+		if n == -1 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("recv err, n is %d, err is %s", n, err)
+	}
+	frame := recvbuffer[:n]
+	// カーネルがVLANのタグを外していたらフレームに戻す
+	if vlanTci, ok := parseVlanAuxdata(oob[:oobn]); ok && n >= 14 {
+		frame = vlanTag(frame, vlanTci)
+	}
+	return frame, nil
+}
+
+func (driver *packetDriver) transmit(frame []byte) error {
+	return syscall.Sendto(driver.socket, frame, 0, &driver.sockaddr)
+}
+
+/*
+インターフェイスのリンクが上がっているかSIOCGIFFLAGSで確認する
+*/
+func (driver *packetDriver) linkUp() bool {
+	// struct ifreq
+	var ifreq [40]byte
+	copy(ifreq[0:syscall.IFNAMSIZ-1], driver.name)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(driver.socket), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifreq[0])))
+	if errno != 0 {
+		return false
+	}
+	flags := binary.LittleEndian.Uint16(ifreq[16:18])
+	return flags&syscall.IFF_UP != 0 && flags&syscall.IFF_RUNNING != 0
+}
+
+/*
+インターフェイスをプロミスキャスモードにする
+*/
+func (driver *packetDriver) setPromiscuous() error {
+	// struct packet_mreq, ホストのバイトオーダー
+	mreq := make([]byte, 16)
+	binary.LittleEndian.PutUint32(mreq[0:4], uint32(driver.sockaddr.Ifindex))
+	binary.LittleEndian.PutUint16(mreq[4:6], syscall.PACKET_MR_PROMISC)
+	return syscall.SetsockoptString(driver.socket, syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP, string(mreq))
+}
+
+func (driver *packetDriver) close() error {
+	return syscall.Close(driver.socket)
+}
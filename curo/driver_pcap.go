@@ -0,0 +1,134 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/*
+pcapファイルのドライバ
+受信するフレームをpcapファイルから読み、送信したフレームを別のpcapファイルに書く
+*/
+type pcapDriver struct {
+	reader io.Reader
+	writer io.Writer
+	order  binary.ByteOrder // 読み込むファイルのバイトオーダー
+	eof    bool
+}
+
+/*
+pcapのドライバを作る
+readerとwriterのどちらかはnilでもよく、readerのないドライバは何も受信しない
+*/
+func newPcapDriver(reader io.Reader, writer io.Writer) (*pcapDriver, error) {
+	driver := &pcapDriver{reader: reader, writer: writer, eof: reader == nil}
+	if reader != nil {
+		header := make([]byte, PCAP_HEADER_LEN)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, fmt.Errorf("read pcap header err : %s", err)
+		}
+		// マジックナンバーで書いたマシンのバイトオーダーを判断する
+		switch {
+		case binary.LittleEndian.Uint32(header[0:4]) == PCAP_MAGIC || binary.LittleEndian.Uint32(header[0:4]) == PCAP_MAGIC_NANO:
+			driver.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(header[0:4]) == PCAP_MAGIC || binary.BigEndian.Uint32(header[0:4]) == PCAP_MAGIC_NANO:
+			driver.order = binary.BigEndian
+		default:
+			return nil, fmt.Errorf("not pcap file, magic is %x", header[0:4])
+		}
+		if linkType := driver.order.Uint32(header[20:24]); linkType != LINKTYPE_ETHERNET {
+			return nil, fmt.Errorf("unsupported pcap link type %d", linkType)
+		}
+	}
+	if writer != nil {
+		if _, err := writer.Write(pcapFileHeader()); err != nil {
+			return nil, fmt.Errorf("write pcap header err : %s", err)
+		}
+	}
+	return driver, nil
+}
+
+/*
+ファイルのパスからpcapのドライバを作る
+空のパスは使わない
+*/
+func newPcapFileDriver(inPath, outPath string) (*pcapDriver, error) {
+	var reader io.Reader
+	var writer io.Writer
+	if inPath != "" {
+		file, err := os.Open(inPath)
+		if err != nil {
+			return nil, err
+		}
+		reader = file
+	}
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			return nil, err
+		}
+		writer = file
+	}
+	return newPcapDriver(reader, writer)
+}
+
+func (driver *pcapDriver) fd() int {
+	return -1
+}
+
+func (driver *pcapDriver) receive() ([]byte, error) {
+	if driver.eof {
+		return nil, nil
+	}
+	record := make([]byte, PCAP_RECORD_LEN)
+	if _, err := io.ReadFull(driver.reader, record); err != nil {
+		driver.eof = true
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read pcap record err : %s", err)
+	}
+	capLen := driver.order.Uint32(record[8:12])
+	if capLen > PCAP_SNAPLEN {
+		driver.eof = true
+		return nil, fmt.Errorf("pcap record length %d is too long", capLen)
+	}
+	frame := make([]byte, capLen)
+	if _, err := io.ReadFull(driver.reader, frame); err != nil {
+		driver.eof = true
+		return nil, fmt.Errorf("read pcap record err : %s", err)
+	}
+	return frame, nil
+}
+
+func (driver *pcapDriver) transmit(frame []byte) error {
+	if driver.writer == nil {
+		return nil
+	}
+	_, err := driver.writer.Write(pcapRecord(time.Now(), frame))
+	return err
+}
+
+func (driver *pcapDriver) linkUp() bool {
+	return true
+}
+
+func (driver *pcapDriver) setPromiscuous() error {
+	return nil
+}
+
+func (driver *pcapDriver) close() error {
+	for _, v := range []interface{}{driver.reader, driver.writer} {
+		if closer, ok := v.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+func (driver *pcapDriver) buffered() bool {
+	return !driver.eof
+}
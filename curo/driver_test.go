@@ -0,0 +1,172 @@
+package curo
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChanDriver(t *testing.T) {
+	a, b := newChanDriverPair(1)
+	frame := []byte{0x01, 0x02, 0x03}
+	if err := a.transmit(frame); err != nil {
+		t.Fatal(err)
+	}
+	// 送信した後にスライスを書き換えても受信側には影響しない
+	frame[0] = 0xff
+	if !b.buffered() {
+		t.Fatal("peer has no buffered frame")
+	}
+	received, err := b.receive()
+	if err != nil || !bytes.Equal(received, []byte{0x01, 0x02, 0x03}) {
+		t.Fatalf("received frame is %x, err is %v", received, err)
+	}
+	if received, _ := b.receive(); received != nil {
+		t.Fatalf("received frame from empty queue is %x", received)
+	}
+
+	// 受信側のキューがいっぱいなら送信できない
+	a.transmit(frame)
+	if err := a.transmit(frame); err == nil {
+		t.Fatal("transmit to full queue succeeded")
+	}
+
+	// 片方が閉じたらリンクが落ちる
+	b.close()
+	if a.linkUp() || b.linkUp() {
+		t.Fatal("link is up after close")
+	}
+	if err := a.transmit(frame); err == nil {
+		t.Fatal("transmit on down link succeeded")
+	}
+}
+
+func TestPcapDriver(t *testing.T) {
+	var buffer bytes.Buffer
+	writer, err := newPcapDriver(nil, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := [][]byte{
+		bytes.Repeat([]byte{0xaa}, 60),
+		bytes.Repeat([]byte{0xbb}, 1514),
+	}
+	for _, frame := range frames {
+		if err := writer.transmit(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if writer.buffered() {
+		t.Fatal("driver without reader has buffered frames")
+	}
+
+	reader, err := newPcapDriver(bytes.NewReader(buffer.Bytes()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range frames {
+		frame, err := reader.receive()
+		if err != nil || !bytes.Equal(frame, want) {
+			t.Fatalf("frame %d is %x, err is %v", i, frame, err)
+		}
+	}
+	if frame, err := reader.receive(); frame != nil || err != nil {
+		t.Fatalf("frame after eof is %x, err is %v", frame, err)
+	}
+	if reader.buffered() {
+		t.Fatal("driver has buffered frames after eof")
+	}
+
+	// pcapではないファイルやイーサネット以外のリンクタイプは読まない
+	invalid := make([]byte, PCAP_HEADER_LEN)
+	if _, err := newPcapDriver(bytes.NewReader(invalid), nil); err == nil {
+		t.Fatal("file with bad magic is opened")
+	}
+	header := append([]byte{}, buffer.Bytes()[:PCAP_HEADER_LEN]...)
+	header[20] = 113
+	if _, err := newPcapDriver(bytes.NewReader(header), nil); err == nil {
+		t.Fatal("file with linux sll link type is opened")
+	}
+}
+
+func TestTunArpReply(t *testing.T) {
+	driver := &tunTapDriver{tun: true, macaddr: [6]uint8{0x02, 0, 0, 0, 0, 0x10}}
+	request := arpIPToEthernet{
+		hardwareType:       ARP_HTYPE_ETHERNET,
+		protocolType:       ETHER_TYPE_IP,
+		hardwareLen:        ETHERNET_ADDRES_LEN,
+		protocolLen:        IP_ADDRESS_LEN,
+		opcode:             ARP_OPERATION_CODE_REQUEST,
+		senderHardwareAddr: driver.macaddr,
+		senderIPAddr:       0xc0a86401,
+		targetIPAddr:       0xc0a86402,
+	}.ToPacket()
+	frame := ethernetHeader{
+		destAddr:  ETHERNET_ADDRESS_BROADCAST,
+		srcAddr:   driver.macaddr,
+		etherType: ETHER_TYPE_ARP,
+	}.ToPacket()
+	// ARPはTUNに書かずにドライバが相手の代わりに応答する
+	if err := driver.transmit(append(frame, request...)); err != nil {
+		t.Fatal(err)
+	}
+	if !driver.buffered() {
+		t.Fatal("arp reply is not queued")
+	}
+	reply, err := driver.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setMacAddr(reply[0:6]) != driver.macaddr || setMacAddr(reply[6:12]) != TUN_PEER_MAC_ADDRESS ||
+		byteToUint16(reply[12:14]) != ETHER_TYPE_ARP {
+		t.Fatalf("ethernet header of arp reply is %x", reply[0:14])
+	}
+	arp := reply[14:]
+	if byteToUint16(arp[6:8]) != ARP_OPERATION_CODE_REPLY || setMacAddr(arp[8:14]) != TUN_PEER_MAC_ADDRESS ||
+		byteToUint32(arp[14:18]) != 0xc0a86402 || byteToUint32(arp[24:28]) != 0xc0a86401 {
+		t.Fatalf("arp reply is %x", arp)
+	}
+	if driver.buffered() {
+		t.Fatal("arp reply is queued twice")
+	}
+}
+
+/*
+チャネルのドライバの上でも物理のデバイスと同じようにARPに応答する
+*/
+func TestNetDeviceOnChanDriver(t *testing.T) {
+	local, peer := newChanDriverPair(8)
+	netdev := &netDevice{
+		name:    "router1-chan0",
+		macaddr: [6]uint8{0x02, 0, 0, 0, 0, 0x20},
+		driver:  local,
+		ipdev:   ipDevice{address: 0xc0a86401, netmask: 0xffffff00, broadcast: 0xc0a864ff},
+	}
+	NewRouter("ch2").addDevice(netdev)
+	hostMac := [6]uint8{0x02, 0, 0, 0, 0, 0x21}
+	request := arpIPToEthernet{
+		hardwareType:       ARP_HTYPE_ETHERNET,
+		protocolType:       ETHER_TYPE_IP,
+		hardwareLen:        ETHERNET_ADDRES_LEN,
+		protocolLen:        IP_ADDRESS_LEN,
+		opcode:             ARP_OPERATION_CODE_REQUEST,
+		senderHardwareAddr: hostMac,
+		senderIPAddr:       0xc0a86402,
+		targetIPAddr:       0xc0a86401,
+	}.ToPacket()
+	frame := ethernetHeader{
+		destAddr:  ETHERNET_ADDRESS_BROADCAST,
+		srcAddr:   hostMac,
+		etherType: ETHER_TYPE_ARP,
+	}.ToPacket()
+	if err := peer.transmit(append(frame, request...)); err != nil {
+		t.Fatal(err)
+	}
+	if err := netdev.netDeviceDrain("ch2"); err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := peer.receive()
+	if len(reply) < 42 || setMacAddr(reply[0:6]) != hostMac || setMacAddr(reply[6:12]) != netdev.macaddr ||
+		byteToUint16(reply[20:22]) != ARP_OPERATION_CODE_REPLY {
+		t.Fatalf("arp reply is %x", reply)
+	}
+}
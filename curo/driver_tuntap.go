@@ -0,0 +1,222 @@
+package curo
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const TUN_DEVICE_PATH = "/dev/net/tun"
+
+// TUNSETIFFのフラグ
+const (
+	TUNSETIFF = 0x400454ca
+	IFF_TUN   = 0x0001
+	IFF_TAP   = 0x0002
+	IFF_NO_PI = 0x1000
+)
+
+// TUNの先にいるとみなす相手のMACアドレス
+var TUN_PEER_MAC_ADDRESS = [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+// TUN/TAPのデバイスの設定
+type tunTapConfig struct {
+	name    string
+	tun     bool // trueならTUN, falseならTAP
+	address uint32
+	netmask uint32
+}
+
+/*
+TUN/TAPのドライバ
+TAPはイーサネットのフレームをそのまま送受信する
+TUNはIPパケットしか扱わないので、受信したパケットにイーサネットヘッダをつけ、ARPには自分で応答する
+*/
+type tunTapDriver struct {
+	name    string
+	file    int
+	tun     bool
+	macaddr [6]uint8 // ルータ側のMACアドレス
+	pending [][]byte // TUNで自分で作ったARPリプライ
+}
+
+/*
+TUN/TAPのデバイスの設定をパースする
+"router1-tap0=192.168.100.1/24" の形で指定する
+*/
+func parseTunTapConfig(rule string, tun bool) (tunTapConfig, error) {
+	fields := strings.Split(rule, "=")
+	if len(fields) != 2 || fields[0] == "" || len(fields[0]) >= syscall.IFNAMSIZ {
+		return tunTapConfig{}, fmt.Errorf("invalid tun/tap rule %q, format is ifname=addr/prefix", rule)
+	}
+	ip, ipnet, err := net.ParseCIDR(fields[1])
+	if err != nil || ip.To4() == nil {
+		return tunTapConfig{}, fmt.Errorf("invalid tun/tap ip addr %q", fields[1])
+	}
+	return tunTapConfig{
+		name:    fields[0],
+		tun:     tun,
+		address: byteToUint32(ip.To4()),
+		netmask: byteToUint32(ipnet.Mask),
+	}, nil
+}
+
+/*
+TUN/TAPのデバイスを作ってカーネル側のインターフェイスを上げる
+ルータ側のMACアドレスはランダムに決める
+*/
+func newTunTapDriver(name string, tun bool) (*tunTapDriver, error) {
+	file, err := syscall.Open(TUN_DEVICE_PATH, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s err : %s", TUN_DEVICE_PATH, err)
+	}
+	// struct ifreq
+	var ifreq [40]byte
+	copy(ifreq[0:syscall.IFNAMSIZ-1], name)
+	flags := uint16(IFF_TAP | IFF_NO_PI)
+	if tun {
+		flags = IFF_TUN | IFF_NO_PI
+	}
+	binary.LittleEndian.PutUint16(ifreq[16:18], flags)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(file), TUNSETIFF, uintptr(unsafe.Pointer(&ifreq[0])))
+	if errno != 0 {
+		syscall.Close(file)
+		return nil, fmt.Errorf("create tun/tap %s err : %s", name, errno)
+	}
+	if err := setInterfaceUp(name); err != nil {
+		syscall.Close(file)
+		return nil, err
+	}
+	driver := &tunTapDriver{name: name, file: file, tun: tun}
+	if _, err := rand.Read(driver.macaddr[:]); err != nil {
+		syscall.Close(file)
+		return nil, err
+	}
+	// ローカルに管理されたユニキャストのアドレスにする
+	driver.macaddr[0] = driver.macaddr[0]&0xfc | 0x02
+	return driver, nil
+}
+
+/*
+カーネルのインターフェイスをSIOCSIFFLAGSで上げる
+*/
+func setInterfaceUp(name string) error {
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+	var ifreq [40]byte
+	copy(ifreq[0:syscall.IFNAMSIZ-1], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifreq[0]))); errno != 0 {
+		return fmt.Errorf("get flags of %s err : %s", name, errno)
+	}
+	flags := binary.LittleEndian.Uint16(ifreq[16:18]) | syscall.IFF_UP
+	binary.LittleEndian.PutUint16(ifreq[16:18], flags)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(sock), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifreq[0]))); errno != 0 {
+		return fmt.Errorf("set %s up err : %s", name, errno)
+	}
+	return nil
+}
+
+func (driver *tunTapDriver) fd() int {
+	return driver.file
+}
+
+func (driver *tunTapDriver) receive() ([]byte, error) {
+	if len(driver.pending) != 0 {
+		frame := driver.pending[0]
+		driver.pending = driver.pending[1:]
+		return frame, nil
+	}
+	buffer := make([]byte, 1500+VLAN_TAG_LEN)
+	n, err := syscall.Read(driver.file, buffer)
+	if err != nil {
+		if err == syscall.EAGAIN {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read err : %s", err)
+	}
+	if !driver.tun {
+		return buffer[:n], nil
+	}
+	// IPのバージョンからイーサタイプを決めてイーサネットヘッダをつける
+	if n < 1 {
+		return nil, nil
+	}
+	etherType := ETHER_TYPE_IP
+	if buffer[0]>>4 == 6 {
+		etherType = ETHER_TYPE_IPV6
+	}
+	frame := ethernetHeader{
+		destAddr:  driver.macaddr,
+		srcAddr:   TUN_PEER_MAC_ADDRESS,
+		etherType: etherType,
+	}.ToPacket()
+	return append(frame, buffer[:n]...), nil
+}
+
+func (driver *tunTapDriver) transmit(frame []byte) error {
+	if !driver.tun {
+		_, err := syscall.Write(driver.file, frame)
+		return err
+	}
+	if len(frame) < 14 {
+		return nil
+	}
+	switch byteToUint16(frame[12:14]) {
+	case ETHER_TYPE_IP, ETHER_TYPE_IPV6:
+		_, err := syscall.Write(driver.file, frame[14:])
+		return err
+	case ETHER_TYPE_ARP:
+		driver.arpReply(frame[14:])
+	}
+	return nil
+}
+
+/*
+TUNの先のアドレスへのARPリクエストに相手の代わりに応答する
+*/
+func (driver *tunTapDriver) arpReply(packet []byte) {
+	if len(packet) < 28 || byteToUint16(packet[6:8]) != ARP_OPERATION_CODE_REQUEST {
+		return
+	}
+	reply := arpIPToEthernet{
+		hardwareType:        ARP_HTYPE_ETHERNET,
+		protocolType:        ETHER_TYPE_IP,
+		hardwareLen:         ETHERNET_ADDRES_LEN,
+		protocolLen:         IP_ADDRESS_LEN,
+		opcode:              ARP_OPERATION_CODE_REPLY,
+		senderHardwareAddr:  TUN_PEER_MAC_ADDRESS,
+		senderIPAddr:        byteToUint32(packet[24:28]),
+		targetHardwareAddrr: setMacAddr(packet[8:14]),
+		targetIPAddr:        byteToUint32(packet[14:18]),
+	}.ToPacket()
+	frame := ethernetHeader{
+		destAddr:  setMacAddr(packet[8:14]),
+		srcAddr:   TUN_PEER_MAC_ADDRESS,
+		etherType: ETHER_TYPE_ARP,
+	}.ToPacket()
+	driver.pending = append(driver.pending, append(frame, reply...))
+}
+
+func (driver *tunTapDriver) linkUp() bool {
+	return true
+}
+
+// TAPのデバイスには全てのフレームが届くので何もしない
+func (driver *tunTapDriver) setPromiscuous() error {
+	return nil
+}
+
+func (driver *tunTapDriver) close() error {
+	return syscall.Close(driver.file)
+}
+
+func (driver *tunTapDriver) buffered() bool {
+	return len(driver.pending) != 0
+}
@@ -0,0 +1,397 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// AF_XDPのソケットとソケットオプション
+const (
+	AF_XDP                   = 44
+	SOL_XDP                  = 283
+	XDP_MMAP_OFFSETS         = 1
+	XDP_RX_RING              = 2
+	XDP_TX_RING              = 3
+	XDP_UMEM_REG             = 4
+	XDP_UMEM_FILL_RING       = 5
+	XDP_UMEM_COMPLETION_RING = 6
+	XDP_COPY                 = 1 << 1 // ドライバが対応していなくても動くようにフレームをコピーする
+)
+
+// リングをmmapする時のオフセット
+const (
+	XDP_PGOFF_RX_RING              = 0
+	XDP_PGOFF_TX_RING              = 0x80000000
+	XDP_UMEM_PGOFF_FILL_RING       = 0x100000000
+	XDP_UMEM_PGOFF_COMPLETION_RING = 0x180000000
+)
+
+// UMEMとリングの大きさ
+// UMEMのフレームの前半を受信に、後半を送信に使う
+const (
+	XDP_FRAME_SIZE = 1 << 12
+	XDP_FRAME_NR   = 1 << 12
+	XDP_RING_SIZE  = XDP_FRAME_NR / 2
+	XDP_TX_BATCH   = 64 // この数だけ送信リングにためたらカーネルに送信させる
+	XDP_QUEUE_ID   = 0  // bindする受信キュー
+)
+
+// struct xdp_descとstruct xdp_mmap_offsetsの大きさ
+const (
+	XDP_DESC_SIZE         = 16
+	XDP_UMEM_DESC_SIZE    = 8
+	XDP_RING_OFFSETS_SIZE = 32
+)
+
+/*
+カーネルと共有するAF_XDPのリング
+producerとconsumerは増え続ける番号で、maskで割った位置のdescを読み書きする
+*/
+type xdpRing struct {
+	mem      []byte
+	producer int
+	consumer int
+	desc     int
+	mask     uint32
+}
+
+// リングのproducerとconsumerを読み書きする
+func (ring *xdpRing) load(offset int) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&ring.mem[offset])))
+}
+
+func (ring *xdpRing) store(offset int, value uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&ring.mem[offset])), value)
+}
+
+// まだ消費していないdescの数
+func (ring *xdpRing) entries() uint32 {
+	return ring.load(ring.producer) - ring.load(ring.consumer)
+}
+
+// 番号のdescの位置
+func (ring *xdpRing) slot(index uint32, size int) []byte {
+	offset := ring.desc + int(index&ring.mask)*size
+	return ring.mem[offset : offset+size]
+}
+
+/*
+AF_XDPのソケットでフレームを送受信するドライバ
+インターフェイスにアタッチしたXDPのプログラムが受信したフレームをソケットにリダイレクトし、
+カーネルがUMEMにコピーしたフレームを受信リングから取り出す
+返したフレームは次にreceiveを呼ぶまで有効で、その時にフレームをFILLリングでカーネルに返す
+送信はUMEMにフレームを書いて送信リングにためておき、flushでまとめてカーネルに送信させる
+*/
+type xdpDriver struct {
+	name       string
+	socket     int
+	control    *packetDriver // リンクの確認とプロミスキャスモードに使うAF_PACKETのソケット
+	umem       []byte
+	fill       xdpRing
+	completion xdpRing
+	rx         xdpRing
+	tx         xdpRing
+	rxAddr     uint64 // 前のreceiveで返したフレームのUMEMのアドレス
+	rxHolding  bool
+	txFree     []uint64 // 送信に使えるUMEMのフレーム
+	txPending  int
+	mapFd      int
+	progFd     int
+	linkFd     int
+}
+
+/*
+インターフェイスの受信キューにbindしたAF_XDPのソケットを作り、XDPのプログラムをアタッチする
+カーネルやインターフェイスがAF_XDPに対応していなければエラーを返す
+*/
+func newXdpDriver(netif net.Interface) (*xdpDriver, error) {
+	if SYS_BPF == 0 {
+		return nil, fmt.Errorf("af_xdp is not supported on %s", runtime.GOARCH)
+	}
+	sock, err := syscall.Socket(AF_XDP, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("create xdp socket err : %s", err)
+	}
+	driver := &xdpDriver{name: netif.Name, socket: sock, mapFd: -1, progFd: -1, linkFd: -1}
+	control, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		syscall.Close(sock)
+		return nil, fmt.Errorf("create socket err : %s", err)
+	}
+	driver.control = &packetDriver{name: netif.Name, socket: control, sockaddr: syscall.SockaddrLinklayer{Ifindex: netif.Index}}
+	if err := driver.setupUmem(); err != nil {
+		driver.close()
+		return nil, err
+	}
+	if err := driver.bind(netif.Index); err != nil {
+		driver.close()
+		return nil, err
+	}
+	if err := driver.attachProgram(netif.Index); err != nil {
+		driver.close()
+		return nil, err
+	}
+	return driver, nil
+}
+
+/*
+UMEMを登録してFILL, COMPLETION, 受信, 送信のリングを作ってmmapする
+*/
+func (driver *xdpDriver) setupUmem() error {
+	umem, err := syscall.Mmap(-1, 0, XDP_FRAME_SIZE*XDP_FRAME_NR,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return fmt.Errorf("mmap umem err : %s", err)
+	}
+	driver.umem = umem
+	// struct xdp_umem_reg
+	reg := make([]byte, 32)
+	binary.LittleEndian.PutUint64(reg[0:8], uint64(uintptr(unsafe.Pointer(&umem[0]))))
+	binary.LittleEndian.PutUint64(reg[8:16], uint64(len(umem)))
+	binary.LittleEndian.PutUint32(reg[16:20], XDP_FRAME_SIZE)
+	if err := syscall.SetsockoptString(driver.socket, SOL_XDP, XDP_UMEM_REG, string(reg)); err != nil {
+		return fmt.Errorf("register umem err : %s", err)
+	}
+	for _, opt := range []int{XDP_UMEM_FILL_RING, XDP_UMEM_COMPLETION_RING, XDP_RX_RING, XDP_TX_RING} {
+		if err := syscall.SetsockoptInt(driver.socket, SOL_XDP, opt, XDP_RING_SIZE); err != nil {
+			return fmt.Errorf("set xdp ring %d size err : %s", opt, err)
+		}
+	}
+	// struct xdp_mmap_offsetsはrx, tx, fill, completionの順
+	offsets := make([]byte, XDP_RING_OFFSETS_SIZE*4)
+	optlen := uint32(len(offsets))
+	_, _, errno := syscall.Syscall6(SYS_GETSOCKOPT, uintptr(driver.socket), SOL_XDP, XDP_MMAP_OFFSETS,
+		uintptr(unsafe.Pointer(&offsets[0])), uintptr(unsafe.Pointer(&optlen)), 0)
+	if errno != 0 {
+		return fmt.Errorf("get xdp mmap offsets err : %s", errno)
+	}
+	rings := []struct {
+		ring     *xdpRing
+		offset   []byte
+		pgoff    int64
+		descSize int
+	}{
+		{&driver.rx, offsets[0:], XDP_PGOFF_RX_RING, XDP_DESC_SIZE},
+		{&driver.tx, offsets[XDP_RING_OFFSETS_SIZE:], XDP_PGOFF_TX_RING, XDP_DESC_SIZE},
+		{&driver.fill, offsets[XDP_RING_OFFSETS_SIZE*2:], XDP_UMEM_PGOFF_FILL_RING, XDP_UMEM_DESC_SIZE},
+		{&driver.completion, offsets[XDP_RING_OFFSETS_SIZE*3:], XDP_UMEM_PGOFF_COMPLETION_RING, XDP_UMEM_DESC_SIZE},
+	}
+	for _, r := range rings {
+		r.ring.producer = int(binary.LittleEndian.Uint64(r.offset[0:8]))
+		r.ring.consumer = int(binary.LittleEndian.Uint64(r.offset[8:16]))
+		r.ring.desc = int(binary.LittleEndian.Uint64(r.offset[16:24]))
+		r.ring.mask = XDP_RING_SIZE - 1
+		mem, err := syscall.Mmap(driver.socket, r.pgoff, r.ring.desc+XDP_RING_SIZE*r.descSize,
+			syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+		if err != nil {
+			return fmt.Errorf("mmap xdp ring err : %s", err)
+		}
+		r.ring.mem = mem
+	}
+	// 受信に使うフレームを全てFILLリングでカーネルに渡す
+	for i := 0; i < XDP_RING_SIZE; i++ {
+		binary.LittleEndian.PutUint64(driver.fill.slot(uint32(i), XDP_UMEM_DESC_SIZE), uint64(i*XDP_FRAME_SIZE))
+	}
+	driver.fill.store(driver.fill.producer, XDP_RING_SIZE)
+	for i := XDP_RING_SIZE; i < XDP_FRAME_NR; i++ {
+		driver.txFree = append(driver.txFree, uint64(i*XDP_FRAME_SIZE))
+	}
+	return nil
+}
+
+/*
+ソケットをインターフェイスの受信キューにコピーモードでbindする
+*/
+func (driver *xdpDriver) bind(ifindex int) error {
+	// struct sockaddr_xdp
+	addr := make([]byte, 16)
+	binary.LittleEndian.PutUint16(addr[0:2], AF_XDP)
+	binary.LittleEndian.PutUint16(addr[2:4], XDP_COPY)
+	binary.LittleEndian.PutUint32(addr[4:8], uint32(ifindex))
+	binary.LittleEndian.PutUint32(addr[8:12], XDP_QUEUE_ID)
+	_, _, errno := syscall.Syscall(SYS_BIND, uintptr(driver.socket), uintptr(unsafe.Pointer(&addr[0])), uintptr(len(addr)))
+	if errno != 0 {
+		return fmt.Errorf("bind xdp socket err : %s", errno)
+	}
+	return nil
+}
+
+/*
+ソケットをXSKMAPに登録して、リダイレクトするXDPのプログラムをインターフェイスにアタッチする
+*/
+func (driver *xdpDriver) attachProgram(ifindex int) error {
+	var err error
+	if driver.mapFd, err = bpfCreateXskMap(XDP_QUEUE_ID + 1); err != nil {
+		return err
+	}
+	if err = bpfMapUpdate(driver.mapFd, XDP_QUEUE_ID, uint32(driver.socket)); err != nil {
+		return err
+	}
+	if driver.progFd, err = bpfLoadXdpProgram(xdpRedirectProgram(driver.mapFd)); err != nil {
+		return err
+	}
+	driver.linkFd, err = bpfAttachXdp(driver.progFd, ifindex)
+	return err
+}
+
+func (driver *xdpDriver) fd() int {
+	return driver.socket
+}
+
+/*
+受信リングから次のフレームを取り出す
+前に返したフレームはルータが使い終わっているのでFILLリングでカーネルに返す
+*/
+func (driver *xdpDriver) receive() ([]byte, error) {
+	if driver.rxHolding {
+		// 受信に使うフレームはFILLリングの大きさと同じなので空きは必ずある
+		prod := driver.fill.load(driver.fill.producer)
+		binary.LittleEndian.PutUint64(driver.fill.slot(prod, XDP_UMEM_DESC_SIZE), driver.rxAddr)
+		driver.fill.store(driver.fill.producer, prod+1)
+		driver.rxHolding = false
+	}
+	if driver.rx.entries() == 0 {
+		return nil, nil
+	}
+	cons := driver.rx.load(driver.rx.consumer)
+	desc := driver.rx.slot(cons, XDP_DESC_SIZE)
+	addr := binary.LittleEndian.Uint64(desc[0:8])
+	length := uint64(binary.LittleEndian.Uint32(desc[8:12]))
+	driver.rx.store(driver.rx.consumer, cons+1)
+	if addr+length > uint64(len(driver.umem)) {
+		return nil, fmt.Errorf("rx ring frame addr %d is out of umem", addr)
+	}
+	// 受信リングのアドレスにはヘッドルームが足されているので、フレームの先頭に戻して返す
+	driver.rxAddr = addr &^ (XDP_FRAME_SIZE - 1)
+	driver.rxHolding = true
+	// ルータがappendしても次のフレームを上書きしないように容量を切る
+	return driver.umem[addr : addr+length : addr+length], nil
+}
+
+/*
+受信リングにフレームがあるか
+*/
+func (driver *xdpDriver) buffered() bool {
+	return driver.rx.entries() != 0
+}
+
+/*
+送信が終わったフレームをCOMPLETIONリングから取り戻す
+*/
+func (driver *xdpDriver) complete() {
+	for n := driver.completion.entries(); n > 0; n-- {
+		cons := driver.completion.load(driver.completion.consumer)
+		addr := binary.LittleEndian.Uint64(driver.completion.slot(cons, XDP_UMEM_DESC_SIZE))
+		driver.txFree = append(driver.txFree, addr)
+		driver.completion.store(driver.completion.consumer, cons+1)
+	}
+}
+
+/*
+UMEMにフレームを書いて送信リングで送信を要求する
+空いているフレームがなければためているフレームを送信させてから書く
+*/
+func (driver *xdpDriver) transmit(frame []byte) error {
+	if len(frame) > XDP_FRAME_SIZE {
+		return fmt.Errorf("frame length %d is too long for umem frame", len(frame))
+	}
+	driver.complete()
+	if len(driver.txFree) == 0 {
+		if err := driver.sendRing(); err != nil {
+			return err
+		}
+		driver.complete()
+		if len(driver.txFree) == 0 {
+			return fmt.Errorf("tx ring is full")
+		}
+	}
+	addr := driver.txFree[len(driver.txFree)-1]
+	driver.txFree = driver.txFree[:len(driver.txFree)-1]
+	copy(driver.umem[addr:addr+XDP_FRAME_SIZE], frame)
+	// 送信に使うフレームは送信リングの大きさと同じなので空きは必ずある
+	prod := driver.tx.load(driver.tx.producer)
+	desc := driver.tx.slot(prod, XDP_DESC_SIZE)
+	binary.LittleEndian.PutUint64(desc[0:8], addr)
+	binary.LittleEndian.PutUint32(desc[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(desc[12:16], 0)
+	driver.tx.store(driver.tx.producer, prod+1)
+	driver.txPending++
+	if driver.txPending >= XDP_TX_BATCH {
+		return driver.flush()
+	}
+	return nil
+}
+
+/*
+送信リングにためたフレームをカーネルに送信させる
+*/
+func (driver *xdpDriver) flush() error {
+	if driver.txPending == 0 {
+		return nil
+	}
+	return driver.sendRing()
+}
+
+/*
+送信リングの全てのフレームをカーネルに送信させる
+コピーモードでは1回のsendtoで送信する数に上限があるので、送信リングが空になるか進まなくなるまで繰り返す
+*/
+func (driver *xdpDriver) sendRing() error {
+	driver.txPending = 0
+	for driver.tx.entries() > 0 {
+		cons := driver.tx.load(driver.tx.consumer)
+		err := syscall.Sendto(driver.socket, nil, syscall.MSG_DONTWAIT, nil)
+		if err != nil && err != syscall.EAGAIN && err != syscall.EBUSY && err != syscall.ENOBUFS {
+			return fmt.Errorf("send tx ring err : %s", err)
+		}
+		if driver.tx.load(driver.tx.consumer) == cons {
+			break
+		}
+	}
+	return nil
+}
+
+/*
+インターフェイスのリンクが上がっているかSIOCGIFFLAGSで確認する
+*/
+func (driver *xdpDriver) linkUp() bool {
+	return driver.control.linkUp()
+}
+
+/*
+インターフェイスをプロミスキャスモードにする
+*/
+func (driver *xdpDriver) setPromiscuous() error {
+	return driver.control.setPromiscuous()
+}
+
+/*
+XDPのプログラムをデタッチして、リングとUMEMを解放する
+*/
+func (driver *xdpDriver) close() error {
+	if driver.tx.mem != nil {
+		driver.flush()
+	}
+	for _, fd := range []int{driver.linkFd, driver.progFd, driver.mapFd} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+	for _, ring := range []*xdpRing{&driver.rx, &driver.tx, &driver.fill, &driver.completion} {
+		if ring.mem != nil {
+			syscall.Munmap(ring.mem)
+			ring.mem = nil
+		}
+	}
+	if driver.umem != nil {
+		syscall.Munmap(driver.umem)
+		driver.umem = nil
+	}
+	driver.control.close()
+	return syscall.Close(driver.socket)
+}
@@ -0,0 +1,87 @@
+package curo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+/*
+vethの上でコピーモードのAF_XDPのソケットからフレームを送受信する
+UMEMのフレームを何周も使い回してもフレームを落とさない
+*/
+func TestXdpDriverVeth(t *testing.T) {
+	local, peer := newTestVethPair(t, 1500)
+	driver := newTestDriver(t, DRIVER_XDP, local)
+	epfd := newTestEpoll(t, driver)
+	peerDriver := newTestDriver(t, DRIVER_MMAP, peer)
+	peerEpfd := newTestEpoll(t, peerDriver)
+	sender := peerDriver.(*mmapDriver)
+
+	// XDPのプログラムがソケットにリダイレクトしたフレームを受信する
+	frames := [][]byte{
+		testDriverFrame(peer, 60, 1),
+		testDriverFrame(peer, 1514, 2),
+		vlanTag(testDriverFrame(peer, 60, 3), 10),
+	}
+	for _, frame := range frames {
+		sender.transmit(frame)
+	}
+	sender.flush()
+	for i, want := range frames {
+		frame := receiveTestFrame(t, driver, epfd, time.Second)
+		if !bytes.Equal(frame, want) {
+			t.Fatalf("received frame %d is %d bytes, want %d bytes", i, len(frame), len(want))
+		}
+	}
+	count := XDP_RING_SIZE * 3
+	for batch := 0; batch < count; batch += XDP_RING_SIZE / 4 {
+		for i := batch; i < batch+XDP_RING_SIZE/4; i++ {
+			sender.transmit(testDriverFrame(peer, 60, byte(i)))
+		}
+		sender.flush()
+		for i := batch; i < batch+XDP_RING_SIZE/4; i++ {
+			frame := receiveTestFrame(t, driver, epfd, time.Second)
+			if frame == nil || frame[14] != byte(i) {
+				t.Fatalf("received frame %d is %x", i, frame)
+			}
+		}
+	}
+
+	// 送信したフレームをvethの反対側で受信する
+	// 反対側のリングがあふれないように、受信と同じく少しずつ送って受信し終わるのを待つ
+	for batch := 0; batch < count; batch += XDP_RING_SIZE / 4 {
+		for i := batch; i < batch+XDP_RING_SIZE/4; i++ {
+			if err := driver.transmit(testDriverFrame(local, 60, byte(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := driver.(flushDriver).flush(); err != nil {
+			t.Fatal(err)
+		}
+		for i := batch; i < batch+XDP_RING_SIZE/4; i++ {
+			frame := receiveTestFrame(t, peerDriver, peerEpfd, time.Second)
+			if frame == nil || frame[14] != byte(i) {
+				t.Fatalf("peer received frame %d is %x", i, frame)
+			}
+		}
+	}
+	if !driver.linkUp() {
+		t.Fatal("link of veth is down")
+	}
+	if err := driver.setPromiscuous(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 受信キューにはAF_XDPのソケットを1つしかbindできないので、2つ目はAF_PACKETのドライバになる
+	router := NewRouter("ch2")
+	router.SetDriver(DRIVER_XDP)
+	fallback, kind, err := router.newInterfaceDriver(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fallback.close()
+	if kind != DRIVER_PACKET || router.fallbacks[local.Name] == nil {
+		t.Fatalf("second driver on the queue is %s, fallback reason is %v", kind, router.fallbacks[local.Name])
+	}
+}
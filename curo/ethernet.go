@@ -0,0 +1,141 @@
+package curo
+
+import (
+	"fmt"
+
+	"github.com/sat0ken/go-curo/ethernet"
+)
+
+const ETHER_TYPE_IP uint16 = 0x0800
+const ETHER_TYPE_ARP uint16 = 0x0806
+const ETHER_TYPE_IPV6 uint16 = 0x86dd
+const ETHERNET_ADDRES_LEN = 6
+
+var ETHERNET_ADDRESS_BROADCAST = [6]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+type ethernetHeader struct {
+	destAddr  [6]uint8 // 宛先MACアドレス
+	srcAddr   [6]uint8 // 送信元MACアドレス
+	etherType uint16   //イーサタイプ
+}
+
+func (ethHeader ethernetHeader) ToPacket() []byte {
+	// イーサネットのヘッダはどんな値でもバイト列にできるのでエラーにならない
+	header, _ := ethernet.Header{
+		Dest: ethHeader.destAddr,
+		Src:  ethHeader.srcAddr,
+		Type: ethHeader.etherType,
+	}.Marshal(nil)
+	return header
+}
+
+func setMacAddr(macAddrByte []byte) [6]uint8 {
+	var macAddrUint8 [6]uint8
+	for i, v := range macAddrByte {
+		macAddrUint8[i] = v
+	}
+	return macAddrUint8
+}
+
+func macToByte(macaddr [6]uint8) (b []byte) {
+	for _, v := range macaddr {
+		b = append(b, v)
+	}
+	return b
+}
+
+/*
+イーサネットのフレームをヘッダとペイロードに分ける
+ヘッダより短いフレームはエラーを返す
+*/
+func parseEthernetHeader(packet []byte) (ethernetHeader, []byte, error) {
+	header, payload, err := ethernet.Parse(packet)
+	if err != nil {
+		return ethernetHeader{}, nil, err
+	}
+	return ethernetHeader{
+		destAddr:  header.Dest,
+		srcAddr:   header.Src,
+		etherType: header.Type,
+	}, payload, nil
+}
+
+// イーサネットの受信処理
+func ethernetInput(netdev *netDevice, packet []byte) {
+	// 送られてきた通信をイーサネットのフレームとして解釈する
+	ethHeader, payload, err := parseEthernetHeader(packet)
+	if err != nil {
+		fmt.Printf("Received ethernet frame is invalid from %s : %s\n", netdev.name, err)
+		return
+	}
+	// LLDPは物理的なリンクごとに処理するので、bondやブリッジより先に受信する
+	if netdev.router.lldp != nil && ethHeader.etherType == ETHER_TYPE_LLDP && ethHeader.destAddr == LLDP_MAC_ADDRESS {
+		netdev.router.lldp.lldpInput(netdev, payload, netdev.router.now())
+		return
+	}
+	// bondのメンバーで受信したフレームはbondの論理デバイスで受信する
+	if netdev.bond != nil {
+		bondInput(netdev, packet)
+		return
+	}
+	// 802.1Qのタグがついていたら外してVLANのサブインターフェイスで受信する
+	if ethHeader.etherType == ETHER_TYPE_VLAN {
+		if len(packet) < ethernet.HEADER_LEN+VLAN_TAG_LEN {
+			return
+		}
+		vlanId, untagged := vlanUntag(packet)
+		vlandev := netdev.vlanDevice(vlanId)
+		if vlandev == nil {
+			// サブインターフェイスのないVLANのフレームは捨てる
+			return
+		}
+		ethernetInput(vlandev, untagged)
+		return
+	}
+	// ブリッジのポートで受信したフレームはブリッジで転送する
+	if netdev.bridge != nil {
+		bridgeInput(netdev, packet)
+		return
+	}
+	netdev.etheHeader = ethHeader
+
+	// 自分のMACアドレス宛てかブロードキャストの通信かを確認する
+	// IPv6の近隣探索はマルチキャストで届くのでマルチキャストも受け取る
+	if netdev.macaddr != netdev.etheHeader.destAddr && netdev.etheHeader.destAddr != ETHERNET_ADDRESS_BROADCAST &&
+		!(netdev.etheHeader.etherType == ETHER_TYPE_IPV6 && netdev.etheHeader.destAddr[0]&0x01 == 0x01) {
+		// 自分のMACアドレス宛てかブロードキャストでなければ return する
+		return
+	}
+
+	// イーサタイプの値から上位プロトコルを特定する
+	switch netdev.etheHeader.etherType {
+	case ETHER_TYPE_ARP:
+		arpInput(netdev, payload)
+	case ETHER_TYPE_IP:
+		ipInput(netdev, payload)
+	case ETHER_TYPE_IPV6:
+		ipv6Input(netdev, payload)
+	}
+}
+
+// イーサネットにカプセル化して送信
+func ethernetOutput(netdev *netDevice, destaddr [6]uint8, packet []byte, ethType uint16) {
+	// イーサネットヘッダのパケットを作成
+	ethHeaderPacket := ethernetHeader{
+		destAddr:  destaddr,
+		srcAddr:   netdev.macaddr,
+		etherType: ethType,
+	}.ToPacket()
+	// イーサネットヘッダに送信するパケットをつなげる
+	ethHeaderPacket = append(ethHeaderPacket, packet...)
+	// RSTPでフォワーディング状態になっていないブリッジのポートからは送信しない
+	if netdev.bridge != nil && netdev.bridge.portState(netdev) != rstpForwarding {
+		return
+	}
+	// ネットワークデバイスに送信する
+	// リンクが落ちているデバイスなどに送れなかったらフレームを捨てる
+	err := netdev.netDeviceTransmit(ethHeaderPacket)
+	if err != nil {
+		fmt.Printf("netDeviceTransmit is err : %v\n", err)
+	}
+}
@@ -0,0 +1,376 @@
+package curo
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+パーサのファズテスト
+go test -fuzz=FuzzEthernetInput ./curo のように1つずつ実行する
+見つかったpanicする入力はtestdata/fuzz/<ターゲット名>/に保存され、次からはgo testで毎回再現する
+*/
+
+var fuzzRemoteMacAddr = [6]uint8{0x02, 0xff, 0x00, 0x00, 0x00, 0x01}
+
+// 内側のホストの2001:db8:1::2
+var fuzzLocalIPv6Addr = [16]byte{0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 15: 0x02}
+
+/*
+ファズテスト用にNATとNAT64, VLAN, LLDPを設定したルータを作る
+入力ごとに作り直して、前の入力で変わった状態に結果が左右されないようにする
+*/
+func newFuzzRouter(t testing.TB) (*simulator, *Router) {
+	sim, router1, _, _ := newChapter5Simulator(nil)
+	router := router1.router
+	inside := router.getnetDeviceByName("router1-br0")
+	inside.ipv6dev = ipv6Device{
+		address:   [16]byte{0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 15: 0x01},
+		prefixLen: 64,
+		linkLocal: [16]byte{0xfe, 0x80, 15: 0x01},
+	}
+	router1.configureNat("router1-br0", "router1-router2", NatOptions{
+		Forwards: []string{"tcp:8080:192.168.1.3:80"},
+		Nat64:    true,
+	})
+	if err := router.AddVlan("router1-br0.10=192.168.10.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	router.EnableLldp("router1", "")
+	// 戻りのパケットも試せるようにUDPとICMPのNATのエントリを作っておく
+	for _, frame := range fuzzNatEntryFrames(router) {
+		ethernetInput(inside, frame)
+	}
+	sim.run()
+	return sim, router
+}
+
+// IPパケットをイーサネットのフレームにする
+func fuzzIPFrame(dest [6]uint8, srcAddr, destAddr uint32, protocol uint8, payload []byte) []byte {
+	ipheader := ipHeader{
+		version:   4,
+		headerLen: 5,
+		totalLen:  uint16(20 + len(payload)),
+		ttl:       64,
+		protocol:  protocol,
+		srcAddr:   srcAddr,
+		destAddr:  destAddr,
+	}
+	packet := append(ipheader.ToPacket(true), payload...)
+	return append(ethernetHeader{destAddr: dest, srcAddr: fuzzRemoteMacAddr, etherType: ETHER_TYPE_IP}.ToPacket(), packet...)
+}
+
+func fuzzUdpSegment(srcAddr, destAddr uint32, srcPort, destPort uint16, payload []byte) []byte {
+	udpheader := udpHeader{srcPort: srcPort, destPort: destPort, length: uint16(8 + len(payload))}
+	segment := append(udpheader.ToPacket(), payload...)
+	copy(segment[6:8], uint16ToByte(calcTransportChecksum(srcAddr, destAddr, IP_PROTOCOL_NUM_UDP, segment)))
+	return segment
+}
+
+func fuzzIcmpMessage(icmpType, icmpCode uint8, rest uint32, data []byte) []byte {
+	message := append([]byte{icmpType, icmpCode, 0, 0}, uint32ToByte(rest)...)
+	message = append(message, data...)
+	copy(message[2:4], calcChecksum(message))
+	return message
+}
+
+// 内側から外側に出るUDPとICMPエコー
+func fuzzNatEntryFrames(router *Router) [][]byte {
+	inside := router.getnetDeviceByName("router1-br0").macaddr
+	return [][]byte{
+		fuzzIPFrame(inside, testNatLocalAddr, testNat64RemoteAddr, IP_PROTOCOL_NUM_UDP,
+			fuzzUdpSegment(testNatLocalAddr, testNat64RemoteAddr, 40000, 53, []byte("query"))),
+		fuzzIPFrame(inside, testNatLocalAddr, testNat64RemoteAddr, IP_PROTOCOL_NUM_ICMP,
+			fuzzIcmpMessage(ICMP_TYPE_ECHO_REQUEST, 0, 0x12340001, []byte("ping"))),
+	}
+}
+
+/*
+ファズテストのシードにするフレーム
+1byte目は受信するデバイスで、0なら内側, 1なら外側で受信する
+*/
+func fuzzEthernetSeeds(router *Router) [][]byte {
+	inside := router.getnetDeviceByName("router1-br0")
+	outside := router.getnetDeviceByName("router1-router2")
+	var seeds [][]byte
+	add := func(netdev *netDevice, frame []byte) {
+		port := uint8(0)
+		if netdev == outside {
+			port = 1
+		}
+		seeds = append(seeds, append([]byte{port}, frame...))
+	}
+	for _, frame := range fuzzNatEntryFrames(router) {
+		add(inside, frame)
+	}
+	// ルータ宛てのARPリクエストとping
+	add(inside, append(ethernetHeader{destAddr: ETHERNET_ADDRESS_BROADCAST, srcAddr: fuzzRemoteMacAddr, etherType: ETHER_TYPE_ARP}.ToPacket(),
+		arpIPToEthernet{
+			hardwareType:       ARP_HTYPE_ETHERNET,
+			protocolType:       ETHER_TYPE_IP,
+			hardwareLen:        ETHERNET_ADDRES_LEN,
+			protocolLen:        IP_ADDRESS_LEN,
+			opcode:             ARP_OPERATION_CODE_REQUEST,
+			senderHardwareAddr: fuzzRemoteMacAddr,
+			senderIPAddr:       testNatLocalAddr,
+			targetIPAddr:       inside.ipdev.address,
+		}.ToPacket()...))
+	add(inside, fuzzIPFrame(inside.macaddr, testNatLocalAddr, inside.ipdev.address, IP_PROTOCOL_NUM_ICMP,
+		fuzzIcmpMessage(ICMP_TYPE_ECHO_REQUEST, 0, 0x00010001, []byte("0123456789abcdef"))))
+	// FTPのALGを通るTCP
+	ftp := tcpHeader{srcPort: 40001, destPort: 21, seq: 1, offset: 5 << 4, tcpflag: TCP_FLAG_ACK | TCP_FLAG_PSH, window: 0xffff,
+		tcpdata: []byte("PORT 192,168,1,2,156,65\r\n")}
+	add(inside, fuzzIPFrame(inside.macaddr, testNatLocalAddr, testNat64RemoteAddr, IP_PROTOCOL_NUM_TCP, ftp.ToPacket()))
+	// 外側からの戻りのUDPとエコーリプライ, ICMPのエラー, ポートフォワーディング
+	add(outside, fuzzIPFrame(outside.macaddr, testNat64RemoteAddr, outside.ipdev.address, IP_PROTOCOL_NUM_UDP,
+		fuzzUdpSegment(testNat64RemoteAddr, outside.ipdev.address, 53, NAT_GLOBAL_PORT_MIN, []byte("answer"))))
+	add(outside, fuzzIPFrame(outside.macaddr, testNat64RemoteAddr, outside.ipdev.address, IP_PROTOCOL_NUM_ICMP,
+		fuzzIcmpMessage(ICMP_TYPE_ECHO_REPLY, 0, 0x00010001, []byte("ping"))))
+	original := fuzzIPFrame(outside.macaddr, outside.ipdev.address, testNat64RemoteAddr, IP_PROTOCOL_NUM_UDP,
+		fuzzUdpSegment(outside.ipdev.address, testNat64RemoteAddr, NAT_GLOBAL_PORT_MIN, 53, []byte("query")))
+	add(outside, fuzzIPFrame(outside.macaddr, testNat64RemoteAddr, outside.ipdev.address, IP_PROTOCOL_NUM_ICMP,
+		fuzzIcmpMessage(ICMP_TYPE_DESTINATION_UNREACHABLE, 3, 0, original[14:14+28])))
+	syn := tcpHeader{srcPort: 50000, destPort: 8080, seq: 1, offset: 6 << 4, tcpflag: TCP_FLAG_SYN, window: 0xffff,
+		options: []byte{0x02, 0x04, 0x05, 0xb4}}
+	add(outside, fuzzIPFrame(outside.macaddr, testNat64RemoteAddr, outside.ipdev.address, IP_PROTOCOL_NUM_TCP, syn.ToPacket()))
+	// VLANのサブインターフェイス宛てのping
+	add(inside, vlanTag(fuzzIPFrame(inside.macaddr, 0xc0a80a02, 0xc0a80a01, IP_PROTOCOL_NUM_ICMP,
+		fuzzIcmpMessage(ICMP_TYPE_ECHO_REQUEST, 0, 0x00010001, nil)), 10))
+	// LLDP
+	add(outside, append(ethernetHeader{destAddr: LLDP_MAC_ADDRESS, srcAddr: fuzzRemoteMacAddr, etherType: ETHER_TYPE_LLDP}.ToPacket(),
+		router.lldp.localLldpdu(outside).ToPacket()...))
+	// 近隣要請とNAT64のUDP
+	solicitation := ndpMessage{icmpType: ICMPV6_TYPE_NEIGHBOR_SOLICITATION, targetAddr: inside.ipv6dev.address, linkLayerAddr: fuzzRemoteMacAddr}.ToPacket()
+	nat64Udp := fuzzUdpSegment(0, 0, 40002, 53, []byte("query"))
+	for _, ipv6 := range []struct {
+		nextHeader uint8
+		destAddr   [16]byte
+		payload    []byte
+	}{
+		{IP_PROTOCOL_NUM_ICMPV6, inside.ipv6dev.address, solicitation},
+		{IP_PROTOCOL_NUM_UDP, inside.ipdev.natdev.nat64SynthesizeAddr(testNat64RemoteAddr), nat64Udp},
+	} {
+		ipv6header := ipv6Header{
+			version:    6,
+			payloadLen: uint16(len(ipv6.payload)),
+			nextHeader: ipv6.nextHeader,
+			hopLimit:   255,
+			srcAddr:    fuzzLocalIPv6Addr,
+			destAddr:   ipv6.destAddr,
+		}
+		// チェックサムを0にしてから疑似ヘッダを含めて計算し直す
+		payload := append([]byte{}, ipv6.payload...)
+		offset := 2
+		if ipv6.nextHeader == IP_PROTOCOL_NUM_UDP {
+			offset = 6
+		}
+		copy(payload[offset:offset+2], []byte{0, 0})
+		copy(payload[offset:offset+2], uint16ToByte(calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, ipv6.nextHeader, payload)))
+		add(inside, append(ethernetHeader{destAddr: inside.macaddr, srcAddr: fuzzRemoteMacAddr, etherType: ETHER_TYPE_IPV6}.ToPacket(),
+			append(ipv6header.ToPacket(), payload...)...))
+	}
+	// 短すぎるフレーム
+	add(inside, []byte{0x00})
+	add(inside, fuzzIPFrame(inside.macaddr, testNatLocalAddr, inside.ipdev.address, IP_PROTOCOL_NUM_ICMP, []byte{ICMP_TYPE_ECHO_REQUEST, 0}))
+	return seeds
+}
+
+func FuzzEthernetInput(f *testing.F) {
+	_, router := newFuzzRouter(f)
+	for _, seed := range fuzzEthernetSeeds(router) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		sim, router := newFuzzRouter(t)
+		netdev := router.getnetDeviceByName("router1-br0")
+		if data[0]%2 == 1 {
+			netdev = router.getnetDeviceByName("router1-router2")
+		}
+		ethernetInput(netdev, data[1:])
+		// ルータが送ったパケットに他のルータやホストが応答するところまで動かす
+		sim.run()
+	})
+}
+
+func FuzzIcmpParsePacket(f *testing.F) {
+	f.Add(fuzzIcmpMessage(ICMP_TYPE_ECHO_REQUEST, 0, 0x00010001, []byte("0123456789abcdef")))
+	f.Add(fuzzIcmpMessage(ICMP_TYPE_ECHO_REQUEST, 0, 0x00010001, nil))
+	f.Add([]byte{ICMP_TYPE_ECHO_REQUEST, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var icmpmsg icmpMessage
+		icmpmsg, err := icmpmsg.ParsePacket(data)
+		if err != nil {
+			return
+		}
+		// エコーリプライはタイプとチェックサムだけが変わる
+		reply := icmpmsg.ReplyPacket()
+		if len(reply) != len(data) || byteToUint16(calcChecksum(reply)) != 0 {
+			t.Fatalf("reply of %x is %x", data, reply)
+		}
+	})
+}
+
+func FuzzUdpParsePacket(f *testing.F) {
+	f.Add(fuzzUdpSegment(testNatLocalAddr, testNat64RemoteAddr, 40000, 53, []byte("query")))
+	f.Add([]byte{0x9c, 0x40, 0x00, 0x35, 0x00, 0x07, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var udpheader udpHeader
+		udpheader, err := udpheader.ParsePacket(data)
+		if err != nil {
+			return
+		}
+		if int(udpheader.length) > len(data) || udpheader.length < 8 {
+			t.Fatalf("parsed udp length %d of %d bytes segment", udpheader.length, len(data))
+		}
+		if string(udpheader.ToPacket()) != string(data[:8]) {
+			t.Fatalf("udp header of %x is marshaled to %x", data, udpheader.ToPacket())
+		}
+	})
+}
+
+func FuzzTcpParsePacket(f *testing.F) {
+	syn := tcpHeader{srcPort: 50000, destPort: 8080, seq: 1, offset: 6 << 4, tcpflag: TCP_FLAG_SYN, window: 0xffff,
+		options: []byte{0x02, 0x04, 0x05, 0xb4}}
+	f.Add(syn.ToPacket())
+	data := tcpHeader{srcPort: 40001, destPort: 21, offset: 5 << 4, tcpflag: TCP_FLAG_ACK, tcpdata: []byte("USER anonymous\r\n")}
+	f.Add(data.ToPacket())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var tcpheader tcpHeader
+		tcpheader, err := tcpheader.ParsePacket(data)
+		if err != nil {
+			return
+		}
+		// オプションとデータも含めて元のセグメントに戻る
+		if string(tcpheader.ToPacket()) != string(data) {
+			t.Fatalf("tcp segment %x is marshaled to %x", data, tcpheader.ToPacket())
+		}
+	})
+}
+
+func FuzzIPv6ParsePacket(f *testing.F) {
+	f.Add(ipv6Header{version: 6, payloadLen: 8, nextHeader: IP_PROTOCOL_NUM_UDP, hopLimit: 64, srcAddr: fuzzLocalIPv6Addr}.ToPacket())
+	f.Add(make([]byte, 39))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var ipv6header ipv6Header
+		ipv6header, err := ipv6header.ParsePacket(data)
+		if err != nil {
+			return
+		}
+		if string(ipv6header.ToPacket()) != string(data[:IPV6_HEADER_LEN]) {
+			t.Fatalf("ipv6 header of %x is marshaled to %x", data, ipv6header.ToPacket())
+		}
+	})
+}
+
+func FuzzParseNdpMessage(f *testing.F) {
+	f.Add(ndpMessage{icmpType: ICMPV6_TYPE_NEIGHBOR_SOLICITATION, targetAddr: fuzzLocalIPv6Addr, linkLayerAddr: fuzzRemoteMacAddr}.ToPacket())
+	f.Add(make([]byte, 26))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseNdpMessage(data)
+	})
+}
+
+func FuzzNatExec(f *testing.F) {
+	// 1byte目でプロトコルと向きを選ぶ
+	f.Add(append([]byte{0}, fuzzUdpSegment(testNatLocalAddr, testNat64RemoteAddr, 40000, 53, []byte("query"))...))
+	f.Add(append([]byte{3}, fuzzUdpSegment(testNat64RemoteAddr, testNatOutsideAddr, 53, NAT_GLOBAL_PORT_MIN, []byte("answer"))...))
+	f.Add(append([]byte{4}, fuzzIcmpMessage(ICMP_TYPE_ECHO_REQUEST, 0, 0x12340001, nil)...))
+	original := fuzzIPFrame(fuzzRemoteMacAddr, testNatOutsideAddr, testNat64RemoteAddr, IP_PROTOCOL_NUM_UDP,
+		fuzzUdpSegment(testNatOutsideAddr, testNat64RemoteAddr, NAT_GLOBAL_PORT_MIN, 53, []byte("query")))
+	f.Add(append([]byte{5}, fuzzIcmpMessage(ICMP_TYPE_DESTINATION_UNREACHABLE, 3, 0, original[14:14+28])...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		natdev := newTestNatDevice()
+		// 戻りのパケットのためにUDPとICMPのエントリを作っておく
+		natdev.natEntry.createNatEntry(udp, testNatLocalAddr, 40000, testNat64RemoteAddr, 53)
+		natdev.natEntry.createNatEntry(icmp, testNatLocalAddr, 0x1234, testNat64RemoteAddr, 0)
+		protocols := []natProtocolType{udp, tcp, icmp}
+		proto := protocols[int(data[0]/2)%len(protocols)]
+		ipheader := ipHeader{version: 4, headerLen: 5, totalLen: uint16(20 + len(data) - 1), ttl: 64, srcAddr: testNatLocalAddr, destAddr: testNat64RemoteAddr}
+		direction := outgoing
+		if data[0]%2 == 1 {
+			direction = incoming
+			ipheader.srcAddr, ipheader.destAddr = testNat64RemoteAddr, testNatOutsideAddr
+		}
+		natExec(&ipheader, natPacketHeader{packet: data[1:]}, natdev, proto, direction)
+	})
+}
+
+func FuzzNat64Exec(f *testing.F) {
+	// 1byte目でIPv6からIPv4かその逆か, 2byte目で上位のプロトコルを選ぶ
+	f.Add(append([]byte{0, IP_PROTOCOL_NUM_UDP}, fuzzUdpSegment(0, 0, 40000, 53, []byte("query"))...))
+	f.Add(append([]byte{0, IP_PROTOCOL_NUM_ICMPV6}, fuzzIcmpMessage(ICMPV6_TYPE_ECHO_REQUEST, 0, 0x12340001, nil)...))
+	f.Add(append([]byte{1, IP_PROTOCOL_NUM_UDP}, fuzzUdpSegment(0, 0, 53, NAT_GLOBAL_PORT_MIN, []byte("answer"))...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 2 {
+			return
+		}
+		natdev := newTestNat64Device(t)
+		payload := data[2:]
+		if data[0]%2 == 0 {
+			ipv6header := ipv6Header{
+				version:    6,
+				payloadLen: uint16(len(payload)),
+				nextHeader: data[1],
+				hopLimit:   64,
+				srcAddr:    testNat64LocalAddr,
+				destAddr:   natdev.nat64SynthesizeAddr(testNat64RemoteAddr),
+			}
+			nat64ExecOutgoing(&ipv6header, payload, natdev)
+			return
+		}
+		// 戻りのパケットのためにIPv6からIPv4に変換したエントリを作っておく
+		ipv6header := ipv6Header{version: 6, payloadLen: 13, nextHeader: IP_PROTOCOL_NUM_UDP, hopLimit: 64,
+			srcAddr: testNat64LocalAddr, destAddr: natdev.nat64SynthesizeAddr(testNat64RemoteAddr)}
+		nat64ExecOutgoing(&ipv6header, fuzzUdpSegment(0, 0, 40000, 53, []byte("query")), natdev)
+		ipheader := ipHeader{version: 4, headerLen: 5, totalLen: uint16(20 + len(payload)), ttl: 64, protocol: data[1],
+			srcAddr: testNat64RemoteAddr, destAddr: testNatOutsideAddr}
+		nat64ExecIncoming(&ipheader, payload, natdev)
+	})
+}
+
+func FuzzLacpInput(f *testing.F) {
+	bond := newTestBond("bond1", 0x0a)
+	peer := newTestBond("bond2", 0x0b)
+	f.Add(lacpdu{actor: peer.actorInfo(peer.members[0]), partner: bond.actorInfo(bond.members[0])}.ToPacket())
+	f.Add(make([]byte, LACPDU_LEN-1))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		bond := newTestBond("bond1", 0x0a)
+		bond.lacpInput(bond.members[0].netdev, data, time.Unix(0, 0))
+	})
+}
+
+func FuzzRstpInput(f *testing.F) {
+	rstp := newRstpTestBridge("br1", 0x8000, 0x0a)
+	f.Add(testBpdu(rstp, rstp.ports[0], RSTP_FLAG_PROPOSAL))
+	f.Add([]byte{0x00, 0x00, 0x02, 0x02})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rstp := newRstpTestBridge("br1", 0x8000, 0x0a)
+		rstp.rstpInput(rstp.ports[0].netdev, data, time.Unix(0, 0))
+	})
+}
+
+func FuzzLldpInput(f *testing.F) {
+	pdu := lldpdu{
+		chassisId:      "02:00:00:00:00:01",
+		portId:         "router1-router2",
+		ttl:            120,
+		systemName:     "router1",
+		capabilities:   LLDP_CAPABILITY_ROUTER,
+		enabled:        LLDP_CAPABILITY_ROUTER,
+		managementAddr: 0xc0a80001,
+		ifIndex:        3,
+	}
+	f.Add(pdu.ToPacket())
+	pdu.ttl = 0
+	f.Add(pdu.ToPacket())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		agent := newLldpAgent(NewRouter("ch2"), lldpConfig{enabled: true, systemName: "router2"})
+		agent.lldpInput(&netDevice{name: "router2-router1"}, data, time.Unix(0, 0))
+	})
+}
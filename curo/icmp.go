@@ -1,8 +1,9 @@
-package main
+package curo
 
 import (
-	"bytes"
 	"fmt"
+
+	icmpcodec "github.com/sat0ken/go-curo/icmp"
 )
 
 const (
@@ -10,6 +11,7 @@ const (
 	ICMP_TYPE_DESTINATION_UNREACHABLE uint8 = 3
 	ICMP_TYPE_ECHO_REQUEST            uint8 = 8
 	ICMP_TYPE_TIME_EXCEEDED           uint8 = 11
+	ICMP_TYPE_PARAMETER_PROBLEM       uint8 = 12
 )
 
 type icmpHeader struct {
@@ -43,22 +45,17 @@ type icmpMessage struct {
 }
 
 func (icmpmsg icmpMessage) ReplyPacket() (icmpPacket []byte) {
-	var b bytes.Buffer
 	// ICMPヘッダ
-	b.Write([]byte{ICMP_TYPE_ECHO_REPLY})
-	b.Write([]byte{0x00})       // icmp code
-	b.Write([]byte{0x00, 0x00}) // checksum
+	reply := icmpcodec.Header{
+		Type:     ICMP_TYPE_ECHO_REPLY,
+		Identify: icmpmsg.icmpEcho.identify,
+		Sequence: icmpmsg.icmpEcho.sequence,
+	}
 	// ICMPエコーメッセージ
-	b.Write(uint16ToByte(icmpmsg.icmpEcho.identify))
-	b.Write(uint16ToByte(icmpmsg.icmpEcho.sequence))
-	b.Write(icmpmsg.icmpEcho.timestamp)
-	b.Write(icmpmsg.icmpEcho.data)
-
-	icmpPacket = b.Bytes()
-	checksum := calcChecksum(icmpPacket)
+	data := append(append([]byte{}, icmpmsg.icmpEcho.timestamp...), icmpmsg.icmpEcho.data...)
 	// 計算したチェックサムをセット
-	icmpPacket[2] = checksum[0]
-	icmpPacket[3] = checksum[1]
+	reply.Checksum = reply.MessageChecksum(data)
+	icmpPacket, _ = reply.Marshal(data)
 
 	fmt.Printf("Send ICMP Packet is %x\n", icmpPacket)
 
@@ -66,23 +63,13 @@ func (icmpmsg icmpMessage) ReplyPacket() (icmpPacket []byte) {
 }
 
 func icmpInput(inputdev *netDevice, sourceAddr, destAddr uint32, icmpPacket []byte) {
-	// ICMPメッセージ長より短かったら
-	if len(icmpPacket) < 4 {
-		fmt.Println("Received ICMP Packet is too short")
-	}
 	// ICMPのパケットとして解釈する
-	icmpmsg := icmpMessage{
-		icmpHeader: icmpHeader{
-			icmpType: icmpPacket[0],
-			icmpCode: icmpPacket[1],
-			checksum: byteToUint16(icmpPacket[2:4]),
-		},
-		icmpEcho: icmpEcho{
-			identify:  byteToUint16(icmpPacket[4:6]),
-			sequence:  byteToUint16(icmpPacket[6:8]),
-			timestamp: icmpPacket[8:16],
-			data:      icmpPacket[16:],
-		},
+	var icmpmsg icmpMessage
+	icmpmsg, err := icmpmsg.ParsePacket(icmpPacket)
+	if err != nil {
+		// ICMPメッセージ長より短かったらドロップ
+		fmt.Printf("Received ICMP Packet is invalid : %s\n", err)
+		return
 	}
 	// fmt.Printf("ICMP Packet is %+v\n", icmpmsg)
 
@@ -95,18 +82,31 @@ func icmpInput(inputdev *netDevice, sourceAddr, destAddr uint32, icmpPacket []by
 	}
 }
 
-func (icmpmsg *icmpMessage) ParsePacket(icmpPacket []byte) icmpMessage {
+/*
+ICMPのパケットをパースする
+ヘッダと識別子, シーケンス番号の8byteより短かったらエラーを返す
+タイムスタンプの8byteがないエコーもあるので、そのときはデータだけにする
+*/
+func (icmpmsg *icmpMessage) ParsePacket(icmpPacket []byte) (icmpMessage, error) {
+	header, data, err := icmpcodec.Parse(icmpPacket)
+	if err != nil {
+		return icmpMessage{}, err
+	}
+	echo := icmpEcho{
+		identify: header.Identify,
+		sequence: header.Sequence,
+		data:     data,
+	}
+	if 8 <= len(data) {
+		echo.timestamp = data[:8]
+		echo.data = data[8:]
+	}
 	return icmpMessage{
 		icmpHeader: icmpHeader{
-			icmpType: icmpPacket[0],
-			icmpCode: icmpPacket[1],
-			checksum: byteToUint16(icmpPacket[2:4]),
-		},
-		icmpEcho: icmpEcho{
-			identify:  byteToUint16(icmpPacket[4:6]),
-			sequence:  byteToUint16(icmpPacket[6:8]),
-			timestamp: icmpPacket[8:16],
-			data:      icmpPacket[16:],
+			icmpType: header.Type,
+			icmpCode: header.Code,
+			checksum: header.Checksum,
 		},
-	}
+		icmpEcho: echo,
+	}, nil
 }
@@ -0,0 +1,247 @@
+package curo
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	ICMPV6_TYPE_DESTINATION_UNREACHABLE uint8 = 1
+	ICMPV6_TYPE_PACKET_TOO_BIG          uint8 = 2
+	ICMPV6_TYPE_TIME_EXCEEDED           uint8 = 3
+	ICMPV6_TYPE_PARAMETER_PROBLEM       uint8 = 4
+	ICMPV6_TYPE_ECHO_REQUEST            uint8 = 128
+	ICMPV6_TYPE_ECHO_REPLY              uint8 = 129
+	ICMPV6_TYPE_NEIGHBOR_SOLICITATION   uint8 = 135
+	ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT  uint8 = 136
+)
+
+const (
+	NDP_OPTION_SOURCE_LINK_LAYER_ADDR uint8 = 1
+	NDP_OPTION_TARGET_LINK_LAYER_ADDR uint8 = 2
+)
+
+// 近隣広告のフラグ
+const (
+	NDP_NA_FLAG_ROUTER    uint8 = 0x80
+	NDP_NA_FLAG_SOLICITED uint8 = 0x40
+	NDP_NA_FLAG_OVERRIDE  uint8 = 0x20
+)
+
+// 近隣探索のパケットはルータを越えないのでホップリミットは255
+const NDP_HOP_LIMIT uint8 = 255
+
+type neighborTableEntry struct {
+	macAddr [6]uint8
+	ipAddr  [16]byte
+	netdev  *netDevice
+}
+
+// 近隣要請と近隣広告のメッセージ
+type ndpMessage struct {
+	icmpType      uint8
+	flags         uint8    // 近隣広告のフラグ
+	targetAddr    [16]byte // 解決したいアドレス
+	linkLayerAddr [6]uint8 // 送信元か対象のリンク層アドレスのオプション
+}
+
+func (ndpmsg ndpMessage) ToPacket() []byte {
+	var b bytes.Buffer
+
+	b.Write([]byte{ndpmsg.icmpType})
+	b.Write([]byte{0x00})       // icmp code
+	b.Write([]byte{0x00, 0x00}) // checksum
+	b.Write([]byte{ndpmsg.flags, 0x00, 0x00, 0x00})
+	b.Write(ndpmsg.targetAddr[:])
+	// リンク層アドレスのオプション
+	if ndpmsg.icmpType == ICMPV6_TYPE_NEIGHBOR_SOLICITATION {
+		b.Write([]byte{NDP_OPTION_SOURCE_LINK_LAYER_ADDR, 1})
+	} else {
+		b.Write([]byte{NDP_OPTION_TARGET_LINK_LAYER_ADDR, 1})
+	}
+	b.Write(macToByte(ndpmsg.linkLayerAddr))
+
+	return b.Bytes()
+}
+
+/*
+近隣要請と近隣広告のパケットをパースする
+*/
+func parseNdpMessage(packet []byte) (ndpMessage, error) {
+	var ndpmsg ndpMessage
+	if len(packet) < 24 {
+		return ndpmsg, fmt.Errorf("NDP message is too short")
+	}
+	ndpmsg.icmpType = packet[0]
+	ndpmsg.flags = packet[4]
+	copy(ndpmsg.targetAddr[:], packet[8:24])
+	// オプションは8byte単位の長さを持つTLV
+	options := packet[24:]
+	for len(options) >= 2 {
+		length := int(options[1]) * 8
+		if length == 0 || len(options) < length {
+			return ndpmsg, fmt.Errorf("invalid NDP option length")
+		}
+		if (options[0] == NDP_OPTION_SOURCE_LINK_LAYER_ADDR || options[0] == NDP_OPTION_TARGET_LINK_LAYER_ADDR) && length >= 8 {
+			ndpmsg.linkLayerAddr = setMacAddr(options[2:8])
+		}
+		options = options[length:]
+	}
+	return ndpmsg, nil
+}
+
+/*
+近隣キャッシュにエントリの追加と更新
+*/
+func addNeighborTableEntry(netdev *netDevice, ipaddr [16]byte, macaddr [6]uint8) {
+	router := netdev.router
+	for i, neighbor := range router.neighborTable {
+		if neighbor.ipAddr == ipaddr {
+			// IPv6アドレスは同じだがMacアドレスが異なる場合は更新
+			router.neighborTable[i].macAddr = macaddr
+			router.neighborTable[i].netdev = netdev
+			return
+		}
+	}
+	router.neighborTable = append(router.neighborTable, neighborTableEntry{
+		macAddr: macaddr,
+		ipAddr:  ipaddr,
+		netdev:  netdev,
+	})
+}
+
+/*
+近隣キャッシュの検索
+*/
+func (router *Router) searchNeighborTableEntry(ipaddr [16]byte) ([6]uint8, *netDevice) {
+	for _, neighbor := range router.neighborTable {
+		if neighbor.ipAddr == ipaddr {
+			return neighbor.macAddr, neighbor.netdev
+		}
+	}
+	return [6]uint8{}, nil
+}
+
+/*
+ICMPv6パケットの受信処理
+*/
+func icmpv6Input(inputdev *netDevice, ipv6header ipv6Header, packet []byte) {
+	// ICMPv6メッセージ長より短かったら
+	if len(packet) < 4 {
+		fmt.Println("Received ICMPv6 Packet is too short")
+		return
+	}
+	if calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, IP_PROTOCOL_NUM_ICMPV6, packet) != 0 {
+		fmt.Println("Received ICMPv6 Packet checksum is invalid")
+		return
+	}
+
+	switch packet[0] {
+	case ICMPV6_TYPE_NEIGHBOR_SOLICITATION:
+		neighborSolicitationArrives(inputdev, ipv6header, packet)
+	case ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT:
+		neighborAdvertisementArrives(inputdev, ipv6header, packet)
+	case ICMPV6_TYPE_ECHO_REQUEST:
+		if !inputdev.ipv6dev.isOurs(ipv6header.destAddr) {
+			return
+		}
+		fmt.Println("ICMPv6 ECHO REQUEST is received, Create Reply Packet")
+		reply := make([]byte, len(packet))
+		copy(reply, packet)
+		reply[0] = ICMPV6_TYPE_ECHO_REPLY
+		reply[2] = 0
+		reply[3] = 0
+		copy(reply[2:4], uint16ToByte(calcIPv6TransportChecksum(ipv6header.destAddr, ipv6header.srcAddr, IP_PROTOCOL_NUM_ICMPV6, reply)))
+		ipv6PacketEncapsulateOutput(inputdev, ipv6header.srcAddr, ipv6header.destAddr, reply, IP_PROTOCOL_NUM_ICMPV6, 64)
+	}
+}
+
+/*
+近隣要請の受信処理
+自分のアドレスの要請なら近隣広告を返す
+*/
+func neighborSolicitationArrives(netdev *netDevice, ipv6header ipv6Header, packet []byte) {
+	if ipv6header.hopLimit != NDP_HOP_LIMIT {
+		return
+	}
+	ndpmsg, err := parseNdpMessage(packet)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// 送信元のリンク層アドレスを近隣キャッシュに入れておく
+	if ipv6header.srcAddr != ([16]byte{}) && ndpmsg.linkLayerAddr != [6]uint8{} {
+		addNeighborTableEntry(netdev, ipv6header.srcAddr, ndpmsg.linkLayerAddr)
+	}
+	if !netdev.ipv6dev.isOurs(ndpmsg.targetAddr) {
+		return
+	}
+
+	fmt.Printf("Sending neighbor advertisement for %s\n", printIPv6Addr(ndpmsg.targetAddr))
+	flags := NDP_NA_FLAG_ROUTER | NDP_NA_FLAG_OVERRIDE
+	destAddr := ipv6header.srcAddr
+	// 重複アドレス検出の要請には全ノードに返す
+	if destAddr == ([16]byte{}) {
+		destAddr = IPV6_ADDRESS_ALL_NODES
+	} else {
+		flags |= NDP_NA_FLAG_SOLICITED
+	}
+	advertisement := ndpMessage{
+		icmpType:      ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT,
+		flags:         flags,
+		targetAddr:    ndpmsg.targetAddr,
+		linkLayerAddr: netdev.macaddr,
+	}.ToPacket()
+	copy(advertisement[2:4], uint16ToByte(calcIPv6TransportChecksum(ndpmsg.targetAddr, destAddr, IP_PROTOCOL_NUM_ICMPV6, advertisement)))
+	ipv6header = ipv6Header{
+		version:    6,
+		payloadLen: uint16(len(advertisement)),
+		nextHeader: IP_PROTOCOL_NUM_ICMPV6,
+		hopLimit:   NDP_HOP_LIMIT,
+		srcAddr:    ndpmsg.targetAddr,
+		destAddr:   destAddr,
+	}
+	// 要請してきたホストには近隣キャッシュがなくてもリンク層アドレスのオプションで返せる
+	destMacAddr := ndpmsg.linkLayerAddr
+	if destAddr[0] == 0xff || destMacAddr == [6]uint8{} {
+		destMacAddr = ipv6MulticastMacAddr(IPV6_ADDRESS_ALL_NODES)
+	}
+	ethernetOutput(netdev, destMacAddr, append(ipv6header.ToPacket(), advertisement...), ETHER_TYPE_IPV6)
+}
+
+/*
+近隣広告の受信処理
+*/
+func neighborAdvertisementArrives(netdev *netDevice, ipv6header ipv6Header, packet []byte) {
+	if ipv6header.hopLimit != NDP_HOP_LIMIT {
+		return
+	}
+	ndpmsg, err := parseNdpMessage(packet)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	macaddr := ndpmsg.linkLayerAddr
+	if macaddr == [6]uint8{} {
+		macaddr = netdev.etheHeader.srcAddr
+	}
+	fmt.Printf("Added neighbor cache entry by neighbor advertisement (%s => %s)\n",
+		printIPv6Addr(ndpmsg.targetAddr), printMacAddr(macaddr))
+	addNeighborTableEntry(netdev, ndpmsg.targetAddr, macaddr)
+}
+
+/*
+近隣要請の送信
+*/
+func sendNeighborSolicitation(netdev *netDevice, targetAddr [16]byte) {
+	fmt.Printf("Sending neighbor solicitation via %s for %s\n", netdev.name, printIPv6Addr(targetAddr))
+	srcAddr := netdev.ipv6dev.sourceAddr(targetAddr)
+	destAddr := solicitedNodeAddr(targetAddr)
+	solicitation := ndpMessage{
+		icmpType:      ICMPV6_TYPE_NEIGHBOR_SOLICITATION,
+		targetAddr:    targetAddr,
+		linkLayerAddr: netdev.macaddr,
+	}.ToPacket()
+	copy(solicitation[2:4], uint16ToByte(calcIPv6TransportChecksum(srcAddr, destAddr, IP_PROTOCOL_NUM_ICMPV6, solicitation)))
+	ipv6PacketEncapsulateOutput(netdev, destAddr, srcAddr, solicitation, IP_PROTOCOL_NUM_ICMPV6, NDP_HOP_LIMIT)
+}
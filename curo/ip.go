@@ -1,10 +1,12 @@
-package main
+package curo
 
 import (
-	"bytes"
 	"fmt"
 	"net"
 	"strings"
+
+	"github.com/sat0ken/go-curo/checksum"
+	"github.com/sat0ken/go-curo/ipv4"
 )
 
 const IP_ADDRESS_LEN = 4
@@ -47,29 +49,35 @@ type ipRouteEntry struct {
 	nexthop uint32
 }
 
+/*
+IPヘッダをバイト列にする
+ペイロードは呼び出し側でつなげるので、トータル長はそのまま書く
+*/
 func (ipheader ipHeader) ToPacket(calc bool) (ipHeaderByte []byte) {
-	var b bytes.Buffer
-
-	b.Write([]byte{ipheader.version<<4 + ipheader.headerLen})
-	b.Write([]byte{ipheader.tos})
-	b.Write(uint16ToByte(ipheader.totalLen))
-	b.Write(uint16ToByte(ipheader.identify))
-	b.Write(uint16ToByte(ipheader.fragOffset))
-	b.Write([]byte{ipheader.ttl})
-	b.Write([]byte{ipheader.protocol})
-	b.Write(uint16ToByte(ipheader.headerChecksum))
-	b.Write(uint32ToByte(ipheader.srcAddr))
-	b.Write(uint32ToByte(ipheader.destAddr))
+	ipHeaderByte, err := ipv4.Header{
+		Version:    ipheader.version,
+		HeaderLen:  ipheader.headerLen,
+		Tos:        ipheader.tos,
+		TotalLen:   ipheader.totalLen,
+		Identify:   ipheader.identify,
+		FragOffset: ipheader.fragOffset,
+		Ttl:        ipheader.ttl,
+		Protocol:   ipheader.protocol,
+		Checksum:   ipheader.headerChecksum,
+		SrcAddr:    ipheader.srcAddr,
+		DestAddr:   ipheader.destAddr,
+	}.MarshalHeader()
+	if err != nil {
+		fmt.Printf("marshal ip header err : %s\n", err)
+		return nil
+	}
 
 	// checksumを計算する
 	if calc {
-		ipHeaderByte = b.Bytes()
 		checksum := calcChecksum(ipHeaderByte)
 		// checksumをセット
 		ipHeaderByte[10] = checksum[0]
 		ipHeaderByte[11] = checksum[1]
-	} else {
-		ipHeaderByte = b.Bytes()
 	}
 
 	return ipHeaderByte
@@ -107,6 +115,30 @@ func subnetToPrefixLen(netmask uint32) uint32 {
 	return prefixlen
 }
 
+/*
+IPパケットをヘッダとペイロードに分ける
+ペイロードはトータル長までなので、イーサネットのパディングは含まない
+*/
+func parseIPHeader(packet []byte) (ipHeader, []byte, error) {
+	header, payload, err := ipv4.Parse(packet)
+	if err != nil {
+		return ipHeader{}, nil, err
+	}
+	return ipHeader{
+		version:        header.Version,
+		headerLen:      header.HeaderLen,
+		tos:            header.Tos,
+		totalLen:       header.TotalLen,
+		identify:       header.Identify,
+		fragOffset:     header.FragOffset,
+		ttl:            header.Ttl,
+		protocol:       header.Protocol,
+		headerChecksum: header.Checksum,
+		srcAddr:        header.SrcAddr,
+		destAddr:       header.DestAddr,
+	}, payload, nil
+}
+
 /*
 IPパケットの受信処理
 https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/ip.cpp#L51
@@ -116,46 +148,23 @@ func ipInput(inputdev *netDevice, packet []byte) {
 	if inputdev.ipdev.address == 0 {
 		return
 	}
-	// IPヘッダ長より短かったらドロップ
-	if len(packet) < 20 {
-		fmt.Printf("Received IP packet too short from %s\n", inputdev.name)
-		return
-	}
 	// 受信したIPパケットをipHeader構造体にセットする
-	ipheader := ipHeader{
-		version:        packet[0] >> 4,
-		headerLen:      packet[0] << 5 >> 5,
-		tos:            packet[1],
-		totalLen:       byteToUint16(packet[2:4]),
-		identify:       byteToUint16(packet[4:6]),
-		fragOffset:     byteToUint16(packet[6:8]),
-		ttl:            packet[8],
-		protocol:       packet[9],
-		headerChecksum: byteToUint16(packet[10:12]),
-		srcAddr:        byteToUint32(packet[12:16]),
-		destAddr:       byteToUint32(packet[16:20]),
+	// IPヘッダ長より短いときやIPv4でないとき, 長さがパケットに収まらないときはドロップ
+	ipheader, payload, err := parseIPHeader(packet)
+	if err != nil {
+		fmt.Printf("Received IP packet is invalid from %s : %s\n", inputdev.name, err)
+		return
 	}
 
 	fmt.Printf("ipInput Received IP in %s, packet type %d from %s to %s\n", inputdev.name, ipheader.protocol,
 		printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
 
 	// 受信したMACアドレスがARPテーブルになければ追加しておく
-	macaddr, _ := searchArpTableEntry(ipheader.srcAddr)
+	macaddr := searchArpTableEntryOnDevice(inputdev, ipheader.srcAddr)
 	if macaddr == [6]uint8{} {
 		addArpTableEntry(inputdev, ipheader.srcAddr, inputdev.etheHeader.srcAddr)
 	}
 
-	// IPバージョンが4でなければドロップ
-	// Todo: IPv6の実装
-	if ipheader.version != 4 {
-		if ipheader.version == 6 {
-			fmt.Println("packet is IPv6")
-		} else {
-			fmt.Println("Incorrect IP version")
-		}
-		return
-	}
-
 	// IPヘッダオプションがついていたらドロップ = ヘッダ長が20byte以上だったら
 	if 20 < (ipheader.headerLen * 4) {
 		fmt.Println("IP header option is not supported")
@@ -165,17 +174,23 @@ func ipInput(inputdev *netDevice, packet []byte) {
 	// 宛先アドレスがブロードキャストアドレスか受信したNICインターフェイスのIPアドレスの場合
 	if ipheader.destAddr == IP_ADDRESS_LIMITED_BROADCAST || inputdev.ipdev.address == ipheader.destAddr {
 		// 自分宛の通信として処理
-		ipInputToOurs(inputdev, &ipheader, packet[20:])
+		ipInputToOurs(inputdev, &ipheader, payload)
 		return
 	}
 
 	// 宛先IPアドレスをルータが持ってるか調べる
 	// つまり宛先IPが他のNICインターフェイスについてるIPアドレスだったら自分宛てのものとして処理する
-	for _, dev := range netDeviceList {
+	for _, dev := range inputdev.router.devices {
 		// 宛先IPアドレスがルータの持っているIPアドレス or ディレクティッド・ブロードキャストアドレスの時の処理
 		if dev.ipdev.address == ipheader.destAddr || dev.ipdev.broadcast == ipheader.destAddr {
 			// 自分宛の通信として処理
-			ipInputToOurs(inputdev, &ipheader, packet[20:])
+			ipInputToOurs(inputdev, &ipheader, payload)
+			return
+		}
+		// 5章で追加
+		// NATの外側のアドレスのプール宛ても自分宛の通信として処理
+		if dev.ipdev.natdev != (natDevice{}) && dev.ipdev.natdev.isOutsideAddr(ipheader.destAddr) {
+			ipInputToOurs(inputdev, &ipheader, payload)
 			return
 		}
 	}
@@ -184,28 +199,46 @@ func ipInput(inputdev *netDevice, packet []byte) {
 	var natPacket []byte
 	// NATの内側から外側への通信
 	if inputdev.ipdev.natdev != (natDevice{}) {
-		var err error
 		switch ipheader.protocol {
 		case IP_PROTOCOL_NUM_UDP:
-			natPacket, err = natExec(&ipheader, natPacketHeader{packet: packet[20:]}, inputdev.ipdev.natdev, udp, outgoing)
+			natPacket, err = natExec(&ipheader, natPacketHeader{packet: payload}, inputdev.ipdev.natdev, udp, outgoing)
 			if err != nil {
 				// NATできないパケットはドロップ
 				fmt.Printf("nat udp packet err is %s\n", err)
 				return
 			}
 		case IP_PROTOCOL_NUM_TCP:
-			natPacket, err = natExec(&ipheader, natPacketHeader{packet: packet[20:]}, inputdev.ipdev.natdev, tcp, outgoing)
+			natPacket, err = natExec(&ipheader, natPacketHeader{packet: payload}, inputdev.ipdev.natdev, tcp, outgoing)
 			if err != nil {
 				// NATできないパケットはドロップ
 				fmt.Printf("nat tcp packet err is %s\n", err)
 				return
 			}
+		case IP_PROTOCOL_NUM_ICMP:
+			natPacket, err = natExec(&ipheader, natPacketHeader{packet: payload}, inputdev.ipdev.natdev, icmp, outgoing)
+			if err != nil {
+				// NATできないパケットはドロップ
+				fmt.Printf("nat icmp packet err is %s\n", err)
+				return
+			}
 		}
 	}
 
 	// 以下は4章で追加
 	// 宛先IPアドレスがルータの持っているIPアドレスでない場合はフォワーディングを行う
-	route := iproute.radixTreeSearch(ipheader.destAddr) // ルーティングテーブルをルックアップ
+	// NATの内側から外側への通信
+	if inputdev.ipdev.natdev != (natDevice{}) {
+		inputdev.router.ipPacketForward(&ipheader, natPacket)
+	} else {
+		inputdev.router.ipPacketForward(&ipheader, payload)
+	}
+}
+
+/*
+IPパケットをルーティングテーブルに従って転送する
+*/
+func (router *Router) ipPacketForward(ipheader *ipHeader, payload []byte) {
+	route := router.route.radixTreeSearch(ipheader.destAddr) // ルーティングテーブルをルックアップ
 	if route == (ipRouteEntry{}) {
 		// 宛先までの経路がなかったらパケットを破棄
 		fmt.Printf("このIPへの経路がありません : %s\n", printIPAddr(ipheader.destAddr))
@@ -219,28 +252,22 @@ func ipInput(inputdev *netDevice, packet []byte) {
 	}
 
 	// TTLを1へらす
+	// TTLとプロトコル番号の16bitの差分だけでIPヘッダチェックサムを計算し直す
+	oldTtl := uint16(ipheader.ttl)<<8 | uint16(ipheader.protocol)
 	ipheader.ttl -= 1
-
-	// IPヘッダチェックサムの再計算
-	ipheader.headerChecksum = 0
-	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(true)))
+	ipheader.headerChecksum = checksum.Adjust(ipheader.headerChecksum, oldTtl, uint16(ipheader.ttl)<<8|uint16(ipheader.protocol))
 
 	// my_buf構造にコピー
-	forwardPacket := ipheader.ToPacket(true)
-	// NATの内側から外側への通信
-	if inputdev.ipdev.natdev != (natDevice{}) {
-		forwardPacket = append(forwardPacket, natPacket...)
-	} else {
-		forwardPacket = append(forwardPacket, packet[20:]...)
-	}
+	forwardPacket := ipheader.ToPacket(false)
+	forwardPacket = append(forwardPacket, payload...)
 
 	if route.iptype == connected { // 直接接続ネットワークの経路なら
 		// hostに直接送信
 		ipPacketOutputToHost(route.netdev, ipheader.destAddr, forwardPacket)
 	} else { // 直接接続ネットワークの経路ではなかったら
 		fmt.Printf("next hop is %s\n", printIPAddr(route.nexthop))
-		fmt.Printf("forward packet is %x : %x\n", forwardPacket[0:20], natPacket)
-		ipPacketOutputToNetxhop(route.nexthop, forwardPacket)
+		fmt.Printf("forward packet is %x : %x\n", forwardPacket[0:20], payload)
+		router.ipPacketOutputToNetxhop(route.nexthop, forwardPacket)
 	}
 }
 
@@ -251,34 +278,66 @@ https://github.com/kametan0730/interface_2022_11/blob/master/chapter2/ip.cpp#L26
 func ipInputToOurs(inputdev *netDevice, ipheader *ipHeader, packet []byte) {
 	// 5章で追加
 	// NATの外側から内側への通信か判断
-	for _, dev := range netDeviceList {
+	for _, dev := range inputdev.router.devices {
 		if dev.ipdev != (ipDevice{}) && dev.ipdev.natdev != (natDevice{}) &&
-			dev.ipdev.natdev.outsideIpAddr == ipheader.destAddr {
+			dev.ipdev.natdev.isOutsideAddr(ipheader.destAddr) {
 			// 送信先のIPがNATの外側のIPなら以下処理を実行
 			// NATの戻りのパケットをDNATする
 			natExecuted := false
 			var destPacket []byte
 			var err error
+			// NATの内側から外側のアドレス宛てに来たパケットはヘアピンNATで内側に折り返す
+			hairpin := inputdev == dev
+			// NAT64のエントリ宛てならIPv6に変換して内側に送る
+			if dev.ipdev.natdev.nat64 && !hairpin {
+				ipv6header, nat64Packet, err := nat64ExecIncoming(ipheader, packet, dev.ipdev.natdev)
+				if err == nil {
+					ipv6PacketOutputToHost(dev, ipv6header.destAddr, append(ipv6header.ToPacket(), nat64Packet...))
+					return
+				}
+				if err != errNoNat64Entry {
+					fmt.Printf("nat64 packet err is %s\n", err)
+					return
+				}
+			}
 			switch ipheader.protocol {
 			case IP_PROTOCOL_NUM_UDP:
-				destPacket, err = natExec(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, udp, incoming)
+				if hairpin {
+					destPacket, err = natExecHairpin(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, udp)
+				} else {
+					destPacket, err = natExec(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, udp, incoming)
+				}
 				if err != nil {
 					return
 				}
 				natExecuted = true
 			case IP_PROTOCOL_NUM_TCP:
-				destPacket, err = natExec(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, tcp, incoming)
+				if hairpin {
+					destPacket, err = natExecHairpin(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, tcp)
+				} else {
+					destPacket, err = natExec(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, tcp, incoming)
+				}
 				if err != nil {
 					return
 				}
 				natExecuted = true
+			case IP_PROTOCOL_NUM_ICMP:
+				// 内側からの外側のアドレスへのpingはルータが応答する
+				if hairpin {
+					break
+				}
+				// NATエントリのないICMPはルータ宛てのものとして処理する
+				destPacket, err = natExec(ipheader, natPacketHeader{packet: packet}, dev.ipdev.natdev, icmp, incoming)
+				if err == nil {
+					natExecuted = true
+				}
 			}
 			if natExecuted {
 				ipPacket := ipheader.ToPacket(false)
 				ipPacket = append(ipPacket, destPacket...)
 				fmt.Printf("To dest is %s, checksum is %x, packet is %x\n", printIPAddr(ipheader.destAddr),
 					ipheader.headerChecksum, ipPacket)
-				ipPacketOutput(dev, iproute, ipheader.destAddr, ipPacket)
+				ipPacketOutput(dev, dev.router.route, ipheader.destAddr, ipPacket)
 				return
 			}
 		}
@@ -305,7 +364,7 @@ IPパケットを直接イーサネットでホストに送信
 */
 func ipPacketOutputToHost(dev *netDevice, destAddr uint32, packet []byte) {
 	// ARPテーブルの検索
-	destMacAddr, _ := searchArpTableEntry(destAddr)
+	destMacAddr := searchArpTableEntryOnDevice(dev, destAddr)
 	if destMacAddr == [6]uint8{0, 0, 0, 0, 0, 0} {
 		// ARPエントリが無かったら
 		fmt.Printf("Trying ip output to host, but no arp record to %s\n", printIPAddr(destAddr))
@@ -320,13 +379,13 @@ func ipPacketOutputToHost(dev *netDevice, destAddr uint32, packet []byte) {
 /*
 IPパケットをNextHopに送信
 */
-func ipPacketOutputToNetxhop(nextHop uint32, packet []byte) {
+func (router *Router) ipPacketOutputToNetxhop(nextHop uint32, packet []byte) {
 	// ARPテーブルの検索
-	destMacAddr, dev := searchArpTableEntry(nextHop)
+	destMacAddr, dev := router.searchArpTableEntry(nextHop)
 	if destMacAddr == [6]uint8{0, 0, 0, 0, 0, 0} {
 		fmt.Printf("Trying ip output to next hop, but no arp record to %s\n", printIPAddr(nextHop))
 		// ルーティングテーブルのルックアップ
-		routeToNexthop := iproute.radixTreeSearch(nextHop)
+		routeToNexthop := router.route.radixTreeSearch(nextHop)
 		//fmt.Printf("next hop route is from %s\n", routeToNexthop.netdev.name)
 		if routeToNexthop == (ipRouteEntry{}) || routeToNexthop.iptype != connected {
 			// next hopへの到達性が無かったら
@@ -356,7 +415,7 @@ func ipPacketOutput(outputdev *netDevice, routeTree radixTreeNode, destAddr uint
 		ipPacketOutputToHost(outputdev, destAddr, packet)
 	} else if route.iptype == network {
 		// 直接つながっていないネットワークなら
-		ipPacketOutputToNetxhop(destAddr, packet)
+		outputdev.router.ipPacketOutputToNetxhop(destAddr, packet)
 	}
 }
 
@@ -392,7 +451,7 @@ func ipPacketEncapsulateOutput(inputdev *netDevice, destAddr, srcAddr uint32, pa
 
 	// ルートテーブルを検索して送信先IPのMACアドレスがなければ、
 	// ARPリクエストを生成して送信して結果を受信してから、ethernetからパケットを送る
-	destMacAddr, _ := searchArpTableEntry(destAddr)
+	destMacAddr := searchArpTableEntryOnDevice(inputdev, destAddr)
 	if destMacAddr != [6]uint8{0, 0, 0, 0, 0, 0} {
 		// ルートテーブルに送信するIPアドレスのMACアドレスがあれば送信
 		ethernetOutput(inputdev, destMacAddr, ipPacket, ETHER_TYPE_IP)
@@ -0,0 +1,246 @@
+package curo
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+const IPV6_ADDRESS_LEN = 16
+const IPV6_HEADER_LEN = 40
+const IPV6_MIN_MTU = 1280
+const IP_PROTOCOL_NUM_ICMPV6 uint8 = 0x3a
+
+// 全ノードのマルチキャストアドレス ff02::1
+var IPV6_ADDRESS_ALL_NODES = [16]uint8{0xff, 0x02, 15: 0x01}
+
+type ipv6Header struct {
+	version      uint8    // バージョン
+	trafficClass uint8    // トラフィッククラス
+	flowLabel    uint32   // フローラベル
+	payloadLen   uint16   // ペイロード長
+	nextHeader   uint8    // 次のヘッダ
+	hopLimit     uint8    // ホップリミット
+	srcAddr      [16]byte // 送信元IPv6アドレス
+	destAddr     [16]byte // 送信先IPv6アドレス
+}
+
+// デバイスのIPv6アドレス
+type ipv6Device struct {
+	address   [16]byte // グローバルアドレス
+	prefixLen int      // プレフィックス長
+	linkLocal [16]byte // リンクローカルアドレス
+}
+
+func (ipv6header ipv6Header) ToPacket() []byte {
+	var b bytes.Buffer
+
+	b.Write(uint32ToByte(uint32(ipv6header.version)<<28 | uint32(ipv6header.trafficClass)<<20 | ipv6header.flowLabel&0xfffff))
+	b.Write(uint16ToByte(ipv6header.payloadLen))
+	b.Write([]byte{ipv6header.nextHeader})
+	b.Write([]byte{ipv6header.hopLimit})
+	b.Write(ipv6header.srcAddr[:])
+	b.Write(ipv6header.destAddr[:])
+
+	return b.Bytes()
+}
+
+/*
+IPv6のヘッダをパースする
+ヘッダより短いときやバージョンが6でないときはエラーを返す
+ICMPのエラーメッセージの中のヘッダはペイロードが切られているので、ペイロード長は呼び出し側で確かめる
+*/
+func (ipv6header *ipv6Header) ParsePacket(packet []byte) (ipv6Header, error) {
+	if len(packet) < IPV6_HEADER_LEN {
+		return ipv6Header{}, fmt.Errorf("ipv6 packet length %d is shorter than header length %d", len(packet), IPV6_HEADER_LEN)
+	}
+	header := ipv6Header{
+		version:      packet[0] >> 4,
+		trafficClass: packet[0]<<4 | packet[1]>>4,
+		flowLabel:    byteToUint32(packet[0:4]) & 0xfffff,
+		payloadLen:   byteToUint16(packet[4:6]),
+		nextHeader:   packet[6],
+		hopLimit:     packet[7],
+	}
+	copy(header.srcAddr[:], packet[8:24])
+	copy(header.destAddr[:], packet[24:40])
+	if header.version != 6 {
+		return ipv6Header{}, fmt.Errorf("ip version %d is not ipv6", header.version)
+	}
+	return header, nil
+}
+
+/*
+疑似ヘッダを含めてIPv6の上位プロトコルのチェックサムを計算する
+*/
+func calcIPv6TransportChecksum(srcAddr, destAddr [16]byte, nextHeader uint8, packet []byte) uint16 {
+	var b bytes.Buffer
+	b.Write(srcAddr[:])
+	b.Write(destAddr[:])
+	b.Write(uint32ToByte(uint32(len(packet))))
+	b.Write([]byte{0, 0, 0, nextHeader})
+	b.Write(packet)
+	return byteToUint16(calcChecksum(b.Bytes()))
+}
+
+func getIPv6device(addrs []net.Addr) (ipv6dev ipv6Device) {
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr.String())
+		if err != nil || ip.To4() != nil {
+			continue
+		}
+		if ip.IsLinkLocalUnicast() {
+			copy(ipv6dev.linkLocal[:], ip.To16())
+		} else {
+			copy(ipv6dev.address[:], ip.To16())
+			ipv6dev.prefixLen, _ = ipnet.Mask.Size()
+		}
+	}
+	return ipv6dev
+}
+
+func printIPv6Addr(ip [16]byte) string {
+	return net.IP(ip[:]).String()
+}
+
+/*
+IPv4アドレスをIPv4射影アドレス ::ffff:a.b.c.d にする
+*/
+func ipv4MappedAddr(ip uint32) (addr [16]byte) {
+	addr[10] = 0xff
+	addr[11] = 0xff
+	copy(addr[12:], uint32ToByte(ip))
+	return addr
+}
+
+/*
+要請ノードマルチキャストアドレス ff02::1:ffXX:XXXX を返す
+*/
+func solicitedNodeAddr(ip [16]byte) [16]byte {
+	addr := [16]byte{0xff, 0x02, 11: 0x01, 12: 0xff}
+	copy(addr[13:], ip[13:])
+	return addr
+}
+
+/*
+IPv6マルチキャストアドレスに対応するMACアドレス 33:33:XX:XX:XX:XX を返す
+*/
+func ipv6MulticastMacAddr(ip [16]byte) [6]uint8 {
+	return [6]uint8{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+/*
+デバイスのIPv6アドレスか確認する
+*/
+func (ipv6dev ipv6Device) isOurs(ip [16]byte) bool {
+	return ip != [16]byte{} && (ipv6dev.address == ip || ipv6dev.linkLocal == ip)
+}
+
+/*
+送信先に合わせてデバイスの送信元アドレスを選ぶ
+同じプレフィックスならグローバルアドレス、それ以外はリンクローカルアドレスを使う
+*/
+func (ipv6dev ipv6Device) sourceAddr(destAddr [16]byte) [16]byte {
+	if ipv6dev.address == ([16]byte{}) {
+		return ipv6dev.linkLocal
+	}
+	mask := net.CIDRMask(ipv6dev.prefixLen, 128)
+	if net.IP(destAddr[:]).Mask(mask).Equal(net.IP(ipv6dev.address[:]).Mask(mask)) || ipv6dev.linkLocal == ([16]byte{}) {
+		return ipv6dev.address
+	}
+	return ipv6dev.linkLocal
+}
+
+/*
+IPv6パケットの受信処理
+ルータ宛てのICMPv6とNAT64の変換対象のパケットだけを処理する
+*/
+func ipv6Input(inputdev *netDevice, packet []byte) {
+	// IPv6アドレスのついていないインターフェースからの受信は無視
+	if inputdev.ipv6dev == (ipv6Device{}) {
+		return
+	}
+	// IPv6ヘッダ長より短いときやバージョンが違うときはドロップ
+	var ipv6header ipv6Header
+	ipv6header, err := ipv6header.ParsePacket(packet)
+	if err != nil {
+		fmt.Printf("Received IPv6 packet is invalid from %s : %s\n", inputdev.name, err)
+		return
+	}
+	if len(packet) < IPV6_HEADER_LEN+int(ipv6header.payloadLen) {
+		fmt.Printf("Received IPv6 packet is shorter than payload length from %s\n", inputdev.name)
+		return
+	}
+	// イーサネットのパディングを取り除く
+	payload := packet[IPV6_HEADER_LEN : IPV6_HEADER_LEN+int(ipv6header.payloadLen)]
+
+	fmt.Printf("ipv6Input Received IPv6 in %s, next header %d from %s to %s\n", inputdev.name, ipv6header.nextHeader,
+		printIPv6Addr(ipv6header.srcAddr), printIPv6Addr(ipv6header.destAddr))
+
+	// 受信したMACアドレスが近隣キャッシュになければ追加しておく
+	if ipv6header.srcAddr != ([16]byte{}) {
+		macaddr, _ := inputdev.router.searchNeighborTableEntry(ipv6header.srcAddr)
+		if macaddr == [6]uint8{} {
+			addNeighborTableEntry(inputdev, ipv6header.srcAddr, inputdev.etheHeader.srcAddr)
+		}
+	}
+
+	// ルータ宛てかマルチキャストならICMPv6を処理する
+	if inputdev.ipv6dev.isOurs(ipv6header.destAddr) || ipv6header.destAddr[0] == 0xff {
+		if ipv6header.nextHeader == IP_PROTOCOL_NUM_ICMPV6 {
+			icmpv6Input(inputdev, ipv6header, payload)
+		}
+		return
+	}
+
+	// 5章で追加
+	// NAT64のプレフィックス宛てならIPv4に変換して転送する
+	natdev := inputdev.ipdev.natdev
+	if natdev != (natDevice{}) && natdev.isNat64Addr(ipv6header.destAddr) {
+		ipheader, natPacket, err := nat64ExecOutgoing(&ipv6header, payload, natdev)
+		if err != nil {
+			// NATできないパケットはドロップ
+			fmt.Printf("nat64 packet err is %s\n", err)
+			return
+		}
+		inputdev.router.ipPacketForward(&ipheader, natPacket)
+		return
+	}
+
+	fmt.Printf("IPv6 forwarding is not supported : %s\n", printIPv6Addr(ipv6header.destAddr))
+}
+
+/*
+IPv6パケットを直接イーサネットでホストに送信
+*/
+func ipv6PacketOutputToHost(dev *netDevice, destAddr [16]byte, packet []byte) {
+	// マルチキャストは対応するMACアドレスに送る
+	if destAddr[0] == 0xff {
+		ethernetOutput(dev, ipv6MulticastMacAddr(destAddr), packet, ETHER_TYPE_IPV6)
+		return
+	}
+	// 近隣キャッシュの検索
+	destMacAddr, _ := dev.router.searchNeighborTableEntry(destAddr)
+	if destMacAddr == [6]uint8{0, 0, 0, 0, 0, 0} {
+		// 近隣キャッシュに無かったら近隣要請を送信
+		fmt.Printf("Trying ipv6 output to host, but no neighbor cache to %s\n", printIPv6Addr(destAddr))
+		sendNeighborSolicitation(dev, destAddr)
+	} else {
+		ethernetOutput(dev, destMacAddr, packet, ETHER_TYPE_IPV6)
+	}
+}
+
+/*
+IPv6パケットにカプセル化して送信
+*/
+func ipv6PacketEncapsulateOutput(dev *netDevice, destAddr, srcAddr [16]byte, payload []byte, nextHeader uint8, hopLimit uint8) {
+	ipv6header := ipv6Header{
+		version:    6,
+		payloadLen: uint16(len(payload)),
+		nextHeader: nextHeader,
+		hopLimit:   hopLimit,
+		srcAddr:    srcAddr,
+		destAddr:   destAddr,
+	}
+	ipv6PacketOutputToHost(dev, destAddr, append(ipv6header.ToPacket(), payload...))
+}
@@ -0,0 +1,398 @@
+package curo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+const ETHER_TYPE_LLDP uint16 = 0x88cc
+
+const (
+	LLDP_TX_INTERVAL = 30 * time.Second
+	LLDP_TX_HOLD     = 4 // TTLは送信間隔のこの倍にする
+)
+
+// LLDPDUの宛先のMACアドレス, ブリッジでは転送されない
+var LLDP_MAC_ADDRESS = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// TLVのタイプ
+const (
+	LLDP_TLV_END                 uint8 = 0
+	LLDP_TLV_CHASSIS_ID          uint8 = 1
+	LLDP_TLV_PORT_ID             uint8 = 2
+	LLDP_TLV_TTL                 uint8 = 3
+	LLDP_TLV_PORT_DESCRIPTION    uint8 = 4
+	LLDP_TLV_SYSTEM_NAME         uint8 = 5
+	LLDP_TLV_SYSTEM_CAPABILITIES uint8 = 7
+	LLDP_TLV_MANAGEMENT_ADDRESS  uint8 = 8
+)
+
+// Chassis IDとPort IDのサブタイプ
+const (
+	LLDP_CHASSIS_ID_MAC_ADDRESS  uint8 = 4
+	LLDP_CHASSIS_ID_LOCAL        uint8 = 7
+	LLDP_PORT_ID_MAC_ADDRESS     uint8 = 3
+	LLDP_PORT_ID_INTERFACE_NAME  uint8 = 5
+	LLDP_PORT_ID_LOCAL           uint8 = 7
+	LLDP_MANAGEMENT_ADDRESS_IPV4 uint8 = 1
+	LLDP_INTERFACE_IFINDEX       uint8 = 2
+)
+
+// System Capabilitiesのビット
+const (
+	LLDP_CAPABILITY_BRIDGE uint16 = 0x0004
+	LLDP_CAPABILITY_ROUTER uint16 = 0x0010
+)
+
+// LLDPの設定
+type lldpConfig struct {
+	enabled       bool
+	systemName    string
+	neighborsFile string // 隣接機器のテーブルを書き出すJSONファイル, 空なら書き出さない
+}
+
+// LLDPDUで送受信する情報
+type lldpdu struct {
+	chassisId       string
+	portId          string
+	ttl             uint16
+	portDescription string
+	systemName      string
+	capabilities    uint16
+	enabled         uint16 // 有効になっている機能
+	managementAddr  uint32
+	ifIndex         uint32
+}
+
+// LLDPで見つけた隣接機器
+type lldpNeighbor struct {
+	localPort string
+	info      lldpdu
+	expires   time.Time
+}
+
+// 隣接機器のテーブルのキー
+type lldpNeighborKey struct {
+	localPort string
+	chassisId string
+	portId    string
+}
+
+// LLDPの送信と隣接機器の管理を行う
+type lldpAgent struct {
+	router    *Router
+	conf      lldpConfig
+	neighbors map[lldpNeighborKey]*lldpNeighbor
+	lastTx    time.Time
+}
+
+func newLldpAgent(router *Router, conf lldpConfig) *lldpAgent {
+	if conf.systemName == "" {
+		conf.systemName, _ = os.Hostname()
+	}
+	return &lldpAgent{
+		router:    router,
+		conf:      conf,
+		neighbors: make(map[lldpNeighborKey]*lldpNeighbor),
+	}
+}
+
+/*
+TLVを書き込む, ヘッダはタイプ7ビットと長さ9ビット
+*/
+func writeLldpTlv(b *bytes.Buffer, tlvType uint8, value []byte) {
+	b.Write(uint16ToByte(uint16(tlvType)<<9 | uint16(len(value))&0x01ff))
+	b.Write(value)
+}
+
+func (pdu lldpdu) ToPacket() []byte {
+	var b bytes.Buffer
+	// ルータのChassis IDはMACアドレス, Port IDはインターフェイス名で送る
+	chassisId := []byte{LLDP_CHASSIS_ID_LOCAL}
+	if mac, err := net.ParseMAC(pdu.chassisId); err == nil && len(mac) == ETHERNET_ADDRES_LEN {
+		chassisId = append([]byte{LLDP_CHASSIS_ID_MAC_ADDRESS}, mac...)
+	} else {
+		chassisId = append(chassisId, pdu.chassisId...)
+	}
+	writeLldpTlv(&b, LLDP_TLV_CHASSIS_ID, chassisId)
+	writeLldpTlv(&b, LLDP_TLV_PORT_ID, append([]byte{LLDP_PORT_ID_INTERFACE_NAME}, pdu.portId...))
+	writeLldpTlv(&b, LLDP_TLV_TTL, uint16ToByte(pdu.ttl))
+	if pdu.portDescription != "" {
+		writeLldpTlv(&b, LLDP_TLV_PORT_DESCRIPTION, []byte(pdu.portDescription))
+	}
+	if pdu.systemName != "" {
+		writeLldpTlv(&b, LLDP_TLV_SYSTEM_NAME, []byte(pdu.systemName))
+	}
+	writeLldpTlv(&b, LLDP_TLV_SYSTEM_CAPABILITIES, append(uint16ToByte(pdu.capabilities), uint16ToByte(pdu.enabled)...))
+	if pdu.managementAddr != 0 {
+		var addr bytes.Buffer
+		addr.Write([]byte{1 + IP_ADDRESS_LEN, LLDP_MANAGEMENT_ADDRESS_IPV4})
+		addr.Write(uint32ToByte(pdu.managementAddr))
+		addr.Write([]byte{LLDP_INTERFACE_IFINDEX})
+		addr.Write(uint32ToByte(pdu.ifIndex))
+		addr.Write([]byte{0}) // OIDは使わない
+		writeLldpTlv(&b, LLDP_TLV_MANAGEMENT_ADDRESS, addr.Bytes())
+	}
+	writeLldpTlv(&b, LLDP_TLV_END, nil)
+	return b.Bytes()
+}
+
+/*
+Chassis IDとPort IDを文字列にする, MACアドレスのサブタイプは表記を揃える
+*/
+func lldpIdString(value []byte, macSubtype uint8) string {
+	if len(value) == 1+ETHERNET_ADDRES_LEN && value[0] == macSubtype {
+		return net.HardwareAddr(value[1:]).String()
+	}
+	return string(value[1:])
+}
+
+/*
+イーサネットヘッダの後ろのLLDPDUをパースする
+最初の3つのTLVはChassis ID, Port ID, TTLでなければならない
+*/
+func parseLldpdu(packet []byte) (lldpdu, error) {
+	var pdu lldpdu
+	for i := 0; ; i++ {
+		if len(packet) < 2 {
+			return lldpdu{}, fmt.Errorf("lldpdu has no end tlv")
+		}
+		tlvType := uint8(packet[0] >> 1)
+		length := int(byteToUint16(packet[0:2]) & 0x01ff)
+		if len(packet) < 2+length {
+			return lldpdu{}, fmt.Errorf("lldp tlv %d is too long", tlvType)
+		}
+		value := packet[2 : 2+length]
+		packet = packet[2+length:]
+		if i < 3 && tlvType != uint8(i+1) {
+			return lldpdu{}, fmt.Errorf("lldp tlv %d must be %d", tlvType, i+1)
+		}
+		switch tlvType {
+		case LLDP_TLV_END:
+			return pdu, nil
+		case LLDP_TLV_CHASSIS_ID, LLDP_TLV_PORT_ID:
+			if length < 2 {
+				return lldpdu{}, fmt.Errorf("lldp id tlv is too short")
+			}
+			if tlvType == LLDP_TLV_CHASSIS_ID {
+				pdu.chassisId = lldpIdString(value, LLDP_CHASSIS_ID_MAC_ADDRESS)
+			} else {
+				pdu.portId = lldpIdString(value, LLDP_PORT_ID_MAC_ADDRESS)
+			}
+		case LLDP_TLV_TTL:
+			if length < 2 {
+				return lldpdu{}, fmt.Errorf("lldp ttl tlv is too short")
+			}
+			pdu.ttl = byteToUint16(value)
+		case LLDP_TLV_PORT_DESCRIPTION:
+			pdu.portDescription = string(value)
+		case LLDP_TLV_SYSTEM_NAME:
+			pdu.systemName = string(value)
+		case LLDP_TLV_SYSTEM_CAPABILITIES:
+			if length >= 4 {
+				pdu.capabilities = byteToUint16(value[0:2])
+				pdu.enabled = byteToUint16(value[2:4])
+			}
+		case LLDP_TLV_MANAGEMENT_ADDRESS:
+			// IPv4のアドレスだけ使う
+			if length >= 2+IP_ADDRESS_LEN && value[0] == 1+IP_ADDRESS_LEN && value[1] == LLDP_MANAGEMENT_ADDRESS_IPV4 && pdu.managementAddr == 0 {
+				pdu.managementAddr = byteToUint32(value[2:6])
+				if length >= 11 {
+					pdu.ifIndex = byteToUint32(value[7:11])
+				}
+			}
+		}
+	}
+}
+
+/*
+デバイスから送るLLDPDUを作る
+管理アドレスにはデバイスのアドレスを使い、bondのメンバーやブリッジのポートなら論理デバイスのアドレス、
+それもなければルータの最初のアドレスを使う
+*/
+func (agent *lldpAgent) localLldpdu(netdev *netDevice) lldpdu {
+	pdu := lldpdu{
+		chassisId:       net.HardwareAddr(netdev.macaddr[:]).String(),
+		portId:          netdev.name,
+		ttl:             uint16(LLDP_TX_INTERVAL * LLDP_TX_HOLD / time.Second),
+		portDescription: "go-curo " + netdev.name,
+		systemName:      agent.conf.systemName,
+		capabilities:    LLDP_CAPABILITY_ROUTER | LLDP_CAPABILITY_BRIDGE,
+		enabled:         LLDP_CAPABILITY_ROUTER,
+		managementAddr:  netdev.ipdev.address,
+		ifIndex:         uint32(netdev.ifindex),
+	}
+	logical := netdev
+	if netdev.bond != nil {
+		logical = netdev.bond.netdev
+	}
+	if logical.bridge != nil {
+		pdu.enabled |= LLDP_CAPABILITY_BRIDGE
+		if logical.bridge.irb != nil {
+			logical = logical.bridge.irb
+		}
+	}
+	if pdu.managementAddr == 0 {
+		pdu.managementAddr = logical.ipdev.address
+	}
+	for _, dev := range agent.router.devices {
+		if pdu.managementAddr != 0 {
+			break
+		}
+		pdu.managementAddr = dev.ipdev.address
+	}
+	return pdu
+}
+
+/*
+ドライバを持つ全てのデバイスからLLDPDUを送信する
+VLANやbondなどの論理デバイスからは送らない
+*/
+func (agent *lldpAgent) transmit(now time.Time) {
+	agent.lastTx = now
+	for _, netdev := range agent.router.devices {
+		if netdev.driver == nil {
+			continue
+		}
+		frame := ethernetHeader{
+			destAddr:  LLDP_MAC_ADDRESS,
+			srcAddr:   netdev.macaddr,
+			etherType: ETHER_TYPE_LLDP,
+		}.ToPacket()
+		frame = append(frame, agent.localLldpdu(netdev).ToPacket()...)
+		if err := netdev.netDeviceTransmit(frame); err != nil {
+			fmt.Printf("lldp: send lldpdu to %s err : %s\n", netdev.name, err)
+		}
+	}
+}
+
+/*
+受信したLLDPDUで隣接機器のテーブルを更新する
+TTLが0なら隣接機器がシャットダウンしたので削除する
+*/
+func (agent *lldpAgent) lldpInput(inport *netDevice, packet []byte, now time.Time) {
+	pdu, err := parseLldpdu(packet)
+	if err != nil {
+		fmt.Printf("lldp: invalid lldpdu from %s : %s\n", inport.name, err)
+		return
+	}
+	key := lldpNeighborKey{localPort: inport.name, chassisId: pdu.chassisId, portId: pdu.portId}
+	neighbor, ok := agent.neighbors[key]
+	if pdu.ttl == 0 {
+		if ok {
+			fmt.Printf("lldp: neighbor %s %s on %s is shutdown\n", pdu.systemName, pdu.portId, inport.name)
+			delete(agent.neighbors, key)
+			agent.writeNeighbors()
+		}
+		return
+	}
+	if !ok {
+		fmt.Printf("lldp: found neighbor %s %s (%s) on %s\n", pdu.systemName, pdu.portId, printIPAddr(pdu.managementAddr), inport.name)
+		neighbor = &lldpNeighbor{localPort: inport.name}
+		agent.neighbors[key] = neighbor
+	}
+	changed := !ok || neighbor.info != pdu
+	neighbor.info = pdu
+	neighbor.expires = now.Add(time.Duration(pdu.ttl) * time.Second)
+	if changed {
+		agent.writeNeighbors()
+	}
+}
+
+/*
+LLDPのタイマーを進める
+TTLを過ぎた隣接機器を削除し、送信間隔ごとにLLDPDUを送る
+*/
+func (agent *lldpAgent) lldpTick(now time.Time) {
+	expired := false
+	for key, neighbor := range agent.neighbors {
+		if now.After(neighbor.expires) {
+			fmt.Printf("lldp: neighbor %s %s on %s is expired\n", neighbor.info.systemName, neighbor.info.portId, neighbor.localPort)
+			delete(agent.neighbors, key)
+			expired = true
+		}
+	}
+	if expired {
+		agent.writeNeighbors()
+	}
+	if now.Sub(agent.lastTx) >= LLDP_TX_INTERVAL {
+		agent.transmit(now)
+	}
+}
+
+// 隣接機器のテーブルのJSONの1エントリ
+type lldpJsonNeighbor struct {
+	LocalPort       string   `json:"local_port"`
+	ChassisId       string   `json:"chassis_id"`
+	PortId          string   `json:"port_id"`
+	PortDescription string   `json:"port_description,omitempty"`
+	SystemName      string   `json:"system_name,omitempty"`
+	ManagementAddr  string   `json:"management_addr,omitempty"`
+	Capabilities    []string `json:"capabilities"`
+	Ttl             uint16   `json:"ttl"`
+	Expires         string   `json:"expires"`
+}
+
+/*
+隣接機器のテーブルをローカルのポート名の順に並べて返す
+*/
+func (agent *lldpAgent) neighborTable() []lldpJsonNeighbor {
+	table := []lldpJsonNeighbor{}
+	for _, neighbor := range agent.neighbors {
+		entry := lldpJsonNeighbor{
+			LocalPort:       neighbor.localPort,
+			ChassisId:       neighbor.info.chassisId,
+			PortId:          neighbor.info.portId,
+			PortDescription: neighbor.info.portDescription,
+			SystemName:      neighbor.info.systemName,
+			Capabilities:    []string{},
+			Ttl:             neighbor.info.ttl,
+			Expires:         neighbor.expires.UTC().Format(time.RFC3339),
+		}
+		if neighbor.info.managementAddr != 0 {
+			entry.ManagementAddr = printIPAddr(neighbor.info.managementAddr)
+		}
+		if neighbor.info.enabled&LLDP_CAPABILITY_BRIDGE != 0 {
+			entry.Capabilities = append(entry.Capabilities, "bridge")
+		}
+		if neighbor.info.enabled&LLDP_CAPABILITY_ROUTER != 0 {
+			entry.Capabilities = append(entry.Capabilities, "router")
+		}
+		table = append(table, entry)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		if table[i].LocalPort != table[j].LocalPort {
+			return table[i].LocalPort < table[j].LocalPort
+		}
+		return table[i].ChassisId < table[j].ChassisId
+	})
+	return table
+}
+
+/*
+隣接機器のテーブルをJSONファイルに書き出す
+読み込む側が書きかけのファイルを見ないように一時ファイルからrenameする
+*/
+func (agent *lldpAgent) writeNeighbors() {
+	if agent.conf.neighborsFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(agent.neighborTable(), "", "  ")
+	if err != nil {
+		fmt.Printf("lldp: marshal neighbors err : %s\n", err)
+		return
+	}
+	tmp := agent.conf.neighborsFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		fmt.Printf("lldp: write neighbors err : %s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, agent.conf.neighborsFile); err != nil {
+		fmt.Printf("lldp: write neighbors err : %s\n", err)
+	}
+}
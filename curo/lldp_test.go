@@ -0,0 +1,104 @@
+package curo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLldpduPacket(t *testing.T) {
+	pdu := lldpdu{
+		chassisId:       "02:00:00:00:00:01",
+		portId:          "router1-router2",
+		ttl:             120,
+		portDescription: "go-curo router1-router2",
+		systemName:      "router1",
+		capabilities:    LLDP_CAPABILITY_ROUTER | LLDP_CAPABILITY_BRIDGE,
+		enabled:         LLDP_CAPABILITY_ROUTER,
+		managementAddr:  0xc0a80001,
+		ifIndex:         3,
+	}
+	packet := pdu.ToPacket()
+	// Chassis IDはMACアドレスのサブタイプで送る
+	if packet[0]>>1 != LLDP_TLV_CHASSIS_ID || packet[1] != 7 || packet[2] != LLDP_CHASSIS_ID_MAC_ADDRESS {
+		t.Fatalf("chassis id tlv is %x", packet[0:9])
+	}
+	parsed, err := parseLldpdu(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != pdu {
+		t.Fatalf("parsed lldpdu is %+v, want %+v", parsed, pdu)
+	}
+
+	// 必須のTLVの順番が違うもの, 途中で切れているものはエラーにする
+	var reordered []byte
+	reordered = append(reordered, packet[9:]...)
+	if _, err := parseLldpdu(reordered); err == nil {
+		t.Fatal("lldpdu without chassis id is parsed")
+	}
+	if _, err := parseLldpdu(packet[:len(packet)-2]); err == nil {
+		t.Fatal("lldpdu without end tlv is parsed")
+	}
+	if _, err := parseLldpdu(packet[:20]); err == nil {
+		t.Fatal("truncated lldpdu is parsed")
+	}
+}
+
+func TestLldpNeighborTable(t *testing.T) {
+	now := time.Now()
+	file := filepath.Join(t.TempDir(), "neighbors.json")
+	agent := newLldpAgent(NewRouter("ch2"), lldpConfig{enabled: true, systemName: "router1", neighborsFile: file})
+	inport := &netDevice{name: "router1-router2"}
+	neighbor := lldpdu{
+		chassisId:      "02:00:00:00:00:02",
+		portId:         "router2-router1",
+		ttl:            120,
+		systemName:     "router2",
+		capabilities:   LLDP_CAPABILITY_ROUTER | LLDP_CAPABILITY_BRIDGE,
+		enabled:        LLDP_CAPABILITY_ROUTER,
+		managementAddr: 0xc0a80002,
+	}
+	agent.lldpInput(inport, neighbor.ToPacket(), now)
+	agent.lldpInput(inport, neighbor.ToPacket(), now)
+	if len(agent.neighbors) != 1 {
+		t.Fatalf("neighbor table has %d entries", len(agent.neighbors))
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table []map[string]interface{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		t.Fatal(err)
+	}
+	if len(table) != 1 || table[0]["local_port"] != "router1-router2" || table[0]["port_id"] != "router2-router1" ||
+		table[0]["system_name"] != "router2" || table[0]["management_addr"] != "192.168.0.2" {
+		t.Fatalf("neighbor table json is %s", data)
+	}
+
+	// TTLを過ぎたら削除する
+	agent.lldpTick(now.Add(119 * time.Second))
+	if len(agent.neighbors) != 1 {
+		t.Fatal("neighbor is expired before ttl")
+	}
+	agent.lldpTick(now.Add(121 * time.Second))
+	if len(agent.neighbors) != 0 {
+		t.Fatal("neighbor is not expired after ttl")
+	}
+	data, _ = os.ReadFile(file)
+	if err := json.Unmarshal(data, &table); err != nil || len(table) != 0 {
+		t.Fatalf("neighbor table json after expiry is %s", data)
+	}
+
+	// TTLが0のLLDPDUを受けたらすぐに削除する
+	agent.lldpInput(inport, neighbor.ToPacket(), now)
+	neighbor.ttl = 0
+	agent.lldpInput(inport, neighbor.ToPacket(), now)
+	if len(agent.neighbors) != 0 {
+		t.Fatal("shutdown neighbor is not deleted")
+	}
+}
@@ -0,0 +1,893 @@
+package curo
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+type natDirectionType uint8
+type natProtocolType uint8
+
+const (
+	incoming natDirectionType = iota
+	outgoing
+)
+
+const (
+	tcp natProtocolType = iota
+	udp
+	icmp
+)
+
+const (
+	NAT_GLOBAL_PORT_MIN  = 20000
+	NAT_GLOBAL_PORT_MAX  = 59999
+	NAT_GLOBAL_PORT_SIZE = (NAT_GLOBAL_PORT_MAX - NAT_GLOBAL_PORT_MIN + 1)
+	NAT_ICMP_ID_SIZE     = 0xffff
+)
+
+// NATエントリのタイムアウト
+// TCPはRFC 5382, UDPはRFC 4787, ICMPはRFC 5508の推奨値に合わせている
+const (
+	NAT_TCP_ESTABLISHED_TIMEOUT = 2*time.Hour + 4*time.Minute
+	NAT_TCP_TRANSITORY_TIMEOUT  = 4 * time.Minute
+	NAT_TCP_CLOSED_TIMEOUT      = 10 * time.Second
+	NAT_UDP_TIMEOUT             = 5 * time.Minute
+	NAT_ICMP_TIMEOUT            = 60 * time.Second
+	NAT_SWEEP_INTERVAL          = 10 * time.Second
+)
+
+// RFC 4787のマッピングの動作
+type natMappingType uint8
+
+const (
+	natMappingEndpointIndependent     natMappingType = iota // 通信相手によらず同じマッピングを使う
+	natMappingAddressDependent                              // 通信相手のアドレスごとにマッピングを作る
+	natMappingAddressAndPortDependent                       // 通信相手のアドレスとポートごとにマッピングを作る
+)
+
+// RFC 4787のフィルタリングの動作
+type natFilteringType uint8
+
+const (
+	natFilteringEndpointIndependent     natFilteringType = iota // どこからの通信でも通す
+	natFilteringAddressDependent                                // 内側から送ったことのあるアドレスからの通信だけ通す
+	natFilteringAddressAndPortDependent                         // 内側から送ったことのあるアドレスとポートからの通信だけ通す
+)
+
+// NATエントリが追跡しているTCPの状態
+type natTcpState uint8
+
+const (
+	natTcpSynSent     natTcpState = iota // 内側からSYNが送られた
+	natTcpEstablished                    // 外側から応答があった
+	natTcpFinWait                        // どちらか片方からFINが送られた
+	natTcpClosed                         // 両方からFINが送られたかRSTが送られた
+)
+
+type natPacketHeader struct {
+	// TCPヘッダかUDPヘッダかICMP
+	packet []byte
+}
+type natEntry struct {
+	globalIpAddr  uint32
+	localIpAddr   uint32
+	globalPort    uint16
+	localPort     uint16
+	lastSeen      time.Time                   // 最後にパケットが通過した時刻
+	tcpState      natTcpState                 // TCPの接続状態
+	finLocal      bool                        // 内側からFINが送られたか
+	finGlobal     bool                        // 外側からFINが送られたか
+	static        bool                        // ポートフォワーディングで作成した削除しないエントリか
+	remoteIpAddr  uint32                      // マッピングを作った時の通信相手のアドレス
+	remotePort    uint16                      // マッピングを作った時の通信相手のポート
+	remotes       map[natEntryKey]struct{}    // 内側から送ったことのある通信相手
+	expected      bool                        // ALGが関連する通信のために作ったエントリか
+	algSeq        map[natSeqKey]*natSeqAdjust // ALGがペイロードを書き換えた時の通信相手ごとのシーケンス番号の補正
+	nat64         bool                        // NAT64で内側がIPv6のエントリか
+	localIpv6Addr [16]byte                    // NAT64の内側のIPv6アドレス
+	packets       uint64                      // 変換したパケットの数
+	bytes         uint64                      // 変換したパケットのバイト数
+}
+
+// UDP, TCP, ICMPのNATテーブルのセット
+// パケットの処理とタイムアウトの掃除が別のgoroutineから触るのでロックする
+type natEntryList struct {
+	mutex     sync.Mutex
+	mapping   natMappingType
+	pool      *natAddressPool
+	tcp       *natTable
+	udp       *natTable
+	icmp      *natTable
+	logger    *natEventLogger  // セッションの作成と削除のイベントの出力先, closeした後はnil
+	clock     func() time.Time // エントリの通過時刻とタイムアウトに使う時刻, ルータの時刻にする
+	stop      chan struct{}    // 閉じるとタイムアウトしたエントリの削除を止める
+	lastSweep time.Time        // 最後にタイムアウトしたエントリを削除した時刻
+}
+
+// ポートフォワーディングのルール
+// 外側のアドレスのglobalPortに来た通信をlocalIpAddr:localPortに転送する
+type natPortForwardRule struct {
+	proto       natProtocolType
+	globalPort  uint16
+	localIpAddr uint32
+	localPort   uint16
+}
+
+// 起動時に引数で指定するNATの設定
+type natConfig struct {
+	forwards      []natPortForwardRule
+	mapping       natMappingType
+	filtering     natFilteringType
+	pool          []uint32         // 外側のアドレスのプール
+	portBlockSize uint16           // 内側のホストごとに割り当てるポートブロックのサイズ
+	statics       []natStaticRule  // 1対1の静的NAT
+	nat64         bool             // NAT64を有効にするか
+	nat64Prefix   [16]byte         // NAT64で使う/96のプレフィックス
+	logger        *natEventLogger  // セッションのイベントの出力先, nilなら出力しない
+	clock         func() time.Time // エントリとイベントの時刻, nilなら実際の時刻
+}
+
+/*
+ライブラリの外から指定するNATの設定
+CLIの引数と同じ形式の文字列で受け取り、ConfigureNatでnatConfigにする
+*/
+type NatOptions struct {
+	Forwards      []string // ポートフォワーディング, "tcp:8080:192.168.1.3:80"
+	Mapping       string   // eim, adm, apdm, 空ならeim
+	Filtering     string   // eif, adf, apdf, 空ならeif
+	Pool          string   // 外側のアドレスのプール, "192.168.0.10-192.168.0.20"
+	PortBlockSize uint     // 内側のホストごとのポートブロックのサイズ, 0なら使わない
+	Statics       []string // 1対1の静的NAT, "192.168.1.3=192.168.0.100"
+	Nat64         bool
+	Nat64Prefix   string // 空ならNAT64_WELL_KNOWN_PREFIX
+	Log           string // セッションのイベントをJSON Linesで追記するファイル
+	Ipfix         string // セッションのイベントをIPFIXで送るコレクタ, "192.168.0.2:4739"
+}
+
+// NATの内側のip_deviceが持つNATデバイス
+type natDevice struct {
+	outsideIpAddr uint32
+	filtering     natFilteringType
+	natEntry      *natEntryList
+	nat64         bool
+	nat64Prefix   [16]byte
+}
+
+/*
+NATの設定をパースする
+*/
+func parseNatOptions(opts NatOptions) (natConfig, error) {
+	var natconf natConfig
+	var err error
+	if opts.Mapping == "" {
+		opts.Mapping = "eim"
+	}
+	natconf.mapping, err = parseNatMappingType(opts.Mapping)
+	if err != nil {
+		return natConfig{}, err
+	}
+	if opts.Filtering == "" {
+		opts.Filtering = "eif"
+	}
+	natconf.filtering, err = parseNatFilteringType(opts.Filtering)
+	if err != nil {
+		return natConfig{}, err
+	}
+	if opts.Pool != "" {
+		natconf.pool, err = parseNatAddressPool(opts.Pool)
+		if err != nil {
+			return natConfig{}, err
+		}
+	}
+	if opts.PortBlockSize > NAT_GLOBAL_PORT_SIZE {
+		return natConfig{}, fmt.Errorf("nat port block size must be less than %d", NAT_GLOBAL_PORT_SIZE)
+	}
+	natconf.portBlockSize = uint16(opts.PortBlockSize)
+	for _, rule := range opts.Statics {
+		static, err := parseNatStaticRule(rule)
+		if err != nil {
+			return natConfig{}, err
+		}
+		natconf.statics = append(natconf.statics, static)
+	}
+	for _, rule := range opts.Forwards {
+		forward, err := parseNatPortForwardRule(rule)
+		if err != nil {
+			return natConfig{}, err
+		}
+		natconf.forwards = append(natconf.forwards, forward)
+	}
+	if opts.Nat64 {
+		if opts.Nat64Prefix == "" {
+			opts.Nat64Prefix = NAT64_WELL_KNOWN_PREFIX
+		}
+		natconf.nat64 = true
+		natconf.nat64Prefix, err = parseNat64Prefix(opts.Nat64Prefix)
+		if err != nil {
+			return natConfig{}, err
+		}
+	}
+	natconf.logger, err = newNatEventLogger(opts.Log, opts.Ipfix)
+	if err != nil {
+		return natConfig{}, err
+	}
+	return natconf, nil
+}
+
+/*
+insideのデバイスにNATを設定する
+outsideのデバイスのアドレスをNATの外側のアドレスにする
+*/
+func (router *Router) ConfigureNat(inside, outside string, opts NatOptions) error {
+	natconf, err := parseNatOptions(opts)
+	if err != nil {
+		return err
+	}
+	if router.getnetDeviceByName(inside).name == "" {
+		natconf.logger.close()
+		return fmt.Errorf("nat inside device %s is not found", inside)
+	}
+	outsidedev := router.getnetDeviceByName(outside)
+	if outsidedev.ipdev.address == 0 {
+		natconf.logger.close()
+		return fmt.Errorf("nat outside device %s has no ip addr", outside)
+	}
+	router.configureIPNat(inside, outsidedev.ipdev.address, natconf)
+	// ポートフォワーディングの設定
+	return router.configureIPPortForward(inside, natconf.forwards)
+}
+
+func (router *Router) configureIPNat(inside string, outside uint32, natconf natConfig) {
+
+	for _, dev := range router.devices {
+		if inside == dev.name {
+			// 設定し直す時は前のエントリの削除とログを止める
+			if dev.ipdev.natdev.natEntry != nil {
+				if err := dev.ipdev.natdev.natEntry.close(); err != nil {
+					fmt.Printf("%s\n", err)
+				}
+			}
+			// エントリとイベントの時刻はpcapのリプレイでも合うようにルータの時刻にする
+			natconf.clock = router.now
+			dev.ipdev.natdev = natDevice{
+				outsideIpAddr: outside,
+				filtering:     natconf.filtering,
+				natEntry:      newNatEntryList(outside, natconf),
+				nat64:         natconf.nat64,
+				nat64Prefix:   natconf.nat64Prefix,
+			}
+			fmt.Printf("Set nat to %s, outside ip addr is %s, mapping is %s, filtering is %s\n",
+				inside, printIPAddr(outside), natconf.mapping, natconf.filtering)
+			for _, addr := range dev.ipdev.natdev.natEntry.pool.addrs {
+				fmt.Printf("Set nat pool addr %s\n", printIPAddr(addr))
+			}
+			for _, static := range natconf.statics {
+				fmt.Printf("Set static nat %s to %s\n", printIPAddr(static.localIpAddr), printIPAddr(static.globalIpAddr))
+			}
+			if natconf.nat64 {
+				fmt.Printf("Set nat64 prefix %s/96\n", printIPv6Addr(natconf.nat64Prefix))
+			}
+			// タイムアウトしたエントリを定期的に削除する, Closeで止まるのを待つ
+			natEntry := dev.ipdev.natdev.natEntry
+			router.workers.Add(1)
+			go func() {
+				defer router.workers.Done()
+				natEntry.runNatSweeper(NAT_SWEEP_INTERVAL)
+			}()
+		}
+	}
+}
+
+func (mapping natMappingType) String() string {
+	switch mapping {
+	case natMappingAddressDependent:
+		return "adm"
+	case natMappingAddressAndPortDependent:
+		return "apdm"
+	}
+	return "eim"
+}
+
+func (filtering natFilteringType) String() string {
+	switch filtering {
+	case natFilteringAddressDependent:
+		return "adf"
+	case natFilteringAddressAndPortDependent:
+		return "apdf"
+	}
+	return "eif"
+}
+
+/*
+マッピングの動作をパースする
+eim, adm, apdmのどれかで指定する
+*/
+func parseNatMappingType(mapping string) (natMappingType, error) {
+	switch strings.ToLower(mapping) {
+	case "eim":
+		return natMappingEndpointIndependent, nil
+	case "adm":
+		return natMappingAddressDependent, nil
+	case "apdm":
+		return natMappingAddressAndPortDependent, nil
+	}
+	return 0, fmt.Errorf("invalid nat mapping %q, must be eim, adm or apdm", mapping)
+}
+
+/*
+フィルタリングの動作をパースする
+eif, adf, apdfのどれかで指定する
+*/
+func parseNatFilteringType(filtering string) (natFilteringType, error) {
+	switch strings.ToLower(filtering) {
+	case "eif":
+		return natFilteringEndpointIndependent, nil
+	case "adf":
+		return natFilteringAddressDependent, nil
+	case "apdf":
+		return natFilteringAddressAndPortDependent, nil
+	}
+	return 0, fmt.Errorf("invalid nat filtering %q, must be eif, adf or apdf", filtering)
+}
+
+/*
+ポートフォワーディングのルールをパースする
+"tcp:8080:192.168.1.3:80" の形式で、外側の8080番を192.168.1.3の80番に転送する
+*/
+func parseNatPortForwardRule(rule string) (natPortForwardRule, error) {
+	var forward natPortForwardRule
+	fields := strings.Split(rule, ":")
+	if len(fields) != 4 {
+		return forward, fmt.Errorf("invalid port forward rule %q, format is proto:outside port:inside addr:inside port", rule)
+	}
+	switch strings.ToLower(fields[0]) {
+	case "tcp":
+		forward.proto = tcp
+	case "udp":
+		forward.proto = udp
+	default:
+		return forward, fmt.Errorf("invalid port forward protocol %q", fields[0])
+	}
+	globalPort, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil || globalPort == 0 {
+		return forward, fmt.Errorf("invalid port forward outside port %q", fields[1])
+	}
+	localIp := net.ParseIP(fields[2]).To4()
+	if localIp == nil {
+		return forward, fmt.Errorf("invalid port forward inside addr %q", fields[2])
+	}
+	localPort, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil || localPort == 0 {
+		return forward, fmt.Errorf("invalid port forward inside port %q", fields[3])
+	}
+	forward.globalPort = uint16(globalPort)
+	forward.localIpAddr = byteToUint32(localIp)
+	forward.localPort = uint16(localPort)
+	return forward, nil
+}
+
+/*
+NATの内側のデバイスにポートフォワーディングのエントリを登録する
+*/
+func (router *Router) configureIPPortForward(inside string, forwards []natPortForwardRule) error {
+	dev := router.getnetDeviceByName(inside)
+	if dev.ipdev.natdev == (natDevice{}) {
+		return fmt.Errorf("nat is not configured on %s", inside)
+	}
+	natdevice := dev.ipdev.natdev
+	natdevice.natEntry.mutex.Lock()
+	defer natdevice.natEntry.mutex.Unlock()
+
+	for _, forward := range forwards {
+		_, err := natdevice.natEntry.createStaticNatEntry(forward.proto, forward.localIpAddr, forward.localPort,
+			natdevice.outsideIpAddr, forward.globalPort)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Set port forward %s %s:%d to %s:%d\n", forward.proto,
+			printIPAddr(natdevice.outsideIpAddr), forward.globalPort, printIPAddr(forward.localIpAddr), forward.localPort)
+	}
+	return nil
+}
+
+func (router *Router) dumpNatTables() {
+	fmt.Println("|-PROTO-|---------LOCAL---------|--------GLOBAL---------|")
+	for _, netdev := range router.devices {
+		if netdev.ipdev != (ipDevice{}) && netdev.ipdev.natdev != (natDevice{}) {
+			list := netdev.ipdev.natdev.natEntry
+			list.mutex.Lock()
+			for _, proto := range []natProtocolType{tcp, udp, icmp} {
+				for _, v := range list.table(proto).byGlobal {
+					fmt.Printf("| %5s | %15s:%05d | %15s:%05d |\n", proto,
+						v.localAddrString(), v.localPort, printIPAddr(v.globalIpAddr), v.globalPort)
+				}
+			}
+			list.mutex.Unlock()
+		}
+	}
+	fmt.Println("|-------|-----------------------|-----------------------|")
+}
+
+/*
+NATのアドレス変換を実行する
+*/
+func natExec(ipheader *ipHeader, natPacket natPacketHeader, natdevice natDevice, proto natProtocolType, direction natDirectionType) ([]byte, error) {
+
+	var udpheader udpHeader
+	var tcpheader tcpHeader
+	var srcPort, destPort uint16
+	var packet []byte
+
+	// プロトコルごとに型を変換
+	switch proto {
+	case udp:
+		var err error
+		udpheader, err = udpheader.ParsePacket(natPacket.packet)
+		if err != nil {
+			return nil, err
+		}
+		srcPort = udpheader.srcPort
+		destPort = udpheader.destPort
+	case tcp:
+		var err error
+		tcpheader, err = tcpheader.ParsePacket(natPacket.packet)
+		if err != nil {
+			return nil, err
+		}
+		srcPort = tcpheader.srcPort
+		destPort = tcpheader.destPort
+	}
+
+	natdevice.natEntry.mutex.Lock()
+	defer natdevice.natEntry.mutex.Unlock()
+
+	// ICMPはポート番号の代わりにICMPの識別子でNATする
+	if proto == icmp {
+		return natExecIcmp(ipheader, natPacket, natdevice, direction)
+	}
+
+	// 1対1の静的NATのホストはエントリを作らずにアドレスだけ変換する
+	var entry *natEntry
+	if direction == incoming {
+		entry = natdevice.natEntry.pool.oneToOneEntry(ipheader.destAddr, destPort, incoming)
+	} else {
+		entry = natdevice.natEntry.pool.oneToOneEntry(ipheader.srcAddr, srcPort, outgoing)
+	}
+	if entry != nil {
+		if direction == incoming {
+			ipheader.destAddr = entry.localIpAddr
+		} else {
+			ipheader.srcAddr = entry.globalIpAddr
+		}
+	} else if direction == incoming { // NATの外から内への通信時
+		// UDPとTCPの時はポート番号
+		entry = natdevice.natEntry.getNatEntryByGlobal(proto, ipheader.destAddr, destPort)
+		// NATエントリが登録されていない場合、エラーを返す
+		// NAT64のエントリはIPv4の内側のホストには変換できない
+		if entry.globalPort == 0 || entry.nat64 {
+			return nil, fmt.Errorf("No nat entry")
+		}
+		// フィルタリングの動作に応じて外からの通信を通すか判断する
+		if !natdevice.natFilterAllows(entry, ipheader.srcAddr, srcPort) {
+			return nil, fmt.Errorf("filtered by nat from %s:%d", printIPAddr(ipheader.srcAddr), srcPort)
+		}
+		fmt.Printf("incoming nat from %s:%d to %s:%d\n",
+			printIPAddr(entry.globalIpAddr), entry.globalPort, printIPAddr(entry.localIpAddr), entry.localPort)
+
+		fmt.Printf("incoming ip header src is %s, dest is %s\n",
+			printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
+		// IPヘッダの送信先アドレスをentryのアドレスにする
+		ipheader.destAddr = entry.localIpAddr
+		udpheader.destPort = entry.localPort
+		tcpheader.destPort = entry.localPort
+
+	} else { // NATの内から外への通信時
+
+		entry = natdevice.natEntry.getNatEntryByLocal(proto, ipheader.srcAddr, srcPort, ipheader.destAddr, destPort)
+
+		if entry.globalPort == 0 {
+			// NATエントリがなかったらエントリ作成
+			entry = natdevice.natEntry.createNatEntry(proto, ipheader.srcAddr, srcPort, ipheader.destAddr, destPort)
+			if entry.globalPort == 0 {
+				return nil, fmt.Errorf("NAT table is full")
+			}
+
+			fmt.Printf("Now, nat entry local %s:%d to global %s:%d\n",
+				printIPAddr(entry.localIpAddr), entry.localPort, printIPAddr(entry.globalIpAddr), entry.globalPort)
+		}
+
+		// 送信先をフィルタリングのために覚えておく
+		entry.remotes[natEntryKey{ipAddr: ipheader.destAddr, port: destPort}] = struct{}{}
+
+		// IPヘッダの送信元アドレスを外側のアドレスにする
+		ipheader.srcAddr = entry.globalIpAddr
+		udpheader.srcPort = entry.globalPort
+		tcpheader.srcPort = entry.globalPort
+	}
+
+	// エントリの最終通過時刻とカウンタ, TCPの状態を更新する
+	entry.touch(natdevice.natEntry.now(), int(ipheader.totalLen))
+	if proto == tcp {
+		entry.updateTcpState(tcpheader.tcpflag, direction)
+	}
+
+	// 書き換えたアドレスとポートの差分だけでチェックサムを計算し直す
+	// ポートはTCPとUDPのヘッダにあり、アドレスは疑似ヘッダとしてTCPとUDPのチェックサムにも含まれる
+	oldAddr, newAddr := entry.localIpAddr, entry.globalIpAddr
+	oldPort, newPort := entry.localPort, entry.globalPort
+	if direction == incoming {
+		oldAddr, newAddr = newAddr, oldAddr
+		oldPort, newPort = newPort, oldPort
+	}
+	ipheader.headerChecksum = checksum.Adjust32(ipheader.headerChecksum, oldAddr, newAddr)
+	if proto == udp {
+		udpheader.checksum = checksum.AdjustUDP32(udpheader.checksum, oldAddr, newAddr)
+		udpheader.checksum = checksum.AdjustUDP(udpheader.checksum, oldPort, newPort)
+	} else {
+		tcpheader.checksum = checksum.Adjust32(tcpheader.checksum, oldAddr, newAddr)
+		tcpheader.checksum = checksum.Adjust(tcpheader.checksum, oldPort, newPort)
+	}
+
+	// 書き換えたヘッダをパケットにつけ直す
+	if proto == udp {
+		// UDPのヘッダの後ろにデータをつける
+		packet = append(udpheader.ToPacket(), natPacket.packet[8:]...)
+	} else {
+		// ALGがペイロードやシーケンス番号を変えたらチェックサムを計算し直す
+		changed, err := natAlgExec(ipheader, &tcpheader, natdevice, entry, direction)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			tcpheader.checksum = 0
+			tcpheader.checksum = calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, IP_PROTOCOL_NUM_TCP, tcpheader.ToPacket())
+		}
+		packet = tcpheader.ToPacket()
+	}
+
+	return packet, nil
+}
+
+/*
+内側のホストから外側のアドレス宛てに来たパケットを内側に折り返すヘアピンNATを実行する
+宛先だけを変換すると内側のサーバが直接応答してしまうので、
+送信元も外側のアドレスに変換して応答がルータを経由するようにする
+*/
+func natExecHairpin(ipheader *ipHeader, natPacket natPacketHeader, natdevice natDevice, proto natProtocolType) ([]byte, error) {
+	if proto == icmp {
+		return nil, fmt.Errorf("ICMP is not supported to hairpin nat")
+	}
+	if len(natPacket.packet) < 4 {
+		return nil, fmt.Errorf("packet is too short to hairpin nat")
+	}
+	// 先に宛先のエントリがあるか確認して、折り返せないパケットで送信元のエントリを作らないようにする
+	natdevice.natEntry.mutex.Lock()
+	entry := natdevice.natEntry.getNatEntryByGlobal(proto, ipheader.destAddr, byteToUint16(natPacket.packet[2:4]))
+	oneToOne := natdevice.natEntry.pool.oneToOneEntry(ipheader.destAddr, 0, incoming)
+	natdevice.natEntry.mutex.Unlock()
+	if entry.globalPort == 0 && oneToOne == nil {
+		return nil, fmt.Errorf("No nat entry")
+	}
+
+	// 送信元を外側のアドレスに変換する
+	srcNatPacket, err := natExec(ipheader, natPacket, natdevice, proto, outgoing)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("hairpin nat from %s to %s\n", printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
+	// 宛先を内側のアドレスに変換する
+	return natExec(ipheader, natPacketHeader{packet: srcNatPacket}, natdevice, proto, incoming)
+}
+
+/*
+NATの外側のアドレスとして使っているアドレスか確認する
+*/
+func (natdevice natDevice) isOutsideAddr(ipaddr uint32) bool {
+	return natdevice.outsideIpAddr == ipaddr || natdevice.natEntry.pool.contains(ipaddr)
+}
+
+/*
+フィルタリングの動作に応じて外側の通信相手からのパケットを通すか判断する
+ポートフォワーディングのエントリはどこからでも通す
+*/
+func (natdevice natDevice) natFilterAllows(entry *natEntry, remoteIpAddr uint32, remotePort uint16) bool {
+	if entry.static {
+		return true
+	}
+	// ALGが作ったエントリは通信相手のポートが分からないのでアドレスだけで判断する
+	if entry.expected && natdevice.filtering != natFilteringEndpointIndependent {
+		for remote := range entry.remotes {
+			if remote.ipAddr == remoteIpAddr {
+				return true
+			}
+		}
+		return false
+	}
+	switch natdevice.filtering {
+	case natFilteringAddressDependent:
+		for remote := range entry.remotes {
+			if remote.ipAddr == remoteIpAddr {
+				return true
+			}
+		}
+		return false
+	case natFilteringAddressAndPortDependent:
+		_, ok := entry.remotes[natEntryKey{ipAddr: remoteIpAddr, port: remotePort}]
+		return ok
+	}
+	return true
+}
+
+/*
+パケットが通過したのでNATエントリの最終通過時刻とカウンタを更新する
+*/
+func (entry *natEntry) touch(now time.Time, size int) {
+	entry.lastSeen = now
+	entry.packets++
+	entry.bytes += uint64(size)
+}
+
+/*
+TCPのフラグからNATエントリの接続状態を更新する
+*/
+func (entry *natEntry) updateTcpState(tcpflag uint8, direction natDirectionType) {
+	// RSTが来たらすぐに閉じた状態にする
+	if tcpflag&TCP_FLAG_RST != 0 {
+		entry.tcpState = natTcpClosed
+		return
+	}
+	if tcpflag&TCP_FLAG_FIN != 0 {
+		if direction == incoming {
+			entry.finGlobal = true
+		} else {
+			entry.finLocal = true
+		}
+	}
+
+	switch {
+	case entry.finLocal && entry.finGlobal:
+		entry.tcpState = natTcpClosed
+	case entry.finLocal || entry.finGlobal:
+		entry.tcpState = natTcpFinWait
+	case entry.tcpState == natTcpSynSent:
+		// SYNで始まっていない途中からの通信と外側からの応答は確立済みとみなす
+		if direction == incoming || tcpflag&TCP_FLAG_SYN == 0 {
+			entry.tcpState = natTcpEstablished
+		}
+	}
+}
+
+/*
+NATエントリのプロトコルと状態に応じたタイムアウトを返す
+*/
+func (entry *natEntry) natEntryTimeout(protoType natProtocolType) time.Duration {
+	switch protoType {
+	case tcp:
+		switch entry.tcpState {
+		case natTcpEstablished:
+			return NAT_TCP_ESTABLISHED_TIMEOUT
+		case natTcpClosed:
+			return NAT_TCP_CLOSED_TIMEOUT
+		default:
+			return NAT_TCP_TRANSITORY_TIMEOUT
+		}
+	case udp:
+		return NAT_UDP_TIMEOUT
+	default:
+		return NAT_ICMP_TIMEOUT
+	}
+}
+
+/*
+IPのプロトコル番号をNATのプロトコルタイプに変換する
+*/
+func natProtocolTypeFromIP(protocol uint8) (natProtocolType, bool) {
+	switch protocol {
+	case IP_PROTOCOL_NUM_TCP:
+		return tcp, true
+	case IP_PROTOCOL_NUM_UDP:
+		return udp, true
+	case IP_PROTOCOL_NUM_ICMP:
+		return icmp, true
+	}
+	return 0, false
+}
+
+/*
+ICMPのNATを実行する
+エコーは識別子をポート番号の代わりに使い、エラーメッセージは中に入っている元のパケットも変換する
+*/
+func natExecIcmp(ipheader *ipHeader, natPacket natPacketHeader, natdevice natDevice, direction natDirectionType) ([]byte, error) {
+	// ICMPのヘッダと識別子, シーケンス番号の8byteより短かったらNATできない
+	if len(natPacket.packet) < 8 {
+		return nil, fmt.Errorf("ICMP packet is too short")
+	}
+	// 受信したバッファを書き換えないようにコピーしておく
+	packet := make([]byte, len(natPacket.packet))
+	copy(packet, natPacket.packet)
+
+	icmpType := packet[0]
+	switch icmpType {
+	case ICMP_TYPE_ECHO_REQUEST, ICMP_TYPE_ECHO_REPLY:
+		identify := byteToUint16(packet[4:6])
+		// 1対1の静的NATのホストは識別子を変換せずアドレスだけ変換する
+		if direction == incoming {
+			if oneToOne := natdevice.natEntry.pool.oneToOneEntry(ipheader.destAddr, identify, incoming); oneToOne != nil {
+				ipheader.destAddr = oneToOne.localIpAddr
+				break
+			}
+		} else if oneToOne := natdevice.natEntry.pool.oneToOneEntry(ipheader.srcAddr, identify, outgoing); oneToOne != nil {
+			ipheader.srcAddr = oneToOne.globalIpAddr
+			break
+		}
+		var entry *natEntry
+		if direction == incoming { // NATの外から内への通信時
+			// 外から来るのは内側が送ったエコーリクエストへのリプライだけ
+			if icmpType != ICMP_TYPE_ECHO_REPLY {
+				return nil, fmt.Errorf("No nat entry")
+			}
+			entry = natdevice.natEntry.getNatEntryByGlobal(icmp, ipheader.destAddr, identify)
+			if entry.globalPort == 0 || entry.nat64 {
+				return nil, fmt.Errorf("No nat entry")
+			}
+			if !natdevice.natFilterAllows(entry, ipheader.srcAddr, 0) {
+				return nil, fmt.Errorf("filtered by nat from %s", printIPAddr(ipheader.srcAddr))
+			}
+			fmt.Printf("incoming icmp nat from %s:%d to %s:%d\n",
+				printIPAddr(entry.globalIpAddr), entry.globalPort, printIPAddr(entry.localIpAddr), entry.localPort)
+			entry.touch(natdevice.natEntry.now(), int(ipheader.totalLen))
+			// 宛先アドレスと識別子をローカルのものにする
+			ipheader.destAddr = entry.localIpAddr
+			copy(packet[4:6], uint16ToByte(entry.localPort))
+		} else { // NATの内から外への通信時
+			// 内から外へ出すのはエコーリクエストだけ
+			if icmpType != ICMP_TYPE_ECHO_REQUEST {
+				return nil, fmt.Errorf("ICMP type %d is not supported to nat", icmpType)
+			}
+			entry = natdevice.natEntry.getNatEntryByLocal(icmp, ipheader.srcAddr, identify, ipheader.destAddr, 0)
+			if entry.globalPort == 0 {
+				// NATエントリがなかったらエントリ作成
+				entry = natdevice.natEntry.createNatEntry(icmp, ipheader.srcAddr, identify, ipheader.destAddr, 0)
+				if entry.globalPort == 0 {
+					return nil, fmt.Errorf("NAT table is full")
+				}
+				fmt.Printf("Now, icmp nat entry local %s:%d to global %s:%d\n",
+					printIPAddr(entry.localIpAddr), entry.localPort, printIPAddr(entry.globalIpAddr), entry.globalPort)
+			}
+			entry.touch(natdevice.natEntry.now(), int(ipheader.totalLen))
+			entry.remotes[natEntryKey{ipAddr: ipheader.destAddr}] = struct{}{}
+			// 送信元アドレスと識別子をグローバルのものにする
+			ipheader.srcAddr = entry.globalIpAddr
+			copy(packet[4:6], uint16ToByte(entry.globalPort))
+		}
+	case ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_TYPE_TIME_EXCEEDED:
+		err := natExecIcmpError(ipheader, packet, natdevice, direction)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("ICMP type %d is not supported to nat", icmpType)
+	}
+
+	// ICMPのチェックサムはIPアドレスを含まないのでメッセージ全体で計算し直す
+	packet[2] = 0
+	packet[3] = 0
+	checksum := calcChecksum(packet)
+	packet[2] = checksum[0]
+	packet[3] = checksum[1]
+
+	// IPヘッダのチェックサムを計算し直す
+	ipheader.headerChecksum = 0
+	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+
+	return packet, nil
+}
+
+/*
+ICMPエラーメッセージのNATを実行する
+エラーメッセージのデータ部にはエラーの原因になったIPヘッダと上位ヘッダの先頭8byteが入っているので、
+外側のIPヘッダと合わせて中のIPヘッダとポート番号(ICMPなら識別子)も変換する
+*/
+func natExecIcmpError(ipheader *ipHeader, packet []byte, natdevice natDevice, direction natDirectionType) error {
+	// ICMPヘッダの8byteの後ろに元のIPヘッダが入っている
+	inner := packet[8:]
+	if len(inner) < 20 {
+		return fmt.Errorf("ICMP error message is too short")
+	}
+	innerHeaderLen := int(inner[0]&0x0f) * 4
+	if innerHeaderLen < 20 || len(inner) < innerHeaderLen+8 {
+		return fmt.Errorf("ICMP error message is too short")
+	}
+	proto, ok := natProtocolTypeFromIP(inner[9])
+	if !ok {
+		return fmt.Errorf("ICMP error for ip protocol %d is not supported to nat", inner[9])
+	}
+	innerSrcAddr := byteToUint32(inner[12:16])
+	innerDestAddr := byteToUint32(inner[16:20])
+	transport := inner[innerHeaderLen:]
+
+	// 中のパケットのポート番号の位置, ICMPなら識別子の位置
+	srcPortOffset, destPortOffset := 0, 2
+	if proto == icmp {
+		srcPortOffset, destPortOffset = 4, 4
+	}
+
+	var entry *natEntry
+	if direction == incoming {
+		// 外から届くエラーの中身は内側から送ったパケットなので、送信元がグローバルの値になっている
+		port := byteToUint16(transport[srcPortOffset : srcPortOffset+2])
+		entry = natdevice.natEntry.pool.oneToOneEntry(innerSrcAddr, port, incoming)
+		if entry == nil {
+			entry = natdevice.natEntry.getNatEntryByGlobal(proto, innerSrcAddr, port)
+		}
+		if entry.globalIpAddr == 0 || entry.nat64 || entry.globalIpAddr != ipheader.destAddr {
+			return fmt.Errorf("No nat entry")
+		}
+		fmt.Printf("incoming icmp error nat from %s:%d to %s:%d\n",
+			printIPAddr(entry.globalIpAddr), entry.globalPort, printIPAddr(entry.localIpAddr), entry.localPort)
+		// 外側の宛先と中の送信元をローカルのものにする
+		ipheader.destAddr = entry.localIpAddr
+		copy(inner[12:16], uint32ToByte(entry.localIpAddr))
+		natRewriteIcmpErrorTransport(proto, transport, srcPortOffset, entry.globalIpAddr, entry.localIpAddr, entry.localPort)
+	} else {
+		// 内から送るエラーの中身は外から届いたパケットなので、宛先がローカルの値になっている
+		// ICMPなら内側のホストが受け取ったエコーリプライか、1対1の静的NATで受け取ったエコーリクエスト
+		port := byteToUint16(transport[destPortOffset : destPortOffset+2])
+		entry = natdevice.natEntry.pool.oneToOneEntry(innerDestAddr, port, outgoing)
+		if entry == nil {
+			remotePort := byteToUint16(transport[0:2])
+			if proto == icmp {
+				remotePort = 0
+			}
+			entry = natdevice.natEntry.getNatEntryByLocal(proto, innerDestAddr, port, innerSrcAddr, remotePort)
+		}
+		if entry.globalIpAddr == 0 || entry.nat64 {
+			return fmt.Errorf("No nat entry")
+		}
+		// 外側の送信元と中の宛先をグローバルのものにする
+		// 内側のルータが送ったエラーでもプライベートアドレスは外に出せないので送信元はグローバルにする
+		ipheader.srcAddr = entry.globalIpAddr
+		copy(inner[16:20], uint32ToByte(entry.globalIpAddr))
+		natRewriteIcmpErrorTransport(proto, transport, destPortOffset, entry.localIpAddr, entry.globalIpAddr, entry.globalPort)
+	}
+
+	// 中のIPヘッダのチェックサムを計算し直す
+	inner[10] = 0
+	inner[11] = 0
+	checksum := calcChecksum(inner[:innerHeaderLen])
+	inner[10] = checksum[0]
+	inner[11] = checksum[1]
+
+	return nil
+}
+
+/*
+ICMPエラーの中のTCP, UDP, ICMPのヘッダのポート番号(ICMPなら識別子)を書き換え、中のチェックサムも差分で計算し直す
+TCPとUDPのチェックサムは疑似ヘッダのアドレスも含むので、中のIPヘッダで書き換えたアドレスの差分も足す
+TCPのチェックサムは先頭8byteより後ろにあるので、エラーメッセージに入っている時だけ計算し直す
+*/
+func natRewriteIcmpErrorTransport(proto natProtocolType, transport []byte, portOffset int, oldAddr, newAddr uint32, newPort uint16) {
+	oldPort := byteToUint16(transport[portOffset : portOffset+2])
+	copy(transport[portOffset:portOffset+2], uint16ToByte(newPort))
+	switch proto {
+	case udp:
+		sum := checksum.AdjustUDP32(byteToUint16(transport[6:8]), oldAddr, newAddr)
+		copy(transport[6:8], uint16ToByte(checksum.AdjustUDP(sum, oldPort, newPort)))
+	case tcp:
+		if len(transport) < 18 {
+			return
+		}
+		sum := checksum.Adjust32(byteToUint16(transport[16:18]), oldAddr, newAddr)
+		copy(transport[16:18], uint16ToByte(checksum.Adjust(sum, oldPort, newPort)))
+	case icmp:
+		// ICMPのチェックサムは疑似ヘッダを含まない
+		copy(transport[2:4], uint16ToByte(checksum.Adjust(byteToUint16(transport[2:4]), oldPort, newPort)))
+	}
+}
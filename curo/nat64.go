@@ -0,0 +1,291 @@
+package curo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NAT64のWell-Known Prefix (RFC 6052)
+const NAT64_WELL_KNOWN_PREFIX = "64:ff9b::/96"
+
+// NAT64のエントリがないことを表すエラー
+// IPv4のNATのエントリかもしれないので、呼び出し元は通常のNATを続ける
+var errNoNat64Entry = errors.New("No nat64 entry")
+
+// NAT64のローカル側の索引のキー
+// natEntryKeyと同じくマッピングの動作に応じて通信相手のアドレスとポートもキーに含める
+type nat64EntryKey struct {
+	ipv6Addr     [16]byte
+	port         uint16
+	remoteIpAddr uint32
+	remotePort   uint16
+}
+
+/*
+NAT64のプレフィックスをパースする
+RFC 6052のプレフィックス長のうち/96だけに対応する
+*/
+func parseNat64Prefix(prefix string) ([16]byte, error) {
+	var addr [16]byte
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil || ip.To4() != nil || !strings.Contains(prefix, ":") {
+		return addr, fmt.Errorf("invalid nat64 prefix %q", prefix)
+	}
+	if ones, _ := ipnet.Mask.Size(); ones != 96 {
+		return addr, fmt.Errorf("invalid nat64 prefix %q, only /96 is supported", prefix)
+	}
+	copy(addr[:], ipnet.IP.To16())
+	return addr, nil
+}
+
+/*
+NAT64のプレフィックス宛てのアドレスか確認する
+*/
+func (natdevice natDevice) isNat64Addr(ipaddr [16]byte) bool {
+	return natdevice.nat64 && bytes.Equal(ipaddr[:12], natdevice.nat64Prefix[:12])
+}
+
+/*
+IPv4アドレスをNAT64のプレフィックスに埋め込んだIPv6アドレスにする
+*/
+func (natdevice natDevice) nat64SynthesizeAddr(ipaddr uint32) [16]byte {
+	addr := natdevice.nat64Prefix
+	copy(addr[12:], uint32ToByte(ipaddr))
+	return addr
+}
+
+/*
+NAT64のプレフィックスに埋め込まれたIPv4アドレスを取り出す
+*/
+func nat64ExtractAddr(ipaddr [16]byte) uint32 {
+	return byteToUint32(ipaddr[12:16])
+}
+
+/*
+マッピングの動作に応じてNAT64のローカル側の索引のキーを作る
+*/
+func (entry *natEntryList) localKey6(ipaddr [16]byte, port uint16, remoteIpAddr uint32, remotePort uint16) nat64EntryKey {
+	key := nat64EntryKey{ipv6Addr: ipaddr, port: port}
+	switch entry.mapping {
+	case natMappingAddressDependent:
+		key.remoteIpAddr = remoteIpAddr
+	case natMappingAddressAndPortDependent:
+		key.remoteIpAddr = remoteIpAddr
+		key.remotePort = remotePort
+	}
+	return key
+}
+
+/*
+内側のIPv6アドレスとポート, 通信相手のアドレスとポートからNAT64のエントリを取得
+*/
+func (entry *natEntryList) getNat64EntryByLocal(protoType natProtocolType, ipaddr [16]byte, port uint16, remoteIpAddr uint32, remotePort uint16) *natEntry {
+	if v, ok := entry.table(protoType).byLocal6[entry.localKey6(ipaddr, port, remoteIpAddr, remotePort)]; ok {
+		return v
+	}
+	// テーブルに一致するエントリがなかったら空のエントリを返す
+	return &natEntry{}
+}
+
+/*
+IPv4のNATと同じ外側のアドレスとポートを割り当て、NAT64のエントリを作成する
+空いているポートがなかったら空のエントリを返す
+*/
+func (entry *natEntryList) createNat64Entry(protoType natProtocolType, localIpAddr [16]byte, localPort uint16, remoteIpAddr uint32, remotePort uint16) *natEntry {
+	table := entry.table(protoType)
+	globalIpAddr, globalPort := entry.allocateGlobalPort(protoType, localIpAddr)
+	if globalPort == 0 {
+		return &natEntry{}
+	}
+
+	newEntry := &natEntry{
+		globalIpAddr:  globalIpAddr,
+		globalPort:    globalPort,
+		localPort:     localPort,
+		remoteIpAddr:  remoteIpAddr,
+		remotePort:    remotePort,
+		remotes:       make(map[natEntryKey]struct{}),
+		nat64:         true,
+		localIpv6Addr: localIpAddr,
+	}
+	table.byLocal6[entry.localKey6(localIpAddr, localPort, remoteIpAddr, remotePort)] = newEntry
+	table.byGlobal[natEntryKey{ipAddr: globalIpAddr, port: globalPort}] = newEntry
+	entry.logEvent(natEventSessionCreate, protoType, newEntry)
+	return newEntry
+}
+
+/*
+内側のIPv6のホストから外側のIPv4のホストへのパケットをIPv4に変換する (RFC 6146, RFC 7915 Section 5)
+変換したIPv4ヘッダとペイロードを返す
+*/
+func nat64ExecOutgoing(ipv6header *ipv6Header, payload []byte, natdevice natDevice) (ipHeader, []byte, error) {
+	ipheader := ipHeader{
+		version:   4,
+		headerLen: 20 / 4,
+		tos:       ipv6header.trafficClass,
+		// IPv6はルータで分割しないのでDFをつける
+		fragOffset: 2 << 13,
+		ttl:        ipv6header.hopLimit,
+		destAddr:   nat64ExtractAddr(ipv6header.destAddr),
+	}
+	if ipv6header.hopLimit <= 1 {
+		return ipheader, nil, fmt.Errorf("hop limit exceeded")
+	}
+
+	// 受信したバッファを書き換えないようにコピーしておく
+	packet := make([]byte, len(payload))
+	copy(packet, payload)
+
+	natdevice.natEntry.mutex.Lock()
+	defer natdevice.natEntry.mutex.Unlock()
+
+	switch ipv6header.nextHeader {
+	case IP_PROTOCOL_NUM_TCP, IP_PROTOCOL_NUM_UDP:
+		proto, _ := natProtocolTypeFromIP(ipv6header.nextHeader)
+		if (proto == tcp && len(packet) < 20) || (proto == udp && len(packet) < 8) {
+			return ipheader, nil, fmt.Errorf("%s packet is too short", proto)
+		}
+		srcPort := byteToUint16(packet[0:2])
+		destPort := byteToUint16(packet[2:4])
+		entry := natdevice.natEntry.getNat64EntryByLocal(proto, ipv6header.srcAddr, srcPort, ipheader.destAddr, destPort)
+		if entry.globalPort == 0 {
+			// NATエントリがなかったらエントリ作成
+			entry = natdevice.natEntry.createNat64Entry(proto, ipv6header.srcAddr, srcPort, ipheader.destAddr, destPort)
+			if entry.globalPort == 0 {
+				return ipheader, nil, fmt.Errorf("NAT table is full")
+			}
+			fmt.Printf("Now, nat64 entry local [%s]:%d to global %s:%d\n",
+				printIPv6Addr(entry.localIpv6Addr), entry.localPort, printIPAddr(entry.globalIpAddr), entry.globalPort)
+		}
+		entry.remotes[natEntryKey{ipAddr: ipheader.destAddr, port: destPort}] = struct{}{}
+		entry.touch(natdevice.natEntry.now(), IPV6_HEADER_LEN+len(payload))
+		if proto == tcp {
+			entry.updateTcpState(packet[13], outgoing)
+		}
+
+		ipheader.protocol = ipv6header.nextHeader
+		ipheader.srcAddr = entry.globalIpAddr
+		copy(packet[0:2], uint16ToByte(entry.globalPort))
+		setTransportChecksum(proto, packet, calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, ipheader.protocol, zeroTransportChecksum(proto, packet)))
+	case IP_PROTOCOL_NUM_ICMPV6:
+		ipheader.protocol = IP_PROTOCOL_NUM_ICMP
+		var err error
+		packet, err = nat64IcmpOutgoing(&ipheader, ipv6header, packet, natdevice)
+		if err != nil {
+			return ipheader, nil, err
+		}
+	default:
+		// 拡張ヘッダやフラグメントには対応しない
+		return ipheader, nil, fmt.Errorf("next header %d is not supported to nat64", ipv6header.nextHeader)
+	}
+
+	ipheader.totalLen = uint16(20 + len(packet))
+	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+	return ipheader, packet, nil
+}
+
+/*
+外側のIPv4のホストから内側のIPv6のホストへのパケットをIPv6に変換する (RFC 6146, RFC 7915 Section 4)
+宛先がNAT64のエントリでなければerrNoNat64Entryを返す
+*/
+func nat64ExecIncoming(ipheader *ipHeader, payload []byte, natdevice natDevice) (ipv6Header, []byte, error) {
+	ipv6header := ipv6Header{
+		version:      6,
+		trafficClass: ipheader.tos,
+		srcAddr:      natdevice.nat64SynthesizeAddr(ipheader.srcAddr),
+	}
+
+	// 受信したバッファを書き換えないようにコピーしておく
+	packet := make([]byte, len(payload))
+	copy(packet, payload)
+
+	natdevice.natEntry.mutex.Lock()
+	defer natdevice.natEntry.mutex.Unlock()
+
+	switch ipheader.protocol {
+	case IP_PROTOCOL_NUM_TCP, IP_PROTOCOL_NUM_UDP:
+		proto, _ := natProtocolTypeFromIP(ipheader.protocol)
+		if (proto == tcp && len(packet) < 20) || (proto == udp && len(packet) < 8) {
+			return ipv6header, nil, errNoNat64Entry
+		}
+		srcPort := byteToUint16(packet[0:2])
+		entry := natdevice.natEntry.getNatEntryByGlobal(proto, ipheader.destAddr, byteToUint16(packet[2:4]))
+		if entry.globalPort == 0 || !entry.nat64 {
+			return ipv6header, nil, errNoNat64Entry
+		}
+		if err := nat64CheckIncoming(ipheader); err != nil {
+			return ipv6header, nil, err
+		}
+		if !natdevice.natFilterAllows(entry, ipheader.srcAddr, srcPort) {
+			return ipv6header, nil, fmt.Errorf("filtered by nat64 from %s:%d", printIPAddr(ipheader.srcAddr), srcPort)
+		}
+		fmt.Printf("incoming nat64 from %s:%d to [%s]:%d\n",
+			printIPAddr(entry.globalIpAddr), entry.globalPort, printIPv6Addr(entry.localIpv6Addr), entry.localPort)
+		entry.touch(natdevice.natEntry.now(), int(ipheader.totalLen))
+		if proto == tcp {
+			entry.updateTcpState(packet[13], incoming)
+		}
+
+		ipv6header.nextHeader = ipheader.protocol
+		ipv6header.destAddr = entry.localIpv6Addr
+		copy(packet[2:4], uint16ToByte(entry.localPort))
+		// IPv6ではUDPのチェックサムも必須なので常に計算する
+		setTransportChecksum(proto, packet, calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, ipv6header.nextHeader, zeroTransportChecksum(proto, packet)))
+	case IP_PROTOCOL_NUM_ICMP:
+		var err error
+		packet, err = nat64IcmpIncoming(ipheader, &ipv6header, packet, natdevice)
+		if err != nil {
+			return ipv6header, nil, err
+		}
+	default:
+		return ipv6header, nil, errNoNat64Entry
+	}
+
+	ipv6header.payloadLen = uint16(len(packet))
+	ipv6header.hopLimit = ipheader.ttl - 1
+	return ipv6header, packet, nil
+}
+
+/*
+NAT64のエントリ宛てのIPv4パケットを変換できるか確認する
+*/
+func nat64CheckIncoming(ipheader *ipHeader) error {
+	// フラグメントは再構築しないので変換できない
+	if ipheader.fragOffset&0x3fff != 0 {
+		return fmt.Errorf("fragmented packet is not supported to nat64")
+	}
+	if ipheader.ttl <= 1 {
+		return fmt.Errorf("ttl exceeded")
+	}
+	return nil
+}
+
+/*
+TCPかUDPのチェックサムを0にしたパケットを返す
+*/
+func zeroTransportChecksum(proto natProtocolType, packet []byte) []byte {
+	if proto == tcp {
+		copy(packet[16:18], []byte{0x00, 0x00})
+	} else {
+		copy(packet[6:8], []byte{0x00, 0x00})
+	}
+	return packet
+}
+
+/*
+TCPかUDPのチェックサムをパケットにセットする
+*/
+func setTransportChecksum(proto natProtocolType, packet []byte, checksum uint16) {
+	if proto == tcp {
+		copy(packet[16:18], uint16ToByte(checksum))
+		return
+	}
+	// UDPのチェックサムの0は計算していないことを表すので0xffffにする
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	copy(packet[6:8], uint16ToByte(checksum))
+}
@@ -0,0 +1,359 @@
+package curo
+
+import (
+	"fmt"
+)
+
+// ICMPv4のエラーメッセージの最大長 (RFC 1812)
+const ICMP_ERROR_MAX_LEN = 576
+
+/*
+ICMPv6のタイプとコードをICMPv4に変換する (RFC 7915 Section 5.2)
+restはICMPヘッダの後ろの4byteで、MTUやポインタを変換する
+変換できないメッセージはエラーを返す
+*/
+func nat64IcmpTypeTo4(icmpType, icmpCode uint8, rest []byte) (uint8, uint8, []byte, error) {
+	rest4 := make([]byte, 4)
+	switch icmpType {
+	case ICMPV6_TYPE_DESTINATION_UNREACHABLE:
+		switch icmpCode {
+		case 0, 2, 3: // No route, Beyond scope, Address unreachable
+			return ICMP_TYPE_DESTINATION_UNREACHABLE, 1, rest4, nil
+		case 1: // Communication administratively prohibited
+			return ICMP_TYPE_DESTINATION_UNREACHABLE, 10, rest4, nil
+		case 4: // Port unreachable
+			return ICMP_TYPE_DESTINATION_UNREACHABLE, 3, rest4, nil
+		}
+	case ICMPV6_TYPE_PACKET_TOO_BIG:
+		// IPv4ヘッダはIPv6ヘッダより20byte短い
+		mtu := byteToUint32(rest) - 20
+		if mtu > 0xffff {
+			mtu = 0xffff
+		}
+		copy(rest4[2:4], uint16ToByte(uint16(mtu)))
+		return ICMP_TYPE_DESTINATION_UNREACHABLE, 4, rest4, nil
+	case ICMPV6_TYPE_TIME_EXCEEDED:
+		return ICMP_TYPE_TIME_EXCEEDED, icmpCode, rest4, nil
+	case ICMPV6_TYPE_PARAMETER_PROBLEM:
+		switch icmpCode {
+		case 0: // Erroneous header field
+			pointer, ok := nat64PointerTo4(byteToUint32(rest))
+			if !ok {
+				break
+			}
+			rest4[0] = pointer
+			return ICMP_TYPE_PARAMETER_PROBLEM, 0, rest4, nil
+		case 1: // Unrecognized Next Header
+			return ICMP_TYPE_DESTINATION_UNREACHABLE, 2, rest4, nil
+		}
+	}
+	return 0, 0, nil, fmt.Errorf("ICMPv6 type %d code %d is not supported to nat64", icmpType, icmpCode)
+}
+
+/*
+ICMPv4のタイプとコードをICMPv6に変換する (RFC 7915 Section 4.2)
+*/
+func nat64IcmpTypeTo6(icmpType, icmpCode uint8, rest []byte) (uint8, uint8, []byte, error) {
+	rest6 := make([]byte, 4)
+	switch icmpType {
+	case ICMP_TYPE_DESTINATION_UNREACHABLE:
+		switch icmpCode {
+		case 0, 1, 5, 6, 7, 8, 11, 12: // Net, Host unreachableなど
+			return ICMPV6_TYPE_DESTINATION_UNREACHABLE, 0, rest6, nil
+		case 2: // Protocol unreachable
+			// IPv6ヘッダのNext Headerの位置を指す
+			copy(rest6, uint32ToByte(6))
+			return ICMPV6_TYPE_PARAMETER_PROBLEM, 1, rest6, nil
+		case 3: // Port unreachable
+			return ICMPV6_TYPE_DESTINATION_UNREACHABLE, 4, rest6, nil
+		case 4: // Fragmentation needed
+			// IPv6ヘッダはIPv4ヘッダより20byte長く、IPv6の最小MTUより小さくはしない
+			mtu := uint32(byteToUint16(rest[2:4])) + 20
+			if mtu < IPV6_MIN_MTU {
+				mtu = IPV6_MIN_MTU
+			}
+			copy(rest6, uint32ToByte(mtu))
+			return ICMPV6_TYPE_PACKET_TOO_BIG, 0, rest6, nil
+		case 9, 10, 13, 15: // Administratively prohibitedなど
+			return ICMPV6_TYPE_DESTINATION_UNREACHABLE, 1, rest6, nil
+		}
+	case ICMP_TYPE_TIME_EXCEEDED:
+		return ICMPV6_TYPE_TIME_EXCEEDED, icmpCode, rest6, nil
+	case ICMP_TYPE_PARAMETER_PROBLEM:
+		if icmpCode == 0 || icmpCode == 2 {
+			pointer, ok := nat64PointerTo6(rest[0])
+			if !ok {
+				break
+			}
+			copy(rest6, uint32ToByte(pointer))
+			return ICMPV6_TYPE_PARAMETER_PROBLEM, 0, rest6, nil
+		}
+	}
+	return 0, 0, nil, fmt.Errorf("ICMP type %d code %d is not supported to nat64", icmpType, icmpCode)
+}
+
+/*
+IPv6ヘッダの問題のある位置をIPv4ヘッダの位置に変換する
+*/
+func nat64PointerTo4(pointer uint32) (uint8, bool) {
+	switch {
+	case pointer == 0: // Version/Traffic Class
+		return 0, true
+	case pointer == 1: // Traffic Class/Flow Label
+		return 1, true
+	case pointer == 4 || pointer == 5: // Payload Length
+		return 2, true
+	case pointer == 6: // Next Header
+		return 9, true
+	case pointer == 7: // Hop Limit
+		return 8, true
+	case 8 <= pointer && pointer <= 23: // Source Address
+		return 12, true
+	case 24 <= pointer && pointer <= 39: // Destination Address
+		return 16, true
+	}
+	return 0, false
+}
+
+/*
+IPv4ヘッダの問題のある位置をIPv6ヘッダの位置に変換する
+*/
+func nat64PointerTo6(pointer uint8) (uint32, bool) {
+	switch {
+	case pointer == 0: // Version/IHL
+		return 0, true
+	case pointer == 1: // Type Of Service
+		return 1, true
+	case pointer == 2 || pointer == 3: // Total Length
+		return 4, true
+	case pointer == 8: // Time to Live
+		return 7, true
+	case pointer == 9: // Protocol
+		return 6, true
+	case 12 <= pointer && pointer <= 15: // Source Address
+		return 8, true
+	case 16 <= pointer && pointer <= 19: // Destination Address
+		return 24, true
+	}
+	return 0, false
+}
+
+/*
+内側のIPv6のホストから送られたICMPv6をICMPv4に変換する
+エコーリクエストは識別子をポート番号の代わりに使い、エラーメッセージは中に入っている元のパケットも変換する
+*/
+func nat64IcmpOutgoing(ipheader *ipHeader, ipv6header *ipv6Header, packet []byte, natdevice natDevice) ([]byte, error) {
+	if len(packet) < 8 {
+		return nil, fmt.Errorf("ICMPv6 packet is too short")
+	}
+
+	switch packet[0] {
+	case ICMPV6_TYPE_ECHO_REQUEST:
+		identify := byteToUint16(packet[4:6])
+		entry := natdevice.natEntry.getNat64EntryByLocal(icmp, ipv6header.srcAddr, identify, ipheader.destAddr, 0)
+		if entry.globalPort == 0 {
+			// NATエントリがなかったらエントリ作成
+			entry = natdevice.natEntry.createNat64Entry(icmp, ipv6header.srcAddr, identify, ipheader.destAddr, 0)
+			if entry.globalPort == 0 {
+				return nil, fmt.Errorf("NAT table is full")
+			}
+			fmt.Printf("Now, icmp nat64 entry local [%s]:%d to global %s:%d\n",
+				printIPv6Addr(entry.localIpv6Addr), entry.localPort, printIPAddr(entry.globalIpAddr), entry.globalPort)
+		}
+		entry.touch(natdevice.natEntry.now(), IPV6_HEADER_LEN+int(ipv6header.payloadLen))
+		entry.remotes[natEntryKey{ipAddr: ipheader.destAddr}] = struct{}{}
+		// タイプと識別子をIPv4のものにする
+		packet[0] = ICMP_TYPE_ECHO_REQUEST
+		copy(packet[4:6], uint16ToByte(entry.globalPort))
+		ipheader.srcAddr = entry.globalIpAddr
+	case ICMPV6_TYPE_DESTINATION_UNREACHABLE, ICMPV6_TYPE_PACKET_TOO_BIG, ICMPV6_TYPE_TIME_EXCEEDED, ICMPV6_TYPE_PARAMETER_PROBLEM:
+		var err error
+		packet, err = nat64IcmpErrorOutgoing(ipheader, packet, natdevice)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("ICMPv6 type %d is not supported to nat64", packet[0])
+	}
+
+	// ICMPv4のチェックサムは疑似ヘッダを含まないのでメッセージ全体で計算し直す
+	packet[2] = 0
+	packet[3] = 0
+	checksum := calcChecksum(packet)
+	packet[2] = checksum[0]
+	packet[3] = checksum[1]
+	return packet, nil
+}
+
+/*
+ICMPv6のエラーメッセージをICMPv4に変換する
+中に入っているのは外側から届いてIPv6に変換したパケットなので、送信元を外側のアドレス、宛先をグローバルの値に戻す
+*/
+func nat64IcmpErrorOutgoing(ipheader *ipHeader, packet []byte, natdevice natDevice) ([]byte, error) {
+	icmpType, icmpCode, rest, err := nat64IcmpTypeTo4(packet[0], packet[1], packet[4:8])
+	if err != nil {
+		return nil, err
+	}
+	inner := packet[8:]
+	if len(inner) < IPV6_HEADER_LEN+8 {
+		return nil, fmt.Errorf("ICMPv6 error message is too short")
+	}
+	var innerHeader ipv6Header
+	innerHeader, err = innerHeader.ParsePacket(inner)
+	if err != nil {
+		return nil, err
+	}
+	// ICMPv6のエコーはリプライにエラーを返さないので、TCPとUDPだけを変換する
+	if innerHeader.nextHeader != IP_PROTOCOL_NUM_TCP && innerHeader.nextHeader != IP_PROTOCOL_NUM_UDP {
+		return nil, fmt.Errorf("ICMPv6 error for next header %d is not supported to nat64", innerHeader.nextHeader)
+	}
+	proto, _ := natProtocolTypeFromIP(innerHeader.nextHeader)
+	transport := inner[IPV6_HEADER_LEN:]
+	remoteIpAddr := nat64ExtractAddr(innerHeader.srcAddr)
+	entry := natdevice.natEntry.getNat64EntryByLocal(proto, innerHeader.destAddr, byteToUint16(transport[2:4]),
+		remoteIpAddr, byteToUint16(transport[0:2]))
+	if entry.globalPort == 0 {
+		return nil, fmt.Errorf("No nat64 entry")
+	}
+
+	innerIpHeader := ipHeader{
+		version:    4,
+		headerLen:  20 / 4,
+		tos:        innerHeader.trafficClass,
+		totalLen:   20 + innerHeader.payloadLen,
+		fragOffset: 2 << 13,
+		ttl:        innerHeader.hopLimit,
+		protocol:   innerHeader.nextHeader,
+		srcAddr:    remoteIpAddr,
+		destAddr:   entry.globalIpAddr,
+	}
+	copy(transport[2:4], uint16ToByte(entry.globalPort))
+
+	message := []byte{icmpType, icmpCode, 0x00, 0x00}
+	message = append(message, rest...)
+	message = append(message, innerIpHeader.ToPacket(true)...)
+	message = append(message, transport...)
+	// ICMPv4のエラーメッセージは576byteを超えないようにする
+	if 20+len(message) > ICMP_ERROR_MAX_LEN {
+		message = message[:ICMP_ERROR_MAX_LEN-20]
+	}
+	// 内側のホストが送ったエラーでもIPv6のアドレスは外に出せないので送信元はグローバルにする
+	ipheader.srcAddr = entry.globalIpAddr
+	return message, nil
+}
+
+/*
+外側のIPv4のホストから届いたICMPv4をICMPv6に変換する
+NAT64のエントリ宛てでなければerrNoNat64Entryを返す
+*/
+func nat64IcmpIncoming(ipheader *ipHeader, ipv6header *ipv6Header, packet []byte, natdevice natDevice) ([]byte, error) {
+	if len(packet) < 8 {
+		return nil, errNoNat64Entry
+	}
+
+	switch packet[0] {
+	case ICMP_TYPE_ECHO_REPLY:
+		entry := natdevice.natEntry.getNatEntryByGlobal(icmp, ipheader.destAddr, byteToUint16(packet[4:6]))
+		if entry.globalPort == 0 || !entry.nat64 {
+			return nil, errNoNat64Entry
+		}
+		if err := nat64CheckIncoming(ipheader); err != nil {
+			return nil, err
+		}
+		if !natdevice.natFilterAllows(entry, ipheader.srcAddr, 0) {
+			return nil, fmt.Errorf("filtered by nat64 from %s", printIPAddr(ipheader.srcAddr))
+		}
+		fmt.Printf("incoming icmp nat64 from %s:%d to [%s]:%d\n",
+			printIPAddr(entry.globalIpAddr), entry.globalPort, printIPv6Addr(entry.localIpv6Addr), entry.localPort)
+		entry.touch(natdevice.natEntry.now(), int(ipheader.totalLen))
+		// タイプと識別子をIPv6のものにする
+		packet[0] = ICMPV6_TYPE_ECHO_REPLY
+		copy(packet[4:6], uint16ToByte(entry.localPort))
+		ipv6header.destAddr = entry.localIpv6Addr
+	case ICMP_TYPE_DESTINATION_UNREACHABLE, ICMP_TYPE_TIME_EXCEEDED, ICMP_TYPE_PARAMETER_PROBLEM:
+		var err error
+		packet, err = nat64IcmpErrorIncoming(ipheader, ipv6header, packet, natdevice)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errNoNat64Entry
+	}
+
+	// ICMPv6のチェックサムは疑似ヘッダを含めて計算し直す
+	ipv6header.nextHeader = IP_PROTOCOL_NUM_ICMPV6
+	packet[2] = 0
+	packet[3] = 0
+	copy(packet[2:4], uint16ToByte(calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, IP_PROTOCOL_NUM_ICMPV6, packet)))
+	return packet, nil
+}
+
+/*
+ICMPv4のエラーメッセージをICMPv6に変換する
+中に入っているのは内側から送ってIPv4に変換したパケットなので、送信元を内側のIPv6アドレスとポートに戻す
+*/
+func nat64IcmpErrorIncoming(ipheader *ipHeader, ipv6header *ipv6Header, packet []byte, natdevice natDevice) ([]byte, error) {
+	inner := packet[8:]
+	if len(inner) < 20 {
+		return nil, errNoNat64Entry
+	}
+	innerHeaderLen := int(inner[0]&0x0f) * 4
+	if innerHeaderLen < 20 || len(inner) < innerHeaderLen+8 {
+		return nil, errNoNat64Entry
+	}
+	proto, ok := natProtocolTypeFromIP(inner[9])
+	if !ok {
+		return nil, errNoNat64Entry
+	}
+	transport := inner[innerHeaderLen:]
+	var port uint16
+	if proto == icmp {
+		port = byteToUint16(transport[4:6])
+	} else {
+		port = byteToUint16(transport[0:2])
+	}
+	entry := natdevice.natEntry.getNatEntryByGlobal(proto, byteToUint32(inner[12:16]), port)
+	if entry.globalPort == 0 || !entry.nat64 || entry.globalIpAddr != ipheader.destAddr {
+		return nil, errNoNat64Entry
+	}
+	if err := nat64CheckIncoming(ipheader); err != nil {
+		return nil, err
+	}
+	icmpType, icmpCode, rest, err := nat64IcmpTypeTo6(packet[0], packet[1], packet[4:8])
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("incoming icmp error nat64 from %s:%d to [%s]:%d\n",
+		printIPAddr(entry.globalIpAddr), entry.globalPort, printIPv6Addr(entry.localIpv6Addr), entry.localPort)
+
+	innerIpv6Header := ipv6Header{
+		version:      6,
+		trafficClass: inner[1],
+		payloadLen:   byteToUint16(inner[2:4]) - uint16(innerHeaderLen),
+		nextHeader:   inner[9],
+		hopLimit:     inner[8],
+		srcAddr:      entry.localIpv6Addr,
+		destAddr:     natdevice.nat64SynthesizeAddr(byteToUint32(inner[16:20])),
+	}
+	// 中のTCPやUDPのチェックサムは途中で切れていることがあるので変換しない
+	if proto == icmp {
+		innerIpv6Header.nextHeader = IP_PROTOCOL_NUM_ICMPV6
+		if transport[0] == ICMP_TYPE_ECHO_REQUEST {
+			transport[0] = ICMPV6_TYPE_ECHO_REQUEST
+		}
+		copy(transport[4:6], uint16ToByte(entry.localPort))
+	} else {
+		copy(transport[0:2], uint16ToByte(entry.localPort))
+	}
+
+	message := []byte{icmpType, icmpCode, 0x00, 0x00}
+	message = append(message, rest...)
+	message = append(message, innerIpv6Header.ToPacket()...)
+	message = append(message, transport...)
+	// ICMPv6のエラーメッセージはIPv6の最小MTUを超えないようにする
+	if IPV6_HEADER_LEN+len(message) > IPV6_MIN_MTU {
+		message = message[:IPV6_MIN_MTU-IPV6_HEADER_LEN]
+	}
+	ipv6header.destAddr = entry.localIpv6Addr
+	return message, nil
+}
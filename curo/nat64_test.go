@@ -0,0 +1,168 @@
+package curo
+
+import (
+	"net"
+	"testing"
+)
+
+// 内側のIPv6のホスト 2001:db8:1::2
+var testNat64LocalAddr = [16]byte{0x20, 0x01, 0x0d, 0xb8, 0x00, 0x01, 15: 0x02}
+
+const testNat64RemoteAddr uint32 = 0xc0a80202 // 192.168.2.2
+
+// テスト用にNAT64を有効にしたNATデバイスを作成する
+func newTestNat64Device(t *testing.T) natDevice {
+	prefix, err := parseNat64Prefix(NAT64_WELL_KNOWN_PREFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	natdev := newTestNatDevice()
+	natdev.nat64 = true
+	natdev.nat64Prefix = prefix
+	return natdev
+}
+
+// テスト用に内側のIPv6のホストからNAT64のプレフィックス宛てのパケットを変換する
+func sendTestNat64(t *testing.T, natdev natDevice, nextHeader uint8, payload []byte) (ipHeader, []byte) {
+	t.Helper()
+	ipv6header := ipv6Header{
+		version:    6,
+		payloadLen: uint16(len(payload)),
+		nextHeader: nextHeader,
+		hopLimit:   64,
+		srcAddr:    testNat64LocalAddr,
+		destAddr:   natdev.nat64SynthesizeAddr(testNat64RemoteAddr),
+	}
+	ipheader, packet, err := nat64ExecOutgoing(&ipv6header, payload, natdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipheader.destAddr != testNat64RemoteAddr || ipheader.srcAddr != testNatOutsideAddr {
+		t.Fatalf("nat64 outgoing is %s -> %s", printIPAddr(ipheader.srcAddr), printIPAddr(ipheader.destAddr))
+	}
+	if int(ipheader.totalLen) != 20+len(packet) || ipheader.ttl != 64 {
+		t.Fatalf("nat64 outgoing total length is %d, ttl is %d", ipheader.totalLen, ipheader.ttl)
+	}
+	return ipheader, packet
+}
+
+func TestParseNat64Prefix(t *testing.T) {
+	prefix, err := parseNat64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net.IP(prefix[:]).Equal(net.ParseIP("64:ff9b::")) {
+		t.Fatalf("prefix is %s", printIPv6Addr(prefix))
+	}
+	for _, invalid := range []string{"64:ff9b::/64", "192.168.0.0/24", "64:ff9b::"} {
+		if _, err := parseNat64Prefix(invalid); err == nil {
+			t.Errorf("parseNat64Prefix(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestNat64Udp(t *testing.T) {
+	natdev := newTestNat64Device(t)
+	// IPv4のホストと同じ外側のアドレスのポートを使う
+	v4entry := natdev.natEntry.createNatEntry(udp, testNatLocalAddr, 5000, testNat64RemoteAddr, 53)
+
+	datagram := (&udpHeader{srcPort: 5000, destPort: 53, length: 12}).ToPacket()
+	datagram = append(datagram, []byte("test")...)
+	ipheader, packet := sendTestNat64(t, natdev, IP_PROTOCOL_NUM_UDP, datagram)
+	globalPort := byteToUint16(packet[0:2])
+	if globalPort == v4entry.globalPort || byteToUint16(packet[2:4]) != 53 {
+		t.Fatalf("nat64 udp ports are %d -> %d", globalPort, byteToUint16(packet[2:4]))
+	}
+	if calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, IP_PROTOCOL_NUM_UDP, packet) != 0 {
+		t.Fatal("udp checksum of translated ipv4 packet is invalid")
+	}
+
+	// 外側からの応答はIPv6に戻す
+	reply := (&udpHeader{srcPort: 53, destPort: globalPort, length: 12}).ToPacket()
+	reply = append(reply, []byte("echo")...)
+	replyHeader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_UDP, ttl: 64, srcAddr: testNat64RemoteAddr, destAddr: testNatOutsideAddr}
+	ipv6header, packet, err := nat64ExecIncoming(&replyHeader, reply, natdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv6header.destAddr != testNat64LocalAddr || ipv6header.srcAddr != natdev.nat64SynthesizeAddr(testNat64RemoteAddr) {
+		t.Fatalf("nat64 incoming is %s -> %s", printIPv6Addr(ipv6header.srcAddr), printIPv6Addr(ipv6header.destAddr))
+	}
+	if byteToUint16(packet[2:4]) != 5000 || ipv6header.hopLimit != 63 || int(ipv6header.payloadLen) != len(packet) {
+		t.Fatalf("nat64 incoming port is %d, hop limit is %d", byteToUint16(packet[2:4]), ipv6header.hopLimit)
+	}
+	if calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, IP_PROTOCOL_NUM_UDP, packet) != 0 {
+		t.Fatal("udp checksum of translated ipv6 packet is invalid")
+	}
+
+	// IPv4のホストのエントリ宛てはNAT64では変換しない
+	replyHeader = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_UDP, ttl: 64, srcAddr: testNat64RemoteAddr, destAddr: testNatOutsideAddr}
+	reply = (&udpHeader{srcPort: 53, destPort: v4entry.globalPort, length: 8}).ToPacket()
+	if _, _, err := nat64ExecIncoming(&replyHeader, reply, natdev); err != errNoNat64Entry {
+		t.Fatalf("nat64 incoming to ipv4 entry err is %v", err)
+	}
+}
+
+func TestNat64IcmpEcho(t *testing.T) {
+	natdev := newTestNat64Device(t)
+
+	request := []byte{ICMPV6_TYPE_ECHO_REQUEST, 0, 0, 0, 0x12, 0x34, 0x00, 0x01, 'p', 'i', 'n', 'g'}
+	_, packet := sendTestNat64(t, natdev, IP_PROTOCOL_NUM_ICMPV6, request)
+	if packet[0] != ICMP_TYPE_ECHO_REQUEST || byteToUint16(calcChecksum(packet)) != 0 {
+		t.Fatalf("translated icmp is %x", packet)
+	}
+	identify := byteToUint16(packet[4:6])
+
+	reply := []byte{ICMP_TYPE_ECHO_REPLY, 0, 0, 0, 0, 0, 0x00, 0x01, 'p', 'i', 'n', 'g'}
+	copy(reply[4:6], uint16ToByte(identify))
+	replyHeader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, ttl: 64, srcAddr: testNat64RemoteAddr, destAddr: testNatOutsideAddr}
+	ipv6header, packet, err := nat64ExecIncoming(&replyHeader, reply, natdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipv6header.nextHeader != IP_PROTOCOL_NUM_ICMPV6 || packet[0] != ICMPV6_TYPE_ECHO_REPLY || byteToUint16(packet[4:6]) != 0x1234 {
+		t.Fatalf("translated icmpv6 is %x", packet)
+	}
+	if calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, IP_PROTOCOL_NUM_ICMPV6, packet) != 0 {
+		t.Fatal("icmpv6 checksum is invalid")
+	}
+}
+
+func TestNat64IcmpError(t *testing.T) {
+	natdev := newTestNat64Device(t)
+	datagram := (&udpHeader{srcPort: 5000, destPort: 53, length: 8}).ToPacket()
+	ipheader, packet := sendTestNat64(t, natdev, IP_PROTOCOL_NUM_UDP, datagram)
+
+	// 外側のホストからのポート到達不能に変換したパケットを入れて返す
+	unreachable := []byte{ICMP_TYPE_DESTINATION_UNREACHABLE, 3, 0, 0, 0, 0, 0, 0}
+	ipheader.headerChecksum = 0
+	unreachable = append(unreachable, ipheader.ToPacket(true)...)
+	unreachable = append(unreachable, packet...)
+	errorHeader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, ttl: 64, srcAddr: testNat64RemoteAddr, destAddr: testNatOutsideAddr}
+	ipv6header, message, err := nat64ExecIncoming(&errorHeader, unreachable, natdev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message[0] != ICMPV6_TYPE_DESTINATION_UNREACHABLE || message[1] != 4 || ipv6header.destAddr != testNat64LocalAddr {
+		t.Fatalf("translated icmpv6 error is %x", message)
+	}
+	var inner ipv6Header
+	inner, err = inner.ParsePacket(message[8:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.srcAddr != testNat64LocalAddr || inner.destAddr != natdev.nat64SynthesizeAddr(testNat64RemoteAddr) ||
+		byteToUint16(message[8+IPV6_HEADER_LEN:]) != 5000 {
+		t.Fatalf("translated inner packet is %x", message[8:])
+	}
+	if calcIPv6TransportChecksum(ipv6header.srcAddr, ipv6header.destAddr, IP_PROTOCOL_NUM_ICMPV6, message) != 0 {
+		t.Fatal("icmpv6 checksum is invalid")
+	}
+
+	// フラグメンテーションが必要なメッセージはPacket Too Bigにして、IPv6ヘッダの分MTUを増やす
+	tooBig := []byte{ICMP_TYPE_DESTINATION_UNREACHABLE, 4, 0, 0, 0, 0, 0x05, 0xc8}
+	icmpType, _, rest, err := nat64IcmpTypeTo6(tooBig[0], tooBig[1], tooBig[4:8])
+	if err != nil || icmpType != ICMPV6_TYPE_PACKET_TOO_BIG || byteToUint32(rest) != 1500 {
+		t.Fatalf("fragmentation needed is translated to type %d mtu %d", icmpType, byteToUint32(rest))
+	}
+}
@@ -0,0 +1,193 @@
+package curo
+
+import (
+	"fmt"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+/*
+NATのALG(Application Level Gateway)
+ペイロードにIPアドレスやポート番号を入れて送るプロトコルのために、
+NATの内側から外側へ出るTCPのペイロードを書き換えて関連する通信のエントリを作る
+*/
+type natAlg interface {
+	// ALGの名前
+	name() string
+	// 対象にするサーバのポート番号
+	port() uint16
+	// 内側から外側へ出るペイロードを書き換える
+	// 書き換えなかった場合はそのままのペイロードを返す
+	rewrite(ctx *natAlgContext, payload []byte) ([]byte, error)
+}
+
+// ALGの一覧
+var natAlgList = []natAlg{
+	ftpAlg{},
+}
+
+// ALGがペイロードを書き換える時に使う情報
+type natAlgContext struct {
+	natdevice    natDevice
+	entry        *natEntry // 制御用のコネクションのNATエントリ
+	localIpAddr  uint32
+	remoteIpAddr uint32
+}
+
+// シーケンス番号の補正をコネクションごとに持つためのキー
+type natSeqKey struct {
+	localPort    uint16
+	remoteIpAddr uint32
+	remotePort   uint16
+}
+
+// ペイロードの長さが変わった時のTCPのシーケンス番号の補正
+// Linuxのnf_conntrack_seqadjと同じく、補正した位置の前後でずらす量を持つ
+type natSeqAdjust struct {
+	correctionPos uint32 // ペイロードの長さを変えたセグメントの元のシーケンス番号
+	offsetBefore  int32  // correctionPosまでのセグメントをずらす量
+	offsetAfter   int32  // correctionPosより後のセグメントをずらす量
+}
+
+/*
+ポート番号から対象のALGを探す
+内側がクライアントなら通信相手のポート、内側がサーバなら内側のポートで判断する
+*/
+func findNatAlg(localPort, remotePort uint16) natAlg {
+	for _, alg := range natAlgList {
+		if alg.port() == localPort || alg.port() == remotePort {
+			return alg
+		}
+	}
+	return nil
+}
+
+/*
+ALGが書き換えたペイロードに合わせて、関連する通信を待ち受けるNATエントリを作る
+外側の通信相手からの接続をlocalIpAddr:localPortに届けるための外側のアドレスとポートを返す
+*/
+func (ctx *natAlgContext) expect(localIpAddr uint32, localPort uint16) (*natEntry, error) {
+	// 1対1の静的NATのホストはポートを変えずにアドレスだけ変換する
+	if oneToOne := ctx.natdevice.natEntry.pool.oneToOneEntry(localIpAddr, localPort, outgoing); oneToOne != nil {
+		return oneToOne, nil
+	}
+	entry := ctx.natdevice.natEntry.getNatEntryByLocal(tcp, localIpAddr, localPort, ctx.remoteIpAddr, 0)
+	if entry.globalPort == 0 {
+		entry = ctx.natdevice.natEntry.createNatEntry(tcp, localIpAddr, localPort, ctx.remoteIpAddr, 0)
+		if entry.globalPort == 0 {
+			return nil, fmt.Errorf("NAT table is full")
+		}
+		entry.lastSeen = ctx.natdevice.natEntry.now()
+		fmt.Printf("Expect nat entry local %s:%d to global %s:%d from %s\n",
+			printIPAddr(entry.localIpAddr), entry.localPort, printIPAddr(entry.globalIpAddr), entry.globalPort,
+			printIPAddr(ctx.remoteIpAddr))
+	}
+	// 通信相手はポートが分からないので、フィルタリングも内側からの応答もアドレスが一致すれば同じエントリを使う
+	entry.expected = true
+	entry.remotes[natEntryKey{ipAddr: ctx.remoteIpAddr}] = struct{}{}
+	return entry, nil
+}
+
+/*
+コネクションごとのシーケンス番号の補正を返す
+*/
+func (entry *natEntry) seqAdjust(remoteIpAddr uint32, remotePort uint16) *natSeqAdjust {
+	if entry.algSeq == nil {
+		entry.algSeq = make(map[natSeqKey]*natSeqAdjust)
+	}
+	key := natSeqKey{localPort: entry.localPort, remoteIpAddr: remoteIpAddr, remotePort: remotePort}
+	adjust, ok := entry.algSeq[key]
+	if !ok {
+		adjust = &natSeqAdjust{}
+		entry.algSeq[key] = adjust
+	}
+	return adjust
+}
+
+/*
+内側から送るセグメントのシーケンス番号を補正する
+*/
+func (adjust *natSeqAdjust) adjustSeq(seq uint32) uint32 {
+	if int32(seq-adjust.correctionPos) > 0 {
+		return seq + uint32(adjust.offsetAfter)
+	}
+	return seq + uint32(adjust.offsetBefore)
+}
+
+/*
+外側から届くセグメントの確認応答番号を補正する
+*/
+func (adjust *natSeqAdjust) adjustAck(ack uint32) uint32 {
+	if int32(ack-uint32(adjust.offsetBefore)-adjust.correctionPos) > 0 {
+		return ack - uint32(adjust.offsetAfter)
+	}
+	return ack - uint32(adjust.offsetBefore)
+}
+
+/*
+シーケンス番号seqのセグメントのペイロードの長さがdeltaだけ変わったことを記録する
+*/
+func (adjust *natSeqAdjust) update(seq uint32, delta int32) {
+	if adjust.offsetBefore == adjust.offsetAfter || int32(seq-adjust.correctionPos) > 0 {
+		adjust.correctionPos = seq
+		adjust.offsetBefore = adjust.offsetAfter
+	}
+	adjust.offsetAfter += delta
+}
+
+/*
+アドレス変換したTCPのセグメントにALGを適用する
+内側から外側へのセグメントはペイロードを書き換えてシーケンス番号を補正し、
+外側から内側へのセグメントは確認応答番号を補正する
+セグメントを変更したらtrueを返す
+*/
+func natAlgExec(ipheader *ipHeader, tcpheader *tcpHeader, natdevice natDevice, entry *natEntry, direction natDirectionType) (bool, error) {
+	var alg natAlg
+	if direction == incoming {
+		alg = findNatAlg(entry.localPort, tcpheader.srcPort)
+	} else {
+		alg = findNatAlg(entry.localPort, tcpheader.destPort)
+	}
+	if alg == nil {
+		return false, nil
+	}
+
+	if direction == incoming {
+		adjust, ok := entry.algSeq[natSeqKey{localPort: entry.localPort, remoteIpAddr: ipheader.srcAddr, remotePort: tcpheader.srcPort}]
+		if !ok || tcpheader.tcpflag&TCP_FLAG_ACK == 0 || (adjust.offsetBefore == 0 && adjust.offsetAfter == 0) {
+			return false, nil
+		}
+		tcpheader.ackseq = adjust.adjustAck(tcpheader.ackseq)
+		return true, nil
+	}
+
+	adjust := entry.seqAdjust(ipheader.destAddr, tcpheader.destPort)
+	seq := tcpheader.seq
+	changed := adjust.offsetAfter != 0 || adjust.offsetBefore != 0
+	if len(tcpheader.tcpdata) != 0 {
+		ctx := &natAlgContext{
+			natdevice:    natdevice,
+			entry:        entry,
+			localIpAddr:  entry.localIpAddr,
+			remoteIpAddr: ipheader.destAddr,
+		}
+		payload, err := alg.rewrite(ctx, tcpheader.tcpdata)
+		if err != nil {
+			return false, fmt.Errorf("%s alg err : %s", alg.name(), err)
+		}
+		if delta := len(payload) - len(tcpheader.tcpdata); delta != 0 {
+			adjust.update(seq, int32(delta))
+			// IPヘッダのチェックサムもトータル長の差分で計算し直す
+			totalLen := uint16(int(ipheader.totalLen) + delta)
+			ipheader.headerChecksum = checksum.Adjust(ipheader.headerChecksum, ipheader.totalLen, totalLen)
+			ipheader.totalLen = totalLen
+		}
+		if string(payload) != string(tcpheader.tcpdata) {
+			fmt.Printf("%s alg rewrite %q to %q\n", alg.name(), tcpheader.tcpdata, payload)
+			tcpheader.tcpdata = payload
+			changed = true
+		}
+	}
+	tcpheader.seq = adjust.adjustSeq(seq)
+	return changed, nil
+}
@@ -0,0 +1,168 @@
+package curo
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const FTP_CONTROL_PORT uint16 = 21
+
+// PORTと227で使う h1,h2,h3,h4,p1,p2 の形式のアドレスとポート
+var ftpHostPortRegexp = regexp.MustCompile(`(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3}),(\d{1,3})`)
+
+// 229で使う (|||port|) の形式のポート
+var ftpEpsvRegexp = regexp.MustCompile(`\(([!-~])([!-~])([!-~])(\d{1,5})([!-~])\)`)
+
+/*
+FTPのALG
+内側のクライアントが送るPORT, EPRTと、内側のサーバが返す227, 229のアドレスとポートを
+外側のアドレスとポートに書き換えて、データコネクションのためのNATエントリを作る
+*/
+type ftpAlg struct{}
+
+func (ftpAlg) name() string {
+	return "FTP"
+}
+
+func (ftpAlg) port() uint16 {
+	return FTP_CONTROL_PORT
+}
+
+func (alg ftpAlg) rewrite(ctx *natAlgContext, payload []byte) ([]byte, error) {
+	// 書き換えるのは先頭の1行だけ
+	end := strings.Index(string(payload), "\r\n")
+	if end == -1 {
+		return payload, nil
+	}
+	line := string(payload[:end])
+	rest := string(payload[end:])
+
+	var newLine string
+	var err error
+	command := strings.ToUpper(line)
+	switch {
+	case strings.HasPrefix(command, "PORT "), strings.HasPrefix(command, "227 "):
+		newLine, err = alg.rewriteHostPort(ctx, line)
+	case strings.HasPrefix(command, "EPRT "):
+		newLine, err = alg.rewriteEprt(ctx, line)
+	case strings.HasPrefix(command, "229 "):
+		newLine, err = alg.rewriteEpsv(ctx, line)
+	default:
+		return payload, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(newLine + rest), nil
+}
+
+/*
+PORTと227の h1,h2,h3,h4,p1,p2 を書き換える
+*/
+func (ftpAlg) rewriteHostPort(ctx *natAlgContext, line string) (string, error) {
+	match := ftpHostPortRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return "", fmt.Errorf("invalid host port %q", line)
+	}
+	var values [6]uint32
+	for i := range values {
+		v, err := strconv.ParseUint(line[match[2+i*2]:match[3+i*2]], 10, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid host port %q", line)
+		}
+		values[i] = uint32(v)
+	}
+	addr := values[0]<<24 | values[1]<<16 | values[2]<<8 | values[3]
+	port := uint16(values[4]<<8 | values[5])
+	// 内側のホスト自身のアドレスでなければ書き換えない
+	if addr != ctx.localIpAddr {
+		return line, nil
+	}
+
+	entry, err := ctx.expect(addr, port)
+	if err != nil {
+		return "", err
+	}
+	global := uint32ToByte(entry.globalIpAddr)
+	hostPort := fmt.Sprintf("%d,%d,%d,%d,%d,%d",
+		global[0], global[1], global[2], global[3], entry.globalPort>>8, entry.globalPort&0xff)
+	return line[:match[0]] + hostPort + line[match[1]:], nil
+}
+
+/*
+EPRT |1|addr|port| を書き換える
+*/
+func (ftpAlg) rewriteEprt(ctx *natAlgContext, line string) (string, error) {
+	arg := strings.TrimSpace(line[len("EPRT "):])
+	if len(arg) < 2 {
+		return "", fmt.Errorf("invalid EPRT %q", line)
+	}
+	delimiter := arg[:1]
+	fields := strings.Split(arg, delimiter)
+	// 区切り文字で始まって終わるので |1|addr|port| は5つに分かれる
+	if len(fields) != 5 {
+		return "", fmt.Errorf("invalid EPRT %q", line)
+	}
+	// IPv4以外は書き換えない
+	if fields[1] != "1" {
+		return line, nil
+	}
+	ip := parseIPv4(fields[2])
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if ip == 0 || err != nil {
+		return "", fmt.Errorf("invalid EPRT %q", line)
+	}
+	if ip != ctx.localIpAddr {
+		return line, nil
+	}
+
+	entry, err := ctx.expect(ip, uint16(port))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %s1%s%s%s%d%s", line[:len("EPRT")], delimiter, delimiter,
+		printIPAddr(entry.globalIpAddr), delimiter, entry.globalPort, delimiter), nil
+}
+
+/*
+229 Entering Extended Passive Mode (|||port|) のポートを書き換える
+アドレスは制御用のコネクションと同じなのでポートだけ変える
+*/
+func (ftpAlg) rewriteEpsv(ctx *natAlgContext, line string) (string, error) {
+	match := ftpEpsvRegexp.FindStringSubmatchIndex(line)
+	if match == nil {
+		return "", fmt.Errorf("invalid EPSV response %q", line)
+	}
+	port, err := strconv.ParseUint(line[match[8]:match[9]], 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid EPSV response %q", line)
+	}
+
+	entry, err := ctx.expect(ctx.localIpAddr, uint16(port))
+	if err != nil {
+		return "", err
+	}
+	return line[:match[8]] + strconv.Itoa(int(entry.globalPort)) + line[match[9]:], nil
+}
+
+/*
+ドット区切りのIPv4アドレスをパースする
+パースできなければ0を返す
+*/
+func parseIPv4(addr string) uint32 {
+	fields := strings.Split(addr, ".")
+	if len(fields) != 4 {
+		return 0
+	}
+	var ip uint32
+	for _, field := range fields {
+		v, err := strconv.ParseUint(field, 10, 8)
+		if err != nil {
+			return 0
+		}
+		ip = ip<<8 | uint32(v)
+	}
+	return ip
+}
@@ -0,0 +1,200 @@
+package curo
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testFtpServerAddr uint32 = 0x08080808 // 8.8.8.8
+
+// テスト用にTCPセグメントをNATして変換後のIPヘッダとセグメントを返す
+func sendTestNatTcp(t *testing.T, natdev natDevice, srcAddr, destAddr uint32, segment tcpHeader, direction natDirectionType) (ipHeader, tcpHeader) {
+	t.Helper()
+	segment.offset = 5 << 4
+	packet := segment.ToPacket()
+	ipheader := ipHeader{version: 4, headerLen: 20 / 4, protocol: IP_PROTOCOL_NUM_TCP, totalLen: uint16(20 + len(packet)), ttl: 64, srcAddr: srcAddr, destAddr: destAddr}
+	ipheader.headerChecksum = byteToUint16(calcChecksum(ipheader.ToPacket(false)))
+	translated, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, tcp, direction)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(ipheader.totalLen) != 20+len(translated) {
+		t.Fatalf("total length is %d, segment is %d bytes", ipheader.totalLen, len(translated))
+	}
+	// ALGがペイロードの長さを変えてもIPヘッダのチェックサムは正しい
+	if byteToUint16(calcChecksum(ipheader.ToPacket(false))) != 0 {
+		t.Fatalf("ip header checksum is invalid, total length is %d", ipheader.totalLen)
+	}
+	var header tcpHeader
+	header, err = header.ParsePacket(translated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipheader, header
+}
+
+func TestNatFtpAlgPort(t *testing.T) {
+	natdev := newTestNatDevice()
+	// 外からのデータコネクションはALGが作ったエントリでしか通らないようにする
+	natdev.filtering = natFilteringAddressAndPortDependent
+
+	sendTestNatTcp(t, natdev, testNatLocalAddr, testFtpServerAddr,
+		tcpHeader{srcPort: 40000, destPort: 21, seq: 999, tcpflag: TCP_FLAG_SYN}, outgoing)
+
+	// 内側のクライアントが192.168.1.2:50000で待ち受けることを伝える
+	command := "PORT 192,168,1,2,195,80\r\n"
+	ipheader, segment := sendTestNatTcp(t, natdev, testNatLocalAddr, testFtpServerAddr,
+		tcpHeader{srcPort: 40000, destPort: 21, seq: 1000, ackseq: 1, tcpflag: TCP_FLAG_ACK | TCP_FLAG_PSH, tcpdata: []byte(command)}, outgoing)
+	if sum := calcTransportChecksum(ipheader.srcAddr, ipheader.destAddr, IP_PROTOCOL_NUM_TCP, segment.ToPacket()); sum != 0 {
+		t.Fatalf("tcp checksum of rewritten segment is invalid")
+	}
+
+	data := natdev.natEntry.getNatEntryByLocal(tcp, testNatLocalAddr, 50000, testFtpServerAddr, 20)
+	if data.globalPort == 0 || !data.expected {
+		t.Fatal("expected entry for data connection is not created")
+	}
+	want := fmt.Sprintf("PORT 192,168,0,1,%d,%d\r\n", data.globalPort>>8, data.globalPort&0xff)
+	if string(segment.tcpdata) != want {
+		t.Fatalf("rewritten payload is %q, want %q", segment.tcpdata, want)
+	}
+	delta := uint32(len(want) - len(command))
+
+	// 書き換えた後のセグメントはシーケンス番号をずらす
+	_, segment = sendTestNatTcp(t, natdev, testNatLocalAddr, testFtpServerAddr,
+		tcpHeader{srcPort: 40000, destPort: 21, seq: 1000 + uint32(len(command)), ackseq: 1, tcpflag: TCP_FLAG_ACK}, outgoing)
+	if segment.seq != 1000+uint32(len(command))+delta {
+		t.Fatalf("seq is %d, want %d", segment.seq, 1000+uint32(len(command))+delta)
+	}
+
+	// サーバからの確認応答番号は元に戻す
+	control := natdev.natEntry.getNatEntryByLocal(tcp, testNatLocalAddr, 40000, testFtpServerAddr, 21)
+	_, segment = sendTestNatTcp(t, natdev, testFtpServerAddr, testNatOutsideAddr,
+		tcpHeader{srcPort: 21, destPort: control.globalPort, seq: 1, ackseq: 1000 + uint32(len(want)), tcpflag: TCP_FLAG_ACK}, incoming)
+	if segment.ackseq != 1000+uint32(len(command)) {
+		t.Fatalf("ack is %d, want %d", segment.ackseq, 1000+uint32(len(command)))
+	}
+
+	// サーバの20番からのデータコネクションがクライアントに届く
+	ipheader, segment = sendTestNatTcp(t, natdev, testFtpServerAddr, testNatOutsideAddr,
+		tcpHeader{srcPort: 20, destPort: data.globalPort, seq: 5000, tcpflag: TCP_FLAG_SYN}, incoming)
+	if ipheader.destAddr != testNatLocalAddr || segment.destPort != 50000 {
+		t.Fatalf("data connection is forwarded to %s:%d", printIPAddr(ipheader.destAddr), segment.destPort)
+	}
+}
+
+func TestNatFtpAlgRewrite(t *testing.T) {
+	tests := []struct {
+		payload string
+		// 期待する書き換え後のペイロード, %sは外側のアドレス, %dは外側のポート
+		want string
+	}{
+		{"EPRT |1|192.168.1.2|50000|\r\n", "EPRT |1|%s|%d|\r\n"},
+		{"227 Entering Passive Mode (192,168,1,2,195,80).\r\n", "227 Entering Passive Mode (%s,%d,%d).\r\n"},
+		{"229 Entering Extended Passive Mode (|||50000|)\r\n", "229 Entering Extended Passive Mode (|||%[2]d|)\r\n"},
+		// 内側のホスト以外のアドレスや他のコマンドは書き換えない
+		{"PORT 10,0,0,1,195,80\r\n", ""},
+		{"USER anonymous\r\n", ""},
+	}
+	for _, tt := range tests {
+		natdev := newTestNatDevice()
+		ctx := &natAlgContext{natdevice: natdev, localIpAddr: testNatLocalAddr, remoteIpAddr: testFtpServerAddr}
+		got, err := ftpAlg{}.rewrite(ctx, []byte(tt.payload))
+		if err != nil {
+			t.Fatalf("rewrite(%q) err : %s", tt.payload, err)
+		}
+		if tt.want == "" {
+			if string(got) != tt.payload {
+				t.Errorf("rewrite(%q) = %q, want unchanged", tt.payload, got)
+			}
+			continue
+		}
+		entry := natdev.natEntry.getNatEntryByLocal(tcp, testNatLocalAddr, 50000, testFtpServerAddr, 0)
+		if entry.globalPort == 0 {
+			t.Fatalf("rewrite(%q) did not create expected entry", tt.payload)
+		}
+		var want string
+		if strings.HasPrefix(tt.payload, "227") {
+			want = fmt.Sprintf(tt.want, strings.ReplaceAll(printIPAddr(entry.globalIpAddr), ".", ","), entry.globalPort>>8, entry.globalPort&0xff)
+		} else {
+			want = fmt.Sprintf(tt.want, printIPAddr(entry.globalIpAddr), entry.globalPort)
+		}
+		if string(got) != want {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.payload, got, want)
+		}
+	}
+}
+
+/*
+Address and Port-Dependentのマッピングとフィルタリングでも、
+ALGが作ったエントリでアクティブモードとパッシブモードのデータコネクションが通る
+*/
+func TestNatFtpAlgAddressAndPortDependent(t *testing.T) {
+	newNatdev := func() natDevice {
+		return natDevice{
+			outsideIpAddr: testNatOutsideAddr,
+			filtering:     natFilteringAddressAndPortDependent,
+			natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{mapping: natMappingAddressAndPortDependent}),
+		}
+	}
+
+	t.Run("active", func(t *testing.T) {
+		natdev := newNatdev()
+		sendTestNatTcp(t, natdev, testNatLocalAddr, testFtpServerAddr,
+			tcpHeader{srcPort: 40000, destPort: 21, seq: 999, tcpflag: TCP_FLAG_SYN}, outgoing)
+		_, segment := sendTestNatTcp(t, natdev, testNatLocalAddr, testFtpServerAddr,
+			tcpHeader{srcPort: 40000, destPort: 21, seq: 1000, ackseq: 1, tcpflag: TCP_FLAG_ACK | TCP_FLAG_PSH, tcpdata: []byte("PORT 192,168,1,2,195,80\r\n")}, outgoing)
+		var h1, h2, h3, h4, p1, p2 int
+		if _, err := fmt.Sscanf(string(segment.tcpdata), "PORT %d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1, &p2); err != nil {
+			t.Fatal(err)
+		}
+		globalPort := uint16(p1<<8 | p2)
+
+		// サーバは20番からつなぎに来る
+		ipheader, segment := sendTestNatTcp(t, natdev, testFtpServerAddr, testNatOutsideAddr,
+			tcpHeader{srcPort: 20, destPort: globalPort, seq: 5000, tcpflag: TCP_FLAG_SYN}, incoming)
+		if ipheader.destAddr != testNatLocalAddr || segment.destPort != 50000 {
+			t.Fatalf("data connection is forwarded to %s:%d", printIPAddr(ipheader.destAddr), segment.destPort)
+		}
+		// クライアントの応答は同じ外側のポートから出る
+		ipheader, segment = sendTestNatTcp(t, natdev, testNatLocalAddr, testFtpServerAddr,
+			tcpHeader{srcPort: 50000, destPort: 20, seq: 7000, ackseq: 5001, tcpflag: TCP_FLAG_SYN | TCP_FLAG_ACK}, outgoing)
+		if ipheader.srcAddr != testNatOutsideAddr || segment.srcPort != globalPort {
+			t.Fatalf("data connection reply is from %s:%d, want port %d", printIPAddr(ipheader.srcAddr), segment.srcPort, globalPort)
+		}
+	})
+
+	t.Run("passive", func(t *testing.T) {
+		natdev := newNatdev()
+		client := uint32(0x08080404)
+		if _, err := natdev.natEntry.createStaticNatEntry(tcp, testNatLocalAddr, 21, testNatOutsideAddr, 21); err != nil {
+			t.Fatal(err)
+		}
+		sendTestNatTcp(t, natdev, client, testNatOutsideAddr,
+			tcpHeader{srcPort: 40000, destPort: 21, seq: 999, tcpflag: TCP_FLAG_SYN}, incoming)
+		_, segment := sendTestNatTcp(t, natdev, testNatLocalAddr, client,
+			tcpHeader{srcPort: 21, destPort: 40000, seq: 1000, ackseq: 1000, tcpflag: TCP_FLAG_ACK | TCP_FLAG_PSH, tcpdata: []byte("229 Entering Extended Passive Mode (|||50000|)\r\n")}, outgoing)
+		var globalPort uint16
+		if _, err := fmt.Sscanf(string(segment.tcpdata), "229 Entering Extended Passive Mode (|||%d|)", &globalPort); err != nil {
+			t.Fatal(err)
+		}
+
+		// クライアントは任意のポートからPASVのポートにつなぎに来る
+		ipheader, segment := sendTestNatTcp(t, natdev, client, testNatOutsideAddr,
+			tcpHeader{srcPort: 40123, destPort: globalPort, seq: 5000, tcpflag: TCP_FLAG_SYN}, incoming)
+		if ipheader.destAddr != testNatLocalAddr || segment.destPort != 50000 {
+			t.Fatalf("data connection is forwarded to %s:%d", printIPAddr(ipheader.destAddr), segment.destPort)
+		}
+		ipheader, segment = sendTestNatTcp(t, natdev, testNatLocalAddr, client,
+			tcpHeader{srcPort: 50000, destPort: 40123, seq: 7000, ackseq: 5001, tcpflag: TCP_FLAG_SYN | TCP_FLAG_ACK}, outgoing)
+		if segment.srcPort != globalPort {
+			t.Fatalf("data connection reply is from port %d, want %d", segment.srcPort, globalPort)
+		}
+		// 別のアドレスからはつなげない
+		packet := (&tcpHeader{srcPort: 40124, destPort: globalPort, offset: 5 << 4, tcpflag: TCP_FLAG_SYN}).ToPacket()
+		ipheader = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_TCP, srcAddr: 0x08080808, destAddr: testNatOutsideAddr}
+		if _, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, tcp, incoming); err == nil {
+			t.Fatal("data connection from another addr is allowed")
+		}
+	})
+}
@@ -0,0 +1,449 @@
+package curo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 書き出しを待つNATのイベントの数, あふれたイベントは捨てる
+const NAT_LOG_QUEUE_SIZE = 4096
+
+type natEventType uint8
+
+const (
+	natEventSessionCreate natEventType = iota
+	natEventSessionDelete
+)
+
+// NATのセッションの作成と削除のイベント
+type natEvent struct {
+	time          time.Time
+	eventType     natEventType
+	proto         natProtocolType
+	nat64         bool
+	insideIpAddr  uint32
+	insideIpv6    [16]byte // NAT64の内側のIPv6アドレス
+	insidePort    uint16
+	outsideIpAddr uint32
+	outsidePort   uint16
+	remoteIpAddr  uint32
+	remoteIpv6    [16]byte // NAT64の通信相手のプレフィックスをつけたアドレス
+	remotePort    uint16
+	packets       uint64
+	bytes         uint64
+	static        bool // ポートフォワーディングか1対1の静的NATのセッション
+}
+
+/*
+NATのイベントの出力先
+*/
+type natEventSink interface {
+	writeEvent(event natEvent) error
+	// バッファにためたイベントを書き出す
+	flush() error
+	close() error
+}
+
+/*
+NATのイベントをすべての出力先に書き出す
+NATのロックを持ったまま書き込まないように、イベントはキューに入れて別のゴルーチンで書き出す
+*/
+type natEventLogger struct {
+	sinks       []natEventSink
+	nat64Prefix [16]byte      // NAT64の通信相手のIPv6アドレスを作るためのプレフィックス
+	events      chan natEvent // 書き出しを待つイベント
+	done        chan struct{} // 書き出すゴルーチンが終わったら閉じる
+	closeOnce   sync.Once
+	dropped     uint64 // キューがあふれて捨てたイベントの数
+}
+
+func (eventType natEventType) String() string {
+	if eventType == natEventSessionDelete {
+		return "delete"
+	}
+	return "create"
+}
+
+/*
+NATのイベントの出力先を作成する
+logPathにはJSON Linesで追記するファイル、ipfixAddrにはIPFIXのコレクタの"host:port"を指定する
+どちらも空ならnilを返す
+*/
+func newNatEventLogger(logPath, ipfixAddr string) (*natEventLogger, error) {
+	logger := &natEventLogger{}
+	if logPath != "" {
+		file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("open nat log err : %s", err)
+		}
+		logger.sinks = append(logger.sinks, newNatJsonSink(file))
+	}
+	if ipfixAddr != "" {
+		conn, err := net.Dial("udp", ipfixAddr)
+		if err != nil {
+			// 先に開いたログのファイルを閉じる
+			for _, sink := range logger.sinks {
+				sink.close()
+			}
+			return nil, fmt.Errorf("dial ipfix collector err : %s", err)
+		}
+		logger.sinks = append(logger.sinks, newNatIpfixExporter(conn))
+	}
+	if len(logger.sinks) == 0 {
+		return nil, nil
+	}
+	logger.start()
+	return logger, nil
+}
+
+/*
+イベントを書き出すゴルーチンを動かす
+*/
+func (logger *natEventLogger) start() {
+	logger.events = make(chan natEvent, NAT_LOG_QUEUE_SIZE)
+	logger.done = make(chan struct{})
+	go logger.run()
+}
+
+/*
+キューのイベントを出力先に書き出す
+続けて届いたイベントはまとめてからflushする
+*/
+func (logger *natEventLogger) run() {
+	defer close(logger.done)
+	for event := range logger.events {
+		for _, sink := range logger.sinks {
+			if err := sink.writeEvent(event); err != nil {
+				fmt.Printf("write nat event err : %s\n", err)
+			}
+		}
+		if len(logger.events) != 0 {
+			continue
+		}
+		for _, sink := range logger.sinks {
+			if err := sink.flush(); err != nil {
+				fmt.Printf("flush nat event err : %s\n", err)
+			}
+		}
+	}
+}
+
+/*
+キューに残っているイベントを書き出してから出力先を閉じる
+*/
+func (logger *natEventLogger) close() error {
+	if logger == nil {
+		return nil
+	}
+	var closeErr error
+	logger.closeOnce.Do(func() {
+		close(logger.events)
+		<-logger.done
+		for _, sink := range logger.sinks {
+			if err := sink.close(); err != nil && closeErr == nil {
+				closeErr = fmt.Errorf("close nat log err : %s", err)
+			}
+		}
+	})
+	return closeErr
+}
+
+/*
+NATエントリからイベントを作成する
+nowにはエントリと同じNATの時刻を渡すので、pcapのリプレイではキャプチャの時刻になる
+*/
+func newNatEvent(now time.Time, eventType natEventType, proto natProtocolType, entry *natEntry) natEvent {
+	return natEvent{
+		time:          now,
+		eventType:     eventType,
+		proto:         proto,
+		nat64:         entry.nat64,
+		insideIpAddr:  entry.localIpAddr,
+		insideIpv6:    entry.localIpv6Addr,
+		insidePort:    entry.localPort,
+		outsideIpAddr: entry.globalIpAddr,
+		outsidePort:   entry.globalPort,
+		remoteIpAddr:  entry.remoteIpAddr,
+		remotePort:    entry.remotePort,
+		packets:       entry.packets,
+		bytes:         entry.bytes,
+		static:        entry.static,
+	}
+}
+
+/*
+NATエントリのイベントをキューに入れる
+出力が追いつかなくてもパケットの処理は止めない
+*/
+func (logger *natEventLogger) logEvent(now time.Time, eventType natEventType, proto natProtocolType, entry *natEntry) {
+	if logger == nil {
+		return
+	}
+	event := newNatEvent(now, eventType, proto, entry)
+	if entry.nat64 {
+		event.remoteIpv6 = logger.nat64Prefix
+		copy(event.remoteIpv6[12:], uint32ToByte(entry.remoteIpAddr))
+	}
+	select {
+	case logger.events <- event:
+	default:
+		logger.dropped++
+		fmt.Printf("nat event queue is full, drop %s event\n", eventType)
+	}
+}
+
+// JSON Linesでイベントを書き出す出力先
+type natJsonSink struct {
+	writer *bufio.Writer
+	closer io.Closer // ファイルならCloseで閉じる
+}
+
+func newNatJsonSink(writer io.Writer) *natJsonSink {
+	sink := &natJsonSink{writer: bufio.NewWriter(writer)}
+	if closer, ok := writer.(io.Closer); ok {
+		sink.closer = closer
+	}
+	return sink
+}
+
+// JSON Linesの1行
+type natJsonEvent struct {
+	Time        string `json:"time"`
+	Event       string `json:"event"`
+	Proto       string `json:"proto"`
+	InsideAddr  string `json:"inside_addr"`
+	InsidePort  uint16 `json:"inside_port"`
+	OutsideAddr string `json:"outside_addr"`
+	OutsidePort uint16 `json:"outside_port"`
+	RemoteAddr  string `json:"remote_addr"`
+	RemotePort  uint16 `json:"remote_port"`
+	Packets     uint64 `json:"packets"`
+	Bytes       uint64 `json:"bytes"`
+	Static      bool   `json:"static,omitempty"`
+}
+
+func (sink *natJsonSink) writeEvent(event natEvent) error {
+	line := natJsonEvent{
+		Time:        event.time.UTC().Format(time.RFC3339Nano),
+		Event:       event.eventType.String(),
+		Proto:       event.proto.String(),
+		InsideAddr:  printIPAddr(event.insideIpAddr),
+		InsidePort:  event.insidePort,
+		OutsideAddr: printIPAddr(event.outsideIpAddr),
+		OutsidePort: event.outsidePort,
+		RemoteAddr:  printIPAddr(event.remoteIpAddr),
+		RemotePort:  event.remotePort,
+		Packets:     event.packets,
+		Bytes:       event.bytes,
+		Static:      event.static,
+	}
+	if event.nat64 {
+		line.InsideAddr = printIPv6Addr(event.insideIpv6)
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = sink.writer.Write(append(b, '\n'))
+	return err
+}
+
+func (sink *natJsonSink) flush() error {
+	return sink.writer.Flush()
+}
+
+func (sink *natJsonSink) close() error {
+	err := sink.writer.Flush()
+	if sink.closer != nil {
+		if closeErr := sink.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// IPFIX (RFC 7011) のNATイベント (RFC 8158)
+const (
+	IPFIX_VERSION                uint16 = 10
+	IPFIX_TEMPLATE_SET_ID        uint16 = 2
+	IPFIX_NAT44_TEMPLATE_ID      uint16 = 256
+	IPFIX_NAT64_TEMPLATE_ID      uint16 = 257
+	IPFIX_TEMPLATE_INTERVAL             = time.Minute // UDPではテンプレートを定期的に送り直す
+	IPFIX_NAT_EVENT_NAT44_CREATE uint8  = 4
+	IPFIX_NAT_EVENT_NAT44_DELETE uint8  = 5
+	IPFIX_NAT_EVENT_NAT64_CREATE uint8  = 6
+	IPFIX_NAT_EVENT_NAT64_DELETE uint8  = 7
+)
+
+// IPFIXの情報要素の番号と長さ
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// RFC 8158のNAT44とNAT64のセッションのテンプレートにカウンタを加えたもの
+var ipfixNat44Template = []ipfixField{
+	{323, 8}, // observationTimeMilliseconds
+	{230, 1}, // natEvent
+	{4, 1},   // protocolIdentifier
+	{8, 4},   // sourceIPv4Address
+	{225, 4}, // postNATSourceIPv4Address
+	{7, 2},   // sourceTransportPort
+	{227, 2}, // postNAPTSourceTransportPort
+	{12, 4},  // destinationIPv4Address
+	{226, 4}, // postNATDestinationIPv4Address
+	{11, 2},  // destinationTransportPort
+	{228, 2}, // postNAPTDestinationTransportPort
+	{86, 8},  // packetTotalCount
+	{85, 8},  // octetTotalCount
+}
+
+var ipfixNat64Template = []ipfixField{
+	{323, 8}, // observationTimeMilliseconds
+	{230, 1}, // natEvent
+	{4, 1},   // protocolIdentifier
+	{27, 16}, // sourceIPv6Address
+	{225, 4}, // postNATSourceIPv4Address
+	{7, 2},   // sourceTransportPort
+	{227, 2}, // postNAPTSourceTransportPort
+	{28, 16}, // destinationIPv6Address
+	{226, 4}, // postNATDestinationIPv4Address
+	{11, 2},  // destinationTransportPort
+	{228, 2}, // postNAPTDestinationTransportPort
+	{86, 8},  // packetTotalCount
+	{85, 8},  // octetTotalCount
+}
+
+// IPFIXのNATイベントをUDPでコレクタに送る出力先
+type natIpfixExporter struct {
+	conn         net.Conn
+	domainId     uint32
+	sequence     uint32    // これまでに送ったデータレコードの数
+	templateSent time.Time // 最後にテンプレートを送った時刻
+}
+
+func newNatIpfixExporter(conn net.Conn) *natIpfixExporter {
+	return &natIpfixExporter{conn: conn}
+}
+
+/*
+テンプレートセットを作る
+*/
+func ipfixTemplateSet() []byte {
+	var records bytes.Buffer
+	for _, template := range []struct {
+		id     uint16
+		fields []ipfixField
+	}{{IPFIX_NAT44_TEMPLATE_ID, ipfixNat44Template}, {IPFIX_NAT64_TEMPLATE_ID, ipfixNat64Template}} {
+		records.Write(uint16ToByte(template.id))
+		records.Write(uint16ToByte(uint16(len(template.fields))))
+		for _, field := range template.fields {
+			records.Write(uint16ToByte(field.id))
+			records.Write(uint16ToByte(field.length))
+		}
+	}
+	return ipfixSet(IPFIX_TEMPLATE_SET_ID, records.Bytes())
+}
+
+/*
+セットIDと長さのヘッダをつける
+*/
+func ipfixSet(setId uint16, records []byte) []byte {
+	var b bytes.Buffer
+	b.Write(uint16ToByte(setId))
+	b.Write(uint16ToByte(uint16(4 + len(records))))
+	b.Write(records)
+	return b.Bytes()
+}
+
+/*
+イベントをテンプレートに合わせたデータレコードにする
+*/
+func (exporter *natIpfixExporter) dataRecord(event natEvent) (uint16, []byte) {
+	var b bytes.Buffer
+	b.Write(uint32ToByte(uint32(uint64(event.time.UnixMilli()) >> 32)))
+	b.Write(uint32ToByte(uint32(event.time.UnixMilli())))
+	templateId := IPFIX_NAT44_TEMPLATE_ID
+	natEvent := IPFIX_NAT_EVENT_NAT44_CREATE
+	if event.nat64 {
+		templateId = IPFIX_NAT64_TEMPLATE_ID
+		natEvent = IPFIX_NAT_EVENT_NAT64_CREATE
+	}
+	if event.eventType == natEventSessionDelete {
+		natEvent++
+	}
+	b.Write([]byte{natEvent})
+	switch event.proto {
+	case tcp:
+		b.Write([]byte{IP_PROTOCOL_NUM_TCP})
+	case udp:
+		b.Write([]byte{IP_PROTOCOL_NUM_UDP})
+	default:
+		if event.nat64 {
+			b.Write([]byte{IP_PROTOCOL_NUM_ICMPV6})
+		} else {
+			b.Write([]byte{IP_PROTOCOL_NUM_ICMP})
+		}
+	}
+	if event.nat64 {
+		b.Write(event.insideIpv6[:])
+	} else {
+		b.Write(uint32ToByte(event.insideIpAddr))
+	}
+	b.Write(uint32ToByte(event.outsideIpAddr))
+	b.Write(uint16ToByte(event.insidePort))
+	b.Write(uint16ToByte(event.outsidePort))
+	// 通信相手のアドレスとポートは変換しない
+	if event.nat64 {
+		b.Write(event.remoteIpv6[:])
+	} else {
+		b.Write(uint32ToByte(event.remoteIpAddr))
+	}
+	b.Write(uint32ToByte(event.remoteIpAddr))
+	b.Write(uint16ToByte(event.remotePort))
+	b.Write(uint16ToByte(event.remotePort))
+	b.Write(uint32ToByte(uint32(event.packets >> 32)))
+	b.Write(uint32ToByte(uint32(event.packets)))
+	b.Write(uint32ToByte(uint32(event.bytes >> 32)))
+	b.Write(uint32ToByte(uint32(event.bytes)))
+	return templateId, b.Bytes()
+}
+
+func (exporter *natIpfixExporter) writeEvent(event natEvent) error {
+	var sets []byte
+	// 最初と一定時間ごとにテンプレートも一緒に送る
+	if event.time.Sub(exporter.templateSent) >= IPFIX_TEMPLATE_INTERVAL {
+		sets = append(sets, ipfixTemplateSet()...)
+		exporter.templateSent = event.time
+	}
+	templateId, record := exporter.dataRecord(event)
+	sets = append(sets, ipfixSet(templateId, record)...)
+
+	var b bytes.Buffer
+	b.Write(uint16ToByte(IPFIX_VERSION))
+	b.Write(uint16ToByte(uint16(16 + len(sets))))
+	b.Write(uint32ToByte(uint32(event.time.Unix())))
+	b.Write(uint32ToByte(exporter.sequence))
+	b.Write(uint32ToByte(exporter.domainId))
+	b.Write(sets)
+	exporter.sequence++
+
+	_, err := exporter.conn.Write(b.Bytes())
+	return err
+}
+
+// IPFIXのメッセージはイベントごとに送るのでためない
+func (exporter *natIpfixExporter) flush() error {
+	return nil
+}
+
+func (exporter *natIpfixExporter) close() error {
+	return exporter.conn.Close()
+}
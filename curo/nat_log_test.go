@@ -0,0 +1,179 @@
+package curo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNatEventJsonLines(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &natEventLogger{sinks: []natEventSink{newNatJsonSink(&buf)}}
+	logger.start()
+	// イベントの時刻はNATの時刻にする
+	now := time.Unix(1700000000, 0)
+	natdev := natDevice{
+		outsideIpAddr: testNatOutsideAddr,
+		natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{logger: logger, clock: func() time.Time { return now }}),
+	}
+
+	entry := natdev.natEntry.createNatEntry(udp, testNatLocalAddr, 5000, 0x08080808, 53)
+	entry.touch(time.Now(), 100)
+	entry.touch(time.Now(), 200)
+	natdev.natEntry.deleteNatEntry(udp, entry)
+	// 閉じるとキューに残っているイベントを書き出す
+	if err := natdev.natEntry.close(); err != nil {
+		t.Fatal(err)
+	}
+	// 閉じた後にパケットを処理してもイベントは出さない
+	natdev.natEntry.createNatEntry(udp, testNatLocalAddr, 5001, 0x08080808, 53)
+
+	var lines []natJsonEvent
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var line natJsonEvent
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0].Event != "create" || lines[1].Event != "delete" {
+		t.Fatalf("nat events are %+v", lines)
+	}
+	deleted := lines[1]
+	if deleted.Proto != "UDP" || deleted.InsideAddr != "192.168.1.2" || deleted.InsidePort != 5000 ||
+		deleted.OutsideAddr != "192.168.0.1" || deleted.OutsidePort != entry.globalPort ||
+		deleted.RemoteAddr != "8.8.8.8" || deleted.RemotePort != 53 {
+		t.Fatalf("delete event is %+v", deleted)
+	}
+	if deleted.Packets != 2 || deleted.Bytes != 300 || lines[0].Packets != 0 {
+		t.Fatalf("delete event counters are %d packets %d bytes", deleted.Packets, deleted.Bytes)
+	}
+	if eventTime, err := time.Parse(time.RFC3339Nano, deleted.Time); err != nil || !eventTime.Equal(now) {
+		t.Fatalf("delete event time is %s, want %s : %v", deleted.Time, now, err)
+	}
+}
+
+func TestNatEventIpfix(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	logger, err := newNatEventLogger("", collector.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.close()
+
+	entry := &natEntry{
+		localIpAddr:  testNatLocalAddr,
+		localPort:    5000,
+		globalIpAddr: testNatOutsideAddr,
+		globalPort:   20000,
+		remoteIpAddr: 0x08080808,
+		remotePort:   53,
+	}
+	logger.logEvent(time.Now(), natEventSessionCreate, tcp, entry)
+	entry.touch(time.Now(), 60)
+	logger.logEvent(time.Now(), natEventSessionDelete, tcp, entry)
+
+	buf := make([]byte, 1500)
+	collector.SetReadDeadline(time.Now().Add(time.Second))
+	for i, natEvent := range []uint8{IPFIX_NAT_EVENT_NAT44_CREATE, IPFIX_NAT_EVENT_NAT44_DELETE} {
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := buf[:n]
+		if byteToUint16(message[0:2]) != IPFIX_VERSION || int(byteToUint16(message[2:4])) != n ||
+			byteToUint32(message[8:12]) != uint32(i) {
+			t.Fatalf("ipfix header is %x", message[:16])
+		}
+		sets := message[16:]
+		// テンプレートは最初のメッセージにだけ含まれる
+		if i == 0 {
+			if byteToUint16(sets[0:2]) != IPFIX_TEMPLATE_SET_ID {
+				t.Fatalf("first set id is %d", byteToUint16(sets[0:2]))
+			}
+			sets = sets[byteToUint16(sets[2:4]):]
+		}
+		if byteToUint16(sets[0:2]) != IPFIX_NAT44_TEMPLATE_ID || int(byteToUint16(sets[2:4])) != len(sets) {
+			t.Fatalf("data set is %x", sets)
+		}
+		record := sets[4:]
+		if record[8] != natEvent || record[9] != IP_PROTOCOL_NUM_TCP {
+			t.Fatalf("nat event is %d, protocol is %d", record[8], record[9])
+		}
+		if byteToUint32(record[10:14]) != testNatLocalAddr || byteToUint32(record[14:18]) != testNatOutsideAddr ||
+			byteToUint16(record[18:20]) != 5000 || byteToUint16(record[20:22]) != 20000 ||
+			byteToUint32(record[22:26]) != 0x08080808 || byteToUint16(record[30:32]) != 53 {
+			t.Fatalf("nat44 record is %x", record)
+		}
+		if i == 1 && (byteToUint32(record[38:42]) != 1 || byteToUint32(record[46:50]) != 60) {
+			t.Fatalf("nat44 record counters are %x", record[34:50])
+		}
+	}
+}
+
+/*
+ポートフォワーディングと1対1の静的NATのセッションも作成と削除をログに出し、
+Closeでキューに残っているイベントを書き出してファイルを閉じる
+*/
+func TestNatEventStaticSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nat.log")
+	router := NewRouter("ch2")
+	router.addDevice(&netDevice{name: "router1-br0", ipdev: ipDevice{address: 0xc0a80101, netmask: 0xffffff00, broadcast: 0xc0a801ff}})
+	router.addDevice(&netDevice{name: "router1-router2", ipdev: ipDevice{address: testNatOutsideAddr, netmask: 0xffffff00, broadcast: 0xc0a800ff}})
+	err := router.ConfigureNat("router1-br0", "router1-router2", NatOptions{
+		Forwards: []string{"tcp:8080:192.168.1.3:80"},
+		Statics:  []string{"192.168.1.4=192.168.0.100"},
+		Log:      path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := router.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	counts := make(map[string]int)
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var line natJsonEvent
+		if err := decoder.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if !line.Static {
+			t.Fatalf("event %+v is not static", line)
+		}
+		counts[line.Event+" "+line.Proto+" "+line.InsideAddr+" "+line.OutsideAddr]++
+	}
+	want := map[string]int{
+		"create TCP 192.168.1.3 192.168.0.1":    1,
+		"delete TCP 192.168.1.3 192.168.0.1":    1,
+		"create TCP 192.168.1.4 192.168.0.100":  1,
+		"create UDP 192.168.1.4 192.168.0.100":  1,
+		"create ICMP 192.168.1.4 192.168.0.100": 1,
+		"delete TCP 192.168.1.4 192.168.0.100":  1,
+		"delete UDP 192.168.1.4 192.168.0.100":  1,
+		"delete ICMP 192.168.1.4 192.168.0.100": 1,
+	}
+	if len(counts) != len(want) {
+		t.Fatalf("nat events are %v", counts)
+	}
+	for key, count := range want {
+		if counts[key] != count {
+			t.Fatalf("nat events are %v, want %v", counts, want)
+		}
+	}
+}
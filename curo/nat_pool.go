@@ -0,0 +1,210 @@
+package curo
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 外側のアドレスのプールに入れられるアドレスの数, /16まで
+const NAT_POOL_MAX_ADDRS = 1 << 16
+
+// 1対1の静的NATのルール
+// localIpAddrのホストはポートを変換せずにglobalIpAddrに変換する
+type natStaticRule struct {
+	localIpAddr  uint32
+	globalIpAddr uint32
+}
+
+// 外側のアドレスのプールを使う内側のホスト(サブスクライバ)
+// RFC 7857のPaired Address Poolingのため、同じホストのマッピングはすべて同じ外側のアドレスを使う
+type natSubscriber struct {
+	globalIpAddr uint32
+	entries      int                  // このホストのNATエントリの数
+	blockIndex   uint16               // 割り当てたポートブロックの番号, ブロックを使わない時は0
+	ports        [2]*natPortAllocator // TCPとUDPのブロック内の空きポート
+}
+
+// NATの外側のアドレスのプール
+type natAddressPool struct {
+	addrs          []uint32
+	portBlockSize  uint16                                 // 0ならポートブロックを使わない
+	subscribers    map[[16]byte]*natSubscriber            // 内側のアドレスごとの割り当て, IPv4はIPv4射影アドレスで持つ
+	counts         map[uint32]int                         // 外側のアドレスごとのサブスクライバの数
+	blocks         map[uint32]*natPortAllocator           // 外側のアドレスごとの空きポートブロック
+	staticByLocal  map[uint32]uint32                      // 1対1の静的NATの内側から外側のアドレス
+	staticByGlobal map[uint32]uint32                      // 1対1の静的NATの外側から内側のアドレス
+	staticSeq      map[uint32]map[natSeqKey]*natSeqAdjust // 1対1の静的NATのホストのALGのシーケンス番号の補正
+}
+
+func newNatAddressPool(addrs []uint32, portBlockSize uint16, statics []natStaticRule) *natAddressPool {
+	pool := &natAddressPool{
+		addrs:          addrs,
+		portBlockSize:  portBlockSize,
+		subscribers:    make(map[[16]byte]*natSubscriber),
+		counts:         make(map[uint32]int),
+		blocks:         make(map[uint32]*natPortAllocator),
+		staticByLocal:  make(map[uint32]uint32),
+		staticByGlobal: make(map[uint32]uint32),
+		staticSeq:      make(map[uint32]map[natSeqKey]*natSeqAdjust),
+	}
+	if portBlockSize != 0 {
+		for _, addr := range addrs {
+			pool.blocks[addr] = newNatPortAllocator(1, uint16(NAT_GLOBAL_PORT_SIZE/int(portBlockSize)))
+		}
+	}
+	for _, static := range statics {
+		pool.staticByLocal[static.localIpAddr] = static.globalIpAddr
+		pool.staticByGlobal[static.globalIpAddr] = static.localIpAddr
+		pool.staticSeq[static.localIpAddr] = make(map[natSeqKey]*natSeqAdjust)
+	}
+	return pool
+}
+
+/*
+外側のアドレスとしてプールか1対1の静的NATで使っているアドレスか確認する
+*/
+func (pool *natAddressPool) contains(ipaddr uint32) bool {
+	for _, addr := range pool.addrs {
+		if addr == ipaddr {
+			return true
+		}
+	}
+	_, ok := pool.staticByGlobal[ipaddr]
+	return ok
+}
+
+/*
+内側のホストの割り当てを返す
+まだ割り当てがなければ、サブスクライバの一番少ない外側のアドレスを割り当てる
+割り当てられるアドレスやポートブロックがなければnilを返す
+*/
+func (pool *natAddressPool) subscriber(localIpAddr [16]byte) *natSubscriber {
+	if sub, ok := pool.subscribers[localIpAddr]; ok {
+		return sub
+	}
+
+	var sub *natSubscriber
+	for _, addr := range pool.addrs {
+		// ポートブロックを使う時は空きブロックのあるアドレスだけ選ぶ
+		if pool.portBlockSize != 0 && pool.blocks[addr].count == 0 {
+			continue
+		}
+		if sub == nil || pool.counts[addr] < pool.counts[sub.globalIpAddr] {
+			sub = &natSubscriber{globalIpAddr: addr}
+		}
+	}
+	if sub == nil {
+		return nil
+	}
+
+	if pool.portBlockSize != 0 {
+		sub.blockIndex = pool.blocks[sub.globalIpAddr].allocate()
+		min := uint16(NAT_GLOBAL_PORT_MIN + int(sub.blockIndex-1)*int(pool.portBlockSize))
+		max := min + pool.portBlockSize - 1
+		sub.ports[tcp] = newNatPortAllocator(min, max)
+		sub.ports[udp] = newNatPortAllocator(min, max)
+		fmt.Printf("Allocate nat port block %d-%d of %s to %s\n",
+			min, max, printIPAddr(sub.globalIpAddr), printIPv6Addr(localIpAddr))
+	}
+	pool.subscribers[localIpAddr] = sub
+	pool.counts[sub.globalIpAddr]++
+	return sub
+}
+
+/*
+NATエントリがなくなった内側のホストの割り当てを解放する
+*/
+func (pool *natAddressPool) releaseSubscriber(localIpAddr [16]byte) {
+	sub, ok := pool.subscribers[localIpAddr]
+	if !ok || sub.entries != 0 {
+		return
+	}
+	if sub.blockIndex != 0 {
+		pool.blocks[sub.globalIpAddr].release(sub.blockIndex)
+	}
+	pool.counts[sub.globalIpAddr]--
+	delete(pool.subscribers, localIpAddr)
+}
+
+/*
+1対1の静的NATの対象なら、ポートを変換しない一時的なNATエントリを返す
+内への通信ならipaddrは外側のアドレス、外への通信なら内側のアドレスを渡す
+対象でなければnilを返す
+*/
+func (pool *natAddressPool) oneToOneEntry(ipaddr uint32, port uint16, direction natDirectionType) *natEntry {
+	var localIpAddr, globalIpAddr uint32
+	var ok bool
+	if direction == incoming {
+		globalIpAddr = ipaddr
+		localIpAddr, ok = pool.staticByGlobal[ipaddr]
+	} else {
+		localIpAddr = ipaddr
+		globalIpAddr, ok = pool.staticByLocal[ipaddr]
+	}
+	if !ok {
+		return nil
+	}
+	return &natEntry{
+		globalIpAddr: globalIpAddr,
+		localIpAddr:  localIpAddr,
+		globalPort:   port,
+		localPort:    port,
+		static:       true,
+		// エントリは毎回作るので、ALGの補正はホストごとに持っておいたものを使う
+		algSeq: pool.staticSeq[localIpAddr],
+	}
+}
+
+/*
+外側のアドレスのプールをパースする
+"192.168.0.10-192.168.0.20" の範囲か "192.168.0.10,192.168.0.11" のリストで指定する
+プールのアドレスはNAT_POOL_MAX_ADDRSまで
+*/
+func parseNatAddressPool(pool string) ([]uint32, error) {
+	var addrs []uint32
+	for _, field := range strings.Split(pool, ",") {
+		from, to, isRange := strings.Cut(field, "-")
+		fromIp := net.ParseIP(from).To4()
+		if fromIp == nil {
+			return nil, fmt.Errorf("invalid nat pool addr %q", from)
+		}
+		if !isRange {
+			addrs = append(addrs, byteToUint32(fromIp))
+			continue
+		}
+		toIp := net.ParseIP(to).To4()
+		if toIp == nil || byteToUint32(toIp) < byteToUint32(fromIp) {
+			return nil, fmt.Errorf("invalid nat pool range %q", field)
+		}
+		// 255.255.255.255まででもあふれないように数で回す
+		count := uint64(byteToUint32(toIp)-byteToUint32(fromIp)) + 1
+		if uint64(len(addrs))+count > NAT_POOL_MAX_ADDRS {
+			return nil, fmt.Errorf("nat pool range %q is too large, max is %d addrs", field, NAT_POOL_MAX_ADDRS)
+		}
+		for i := uint64(0); i < count; i++ {
+			addrs = append(addrs, byteToUint32(fromIp)+uint32(i))
+		}
+	}
+	if len(addrs) > NAT_POOL_MAX_ADDRS {
+		return nil, fmt.Errorf("nat pool has too many addrs, max is %d addrs", NAT_POOL_MAX_ADDRS)
+	}
+	return addrs, nil
+}
+
+/*
+1対1の静的NATのルールをパースする
+"192.168.1.3=192.168.0.100" の形式で、内側の192.168.1.3を外側の192.168.0.100に変換する
+*/
+func parseNatStaticRule(rule string) (natStaticRule, error) {
+	var static natStaticRule
+	local, global, ok := strings.Cut(rule, "=")
+	localIp := net.ParseIP(local).To4()
+	globalIp := net.ParseIP(global).To4()
+	if !ok || localIp == nil || globalIp == nil {
+		return static, fmt.Errorf("invalid static nat rule %q, format is inside addr=outside addr", rule)
+	}
+	static.localIpAddr = byteToUint32(localIp)
+	static.globalIpAddr = byteToUint32(globalIp)
+	return static, nil
+}
@@ -0,0 +1,475 @@
+package curo
+
+import (
+	"fmt"
+	"time"
+)
+
+// NATテーブルを検索するためのキー
+// ローカル側の索引ではマッピングの動作に応じて通信相手のアドレスとポートもキーに含める
+type natEntryKey struct {
+	ipAddr       uint32
+	port         uint16
+	remoteIpAddr uint32
+	remotePort   uint16
+}
+
+/*
+空いているグローバルポートを管理するアロケータ
+空きポートをリングバッファのキューで持ち、解放されたポートは末尾に戻すので
+同じポートがすぐに再利用されにくい
+*/
+type natPortAllocator struct {
+	free  []uint16
+	head  int
+	count int
+}
+
+// プロトコルごとのNATテーブル
+// ローカル側とグローバル側のどちらからでもO(1)で引けるように2つのmapで索引を持つ
+type natTable struct {
+	byLocal  map[natEntryKey]*natEntry
+	byLocal6 map[nat64EntryKey]*natEntry // NAT64の内側のIPv6アドレスの索引
+	byGlobal map[natEntryKey]*natEntry
+	ports    map[uint32]*natPortAllocator // 外側のアドレスごとの空きポート
+	portMin  uint16
+	portMax  uint16
+}
+
+func newNatPortAllocator(min, max uint16) *natPortAllocator {
+	size := int(max) - int(min) + 1
+	allocator := &natPortAllocator{
+		free:  make([]uint16, size),
+		count: size,
+	}
+	for i := 0; i < size; i++ {
+		allocator.free[i] = min + uint16(i)
+	}
+	return allocator
+}
+
+/*
+空いているポートを先頭から取り出す
+空きがなければ0を返す
+*/
+func (allocator *natPortAllocator) allocate() uint16 {
+	if allocator.count == 0 {
+		return 0
+	}
+	port := allocator.free[allocator.head]
+	allocator.head = (allocator.head + 1) % len(allocator.free)
+	allocator.count--
+	return port
+}
+
+/*
+使い終わったポートを末尾に戻す
+*/
+func (allocator *natPortAllocator) release(port uint16) {
+	if allocator.count == len(allocator.free) {
+		return
+	}
+	allocator.free[(allocator.head+allocator.count)%len(allocator.free)] = port
+	allocator.count++
+}
+
+/*
+指定したポートを空きポートから取り除く
+静的なエントリで動的に割り当てる範囲のポートを使う時に呼ぶ
+*/
+func (allocator *natPortAllocator) reserve(port uint16) bool {
+	for i := 0; i < allocator.count; i++ {
+		index := (allocator.head + i) % len(allocator.free)
+		if allocator.free[index] == port {
+			// 先頭の空きポートと入れ替えて先頭を進める
+			allocator.free[index] = allocator.free[allocator.head]
+			allocator.head = (allocator.head + 1) % len(allocator.free)
+			allocator.count--
+			return true
+		}
+	}
+	return false
+}
+
+func newNatTable(min, max uint16) *natTable {
+	return &natTable{
+		byLocal:  make(map[natEntryKey]*natEntry),
+		byLocal6: make(map[nat64EntryKey]*natEntry),
+		byGlobal: make(map[natEntryKey]*natEntry),
+		ports:    make(map[uint32]*natPortAllocator),
+		portMin:  min,
+		portMax:  max,
+	}
+}
+
+/*
+外側のアドレスの空きポートのアロケータを返す
+初めて使うアドレスならアロケータを作る
+*/
+func (table *natTable) allocator(ipaddr uint32) *natPortAllocator {
+	allocator, ok := table.ports[ipaddr]
+	if !ok {
+		allocator = newNatPortAllocator(table.portMin, table.portMax)
+		table.ports[ipaddr] = allocator
+	}
+	return allocator
+}
+
+/*
+NATテーブルを作成する
+外側のアドレスのプールが指定されていなければoutsideのアドレスだけを使う
+*/
+func newNatEntryList(outside uint32, natconf natConfig) *natEntryList {
+	addrs := natconf.pool
+	if len(addrs) == 0 {
+		addrs = []uint32{outside}
+	}
+	if natconf.logger != nil {
+		natconf.logger.nat64Prefix = natconf.nat64Prefix
+	}
+	list := &natEntryList{
+		logger:  natconf.logger,
+		mapping: natconf.mapping,
+		pool:    newNatAddressPool(addrs, natconf.portBlockSize, natconf.statics),
+		tcp:     newNatTable(NAT_GLOBAL_PORT_MIN, NAT_GLOBAL_PORT_MAX),
+		udp:     newNatTable(NAT_GLOBAL_PORT_MIN, NAT_GLOBAL_PORT_MAX),
+		// ICMPの識別子の0は使わないので1から割り当てる
+		icmp:  newNatTable(1, NAT_ICMP_ID_SIZE),
+		clock: time.Now,
+		stop:  make(chan struct{}),
+	}
+	if natconf.clock != nil {
+		list.clock = natconf.clock
+	}
+	// 1対1の静的NATはどのプロトコルでも使えるセッションとしてログに出す
+	for _, static := range natconf.statics {
+		for _, proto := range []natProtocolType{tcp, udp, icmp} {
+			list.logEvent(natEventSessionCreate, proto, oneToOneSession(static.localIpAddr, static.globalIpAddr))
+		}
+	}
+	return list
+}
+
+// 1対1の静的NATのセッションをログに出すためのエントリ
+func oneToOneSession(localIpAddr, globalIpAddr uint32) *natEntry {
+	return &natEntry{localIpAddr: localIpAddr, globalIpAddr: globalIpAddr, static: true}
+}
+
+/*
+NATの現在時刻
+*/
+func (entry *natEntryList) now() time.Time {
+	if entry.clock == nil {
+		return time.Now()
+	}
+	return entry.clock()
+}
+
+/*
+NATエントリのイベントをNATの時刻でログに出す
+NATを止めた後はloggerがnilになるので何もしない
+*/
+func (entry *natEntryList) logEvent(eventType natEventType, proto natProtocolType, target *natEntry) {
+	entry.logger.logEvent(entry.now(), eventType, proto, target)
+}
+
+func (protoType natProtocolType) String() string {
+	switch protoType {
+	case tcp:
+		return "TCP"
+	case udp:
+		return "UDP"
+	case icmp:
+		return "ICMP"
+	}
+	return "UNKNOWN"
+}
+
+/*
+マッピングの動作に応じてローカル側の索引のキーを作る
+Endpoint-Independentは通信相手によらず同じマッピングを使うので相手をキーに含めない
+*/
+func (entry *natEntryList) localKey(ipaddr uint32, port uint16, remoteIpAddr uint32, remotePort uint16) natEntryKey {
+	key := natEntryKey{ipAddr: ipaddr, port: port}
+	switch entry.mapping {
+	case natMappingAddressDependent:
+		key.remoteIpAddr = remoteIpAddr
+	case natMappingAddressAndPortDependent:
+		key.remoteIpAddr = remoteIpAddr
+		key.remotePort = remotePort
+	}
+	return key
+}
+
+/*
+アドレスの割り当てに使う内側のホストのアドレスを返す
+IPv4のホストはIPv4射影アドレスにする
+*/
+func (entry *natEntry) hostAddr() [16]byte {
+	if entry.nat64 {
+		return entry.localIpv6Addr
+	}
+	return ipv4MappedAddr(entry.localIpAddr)
+}
+
+/*
+ログに出すための内側のアドレスを返す
+*/
+func (entry *natEntry) localAddrString() string {
+	if entry.nat64 {
+		return printIPv6Addr(entry.localIpv6Addr)
+	}
+	return printIPAddr(entry.localIpAddr)
+}
+
+/*
+プロトコルに対応するNATテーブルを返す
+*/
+func (entry *natEntryList) table(protoType natProtocolType) *natTable {
+	switch protoType {
+	case tcp:
+		return entry.tcp
+	case udp:
+		return entry.udp
+	default:
+		return entry.icmp
+	}
+}
+
+/*
+グローバルアドレスとグローバルポートからNATエントリを取得
+*/
+func (entry *natEntryList) getNatEntryByGlobal(protoType natProtocolType, ipaddr uint32, port uint16) *natEntry {
+	if v, ok := entry.table(protoType).byGlobal[natEntryKey{ipAddr: ipaddr, port: port}]; ok {
+		return v
+	}
+	// テーブルに一致するエントリがなかったら空のエントリを返す
+	return &natEntry{}
+}
+
+/*
+ローカルアドレスとローカルポート, 通信相手のアドレスとポートからNATエントリを取得
+*/
+func (entry *natEntryList) getNatEntryByLocal(protoType natProtocolType, ipaddr uint32, port uint16, remoteIpAddr uint32, remotePort uint16) *natEntry {
+	table := entry.table(protoType)
+	if v, ok := table.byLocal[entry.localKey(ipaddr, port, remoteIpAddr, remotePort)]; ok {
+		return v
+	}
+	// ポートフォワーディングのエントリは通信相手によらないので相手を含めないキーでも探す
+	if v, ok := table.byLocal[natEntryKey{ipAddr: ipaddr, port: port}]; ok && v.static {
+		return v
+	}
+	// ALGが作ったエントリは通信相手のポートが分からないので、相手のポートを0にしたキーでも探す
+	if v, ok := table.byLocal[entry.localKey(ipaddr, port, remoteIpAddr, 0)]; ok && v.expected {
+		return v
+	}
+	// テーブルに一致するエントリがなかったら空のエントリを返す
+	return &natEntry{}
+}
+
+/*
+内側のホストの割り当てに応じたポートのアロケータを返す
+ポートブロックを割り当てていればTCPとUDPはブロック内から、それ以外は外側のアドレス全体から割り当てる
+*/
+func (entry *natEntryList) portAllocator(protoType natProtocolType, sub *natSubscriber) *natPortAllocator {
+	if protoType != icmp && sub.blockIndex != 0 {
+		return sub.ports[protoType]
+	}
+	return entry.table(protoType).allocator(sub.globalIpAddr)
+}
+
+/*
+内側のホストに外側のアドレスと空いているポートを割り当てる
+空いているポートがなかったらポートに0を返す
+*/
+func (entry *natEntryList) allocateGlobalPort(protoType natProtocolType, host [16]byte) (uint32, uint16) {
+	table := entry.table(protoType)
+	sub := entry.pool.subscriber(host)
+	if sub == nil {
+		return 0, 0
+	}
+	allocator := entry.portAllocator(protoType, sub)
+	for {
+		globalPort := allocator.allocate()
+		if globalPort == 0 {
+			// 空きがなければ割り当てたばかりのアドレスを解放する
+			entry.pool.releaseSubscriber(host)
+			return 0, 0
+		}
+		// ポートフォワーディングで使っているポートは飛ばす
+		if _, ok := table.byGlobal[natEntryKey{ipAddr: sub.globalIpAddr, port: globalPort}]; !ok {
+			sub.entries++
+			return sub.globalIpAddr, globalPort
+		}
+	}
+}
+
+/*
+外側のアドレスと空いてるポートを割り当て、NATエントリを作成する
+空いているポートがなかったら空のエントリを返す
+*/
+func (entry *natEntryList) createNatEntry(protoType natProtocolType, localIpAddr uint32, localPort uint16, remoteIpAddr uint32, remotePort uint16) *natEntry {
+	table := entry.table(protoType)
+	globalIpAddr, globalPort := entry.allocateGlobalPort(protoType, ipv4MappedAddr(localIpAddr))
+	if globalPort == 0 {
+		return &natEntry{}
+	}
+
+	newEntry := &natEntry{
+		globalIpAddr: globalIpAddr,
+		localIpAddr:  localIpAddr,
+		globalPort:   globalPort,
+		localPort:    localPort,
+		remoteIpAddr: remoteIpAddr,
+		remotePort:   remotePort,
+		remotes:      make(map[natEntryKey]struct{}),
+	}
+	table.byLocal[entry.localKey(localIpAddr, localPort, remoteIpAddr, remotePort)] = newEntry
+	table.byGlobal[natEntryKey{ipAddr: globalIpAddr, port: globalPort}] = newEntry
+	entry.logEvent(natEventSessionCreate, protoType, newEntry)
+	return newEntry
+}
+
+/*
+ポートフォワーディングのための削除されないNATエントリを作成する
+グローバルポートが動的に割り当てる範囲にあれば、アロケータから取り除いて重複しないようにする
+*/
+func (entry *natEntryList) createStaticNatEntry(protoType natProtocolType, localIpAddr uint32, localPort uint16, globalIpAddr uint32, globalPort uint16) (*natEntry, error) {
+	table := entry.table(protoType)
+	if _, ok := table.byGlobal[natEntryKey{ipAddr: globalIpAddr, port: globalPort}]; ok {
+		return nil, fmt.Errorf("%s global port %d is already used", protoType, globalPort)
+	}
+	if _, ok := table.byLocal[natEntryKey{ipAddr: localIpAddr, port: localPort}]; ok {
+		return nil, fmt.Errorf("%s local %s:%d is already mapped", protoType, printIPAddr(localIpAddr), localPort)
+	}
+	table.allocator(globalIpAddr).reserve(globalPort)
+
+	newEntry := &natEntry{
+		globalIpAddr: globalIpAddr,
+		localIpAddr:  localIpAddr,
+		globalPort:   globalPort,
+		localPort:    localPort,
+		remotes:      make(map[natEntryKey]struct{}),
+		static:       true,
+	}
+	table.byLocal[natEntryKey{ipAddr: localIpAddr, port: localPort}] = newEntry
+	table.byGlobal[natEntryKey{ipAddr: globalIpAddr, port: globalPort}] = newEntry
+	entry.logEvent(natEventSessionCreate, protoType, newEntry)
+	return newEntry, nil
+}
+
+/*
+NATエントリを削除してポートを空ける
+*/
+func (entry *natEntryList) deleteNatEntry(protoType natProtocolType, target *natEntry) {
+	table := entry.table(protoType)
+	if target.nat64 {
+		delete(table.byLocal6, entry.localKey6(target.localIpv6Addr, target.localPort, target.remoteIpAddr, target.remotePort))
+	} else if target.static {
+		delete(table.byLocal, natEntryKey{ipAddr: target.localIpAddr, port: target.localPort})
+	} else {
+		delete(table.byLocal, entry.localKey(target.localIpAddr, target.localPort, target.remoteIpAddr, target.remotePort))
+	}
+	delete(table.byGlobal, natEntryKey{ipAddr: target.globalIpAddr, port: target.globalPort})
+	entry.logEvent(natEventSessionDelete, protoType, target)
+	// 静的なエントリのポートはアロケータに戻さない
+	if target.static {
+		return
+	}
+	sub, ok := entry.pool.subscribers[target.hostAddr()]
+	if !ok {
+		return
+	}
+	entry.portAllocator(protoType, sub).release(target.globalPort)
+	sub.entries--
+	// 内側のホストのエントリがなくなったら外側のアドレスとポートブロックの割り当ても解放する
+	entry.pool.releaseSubscriber(target.hostAddr())
+}
+
+/*
+タイムアウトしたNATエントリを削除してポートを空ける
+削除したエントリの数を返す
+*/
+func (entry *natEntryList) sweepNatEntries(now time.Time) int {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+
+	entry.lastSweep = now
+	count := 0
+	for _, proto := range []natProtocolType{tcp, udp, icmp} {
+		for _, v := range entry.table(proto).byGlobal {
+			// ポートフォワーディングのエントリはタイムアウトさせない
+			if !v.static && now.Sub(v.lastSeen) > v.natEntryTimeout(proto) {
+				fmt.Printf("Delete nat entry local %s:%d to global %s:%d\n",
+					printIPAddr(v.localIpAddr), v.localPort, printIPAddr(v.globalIpAddr), v.globalPort)
+				entry.deleteNatEntry(proto, v)
+				count++
+			}
+		}
+	}
+	return count
+}
+
+/*
+ルータのタイマーからタイムアウトしたNATエントリを削除する
+pcapのリプレイでもキャプチャの時刻でタイムアウトするように、前に削除してからNAT_SWEEP_INTERVALたっていれば削除する
+*/
+func (entry *natEntryList) natTick(now time.Time) {
+	entry.mutex.Lock()
+	due := now.Sub(entry.lastSweep) >= NAT_SWEEP_INTERVAL
+	entry.mutex.Unlock()
+	if due {
+		entry.sweepNatEntries(now)
+	}
+}
+
+/*
+一定間隔でタイムアウトしたNATエントリを削除し続ける
+*/
+func (entry *natEntryList) runNatSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			entry.sweepNatEntries(entry.now())
+		case <-entry.stop:
+			return
+		}
+	}
+}
+
+/*
+タイムアウトしたNATエントリの削除を止める
+*/
+func (entry *natEntryList) stopNatSweeper() {
+	select {
+	case <-entry.stop:
+	default:
+		close(entry.stop)
+	}
+}
+
+/*
+NATを止める
+タイムアウトしない静的なセッションは止めた時に削除のイベントを出してから、ログの出力先を閉じる
+まだパケットを処理していても閉じたキューに入れないように、ロックを持ったままloggerを外してから閉じる
+*/
+func (entry *natEntryList) close() error {
+	entry.stopNatSweeper()
+	entry.mutex.Lock()
+	for _, proto := range []natProtocolType{tcp, udp, icmp} {
+		for _, v := range entry.table(proto).byGlobal {
+			if v.static {
+				entry.logEvent(natEventSessionDelete, proto, v)
+			}
+		}
+		for local, global := range entry.pool.staticByLocal {
+			entry.logEvent(natEventSessionDelete, proto, oneToOneSession(local, global))
+		}
+	}
+	logger := entry.logger
+	entry.logger = nil
+	entry.mutex.Unlock()
+	return logger.close()
+}
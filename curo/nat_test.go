@@ -0,0 +1,703 @@
+package curo
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	testNatOutsideAddr uint32 = 0xc0a80001 // 192.168.0.1
+	testNatLocalAddr   uint32 = 0xc0a80102 // 192.168.1.2
+)
+
+// テスト用にNATデバイスを作成する
+func newTestNatDevice() natDevice {
+	return natDevice{
+		outsideIpAddr: testNatOutsideAddr,
+		natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{}),
+	}
+}
+
+// NATテーブルを全ポート使い切るまで埋める
+func fillNatTable(t testing.TB, natdev natDevice, proto natProtocolType) {
+	for i := 0; i < NAT_GLOBAL_PORT_SIZE; i++ {
+		entry := natdev.natEntry.createNatEntry(proto, testNatLocalAddr, uint16(1024+i), 0x08080808, 53)
+		if entry.globalPort == 0 {
+			t.Fatalf("NAT table is full at %d entries", i)
+		}
+	}
+}
+
+func TestNatPortAllocator(t *testing.T) {
+	allocator := newNatPortAllocator(100, 102)
+
+	for want := uint16(100); want <= 102; want++ {
+		if got := allocator.allocate(); got != want {
+			t.Fatalf("allocate() = %d, want %d", got, want)
+		}
+	}
+	if got := allocator.allocate(); got != 0 {
+		t.Fatalf("allocate() on exhausted allocator = %d, want 0", got)
+	}
+
+	// 解放したポートは末尾に戻るので次に取り出される
+	allocator.release(101)
+	if got := allocator.allocate(); got != 101 {
+		t.Fatalf("allocate() after release = %d, want 101", got)
+	}
+}
+
+func TestNatTableFullAndReclaim(t *testing.T) {
+	natdev := newTestNatDevice()
+	fillNatTable(t, natdev, udp)
+
+	entry := natdev.natEntry.createNatEntry(udp, testNatLocalAddr+1, 80, 0x08080808, 53)
+	if entry.globalPort != 0 {
+		t.Fatalf("createNatEntry on full table returned port %d", entry.globalPort)
+	}
+
+	// エントリを消すとそのポートがまた使える
+	victim := natdev.natEntry.getNatEntryByGlobal(udp, natdev.outsideIpAddr, NAT_GLOBAL_PORT_MIN+10)
+	if victim.globalPort == 0 {
+		t.Fatal("entry for global port not found")
+	}
+	natdev.natEntry.deleteNatEntry(udp, victim)
+	if got := natdev.natEntry.getNatEntryByLocal(udp, victim.localIpAddr, victim.localPort, 0x08080808, 53); got.globalPort != 0 {
+		t.Fatal("deleted entry is still found by local tuple")
+	}
+
+	entry = natdev.natEntry.createNatEntry(udp, testNatLocalAddr+1, 80, 0x08080808, 53)
+	if entry.globalPort != NAT_GLOBAL_PORT_MIN+10 {
+		t.Fatalf("createNatEntry after delete returned port %d, want %d", entry.globalPort, NAT_GLOBAL_PORT_MIN+10)
+	}
+	if got := natdev.natEntry.getNatEntryByGlobal(udp, natdev.outsideIpAddr, entry.globalPort); got != entry {
+		t.Fatal("new entry is not found by global tuple")
+	}
+}
+
+func TestParseNatPortForwardRule(t *testing.T) {
+	forward, err := parseNatPortForwardRule("tcp:8080:192.168.1.3:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := natPortForwardRule{proto: tcp, globalPort: 8080, localIpAddr: 0xc0a80103, localPort: 80}
+	if forward != want {
+		t.Fatalf("parseNatPortForwardRule() = %+v, want %+v", forward, want)
+	}
+
+	for _, rule := range []string{"tcp:8080:192.168.1.3", "icmp:1:192.168.1.3:1", "udp:0:192.168.1.3:53", "udp:53:host0:53"} {
+		if _, err := parseNatPortForwardRule(rule); err == nil {
+			t.Errorf("parseNatPortForwardRule(%q) returned no error", rule)
+		}
+	}
+}
+
+func TestStaticNatEntryInDynamicRange(t *testing.T) {
+	natdev := newTestNatDevice()
+	// 動的に割り当てる範囲の先頭のポートを静的に使う
+	static, err := natdev.natEntry.createStaticNatEntry(tcp, 0xc0a80103, 80, testNatOutsideAddr, NAT_GLOBAL_PORT_MIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := natdev.natEntry.createStaticNatEntry(tcp, 0xc0a80104, 80, testNatOutsideAddr, NAT_GLOBAL_PORT_MIN); err == nil {
+		t.Fatal("duplicated static global port is accepted")
+	}
+
+	dynamic := natdev.natEntry.createNatEntry(tcp, testNatLocalAddr, 1024, 0x08080808, 53)
+	if dynamic.globalPort == static.globalPort {
+		t.Fatalf("dynamic entry got static port %d", dynamic.globalPort)
+	}
+
+	// 静的なエントリはタイムアウトしない
+	if n := natdev.natEntry.sweepNatEntries(time.Now().Add(24 * time.Hour)); n != 1 {
+		t.Fatalf("sweepNatEntries() deleted %d entries, want 1", n)
+	}
+	if got := natdev.natEntry.getNatEntryByGlobal(tcp, testNatOutsideAddr, NAT_GLOBAL_PORT_MIN); got != static {
+		t.Fatal("static entry is swept")
+	}
+}
+
+func TestNatExecHairpin(t *testing.T) {
+	natdev := newTestNatDevice()
+	server := uint32(0xc0a80103)
+	if _, err := natdev.natEntry.createStaticNatEntry(tcp, server, 80, testNatOutsideAddr, 8080); err != nil {
+		t.Fatal(err)
+	}
+
+	// 内側のクライアントから外側のアドレスの8080番へ
+	request := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_TCP, srcAddr: testNatLocalAddr, destAddr: testNatOutsideAddr}
+	segment := (&tcpHeader{srcPort: 40000, destPort: 8080, offset: 5 << 4, tcpflag: TCP_FLAG_SYN}).ToPacket()
+	translated, err := natExecHairpin(&request, natPacketHeader{packet: segment}, natdev, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.srcAddr != testNatOutsideAddr || request.destAddr != server {
+		t.Fatalf("hairpin request is %s -> %s", printIPAddr(request.srcAddr), printIPAddr(request.destAddr))
+	}
+	clientPort := byteToUint16(translated[0:2])
+	if byteToUint16(translated[2:4]) != 80 || clientPort == 40000 {
+		t.Fatalf("hairpin request ports are %d -> %d", clientPort, byteToUint16(translated[2:4]))
+	}
+
+	// サーバからの応答はクライアントに割り当てた外側のポート宛てに来る
+	reply := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_TCP, srcAddr: server, destAddr: testNatOutsideAddr}
+	segment = (&tcpHeader{srcPort: 80, destPort: clientPort, offset: 5 << 4, tcpflag: TCP_FLAG_SYN | TCP_FLAG_ACK}).ToPacket()
+	translated, err = natExecHairpin(&reply, natPacketHeader{packet: segment}, natdev, tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.srcAddr != testNatOutsideAddr || reply.destAddr != testNatLocalAddr {
+		t.Fatalf("hairpin reply is %s -> %s", printIPAddr(reply.srcAddr), printIPAddr(reply.destAddr))
+	}
+	if byteToUint16(translated[0:2]) != 8080 || byteToUint16(translated[2:4]) != 40000 {
+		t.Fatalf("hairpin reply ports are %d -> %d", byteToUint16(translated[0:2]), byteToUint16(translated[2:4]))
+	}
+
+	// 転送先のないポートは折り返さない
+	request = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_TCP, srcAddr: testNatLocalAddr, destAddr: testNatOutsideAddr}
+	segment = (&tcpHeader{srcPort: 40001, destPort: 8081, offset: 5 << 4, tcpflag: TCP_FLAG_SYN}).ToPacket()
+	if _, err := natExecHairpin(&request, natPacketHeader{packet: segment}, natdev, tcp); err == nil {
+		t.Fatal("hairpin to unforwarded port succeeded")
+	}
+}
+
+// テスト用に内側から外側へUDPパケットを送ってNATエントリを返す
+func sendTestNatUdp(t *testing.T, natdev natDevice, srcPort uint16, destAddr uint32, destPort uint16) *natEntry {
+	ipheader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_UDP, srcAddr: testNatLocalAddr, destAddr: destAddr}
+	packet := (&udpHeader{srcPort: srcPort, destPort: destPort, length: 8}).ToPacket()
+	if _, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, udp, outgoing); err != nil {
+		t.Fatal(err)
+	}
+	return natdev.natEntry.getNatEntryByLocal(udp, testNatLocalAddr, srcPort, destAddr, destPort)
+}
+
+func TestNatMappingBehavior(t *testing.T) {
+	remoteA := uint32(0x08080808)
+	remoteB := uint32(0x08080404)
+	tests := []struct {
+		mapping          natMappingType
+		samePortA        bool // 同じアドレスの別ポートで同じマッピングを使うか
+		sameAddrB        bool // 別のアドレスで同じマッピングを使うか
+		wantEntriesCount int
+	}{
+		{natMappingEndpointIndependent, true, true, 1},
+		{natMappingAddressDependent, true, false, 2},
+		{natMappingAddressAndPortDependent, false, false, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mapping.String(), func(t *testing.T) {
+			natdev := natDevice{outsideIpAddr: testNatOutsideAddr, natEntry: newNatEntryList(testNatOutsideAddr, natConfig{mapping: tt.mapping})}
+			first := sendTestNatUdp(t, natdev, 5000, remoteA, 53)
+			samePortA := sendTestNatUdp(t, natdev, 5000, remoteA, 54)
+			sameAddrB := sendTestNatUdp(t, natdev, 5000, remoteB, 53)
+
+			if (first == samePortA) != tt.samePortA {
+				t.Errorf("mapping to another port of same address: reused = %v, want %v", first == samePortA, tt.samePortA)
+			}
+			if (first == sameAddrB) != tt.sameAddrB {
+				t.Errorf("mapping to another address: reused = %v, want %v", first == sameAddrB, tt.sameAddrB)
+			}
+			if got := len(natdev.natEntry.udp.byGlobal); got != tt.wantEntriesCount {
+				t.Errorf("nat entries count = %d, want %d", got, tt.wantEntriesCount)
+			}
+		})
+	}
+}
+
+func TestNatFilteringBehavior(t *testing.T) {
+	remoteA := uint32(0x08080808)
+	remoteB := uint32(0x08080404)
+	tests := []struct {
+		filtering natFilteringType
+		// 送ったことのある相手, 同じアドレスの別ポート, 別のアドレスからの通信を通すか
+		want [3]bool
+	}{
+		{natFilteringEndpointIndependent, [3]bool{true, true, true}},
+		{natFilteringAddressDependent, [3]bool{true, true, false}},
+		{natFilteringAddressAndPortDependent, [3]bool{true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filtering.String(), func(t *testing.T) {
+			natdev := natDevice{
+				outsideIpAddr: testNatOutsideAddr,
+				filtering:     tt.filtering,
+				natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{}),
+			}
+			entry := sendTestNatUdp(t, natdev, 5000, remoteA, 53)
+
+			remotes := []natEntryKey{{ipAddr: remoteA, port: 53}, {ipAddr: remoteA, port: 54}, {ipAddr: remoteB, port: 53}}
+			for i, remote := range remotes {
+				ipheader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_UDP, srcAddr: remote.ipAddr, destAddr: testNatOutsideAddr}
+				packet := (&udpHeader{srcPort: remote.port, destPort: entry.globalPort, length: 8}).ToPacket()
+				_, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, udp, incoming)
+				if (err == nil) != tt.want[i] {
+					t.Errorf("incoming from %s:%d allowed = %v, want %v", printIPAddr(remote.ipAddr), remote.port, err == nil, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNatAddressPoolPairing(t *testing.T) {
+	pool := []uint32{0xc0a8000a, 0xc0a8000b}
+	natdev := natDevice{
+		outsideIpAddr: testNatOutsideAddr,
+		natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{pool: pool}),
+	}
+
+	// 同じホストのマッピングはプロトコルが違っても同じ外側のアドレスを使う
+	hostA := natdev.natEntry.createNatEntry(tcp, 0xc0a80102, 1000, 0x08080808, 80)
+	hostAUdp := natdev.natEntry.createNatEntry(udp, 0xc0a80102, 1001, 0x08080404, 53)
+	if hostA.globalIpAddr != hostAUdp.globalIpAddr {
+		t.Fatalf("same host mapped to %s and %s", printIPAddr(hostA.globalIpAddr), printIPAddr(hostAUdp.globalIpAddr))
+	}
+	// 別のホストは空いている別のアドレスを使う
+	hostB := natdev.natEntry.createNatEntry(tcp, 0xc0a80103, 1000, 0x08080808, 80)
+	if hostB.globalIpAddr == hostA.globalIpAddr {
+		t.Fatalf("second host mapped to same addr %s", printIPAddr(hostB.globalIpAddr))
+	}
+	if !natdev.isOutsideAddr(hostB.globalIpAddr) {
+		t.Fatalf("%s is not outside addr", printIPAddr(hostB.globalIpAddr))
+	}
+
+	// エントリがなくなったらアドレスの割り当ても解放される
+	natdev.natEntry.deleteNatEntry(tcp, hostA)
+	natdev.natEntry.deleteNatEntry(udp, hostAUdp)
+	if _, ok := natdev.natEntry.pool.subscribers[ipv4MappedAddr(0xc0a80102)]; ok {
+		t.Fatal("subscriber is not released")
+	}
+}
+
+func TestNatPortBlock(t *testing.T) {
+	natdev := natDevice{
+		outsideIpAddr: testNatOutsideAddr,
+		natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{portBlockSize: 4}),
+	}
+	hostA := natdev.natEntry.createNatEntry(udp, 0xc0a80102, 1000, 0x08080808, 53)
+	hostB := natdev.natEntry.createNatEntry(udp, 0xc0a80103, 1000, 0x08080808, 53)
+	if hostA.globalPort != NAT_GLOBAL_PORT_MIN || hostB.globalPort != NAT_GLOBAL_PORT_MIN+4 {
+		t.Fatalf("port blocks start at %d and %d", hostA.globalPort, hostB.globalPort)
+	}
+	// ブロックを使い切ったらそのホストはそれ以上マッピングを作れない
+	for port := uint16(1001); port < 1004; port++ {
+		entry := natdev.natEntry.createNatEntry(udp, 0xc0a80102, port, 0x08080808, 53)
+		if entry.globalPort < NAT_GLOBAL_PORT_MIN || NAT_GLOBAL_PORT_MIN+3 < entry.globalPort {
+			t.Fatalf("port %d is out of block", entry.globalPort)
+		}
+	}
+	if entry := natdev.natEntry.createNatEntry(udp, 0xc0a80102, 1004, 0x08080808, 53); entry.globalPort != 0 {
+		t.Fatalf("port %d is allocated from exhausted block", entry.globalPort)
+	}
+}
+
+func TestNatOneToOneStatic(t *testing.T) {
+	local := uint32(0xc0a80103)
+	global := uint32(0xc0a80064)
+	natdev := natDevice{
+		outsideIpAddr: testNatOutsideAddr,
+		filtering:     natFilteringAddressAndPortDependent,
+		natEntry:      newNatEntryList(testNatOutsideAddr, natConfig{statics: []natStaticRule{{localIpAddr: local, globalIpAddr: global}}}),
+	}
+
+	// 外から1対1のアドレスへはエントリがなくても届く
+	ipheader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_UDP, srcAddr: 0x08080808, destAddr: global}
+	packet := (&udpHeader{srcPort: 53, destPort: 5353, length: 8}).ToPacket()
+	if _, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, udp, incoming); err != nil {
+		t.Fatal(err)
+	}
+	if ipheader.destAddr != local {
+		t.Fatalf("incoming dest is %s, want %s", printIPAddr(ipheader.destAddr), printIPAddr(local))
+	}
+
+	// 内から外へはポートを変えずアドレスだけ変換する
+	ipheader = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_UDP, srcAddr: local, destAddr: 0x08080808}
+	packet = (&udpHeader{srcPort: 5353, destPort: 53, length: 8}).ToPacket()
+	translated, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, udp, outgoing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ipheader.srcAddr != global || byteToUint16(translated[0:2]) != 5353 {
+		t.Fatalf("outgoing src is %s:%d", printIPAddr(ipheader.srcAddr), byteToUint16(translated[0:2]))
+	}
+	if len(natdev.natEntry.udp.byGlobal) != 0 {
+		t.Fatal("1:1 static nat created nat entry")
+	}
+}
+
+// テスト用にチェックサムを計算したTCP, UDPのセグメントやICMPのエコーを作る, ICMPはsrcPortを識別子にする
+func testNatSegment(proto natProtocolType, srcAddr, destAddr uint32, srcPort, destPort uint16) []byte {
+	var segment []byte
+	switch proto {
+	case udp:
+		segment = append((&udpHeader{srcPort: srcPort, destPort: destPort, length: 12}).ToPacket(), "curo"...)
+		copy(segment[6:8], uint16ToByte(calcTransportChecksum(srcAddr, destAddr, IP_PROTOCOL_NUM_UDP, segment)))
+	case tcp:
+		segment = (&tcpHeader{srcPort: srcPort, destPort: destPort, seq: 1, offset: 5 << 4, tcpflag: TCP_FLAG_SYN, window: 1024}).ToPacket()
+		copy(segment[16:18], uint16ToByte(calcTransportChecksum(srcAddr, destAddr, IP_PROTOCOL_NUM_TCP, segment)))
+	case icmp:
+		segment = []byte{ICMP_TYPE_ECHO_REQUEST, 0, 0, 0}
+		segment = append(segment, uint16ToByte(srcPort)...)
+		segment = append(segment, 0, 1)
+		copy(segment[2:4], calcChecksum(segment))
+	}
+	return segment
+}
+
+// テスト用にsegmentの入ったIPパケットを原因にしたICMPエラーを作る
+func testNatIcmpError(icmpType uint8, protocol uint8, srcAddr, destAddr uint32, segment []byte) []byte {
+	inner := ipHeader{
+		version:   4,
+		headerLen: 20 / 4,
+		totalLen:  uint16(20 + len(segment)),
+		ttl:       1,
+		protocol:  protocol,
+		srcAddr:   srcAddr,
+		destAddr:  destAddr,
+	}.ToPacket(true)
+	packet := append([]byte{icmpType, 3, 0, 0, 0, 0, 0, 0}, inner...)
+	packet = append(packet, segment...)
+	copy(packet[2:4], calcChecksum(packet))
+	return packet
+}
+
+// ICMPエラーの中のIPヘッダとTCP, UDP, ICMPのチェックサムが正しいか確かめる
+func checkTestNatIcmpError(t *testing.T, packet []byte) (ipHeader, []byte) {
+	t.Helper()
+	if byteToUint16(calcChecksum(packet)) != 0 {
+		t.Errorf("icmp checksum is invalid")
+	}
+	inner, segment, err := parseIPHeader(packet[8:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byteToUint16(calcChecksum(packet[8:28])) != 0 {
+		t.Errorf("inner ip header checksum is invalid")
+	}
+	switch inner.protocol {
+	case IP_PROTOCOL_NUM_ICMP:
+		if byteToUint16(calcChecksum(segment)) != 0 {
+			t.Errorf("inner icmp checksum is invalid")
+		}
+	default:
+		if calcTransportChecksum(inner.srcAddr, inner.destAddr, inner.protocol, segment) != 0 {
+			t.Errorf("inner protocol %d checksum is invalid", inner.protocol)
+		}
+	}
+	return inner, segment
+}
+
+func TestNatExecIcmpEcho(t *testing.T) {
+	natdev := newTestNatDevice()
+	remote := uint32(0x08080808)
+
+	// 内側からのエコーリクエストは識別子を外側のポートに変換する
+	request := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, srcAddr: testNatLocalAddr, destAddr: remote}
+	translated, err := natExec(&request, natPacketHeader{packet: testNatSegment(icmp, testNatLocalAddr, remote, 100, 0)}, natdev, icmp, outgoing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identify := byteToUint16(translated[4:6])
+	if request.srcAddr != testNatOutsideAddr || identify == 0 {
+		t.Fatalf("echo request is from %s id %d", printIPAddr(request.srcAddr), identify)
+	}
+	if byteToUint16(calcChecksum(translated)) != 0 {
+		t.Fatal("echo request checksum is invalid")
+	}
+
+	// リプライは元の識別子に戻して内側のホストへ届ける
+	reply := testNatSegment(icmp, remote, testNatOutsideAddr, identify, 0)
+	reply[0] = ICMP_TYPE_ECHO_REPLY
+	copy(reply[2:4], []byte{0, 0})
+	copy(reply[2:4], calcChecksum(reply))
+	replyHeader := ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, srcAddr: remote, destAddr: testNatOutsideAddr}
+	translated, err = natExec(&replyHeader, natPacketHeader{packet: reply}, natdev, icmp, incoming)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyHeader.destAddr != testNatLocalAddr || byteToUint16(translated[4:6]) != 100 {
+		t.Fatalf("echo reply is to %s id %d", printIPAddr(replyHeader.destAddr), byteToUint16(translated[4:6]))
+	}
+	if byteToUint16(calcChecksum(translated)) != 0 {
+		t.Fatal("echo reply checksum is invalid")
+	}
+
+	// 外から来たエコーリクエストは変換しない
+	reply[0] = ICMP_TYPE_ECHO_REQUEST
+	replyHeader = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, srcAddr: remote, destAddr: testNatOutsideAddr}
+	if _, err := natExec(&replyHeader, natPacketHeader{packet: reply}, natdev, icmp, incoming); err == nil {
+		t.Fatal("incoming echo request is translated")
+	}
+}
+
+func TestNatExecIcmpError(t *testing.T) {
+	remote := uint32(0x08080808)
+	gateway := uint32(0x0a0000fe)
+	tests := []struct {
+		proto    natProtocolType
+		protocol uint8
+	}{
+		{udp, IP_PROTOCOL_NUM_UDP},
+		{tcp, IP_PROTOCOL_NUM_TCP},
+		{icmp, IP_PROTOCOL_NUM_ICMP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto.String(), func(t *testing.T) {
+			natdev := newTestNatDevice()
+			ipheader := ipHeader{version: 4, protocol: tt.protocol, srcAddr: testNatLocalAddr, destAddr: remote}
+			if _, err := natExec(&ipheader, natPacketHeader{packet: testNatSegment(tt.proto, testNatLocalAddr, remote, 5000, 53)}, natdev, tt.proto, outgoing); err != nil {
+				t.Fatal(err)
+			}
+			remotePort := uint16(53)
+			if tt.proto == icmp {
+				remotePort = 0
+			}
+			entry := natdev.natEntry.getNatEntryByLocal(tt.proto, testNatLocalAddr, 5000, remote, remotePort)
+			if entry.globalPort == 0 {
+				t.Fatal("nat entry is not created")
+			}
+
+			// 外の経路上のルータから届くエラーの中身は変換後のパケット
+			segment := testNatSegment(tt.proto, testNatOutsideAddr, remote, entry.globalPort, 53)
+			ipheader = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, srcAddr: gateway, destAddr: testNatOutsideAddr}
+			packet := testNatIcmpError(ICMP_TYPE_DESTINATION_UNREACHABLE, tt.protocol, testNatOutsideAddr, remote, segment)
+			translated, err := natExec(&ipheader, natPacketHeader{packet: packet}, natdev, icmp, incoming)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ipheader.destAddr != testNatLocalAddr {
+				t.Fatalf("incoming error is to %s", printIPAddr(ipheader.destAddr))
+			}
+			inner, segment := checkTestNatIcmpError(t, translated)
+			port := byteToUint16(segment[0:2])
+			if tt.proto == icmp {
+				port = byteToUint16(segment[4:6])
+			}
+			if inner.srcAddr != testNatLocalAddr || port != 5000 {
+				t.Fatalf("inner packet of incoming error is from %s:%d", printIPAddr(inner.srcAddr), port)
+			}
+
+			// 内側のホストが外から届いたパケットに返すエラーの中身は変換前の宛先を持つ
+			segment = testNatSegment(tt.proto, remote, testNatLocalAddr, 53, 5000)
+			if tt.proto == icmp {
+				segment = testNatSegment(tt.proto, remote, testNatLocalAddr, 5000, 0)
+			}
+			ipheader = ipHeader{version: 4, protocol: IP_PROTOCOL_NUM_ICMP, srcAddr: testNatLocalAddr, destAddr: remote}
+			packet = testNatIcmpError(ICMP_TYPE_DESTINATION_UNREACHABLE, tt.protocol, remote, testNatLocalAddr, segment)
+			translated, err = natExec(&ipheader, natPacketHeader{packet: packet}, natdev, icmp, outgoing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ipheader.srcAddr != testNatOutsideAddr {
+				t.Fatalf("outgoing error is from %s", printIPAddr(ipheader.srcAddr))
+			}
+			inner, segment = checkTestNatIcmpError(t, translated)
+			port = byteToUint16(segment[2:4])
+			if tt.proto == icmp {
+				port = byteToUint16(segment[4:6])
+			}
+			if inner.destAddr != testNatOutsideAddr || port != entry.globalPort {
+				t.Fatalf("inner packet of outgoing error is to %s:%d", printIPAddr(inner.destAddr), port)
+			}
+		})
+	}
+}
+
+func TestNatEntryTimeout(t *testing.T) {
+	remote := uint32(0x08080808)
+	type step struct {
+		tcpflag   uint8
+		direction natDirectionType
+	}
+	tests := []struct {
+		name        string
+		proto       natProtocolType
+		steps       []step
+		wantState   natTcpState
+		wantTimeout time.Duration
+	}{
+		{"TCP SYN", tcp, []step{{TCP_FLAG_SYN, outgoing}}, natTcpSynSent, NAT_TCP_TRANSITORY_TIMEOUT},
+		{"TCP established", tcp, []step{{TCP_FLAG_SYN, outgoing}, {TCP_FLAG_SYN | TCP_FLAG_ACK, incoming}, {TCP_FLAG_ACK, outgoing}},
+			natTcpEstablished, NAT_TCP_ESTABLISHED_TIMEOUT},
+		{"TCP FIN from local", tcp, []step{{TCP_FLAG_SYN, outgoing}, {TCP_FLAG_SYN | TCP_FLAG_ACK, incoming}, {TCP_FLAG_FIN | TCP_FLAG_ACK, outgoing}},
+			natTcpFinWait, NAT_TCP_TRANSITORY_TIMEOUT},
+		{"TCP FIN from both", tcp, []step{{TCP_FLAG_SYN, outgoing}, {TCP_FLAG_SYN | TCP_FLAG_ACK, incoming}, {TCP_FLAG_FIN | TCP_FLAG_ACK, outgoing}, {TCP_FLAG_FIN | TCP_FLAG_ACK, incoming}},
+			natTcpClosed, NAT_TCP_CLOSED_TIMEOUT},
+		{"TCP RST", tcp, []step{{TCP_FLAG_SYN, outgoing}, {TCP_FLAG_SYN | TCP_FLAG_ACK, incoming}, {TCP_FLAG_RST, incoming}},
+			natTcpClosed, NAT_TCP_CLOSED_TIMEOUT},
+		{"UDP", udp, []step{{0, outgoing}, {0, incoming}}, natTcpSynSent, NAT_UDP_TIMEOUT},
+		{"ICMP", icmp, []step{{0, outgoing}}, natTcpSynSent, NAT_ICMP_TIMEOUT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			natdev := newTestNatDevice()
+			now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			natdev.natEntry.clock = func() time.Time { return now }
+			protocol := map[natProtocolType]uint8{tcp: IP_PROTOCOL_NUM_TCP, udp: IP_PROTOCOL_NUM_UDP, icmp: IP_PROTOCOL_NUM_ICMP}[tt.proto]
+
+			var entry *natEntry
+			for _, s := range tt.steps {
+				// パケットの間も時刻を進める
+				now = now.Add(time.Second)
+				ipheader := ipHeader{version: 4, protocol: protocol, srcAddr: testNatLocalAddr, destAddr: remote}
+				segment := testNatSegment(tt.proto, testNatLocalAddr, remote, 5000, 80)
+				if s.direction == incoming {
+					ipheader = ipHeader{version: 4, protocol: protocol, srcAddr: remote, destAddr: testNatOutsideAddr}
+					segment = testNatSegment(tt.proto, remote, testNatOutsideAddr, 80, entry.globalPort)
+				}
+				if tt.proto == tcp {
+					segment[13] = s.tcpflag
+				}
+				if _, err := natExec(&ipheader, natPacketHeader{packet: segment}, natdev, tt.proto, s.direction); err != nil {
+					t.Fatal(err)
+				}
+				if entry == nil {
+					remotePort := uint16(80)
+					if tt.proto == icmp {
+						remotePort = 0
+					}
+					entry = natdev.natEntry.getNatEntryByLocal(tt.proto, testNatLocalAddr, 5000, remote, remotePort)
+				}
+			}
+			if tt.proto == tcp && entry.tcpState != tt.wantState {
+				t.Fatalf("tcp state is %d, want %d", entry.tcpState, tt.wantState)
+			}
+			if !entry.lastSeen.Equal(now) {
+				t.Fatalf("last seen is %s, want %s", entry.lastSeen, now)
+			}
+			if got := entry.natEntryTimeout(tt.proto); got != tt.wantTimeout {
+				t.Fatalf("timeout is %s, want %s", got, tt.wantTimeout)
+			}
+
+			// タイムアウトするまでは削除しない
+			if count := natdev.natEntry.sweepNatEntries(now.Add(tt.wantTimeout)); count != 0 {
+				t.Fatalf("%d entries are deleted before timeout", count)
+			}
+			if count := natdev.natEntry.sweepNatEntries(now.Add(tt.wantTimeout + time.Second)); count != 1 {
+				t.Fatalf("%d entries are deleted after timeout", count)
+			}
+			if len(natdev.natEntry.table(tt.proto).byGlobal) != 0 {
+				t.Fatal("timed out entry is left")
+			}
+		})
+	}
+}
+
+func TestNatSweeperStop(t *testing.T) {
+	natdev := newTestNatDevice()
+	sendTestNatUdp(t, natdev, 5000, 0x08080808, 53)
+	// 削除はNATの時刻で判定する
+	natdev.natEntry.clock = func() time.Time { return time.Now().Add(NAT_UDP_TIMEOUT + time.Minute) }
+
+	done := make(chan struct{})
+	go func() {
+		natdev.natEntry.runNatSweeper(time.Millisecond)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); ; {
+		natdev.natEntry.mutex.Lock()
+		count := len(natdev.natEntry.udp.byGlobal)
+		natdev.natEntry.mutex.Unlock()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out entry is not deleted by sweeper")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	natdev.natEntry.stopNatSweeper()
+	// 2回止めてもpanicしない
+	natdev.natEntry.stopNatSweeper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("sweeper is not stopped")
+	}
+}
+
+func TestParseNatAddressPool(t *testing.T) {
+	addrs, err := parseNatAddressPool("192.168.0.10-192.168.0.12,192.168.0.20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint32{0xc0a8000a, 0xc0a8000b, 0xc0a8000c, 0xc0a80014}
+	if len(addrs) != len(want) {
+		t.Fatalf("parseNatAddressPool() = %v, want %v", addrs, want)
+	}
+	for i := range want {
+		if addrs[i] != want[i] {
+			t.Fatalf("parseNatAddressPool() = %v, want %v", addrs, want)
+		}
+	}
+	if _, err := parseNatAddressPool("192.168.0.12-192.168.0.10"); err == nil {
+		t.Fatal("reversed range is accepted")
+	}
+
+	// 最後のアドレスまでの範囲でも止まる
+	addrs, err = parseNatAddressPool("255.255.255.254-255.255.255.255")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 2 || addrs[0] != 0xfffffffe || addrs[1] != 0xffffffff {
+		t.Fatalf("parseNatAddressPool() = %v", addrs)
+	}
+	// 大きすぎる範囲は受け付けない
+	for _, pool := range []string{"0.0.0.0-255.255.255.255", "10.0.0.0-10.1.0.0", "10.0.0.0-10.0.255.255,10.1.0.0"} {
+		if _, err := parseNatAddressPool(pool); err == nil {
+			t.Errorf("too large pool %q is accepted", pool)
+		}
+	}
+	if addrs, err := parseNatAddressPool("10.0.0.0-10.0.255.255"); err != nil || len(addrs) != NAT_POOL_MAX_ADDRS {
+		t.Fatalf("/16 pool has %d addrs, err is %v", len(addrs), err)
+	}
+}
+
+func BenchmarkGetNatEntryByLocalFullTable(b *testing.B) {
+	natdev := newTestNatDevice()
+	fillNatTable(b, natdev, tcp)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		natdev.natEntry.getNatEntryByLocal(tcp, testNatLocalAddr, uint16(1024+i%NAT_GLOBAL_PORT_SIZE), 0x08080808, 53)
+	}
+}
+
+func BenchmarkGetNatEntryByGlobalFullTable(b *testing.B) {
+	natdev := newTestNatDevice()
+	fillNatTable(b, natdev, tcp)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		natdev.natEntry.getNatEntryByGlobal(tcp, testNatOutsideAddr, uint16(NAT_GLOBAL_PORT_MIN+i%NAT_GLOBAL_PORT_SIZE))
+	}
+}
+
+func BenchmarkCreateDeleteNatEntryFullTable(b *testing.B) {
+	natdev := newTestNatDevice()
+	fillNatTable(b, natdev, udp)
+	// 1つだけ空けて作成と削除を繰り返す
+	natdev.natEntry.deleteNatEntry(udp, natdev.natEntry.getNatEntryByGlobal(udp, testNatOutsideAddr, NAT_GLOBAL_PORT_MIN))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry := natdev.natEntry.createNatEntry(udp, testNatLocalAddr+1, 80, 0x08080808, 53)
+		natdev.natEntry.deleteNatEntry(udp, entry)
+	}
+}
+
+func BenchmarkNatExecOutgoingUdpFullTable(b *testing.B) {
+	natdev := newTestNatDevice()
+	fillNatTable(b, natdev, udp)
+	udpPacket := (&udpHeader{srcPort: 1024, destPort: 53, length: 8}).ToPacket()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ipheader := ipHeader{
+			version:  4,
+			protocol: IP_PROTOCOL_NUM_UDP,
+			srcAddr:  testNatLocalAddr,
+			destAddr: 0x08080808,
+		}
+		_, err := natExec(&ipheader, natPacketHeader{packet: udpPacket}, natdev, udp, outgoing)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
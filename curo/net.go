@@ -0,0 +1,131 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+var IGNORE_INTERFACES = []string{"lo", "bond0", "dummy0", "tunl0", "sit0"}
+
+// カーネルが外したVLANのタグを受け取るためのソケットオプション
+const PACKET_AUXDATA = 8
+const TP_STATUS_VLAN_VALID = 0x10
+
+type netDevice struct {
+	name       string
+	macaddr    [6]uint8
+	driver     netDeviceDriver // 論理デバイスならnil
+	ifindex    int
+	etheHeader ethernetHeader
+	ipdev      ipDevice // 2章で追加
+	ipv6dev    ipv6Device
+	vlanId     uint16        // VLANのサブインターフェイスならVLAN ID
+	parent     *netDevice    // VLANのサブインターフェイスの親のデバイス
+	bridge     *bridgeDomain // ブリッジのポートなら所属するブリッジ
+	irb        *bridgeDomain // IRBのインターフェイスならつながっているブリッジ
+	bond       *bondDevice   // bondのメンバーなら所属するbond
+	aggregator *bondDevice   // bondの論理デバイスならまとめているbond
+	router     *Router       // デバイスが所属するルータ
+}
+
+func isIgnoreInterfaces(name string) bool {
+	for _, v := range IGNORE_INTERFACES {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// htons converts a short (uint16) from host-to-network byte order.
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
+
+// ネットデバイスの送信処理
+func (netdev netDevice) netDeviceTransmit(data []byte) error {
+	// IRBのインターフェイスはブリッジのポートから送信する
+	if netdev.irb != nil {
+		return netdev.irb.irbTransmit(data)
+	}
+	// bondの論理デバイスはフローごとにメンバーを選んで送信する
+	if netdev.aggregator != nil {
+		return netdev.aggregator.transmit(data)
+	}
+	// VLANのサブインターフェイスはタグをつけて親のデバイスから送信する
+	if netdev.parent != nil {
+		return netdev.parent.netDeviceTransmit(vlanTag(data, netdev.vlanId))
+	}
+	if netdev.driver == nil {
+		return fmt.Errorf("device %s has no driver", netdev.name)
+	}
+	netdev.router.captureFrame(&netdev, data, captureOutbound)
+	return netdev.driver.transmit(data)
+}
+
+// ネットデバイスの受信処理
+func (netdev *netDevice) netDevicePoll(mode string) error {
+	frame, err := netdev.driver.receive()
+	if err != nil {
+		return fmt.Errorf("recv err, device is %s, err is %s", netdev.name, err)
+	}
+	if frame == nil {
+		return nil
+	}
+	netdev.netDeviceInput(mode, frame)
+	return nil
+}
+
+/*
+受信したフレームの処理
+pcapのリプレイではドライバから受信せずにファイルから読んだフレームを渡す
+*/
+func (netdev *netDevice) netDeviceInput(mode string, frame []byte) {
+	netdev.router.captureFrame(netdev, frame, captureInbound)
+	// 1章では受信したパケットをprintするだけ
+	if mode == "ch1" {
+		fmt.Printf("Received %d bytes from %s: %x\n", len(frame), netdev.name, frame)
+	} else {
+		// 2章から追加
+		ethernetInput(netdev, frame)
+	}
+}
+
+/*
+epollで待てないドライバにたまっているフレームを全て受信する
+*/
+func (netdev *netDevice) netDeviceDrain(mode string) error {
+	driver, ok := netdev.driver.(bufferedDriver)
+	if !ok {
+		return nil
+	}
+	for driver.buffered() {
+		if err := netdev.netDevicePoll(mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+PACKET_AUXDATAの制御メッセージからカーネルが外したVLANのタグを取り出す
+struct tpacket_auxdataのtp_statusとtp_vlan_tciを読む
+*/
+func parseVlanAuxdata(oob []byte) (uint16, bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != syscall.SOL_PACKET || msg.Header.Type != PACKET_AUXDATA || len(msg.Data) < 18 {
+			continue
+		}
+		// auxdataはホストのバイトオーダー
+		status := binary.LittleEndian.Uint32(msg.Data[0:4])
+		if status&TP_STATUS_VLAN_VALID != 0 {
+			return binary.LittleEndian.Uint16(msg.Data[16:18]), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,130 @@
+package curo
+
+import (
+	"fmt"
+
+	"github.com/sat0ken/go-curo/checksum"
+	tcpcodec "github.com/sat0ken/go-curo/tcp"
+	udpcodec "github.com/sat0ken/go-curo/udp"
+)
+
+// TCPのフラグ
+const (
+	TCP_FLAG_FIN uint8 = 0x01
+	TCP_FLAG_SYN uint8 = 0x02
+	TCP_FLAG_RST uint8 = 0x04
+	TCP_FLAG_PSH uint8 = 0x08
+	TCP_FLAG_ACK uint8 = 0x10
+	TCP_FLAG_URG uint8 = 0x20
+)
+
+type udpHeader struct {
+	srcPort  uint16
+	destPort uint16
+	length   uint16
+	checksum uint16
+}
+
+type tcpHeader struct {
+	srcPort    uint16
+	destPort   uint16
+	seq        uint32
+	ackseq     uint32
+	offset     uint8
+	tcpflag    uint8
+	window     uint16
+	checksum   uint16
+	urgPointer uint16
+	options    []byte
+	tcpdata    []byte
+}
+
+/*
+疑似ヘッダを含めてTCPやUDPのチェックサムを計算する
+*/
+func calcTransportChecksum(srcAddr, destAddr uint32, protocol uint8, packet []byte) uint16 {
+	return checksum.Transport(srcAddr, destAddr, protocol, packet)
+}
+
+/*
+UDPのヘッダだけをバイト列にする
+データはNATで書き換えないので呼び出し側でつなげる
+*/
+func (udpheder *udpHeader) ToPacket() []byte {
+	return udpcodec.Header{
+		SrcPort:  udpheder.srcPort,
+		DestPort: udpheder.destPort,
+		Length:   udpheder.length,
+		Checksum: udpheder.checksum,
+	}.MarshalHeader()
+}
+
+/*
+TCPのヘッダにオプションとデータをつなげてバイト列にする
+*/
+func (tcpheader *tcpHeader) ToPacket() []byte {
+	packet, err := tcpcodec.Header{
+		SrcPort:    tcpheader.srcPort,
+		DestPort:   tcpheader.destPort,
+		Seq:        tcpheader.seq,
+		Ack:        tcpheader.ackseq,
+		DataOffset: tcpheader.offset >> 4,
+		Reserved:   tcpheader.offset & 0x0f,
+		Flags:      tcpheader.tcpflag,
+		Window:     tcpheader.window,
+		Checksum:   tcpheader.checksum,
+		UrgPointer: tcpheader.urgPointer,
+		Options:    tcpheader.options,
+	}.Marshal(tcpheader.tcpdata)
+	if err != nil {
+		fmt.Printf("marshal tcp header err : %s\n", err)
+	}
+	return packet
+}
+
+/*
+UDPのヘッダをパースする
+ヘッダより短いときやUDPの長さがパケットに収まらないときはエラーを返す
+*/
+func (udpheader *udpHeader) ParsePacket(packet []byte) (udpHeader, error) {
+	header, _, err := udpcodec.Parse(packet)
+	if err != nil {
+		return udpHeader{}, err
+	}
+	return udpHeader{
+		srcPort:  header.SrcPort,
+		destPort: header.DestPort,
+		length:   header.Length,
+		checksum: header.Checksum,
+	}, nil
+}
+
+/*
+TCPのヘッダをパースする
+ヘッダより短いときやヘッダ長がパケットに収まらないときはエラーを返す
+*/
+func (tcpheader *tcpHeader) ParsePacket(packet []byte) (tcpHeader, error) {
+	parsed, tcpdata, err := tcpcodec.Parse(packet)
+	if err != nil {
+		return tcpHeader{}, err
+	}
+	header := tcpHeader{
+		srcPort:    parsed.SrcPort,
+		destPort:   parsed.DestPort,
+		seq:        parsed.Seq,
+		ackseq:     parsed.Ack,
+		offset:     parsed.DataOffset<<4 | parsed.Reserved,
+		tcpflag:    parsed.Flags,
+		window:     parsed.Window,
+		checksum:   parsed.Checksum,
+		urgPointer: parsed.UrgPointer,
+		// TCPのオプションがあれば
+		options: parsed.Options,
+	}
+	// TCPデータがあれば
+	if len(tcpdata) != 0 {
+		header.tcpdata = tcpdata
+	}
+	fmt.Printf("parsed tcp header is %+v\n", header)
+	return header, nil
+}
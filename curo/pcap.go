@@ -0,0 +1,355 @@
+package curo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// pcapのファイルフォーマット
+const (
+	PCAP_MAGIC         uint32 = 0xa1b2c3d4
+	PCAP_MAGIC_NANO    uint32 = 0xa1b23c4d
+	PCAP_VERSION_MAJOR uint16 = 2
+	PCAP_VERSION_MINOR uint16 = 4
+	PCAP_SNAPLEN       uint32 = 65535
+	PCAP_HEADER_LEN           = 24
+	PCAP_RECORD_LEN           = 16
+	LINKTYPE_ETHERNET  uint32 = 1
+)
+
+// pcapngのファイルフォーマット
+const (
+	PCAPNG_BLOCK_SECTION_HEADER     uint32 = 0x0a0d0d0a
+	PCAPNG_BLOCK_INTERFACE          uint32 = 0x00000001
+	PCAPNG_BLOCK_ENHANCED_PACKET    uint32 = 0x00000006
+	PCAPNG_BYTE_ORDER_MAGIC         uint32 = 0x1a2b3c4d
+	PCAPNG_BYTE_ORDER_MAGIC_SWAPPED uint32 = 0x4d3c2b1a
+	PCAPNG_VERSION_MAJOR            uint16 = 1
+	PCAPNG_VERSION_MINOR            uint16 = 0
+	PCAPNG_OPTION_END               uint16 = 0
+	PCAPNG_OPTION_IF_NAME           uint16 = 2
+	PCAPNG_OPTION_IF_TSRESOL        uint16 = 9
+	PCAPNG_OPTION_EPB_FLAGS         uint16 = 2
+	PCAPNG_EPB_FLAG_INBOUND         uint32 = 0x1
+	PCAPNG_EPB_FLAG_OUTBOUND        uint32 = 0x2
+	PCAPNG_EPB_FLAG_DIRECTION       uint32 = 0x3
+	PCAPNG_TSRESOL_NANO             uint8  = 9
+	PCAPNG_TSRESOL_MICRO            uint8  = 6 // if_tsresolがない時のタイムスタンプの単位
+	PCAPNG_TSRESOL_BASE2            uint8  = 0x80
+	PCAPNG_BLOCK_LEN_MAX                   = 16 * 1024 * 1024
+	PCAPNG_BLOCK_HEADER_LEN                = 8
+	PCAPNG_SECTION_HEADER_BODY_LEN         = 16
+	PCAPNG_INTERFACE_BODY_LEN              = 8
+	PCAPNG_ENHANCED_PACKET_BODY_LEN        = 20
+)
+
+/*
+pcapのファイルの先頭のヘッダを作る
+タイムスタンプはマイクロ秒で書く
+*/
+func pcapFileHeader() []byte {
+	header := make([]byte, PCAP_HEADER_LEN)
+	binary.LittleEndian.PutUint32(header[0:4], PCAP_MAGIC)
+	binary.LittleEndian.PutUint16(header[4:6], PCAP_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(header[6:8], PCAP_VERSION_MINOR)
+	binary.LittleEndian.PutUint32(header[16:20], PCAP_SNAPLEN)
+	binary.LittleEndian.PutUint32(header[20:24], LINKTYPE_ETHERNET)
+	return header
+}
+
+/*
+pcapのレコードのヘッダにフレームをつなげる
+*/
+func pcapRecord(ts time.Time, frame []byte) []byte {
+	record := make([]byte, PCAP_RECORD_LEN, PCAP_RECORD_LEN+len(frame))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(frame)))
+	return append(record, frame...)
+}
+
+// 4バイト境界に合わせるためのパディングの長さ
+func pcapngPadLen(length int) int {
+	return (4 - length%4) % 4
+}
+
+/*
+pcapngのブロックを作る
+ブロックの長さは先頭と末尾の両方に書く
+*/
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	totalLen := PCAPNG_BLOCK_HEADER_LEN + len(body) + 4
+	block := make([]byte, 0, totalLen)
+	block = binary.LittleEndian.AppendUint32(block, blockType)
+	block = binary.LittleEndian.AppendUint32(block, uint32(totalLen))
+	block = append(block, body...)
+	return binary.LittleEndian.AppendUint32(block, uint32(totalLen))
+}
+
+// pcapngのオプションを1つ追加する
+func pcapngAppendOption(body []byte, code uint16, value []byte) []byte {
+	body = binary.LittleEndian.AppendUint16(body, code)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(value)))
+	body = append(body, value...)
+	return append(body, make([]byte, pcapngPadLen(len(value)))...)
+}
+
+/*
+pcapngのセクションヘッダブロックを作る
+セクションの長さは分からないので-1にする
+*/
+func pcapngSectionHeader() []byte {
+	body := make([]byte, PCAPNG_SECTION_HEADER_BODY_LEN)
+	binary.LittleEndian.PutUint32(body[0:4], PCAPNG_BYTE_ORDER_MAGIC)
+	binary.LittleEndian.PutUint16(body[4:6], PCAPNG_VERSION_MAJOR)
+	binary.LittleEndian.PutUint16(body[6:8], PCAPNG_VERSION_MINOR)
+	binary.LittleEndian.PutUint64(body[8:16], 0xffffffffffffffff)
+	return pcapngBlock(PCAPNG_BLOCK_SECTION_HEADER, body)
+}
+
+/*
+pcapngのインターフェイス記述ブロックを作る
+インターフェイス名をif_nameに入れ、タイムスタンプはナノ秒にする
+*/
+func pcapngInterfaceBlock(name string) []byte {
+	body := make([]byte, PCAPNG_INTERFACE_BODY_LEN)
+	binary.LittleEndian.PutUint16(body[0:2], uint16(LINKTYPE_ETHERNET))
+	binary.LittleEndian.PutUint32(body[4:8], PCAP_SNAPLEN)
+	body = pcapngAppendOption(body, PCAPNG_OPTION_IF_NAME, []byte(name))
+	body = pcapngAppendOption(body, PCAPNG_OPTION_IF_TSRESOL, []byte{PCAPNG_TSRESOL_NANO})
+	body = pcapngAppendOption(body, PCAPNG_OPTION_END, nil)
+	return pcapngBlock(PCAPNG_BLOCK_INTERFACE, body)
+}
+
+/*
+pcapngの拡張パケットブロックを作る
+flagsには受信か送信かの向きを入れる
+*/
+func pcapngPacketBlock(interfaceId uint32, ts time.Time, frame []byte, flags uint32) []byte {
+	body := make([]byte, PCAPNG_ENHANCED_PACKET_BODY_LEN, PCAPNG_ENHANCED_PACKET_BODY_LEN+len(frame)+16)
+	nano := uint64(ts.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:4], interfaceId)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(nano>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(nano))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(frame)))
+	body = append(body, frame...)
+	body = append(body, make([]byte, pcapngPadLen(len(frame)))...)
+	if flags != 0 {
+		body = pcapngAppendOption(body, PCAPNG_OPTION_EPB_FLAGS, binary.LittleEndian.AppendUint32(nil, flags))
+		body = pcapngAppendOption(body, PCAPNG_OPTION_END, nil)
+	}
+	return pcapngBlock(PCAPNG_BLOCK_ENHANCED_PACKET, body)
+}
+
+/*
+pcapngのファイルから読んだフレーム
+*/
+type pcapngPacket struct {
+	ifname string
+	ts     time.Time
+	flags  uint32 // epb_flags, 向きが分からなければ0
+	frame  []byte
+}
+
+// pcapngのインターフェイス記述ブロックから読んだインターフェイス
+type pcapngInterface struct {
+	name    string
+	tsresol uint8
+}
+
+/*
+pcapngのファイルを読んで拡張パケットブロックのフレームを全て返す
+セクションが変わるとインターフェイスのIDは振り直しになる
+イーサネット以外のリンクタイプのインターフェイスや、名前のないインターフェイスのフレームはエラーにする
+*/
+func readPcapng(reader io.Reader) ([]pcapngPacket, error) {
+	var order binary.ByteOrder
+	var interfaces []pcapngInterface
+	var packets []pcapngPacket
+	for {
+		header := make([]byte, PCAPNG_BLOCK_HEADER_LEN)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF && order != nil {
+				return packets, nil
+			}
+			return nil, fmt.Errorf("read pcapng block err : %s", err)
+		}
+		blockType := binary.LittleEndian.Uint32(header[0:4])
+		if blockType == PCAPNG_BLOCK_SECTION_HEADER {
+			// セクションヘッダのマジックナンバーでバイトオーダーを判断する
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(reader, magic); err != nil {
+				return nil, fmt.Errorf("read pcapng section header err : %s", err)
+			}
+			switch binary.LittleEndian.Uint32(magic) {
+			case PCAPNG_BYTE_ORDER_MAGIC:
+				order = binary.LittleEndian
+			case PCAPNG_BYTE_ORDER_MAGIC_SWAPPED:
+				order = binary.BigEndian
+			default:
+				return nil, fmt.Errorf("invalid pcapng byte order magic %x", magic)
+			}
+			header = append(header, magic...)
+			interfaces = nil
+		} else if order == nil {
+			return nil, fmt.Errorf("not pcapng file, first block type is %x", blockType)
+		}
+		blockType = order.Uint32(header[0:4])
+		totalLen := int(order.Uint32(header[4:8]))
+		if totalLen%4 != 0 || totalLen < len(header)+4 || totalLen > PCAPNG_BLOCK_LEN_MAX {
+			return nil, fmt.Errorf("invalid pcapng block length %d", totalLen)
+		}
+		block := make([]byte, totalLen)
+		copy(block, header)
+		if _, err := io.ReadFull(reader, block[len(header):]); err != nil {
+			return nil, fmt.Errorf("read pcapng block err : %s", err)
+		}
+		if int(order.Uint32(block[totalLen-4:])) != totalLen {
+			return nil, fmt.Errorf("pcapng block length %d does not match trailer", totalLen)
+		}
+		body := block[PCAPNG_BLOCK_HEADER_LEN : totalLen-4]
+		switch blockType {
+		case PCAPNG_BLOCK_SECTION_HEADER:
+			if len(body) < PCAPNG_SECTION_HEADER_BODY_LEN {
+				return nil, fmt.Errorf("pcapng section header is too short")
+			}
+			if major := order.Uint16(body[4:6]); major != PCAPNG_VERSION_MAJOR {
+				return nil, fmt.Errorf("unsupported pcapng version %d", major)
+			}
+		case PCAPNG_BLOCK_INTERFACE:
+			netif, err := parsePcapngInterface(order, body)
+			if err != nil {
+				return nil, err
+			}
+			interfaces = append(interfaces, netif)
+		case PCAPNG_BLOCK_ENHANCED_PACKET:
+			packet, err := parsePcapngPacket(order, body, interfaces)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, packet)
+		}
+		// それ以外のブロックは読み飛ばす
+	}
+}
+
+/*
+インターフェイス記述ブロックからリンクタイプとインターフェイス名、タイムスタンプの単位を読む
+*/
+func parsePcapngInterface(order binary.ByteOrder, body []byte) (pcapngInterface, error) {
+	if len(body) < PCAPNG_INTERFACE_BODY_LEN {
+		return pcapngInterface{}, fmt.Errorf("pcapng interface block is too short")
+	}
+	if linkType := uint32(order.Uint16(body[0:2])); linkType != LINKTYPE_ETHERNET {
+		return pcapngInterface{}, fmt.Errorf("unsupported pcapng link type %d", linkType)
+	}
+	netif := pcapngInterface{tsresol: PCAPNG_TSRESOL_MICRO}
+	err := parsePcapngOptions(order, body[PCAPNG_INTERFACE_BODY_LEN:], func(code uint16, value []byte) error {
+		switch code {
+		case PCAPNG_OPTION_IF_NAME:
+			netif.name = string(value)
+		case PCAPNG_OPTION_IF_TSRESOL:
+			if len(value) != 1 {
+				return fmt.Errorf("invalid if_tsresol length %d", len(value))
+			}
+			netif.tsresol = value[0]
+			// 2の累乗の単位は63まで, 10の累乗の単位はナノ秒より細かいと64ビットに収まらないので19まで
+			if netif.tsresol&PCAPNG_TSRESOL_BASE2 != 0 && netif.tsresol&^PCAPNG_TSRESOL_BASE2 > 63 ||
+				netif.tsresol&PCAPNG_TSRESOL_BASE2 == 0 && netif.tsresol > 19 {
+				return fmt.Errorf("unsupported if_tsresol %x", netif.tsresol)
+			}
+		}
+		return nil
+	})
+	return netif, err
+}
+
+/*
+拡張パケットブロックからフレームとタイムスタンプ、向きを読む
+*/
+func parsePcapngPacket(order binary.ByteOrder, body []byte, interfaces []pcapngInterface) (pcapngPacket, error) {
+	if len(body) < PCAPNG_ENHANCED_PACKET_BODY_LEN {
+		return pcapngPacket{}, fmt.Errorf("pcapng enhanced packet block is too short")
+	}
+	interfaceId := order.Uint32(body[0:4])
+	if int(interfaceId) >= len(interfaces) {
+		return pcapngPacket{}, fmt.Errorf("pcapng interface id %d is not described", interfaceId)
+	}
+	netif := interfaces[interfaceId]
+	if netif.name == "" {
+		return pcapngPacket{}, fmt.Errorf("pcapng interface %d has no name", interfaceId)
+	}
+	capLen := int(order.Uint32(body[12:16]))
+	if capLen > len(body)-PCAPNG_ENHANCED_PACKET_BODY_LEN {
+		return pcapngPacket{}, fmt.Errorf("pcapng captured length %d is longer than block", capLen)
+	}
+	packet := pcapngPacket{
+		ifname: netif.name,
+		ts:     pcapngTimestamp(uint64(order.Uint32(body[4:8]))<<32|uint64(order.Uint32(body[8:12])), netif.tsresol),
+		frame:  body[PCAPNG_ENHANCED_PACKET_BODY_LEN : PCAPNG_ENHANCED_PACKET_BODY_LEN+capLen],
+	}
+	optionsOffset := PCAPNG_ENHANCED_PACKET_BODY_LEN + capLen + pcapngPadLen(capLen)
+	if optionsOffset > len(body) {
+		return pcapngPacket{}, fmt.Errorf("pcapng enhanced packet block has no padding")
+	}
+	err := parsePcapngOptions(order, body[optionsOffset:], func(code uint16, value []byte) error {
+		if code == PCAPNG_OPTION_EPB_FLAGS && len(value) == 4 {
+			packet.flags = order.Uint32(value)
+		}
+		return nil
+	})
+	return packet, err
+}
+
+/*
+ブロックの末尾のオプションを順番に読む
+opt_endofoptか末尾で終わる
+*/
+func parsePcapngOptions(order binary.ByteOrder, options []byte, fn func(code uint16, value []byte) error) error {
+	for len(options) >= 4 {
+		code, length := order.Uint16(options[0:2]), int(order.Uint16(options[2:4]))
+		if code == PCAPNG_OPTION_END {
+			return nil
+		}
+		if 4+length > len(options) {
+			return fmt.Errorf("pcapng option %d length %d is longer than block", code, length)
+		}
+		if err := fn(code, options[4:4+length]); err != nil {
+			return err
+		}
+		next := 4 + length + pcapngPadLen(length)
+		if next > len(options) {
+			return nil
+		}
+		options = options[next:]
+	}
+	return nil
+}
+
+/*
+if_tsresolの単位のタイムスタンプを時刻にする
+最上位ビットが立っていれば2の累乗, そうでなければ10の累乗分の1秒が単位
+*/
+func pcapngTimestamp(units uint64, tsresol uint8) time.Time {
+	if tsresol&PCAPNG_TSRESOL_BASE2 != 0 {
+		shift := tsresol &^ PCAPNG_TSRESOL_BASE2
+		frac := units & (1<<shift - 1)
+		hi, lo := bits.Mul64(frac, uint64(time.Second))
+		nsec, _ := bits.Div64(hi, lo, 1<<shift)
+		return time.Unix(int64(units>>shift), int64(nsec))
+	}
+	unit := uint64(1)
+	for i := uint8(0); i < tsresol; i++ {
+		unit *= 10
+	}
+	sec := units / unit
+	frac := units % unit
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nsec, _ := bits.Div64(hi, lo, unit)
+	return time.Unix(int64(sec), int64(nsec))
+}
@@ -0,0 +1,109 @@
+package curo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// テスト用にビッグエンディアンのpcapngのブロックを作る
+func testBigEndianPcapngBlock(blockType uint32, body []byte) []byte {
+	totalLen := uint32(PCAPNG_BLOCK_HEADER_LEN + len(body) + 4)
+	block := binary.BigEndian.AppendUint32(nil, blockType)
+	block = binary.BigEndian.AppendUint32(block, totalLen)
+	block = append(block, body...)
+	return binary.BigEndian.AppendUint32(block, totalLen)
+}
+
+func TestReadPcapng(t *testing.T) {
+	ts := time.Unix(1700000000, 123456789)
+	frame := bytes.Repeat([]byte{0xaa}, 61)
+	var file []byte
+	file = append(file, pcapngSectionHeader()...)
+	file = append(file, pcapngInterfaceBlock("router1-br0")...)
+	file = append(file, pcapngInterfaceBlock("router1-router2")...)
+	file = append(file, pcapngPacketBlock(1, ts, frame, PCAPNG_EPB_FLAG_OUTBOUND)...)
+	file = append(file, pcapngPacketBlock(0, ts.Add(time.Second), frame[:60], 0)...)
+	packets, err := readPcapng(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 || packets[0].ifname != "router1-router2" || !packets[0].ts.Equal(ts) ||
+		packets[0].flags != PCAPNG_EPB_FLAG_OUTBOUND || !bytes.Equal(packets[0].frame, frame) {
+		t.Fatalf("first packet is %+v", packets[0])
+	}
+	if packets[1].ifname != "router1-br0" || packets[1].flags != 0 || len(packets[1].frame) != 60 {
+		t.Fatalf("second packet is %+v", packets[1])
+	}
+
+	// ビッグエンディアンで書かれた, if_tsresolのないファイルはマイクロ秒で読む
+	shb := binary.BigEndian.AppendUint32(nil, PCAPNG_BYTE_ORDER_MAGIC)
+	shb = binary.BigEndian.AppendUint16(shb, PCAPNG_VERSION_MAJOR)
+	shb = binary.BigEndian.AppendUint16(shb, PCAPNG_VERSION_MINOR)
+	shb = binary.BigEndian.AppendUint64(shb, 0xffffffffffffffff)
+	idb := binary.BigEndian.AppendUint16(nil, uint16(LINKTYPE_ETHERNET))
+	idb = append(idb, 0, 0, 0, 0, 0xff, 0xff)
+	idb = binary.BigEndian.AppendUint16(idb, PCAPNG_OPTION_IF_NAME)
+	idb = binary.BigEndian.AppendUint16(idb, 4)
+	idb = append(idb, "eth0"...)
+	epb := binary.BigEndian.AppendUint32(nil, 0)
+	micro := uint64(ts.UnixMicro())
+	epb = binary.BigEndian.AppendUint32(epb, uint32(micro>>32))
+	epb = binary.BigEndian.AppendUint32(epb, uint32(micro))
+	epb = binary.BigEndian.AppendUint32(epb, 2)
+	epb = binary.BigEndian.AppendUint32(epb, 2)
+	epb = append(epb, 0x01, 0x02, 0, 0)
+	file = testBigEndianPcapngBlock(PCAPNG_BLOCK_SECTION_HEADER, shb)
+	file = append(file, testBigEndianPcapngBlock(PCAPNG_BLOCK_INTERFACE, idb)...)
+	// 知らないブロックは読み飛ばす
+	file = append(file, testBigEndianPcapngBlock(0x00000005, make([]byte, 8))...)
+	file = append(file, testBigEndianPcapngBlock(PCAPNG_BLOCK_ENHANCED_PACKET, epb)...)
+	packets, err = readPcapng(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || packets[0].ifname != "eth0" || !packets[0].ts.Equal(ts.Truncate(time.Microsecond)) ||
+		!bytes.Equal(packets[0].frame, []byte{0x01, 0x02}) {
+		t.Fatalf("big endian packet is %+v", packets)
+	}
+
+	// 2の累乗の単位のタイムスタンプ
+	if got := pcapngTimestamp(3<<20|1<<19, PCAPNG_TSRESOL_BASE2|20); !got.Equal(time.Unix(3, 500000000)) {
+		t.Fatalf("base2 timestamp is %s", got)
+	}
+
+	// pcapngではないファイル, 途中で切れたファイル, 記述のないインターフェイスのフレームはエラーにする
+	invalid := [][]byte{
+		pcapFileHeader(),
+		pcapngSectionHeader()[:20],
+		append(pcapngSectionHeader(), pcapngPacketBlock(0, ts, frame, 0)...),
+		append(pcapngSectionHeader(), pcapngInterfaceBlock("router1-br0")[:16]...),
+	}
+	for i, data := range invalid {
+		if _, err := readPcapng(bytes.NewReader(data)); err == nil {
+			t.Errorf("invalid file %d is read", i)
+		}
+	}
+}
+
+func FuzzReadPcapng(f *testing.F) {
+	ts := time.Unix(1700000000, 0)
+	var file []byte
+	file = append(file, pcapngSectionHeader()...)
+	file = append(file, pcapngInterfaceBlock("router1-br0")...)
+	file = append(file, pcapngPacketBlock(0, ts, []byte{0x01, 0x02, 0x03}, PCAPNG_EPB_FLAG_INBOUND)...)
+	f.Add(file)
+	f.Add(pcapngSectionHeader())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packets, err := readPcapng(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if packet.ifname == "" || len(packet.frame) > len(data) {
+				t.Fatalf("packet is %+v", packet)
+			}
+		}
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package curo
 
 // IPアドレスのLongest prefix matchingに使う二分探索木ノード
 type radixTreeNode struct {
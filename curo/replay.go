@@ -0,0 +1,127 @@
+package curo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+/*
+pcapをリプレイしている時のドライバ
+何も受信せず、送信したフレームはリプレイの出力のファイルに書く
+*/
+type replayDriver struct {
+	name   string
+	output *packetCapture
+}
+
+func (driver *replayDriver) fd() int {
+	return -1
+}
+
+func (driver *replayDriver) receive() ([]byte, error) {
+	return nil, nil
+}
+
+func (driver *replayDriver) transmit(frame []byte) error {
+	return driver.output.writeFrame(driver.name, frame, captureOutbound)
+}
+
+func (driver *replayDriver) linkUp() bool {
+	return true
+}
+
+func (driver *replayDriver) setPromiscuous() error {
+	return nil
+}
+
+func (driver *replayDriver) close() error {
+	return nil
+}
+
+/*
+pcapngのファイルのフレームをタイムスタンプの順にルータに受信させ、ルータが送信したフレームをoutPathに書き出す
+フレームはキャプチャした時と同じ名前のデバイスで受信させるので、先にデバイスを作っておく
+outPathの拡張子が.pcapngならインターフェイスのわかるpcapngで書き、それ以外ならpcapで書く
+デバイスのドライバをリプレイのドライバに置き換えるので、リプレイした後はRunできない
+*/
+func (router *Router) Replay(inPath, outPath string) error {
+	file, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	packets, err := readPcapng(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("read replay file err : %s", err)
+	}
+	format := "pcap"
+	if filepath.Ext(outPath) == ".pcapng" {
+		format = "pcapng"
+	}
+	output, err := newPacketCapture(CaptureOptions{Path: outPath, Format: format})
+	if err != nil {
+		return err
+	}
+	return router.replay(packets, output)
+}
+
+/*
+キャプチャしたフレームのうちルータが受信したものをリプレイする
+ルータの時刻は処理しているフレームのタイムスタンプにするので、RSTPなどのタイマーやNATのタイムアウトもキャプチャの時刻で動く
+*/
+func (router *Router) replay(packets []pcapngPacket, output *packetCapture) error {
+	var inputs []pcapngPacket
+	for _, packet := range packets {
+		netdev := router.getnetDeviceByName(packet.ifname)
+		if netdev.name == "" || netdev.driver == nil {
+			return fmt.Errorf("device %s of replayed frame is not found", packet.ifname)
+		}
+		// キャプチャした時にルータが送信したフレームは受信させない
+		direction := packet.flags & PCAPNG_EPB_FLAG_DIRECTION
+		if direction == PCAPNG_EPB_FLAG_OUTBOUND {
+			continue
+		}
+		// 向きが分からないファイルではルータのMACアドレスから送信したフレームを除く
+		if direction == 0 && len(packet.frame) >= 12 && setMacAddr(packet.frame[6:12]) == netdev.macaddr {
+			continue
+		}
+		inputs = append(inputs, packet)
+	}
+	sort.SliceStable(inputs, func(i, j int) bool {
+		return inputs[i].ts.Before(inputs[j].ts)
+	})
+
+	for _, netdev := range router.devices {
+		if netdev.driver == nil {
+			continue
+		}
+		netdev.driver.close()
+		netdev.driver = &replayDriver{name: netdev.name, output: output}
+	}
+	// NATのエントリは実際の時刻で動くゴルーチンではなくtickでキャプチャの時刻で削除する
+	// ゴルーチンがルータの時刻を読まなくなってから時刻を置き換える
+	for _, netdev := range router.devices {
+		if netdev.ipdev.natdev.natEntry != nil {
+			netdev.ipdev.natdev.natEntry.stopNatSweeper()
+		}
+	}
+	router.workers.Wait()
+	var current time.Time
+	router.clock = func() time.Time {
+		return current
+	}
+	output.now = router.clock
+	if router.capture != nil {
+		router.capture.now = router.clock
+	}
+	for _, packet := range inputs {
+		current = packet.ts
+		router.tick(current)
+		router.getnetDeviceByName(packet.ifname).netDeviceInput(router.mode, packet.frame)
+	}
+	fmt.Printf("Replayed %d of %d captured frames\n", len(inputs), len(packets))
+	return output.close()
+}
@@ -0,0 +1,107 @@
+package curo
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+シミュレータで動かしたrouter1のキャプチャを新しいrouter1にリプレイすると、同じフレームを同じ順番で送信する
+*/
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	capturePath := filepath.Join(dir, "router1.pcapng")
+	sim, router1, _, hosts := newChapter5Simulator(&NatOptions{})
+	if err := router1.router.EnableCapture(CaptureOptions{Path: capturePath}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	router1.router.capture.now = func() time.Time {
+		now = now.Add(time.Millisecond)
+		return now
+	}
+	if !sim.ping(hosts[0], "192.168.2.2") {
+		t.Fatal("ping from host0 to host2 failed")
+	}
+	hosts[1].sendUdp(parseSimIPAddr("192.168.2.2"), 5000, 53, []byte("query"))
+	sim.run()
+	router1.router.Close()
+	captured := readTestPcapng(t, capturePath)
+
+	// キャプチャと同じ構成のルータを作ってリプレイする, MACアドレスも同じ順番で割り当てられる
+	_, replayed, _, _ := newChapter5Simulator(&NatOptions{})
+	outPath := filepath.Join(dir, "replay.pcapng")
+	if err := replayed.router.Replay(capturePath, outPath); err != nil {
+		t.Fatal(err)
+	}
+	outputs := readTestPcapng(t, outPath)
+
+	var want []testPcapngPacket
+	for _, packet := range captured {
+		if packet.flags == PCAPNG_EPB_FLAG_OUTBOUND {
+			want = append(want, packet)
+		}
+	}
+	if len(outputs) == 0 || len(outputs) != len(want) {
+		t.Fatalf("replay sent %d frames, want %d", len(outputs), len(want))
+	}
+	for i := range want {
+		if outputs[i].ifname != want[i].ifname || !bytes.Equal(outputs[i].frame, want[i].frame) {
+			t.Fatalf("replayed frame %d is %s %x, want %s %x", i, outputs[i].ifname, outputs[i].frame, want[i].ifname, want[i].frame)
+		}
+		// 送信したフレームには受信したフレームのタイムスタンプをつける
+		if outputs[i].ts.After(want[i].ts) || outputs[i].flags != PCAPNG_EPB_FLAG_OUTBOUND {
+			t.Fatalf("replayed frame %d is sent at %s, captured at %s", i, outputs[i].ts, want[i].ts)
+		}
+	}
+	// NATのエントリもキャプチャの時と同じに作られる
+	var query *capturePacket
+	for _, packet := range outputs {
+		if decoded := decodeCapturePacket(packet.frame, captureOutbound); decoded.hasPorts && decoded.destPort == 53 {
+			query = decoded
+		}
+	}
+	if query == nil {
+		t.Fatal("udp query is not replayed")
+	}
+	if entry := replayed.natEntry("router1-br0", udp, 0xc0a80001, query.srcPort); entry == nil || entry.localIpAddr != 0xc0a80102 {
+		t.Fatalf("nat entry after replay is %+v", entry)
+	}
+	// NATのエントリは実際の時刻ではなくキャプチャの時刻でタイムアウトする
+	last := captured[len(captured)-1].ts
+	replayed.router.tick(last.Add(NAT_UDP_TIMEOUT - time.Second))
+	if entry := replayed.natEntry("router1-br0", udp, 0xc0a80001, query.srcPort); entry == nil || entry.localIpAddr == 0 {
+		t.Fatal("nat entry is deleted before timeout of capture time")
+	}
+	replayed.router.tick(last.Add(NAT_UDP_TIMEOUT + NAT_SWEEP_INTERVAL))
+	if entry := replayed.natEntry("router1-br0", udp, 0xc0a80001, query.srcPort); entry != nil && entry.localIpAddr != 0 {
+		t.Fatalf("nat entry is not deleted after timeout of capture time : %+v", entry)
+	}
+
+	// 向きのないキャプチャでもルータが送信したフレームは受信させない
+	var undirected []pcapngPacket
+	for _, packet := range captured {
+		undirected = append(undirected, pcapngPacket{ifname: packet.ifname, ts: packet.ts, frame: packet.frame})
+	}
+	_, replayed, _, _ = newChapter5Simulator(&NatOptions{})
+	output, err := newPacketCapture(CaptureOptions{Path: filepath.Join(dir, "undirected.pcapng")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replayed.router.replay(undirected, output); err != nil {
+		t.Fatal(err)
+	}
+	if outputs := readTestPcapng(t, filepath.Join(dir, "undirected.pcapng")); len(outputs) != len(want) {
+		t.Fatalf("replay of undirected capture sent %d frames, want %d", len(outputs), len(want))
+	}
+
+	// キャプチャしたインターフェイスがなければリプレイしない
+	_, replayed, _, _ = newChapter5Simulator(nil)
+	undirected[0].ifname = "router1-eth9"
+	output, _ = newPacketCapture(CaptureOptions{Path: filepath.Join(dir, "unknown.pcap"), Format: "pcap"})
+	if err := replayed.router.replay(undirected, output); err == nil {
+		t.Fatal("capture of unknown interface is replayed")
+	}
+}
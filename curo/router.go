@@ -0,0 +1,537 @@
+package curo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+ルータ
+デバイス, ルーティングテーブル, ARPテーブルと近隣キャッシュ, NATなどの状態を全て持つので、
+1つのプロセスで複数のルータを動かせる
+*/
+type Router struct {
+	mode          string
+	devices       []*netDevice
+	route         radixTreeNode
+	arpTable      []arpTableEntry
+	neighborTable []neighborTableEntry
+	bridges       []*bridgeDomain
+	bonds         []*bondDevice
+	lldp          *lldpAgent     // LLDPを使わなければnil
+	capture       *packetCapture // キャプチャしなければnil
+	clock         func() time.Time
+	drivers       map[string]string // インターフェイスごとのドライバ, ""は全てのインターフェイス
+	fallbacks     map[string]error  // AF_XDPが使えずにAF_PACKETにしたインターフェイスと理由
+	workers       sync.WaitGroup    // ルータが動かしているゴルーチン, Closeで全て止まるのを待つ
+}
+
+/*
+ルータを作る
+modeがch1なら受信したフレームを表示するだけで、それ以外ならルータとして動く
+*/
+func NewRouter(mode string) *Router {
+	return &Router{mode: mode, clock: time.Now}
+}
+
+/*
+デバイスをルータに追加する
+アドレスがあれば直接接続ネットワークの経路をルートテーブルのエントリに設定する
+*/
+func (router *Router) addDevice(netdev *netDevice) {
+	netdev.router = router
+	router.devices = append(router.devices, netdev)
+	// ブリッジのポートのようにIPアドレスのないデバイスは経路を登録しない
+	if netdev.ipdev.address == 0 {
+		return
+	}
+	prefixLen := subnetToPrefixLen(netdev.ipdev.netmask)
+	router.route.radixTreeAdd(netdev.ipdev.address&netdev.ipdev.netmask, prefixLen, ipRouteEntry{
+		iptype: connected,
+		netdev: netdev,
+	})
+	fmt.Printf("Set directly connected route %s/%d via %s\n",
+		printIPAddr(netdev.ipdev.address&netdev.ipdev.netmask), prefixLen, netdev.name)
+}
+
+// インターフェイス名からデバイスを探す
+func (router *Router) getnetDeviceByName(name string) *netDevice {
+	for _, dev := range router.devices {
+		if name == dev.name {
+			return dev
+		}
+	}
+	return &netDevice{}
+}
+
+// AF_PACKETのインターフェイスで使えるドライバ
+const (
+	DRIVER_PACKET = "packet"
+	DRIVER_MMAP   = "mmap"
+	DRIVER_XDP    = "xdp"
+)
+
+/*
+AddInterfacesで作るインターフェイスのドライバを選ぶ
+"mmap" の形で全てのインターフェイス, "router1-br0=mmap" の形でインターフェイスごとに指定する
+*/
+func (router *Router) SetDriver(rule string) error {
+	name, kind := "", rule
+	if fields := strings.Split(rule, "="); len(fields) == 2 {
+		name, kind = fields[0], fields[1]
+	}
+	switch kind {
+	case DRIVER_PACKET, DRIVER_MMAP, DRIVER_XDP:
+	default:
+		return fmt.Errorf("invalid driver rule %q, driver is %s, %s or %s", rule, DRIVER_PACKET, DRIVER_MMAP, DRIVER_XDP)
+	}
+	if router.drivers == nil {
+		router.drivers = make(map[string]string)
+	}
+	router.drivers[name] = kind
+	return nil
+}
+
+/*
+インターフェイスに指定されたドライバを作る
+指定がなければrecvmsgで1つずつ受信するAF_PACKETのドライバにする
+AF_XDPが使えないカーネルやインターフェイスでもAF_PACKETのドライバにする
+*/
+func (router *Router) newInterfaceDriver(netif net.Interface) (netDeviceDriver, string, error) {
+	kind, ok := router.drivers[netif.Name]
+	if !ok {
+		kind = router.drivers[""]
+	}
+	switch kind {
+	case DRIVER_MMAP:
+		driver, err := newMmapDriver(netif)
+		return driver, kind, err
+	case DRIVER_XDP:
+		driver, err := newXdpDriver(netif)
+		if err == nil {
+			return driver, kind, nil
+		}
+		fmt.Printf("%s can not use af_xdp, fallback to af_packet : %s\n", netif.Name, err)
+		if router.fallbacks == nil {
+			router.fallbacks = make(map[string]error)
+		}
+		router.fallbacks[netif.Name] = err
+	}
+	driver, err := newPacketDriver(netif)
+	return driver, DRIVER_PACKET, err
+}
+
+/*
+無視するもの以外の全てのネットワークインターフェイスをAF_PACKETのドライバでルータに追加する
+*/
+func (router *Router) AddInterfaces() error {
+	// ネットワークインターフェイスの情報を取得
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, netif := range interfaces {
+		// 無視するインターフェイスか確認
+		if isIgnoreInterfaces(netif.Name) {
+			continue
+		}
+		// インターフェイスにbindしたAF_PACKETのソケットをドライバにする
+		driver, kind, err := router.newInterfaceDriver(netif)
+		if err != nil {
+			return fmt.Errorf("create %s driver for %s err : %s", kind, netif.Name, err)
+		}
+		fmt.Printf("Created device %s socket %d adddress %s driver %s\n",
+			netif.Name, driver.fd(), netif.HardwareAddr.String(), kind)
+		netaddrs, err := netif.Addrs()
+		if err != nil {
+			return fmt.Errorf("get ip addr from nic interface is err : %s", err)
+		}
+		// netDevice構造体を作成
+		// net_deviceの連結リストに連結させる
+		router.addDevice(&netDevice{
+			name:    netif.Name,
+			macaddr: setMacAddr(netif.HardwareAddr),
+			driver:  driver,
+			ifindex: netif.Index,
+			ipdev:   getIPdevice(netaddrs),
+			ipv6dev: getIPv6device(netaddrs),
+		})
+	}
+	return nil
+}
+
+/*
+TAPのデバイスを作ってカーネルのネットワークスタックとつなぐ
+"router1-tap0=192.168.100.1/24" の形で指定する
+*/
+func (router *Router) AddTap(rule string) error {
+	return router.addTunTap(rule, false)
+}
+
+/*
+TUNのデバイスを作ってカーネルのネットワークスタックとつなぐ
+"router1-tun0=192.168.101.1/24" の形で指定する
+*/
+func (router *Router) AddTun(rule string) error {
+	return router.addTunTap(rule, true)
+}
+
+func (router *Router) addTunTap(rule string, tun bool) error {
+	conf, err := parseTunTapConfig(rule, tun)
+	if err != nil {
+		return err
+	}
+	driver, err := newTunTapDriver(conf.name, conf.tun)
+	if err != nil {
+		return err
+	}
+	kind := "tap"
+	if conf.tun {
+		kind = "tun"
+	}
+	fmt.Printf("Created %s device %s adddress %s\n", kind, conf.name, printMacAddr(driver.macaddr))
+	router.addDevice(&netDevice{
+		name:    conf.name,
+		macaddr: driver.macaddr,
+		driver:  driver,
+		ipdev: ipDevice{
+			address:   conf.address,
+			netmask:   conf.netmask,
+			broadcast: conf.address | ^conf.netmask,
+		},
+	})
+	return nil
+}
+
+/*
+bondの論理デバイスを作ってメンバーのデバイスをまとめる
+"router1-bond0=router1-r2a+router1-r2b@192.168.0.1/24" の形で指定する
+*/
+func (router *Router) AddBond(rule string) error {
+	conf, err := parseBondConfig(rule)
+	if err != nil {
+		return err
+	}
+	var members []*netDevice
+	for _, name := range conf.members {
+		member := router.getnetDeviceByName(name)
+		if member.name == "" {
+			return fmt.Errorf("member device %s of bond %s is not found", name, conf.name)
+		}
+		// 論理デバイスのMACアドレス宛てのフレームも受信する
+		if member.driver != nil {
+			if err := member.driver.setPromiscuous(); err != nil {
+				return fmt.Errorf("set promiscuous mode to %s err : %s", member.name, err)
+			}
+		}
+		members = append(members, member)
+	}
+	bond := newBondDevice(conf, members)
+	bond.key = uint16(len(router.bonds) + 1)
+	router.bonds = append(router.bonds, bond)
+	fmt.Printf("Created bond %s with %s\n", conf.name, strings.Join(conf.members, ", "))
+	router.addDevice(bond.netdev)
+	return nil
+}
+
+/*
+VLANのサブインターフェイスを親のデバイスの上に作る
+"router1-br0.10=192.168.10.1/24" の形で指定する
+*/
+func (router *Router) AddVlan(rule string) error {
+	conf, err := parseVlanConfig(rule)
+	if err != nil {
+		return err
+	}
+	parent := router.getnetDeviceByName(conf.parent)
+	if parent.name == "" {
+		return fmt.Errorf("parent device %s of vlan %s is not found", conf.parent, conf.name)
+	}
+	netdev := newVlanDevice(parent, conf)
+	fmt.Printf("Created vlan device %s on %s vlan id %d\n", netdev.name, parent.name, netdev.vlanId)
+	router.addDevice(netdev)
+	return nil
+}
+
+/*
+ブリッジを作ってポートのデバイスを所属させる
+"router1-br0=router1-host0+router1-host1@192.168.1.1/24" の形で指定する
+rstpがtrueならrstpPriorityのブリッジの優先度でRSTPを動かす
+*/
+func (router *Router) AddBridge(rule string, rstp bool, rstpPriority uint16) error {
+	conf, err := parseBridgeConfig(rule)
+	if err != nil {
+		return err
+	}
+	if rstpPriority > 61440 || rstpPriority%4096 != 0 {
+		return fmt.Errorf("rstp priority must be a multiple of 4096 up to 61440")
+	}
+	conf.rstp = rstp
+	conf.rstpPriority = rstpPriority
+	var members []*netDevice
+	for _, name := range conf.members {
+		member := router.getnetDeviceByName(name)
+		if member.name == "" {
+			return fmt.Errorf("member device %s of bridge %s is not found", name, conf.name)
+		}
+		members = append(members, member)
+		// 自分宛て以外のフレームも受信する, bondのメンバーは作成時に設定済み
+		physical := member
+		if member.parent != nil {
+			physical = member.parent
+		}
+		if physical.aggregator != nil || physical.driver == nil {
+			continue
+		}
+		if err := physical.driver.setPromiscuous(); err != nil {
+			return fmt.Errorf("set promiscuous mode to %s err : %s", physical.name, err)
+		}
+	}
+	bridge, irb := newBridgeDomain(conf, members)
+	router.bridges = append(router.bridges, bridge)
+	fmt.Printf("Created bridge %s with %s\n", conf.name, strings.Join(conf.members, ", "))
+	if irb != nil {
+		router.addDevice(irb)
+	}
+	return nil
+}
+
+/*
+ネクストホップへの経路を追加する
+"192.168.2.0/24" のプレフィックスと "192.168.0.2" のネクストホップで指定する
+*/
+func (router *Router) AddRoute(prefix, nexthop string) error {
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil || ipnet.IP.To4() == nil {
+		return fmt.Errorf("invalid route prefix %q", prefix)
+	}
+	gateway := net.ParseIP(nexthop).To4()
+	if gateway == nil {
+		return fmt.Errorf("invalid route next hop %q", nexthop)
+	}
+	netmask := byteToUint32(ipnet.Mask)
+	router.route.radixTreeAdd(byteToUint32(ipnet.IP.To4())&netmask, subnetToPrefixLen(netmask), ipRouteEntry{
+		iptype:  network,
+		nexthop: byteToUint32(gateway),
+	})
+	return nil
+}
+
+/*
+全てのデバイスを作ってからLLDPで隣接機器に知らせる
+systemNameが空ならホスト名を使い、neighborsFileが空でなければ隣接機器のテーブルをJSONで書き出す
+*/
+func (router *Router) EnableLldp(systemName, neighborsFile string) {
+	router.lldp = newLldpAgent(router, lldpConfig{
+		enabled:       true,
+		systemName:    systemName,
+		neighborsFile: neighborsFile,
+	})
+	fmt.Printf("Start lldp as %s\n", router.lldp.conf.systemName)
+}
+
+/*
+ルータが送受信する全てのフレームをpcapかpcapngのファイルに書き出す
+*/
+func (router *Router) EnableCapture(opts CaptureOptions) error {
+	capture, err := newPacketCapture(opts)
+	if err != nil {
+		return err
+	}
+	router.capture = capture
+	return nil
+}
+
+/*
+キャプチャが有効ならフレームを書き出す
+*/
+func (router *Router) captureFrame(netdev *netDevice, frame []byte, direction captureDirection) {
+	if router == nil || router.capture == nil {
+		return
+	}
+	router.capture.captureFrame(netdev.name, frame, direction)
+}
+
+/*
+ルータの現在時刻
+pcapをリプレイしている時は処理しているフレームのタイムスタンプになる
+*/
+func (router *Router) now() time.Time {
+	if router == nil || router.clock == nil {
+		return time.Now()
+	}
+	return router.clock()
+}
+
+/*
+RSTPとLACP, LLDPのタイマーとブリッジのエージング, NATのエントリのタイムアウトを動かす
+*/
+func (router *Router) tick(now time.Time) {
+	for _, netdev := range router.devices {
+		if netdev.ipdev.natdev.natEntry != nil {
+			netdev.ipdev.natdev.natEntry.natTick(now)
+		}
+	}
+	for _, bridge := range router.bridges {
+		bridge.ageFdb(now)
+		if bridge.rstp != nil {
+			bridge.rstp.rstpTick(now)
+		}
+	}
+	for _, bond := range router.bonds {
+		bond.lacpTick(now)
+	}
+	if router.lldp != nil {
+		router.lldp.lldpTick(now)
+	}
+}
+
+/*
+epollで待てないドライバにたまっているフレームを処理して、ためている送信するフレームを送信する
+*/
+func (router *Router) drain() error {
+	for _, netdev := range router.devices {
+		if err := netdev.netDeviceDrain(router.mode); err != nil {
+			return err
+		}
+	}
+	for _, netdev := range router.devices {
+		if driver, ok := netdev.driver.(flushDriver); ok {
+			if err := driver.flush(); err != nil {
+				return fmt.Errorf("flush err, device is %s, err is %s", netdev.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+epollでデバイスからの受信を待ってルータを動かす
+ctxがキャンセルされたら送信をためているフレームを送信してnilを返すので、止まってからCloseで閉じる
+*/
+func (router *Router) Run(ctx context.Context) error {
+	events := make([]syscall.EpollEvent, 10)
+	// epoll作成
+	epfd, err := syscall.EpollCreate1(0)
+	if err != nil {
+		return fmt.Errorf("epoll create err : %s", err)
+	}
+	defer syscall.Close(epfd)
+
+	// ctxがキャンセルされたらパイプに書いてepoll_waitから戻す
+	wakeFds := make([]int, 2)
+	if err := syscall.Pipe2(wakeFds, syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return fmt.Errorf("create pipe err : %s", err)
+	}
+	defer syscall.Close(wakeFds[0])
+	defer syscall.Close(wakeFds[1])
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, wakeFds[0], &syscall.EpollEvent{
+		Events: syscall.EPOLLIN,
+		Fd:     int32(wakeFds[0]),
+	})
+	if err != nil {
+		return fmt.Errorf("epoll ctrl err : %s", err)
+	}
+	done := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			syscall.Write(wakeFds[1], []byte{1})
+		case <-done:
+		}
+	}()
+	// パイプを閉じる前にゴルーチンが終わるのを待つ
+	defer func() {
+		close(done)
+		<-watcherDone
+	}()
+	for _, netdev := range router.devices {
+		// epollで待てるドライバのファイルディスクリプタを監視対象として登録
+		if netdev.driver == nil || netdev.driver.fd() < 0 {
+			continue
+		}
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, netdev.driver.fd(), &syscall.EpollEvent{
+			Events: syscall.EPOLLIN,
+			Fd:     int32(netdev.driver.fd()),
+		})
+		if err != nil {
+			return fmt.Errorf("epoll ctrl err : %s", err)
+		}
+	}
+
+	fmt.Printf("mode is %s start router...\n", router.mode)
+
+	// RSTPとLACP, LLDPのタイマーとブリッジのエージングを動かすために1秒ごとにepoll_waitから戻る
+	timeout := -1
+	if len(router.bridges) != 0 || len(router.bonds) != 0 || router.lldp != nil {
+		timeout = 1000
+	}
+
+	for {
+		// epoll_waitでパケットの受信を待つ
+		nfds, err := syscall.EpollWait(epfd, events, timeout)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("epoll wait err : %s", err)
+		}
+		router.tick(router.now())
+		for i := 0; i < nfds; i++ {
+			if events[i].Fd == int32(wakeFds[0]) {
+				fmt.Printf("mode is %s stop router...\n", router.mode)
+				return router.drain()
+			}
+			// デバイスから通信を受信
+			for _, netdev := range router.devices {
+				// イベントがあったソケットとマッチしたらパケットを読み込む処理を実行
+				if netdev.driver != nil && events[i].Fd == int32(netdev.driver.fd()) {
+					if err := netdev.netDevicePoll(router.mode); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := router.drain(); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+全てのデバイスのドライバとキャプチャ, NATのログのファイルを閉じる
+NATのエントリの削除などルータが動かしているゴルーチンは止まるまで待つ
+*/
+func (router *Router) Close() error {
+	var closeErr error
+	for _, netdev := range router.devices {
+		if netdev.ipdev.natdev.natEntry == nil {
+			continue
+		}
+		if err := netdev.ipdev.natdev.natEntry.close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	router.workers.Wait()
+	if router.capture != nil {
+		if err := router.capture.close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	for _, netdev := range router.devices {
+		if netdev.driver == nil {
+			continue
+		}
+		if err := netdev.driver.close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("close %s err : %s", netdev.name, err)
+		}
+	}
+	return closeErr
+}
@@ -0,0 +1,151 @@
+package curo
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRouterConfigure(t *testing.T) {
+	router := NewRouter("ch2")
+	lan := &netDevice{name: "router1-br0", ipdev: ipDevice{address: 0xc0a80101, netmask: 0xffffff00, broadcast: 0xc0a801ff}}
+	wan := &netDevice{name: "router1-router2", ipdev: ipDevice{address: 0xc0a80001, netmask: 0xffffff00, broadcast: 0xc0a800ff}}
+	port := &netDevice{name: "router1-host0"}
+	router.addDevice(lan)
+	router.addDevice(wan)
+	router.addDevice(port)
+
+	// 直接接続の経路はアドレスのあるデバイスだけに作る
+	if route := router.route.radixTreeSearch(0xc0a80105); route.iptype != connected || route.netdev != lan {
+		t.Fatalf("route to lan is %+v", route)
+	}
+	if err := router.AddRoute("192.168.2.0/24", "192.168.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if route := router.route.radixTreeSearch(0xc0a80202); route.iptype != network || route.nexthop != 0xc0a80002 {
+		t.Fatalf("route to host2 is %+v", route)
+	}
+	for _, invalid := range [][2]string{{"192.168.2.0", "192.168.0.2"}, {"2001:db8::/64", "192.168.0.2"}, {"192.168.2.0/24", "router2"}} {
+		if err := router.AddRoute(invalid[0], invalid[1]); err == nil {
+			t.Errorf("AddRoute(%q, %q) succeeded", invalid[0], invalid[1])
+		}
+	}
+
+	// 論理デバイスも同じルータに所属する
+	if err := router.AddVlan("router1-br0.10=192.168.10.1/24"); err != nil {
+		t.Fatal(err)
+	}
+	if vlan := router.getnetDeviceByName("router1-br0.10"); vlan.router != router || lan.vlanDevice(10) != vlan {
+		t.Fatal("vlan device is not added to router")
+	}
+	if err := router.AddVlan("router1-eth9.10=192.168.11.1/24"); err == nil {
+		t.Fatal("vlan on unknown parent is added")
+	}
+	if err := router.AddBridge("router1-br1=router1-host0+router1-host9", false, RSTP_DEFAULT_BRIDGE_PRIORITY); err == nil {
+		t.Fatal("bridge with unknown member is added")
+	}
+	if err := router.AddBridge("router1-br1=router1-host0@192.168.3.1/24", true, 1000); err == nil {
+		t.Fatal("bridge with invalid rstp priority is added")
+	}
+	if err := router.AddBridge("router1-br1=router1-host0@192.168.3.1/24", false, RSTP_DEFAULT_BRIDGE_PRIORITY); err != nil {
+		t.Fatal(err)
+	}
+	if irb := router.getnetDeviceByName("router1-br1"); irb.router != router || port.bridge == nil {
+		t.Fatal("bridge is not added to router")
+	}
+
+	if err := router.ConfigureNat("router1-br0", "router1-router2", NatOptions{Mapping: "fullcone"}); err == nil {
+		t.Fatal("nat with invalid mapping is configured")
+	}
+	if err := router.ConfigureNat("router1-br0", "router1-host0", NatOptions{}); err == nil {
+		t.Fatal("nat with outside device without addr is configured")
+	}
+	if err := router.ConfigureNat("router1-br0", "router1-router2", NatOptions{Forwards: []string{"tcp:8080:192.168.1.3:80"}}); err != nil {
+		t.Fatal(err)
+	}
+	if !isNatPoolAddrOnDevice(wan, 0xc0a80001) {
+		t.Fatal("nat outside addr is not found on router")
+	}
+}
+
+/*
+2つのルータのARPテーブルは別々に持つ
+*/
+func TestRouterIndependentState(t *testing.T) {
+	router1, router2 := NewRouter("ch2"), NewRouter("ch2")
+	dev1 := &netDevice{name: "eth0", ipdev: ipDevice{address: 0xc0a80001, netmask: 0xffffff00}}
+	dev2 := &netDevice{name: "eth0", ipdev: ipDevice{address: 0xc0a80002, netmask: 0xffffff00}}
+	router1.addDevice(dev1)
+	router2.addDevice(dev2)
+	addArpTableEntry(dev1, 0xc0a80003, [6]uint8{0x02, 0, 0, 0, 0, 0x03})
+	if mac, dev := router1.searchArpTableEntry(0xc0a80003); dev != dev1 || mac[5] != 0x03 {
+		t.Fatal("arp entry is not added to router1")
+	}
+	if mac, _ := router2.searchArpTableEntry(0xc0a80003); mac != ([6]uint8{}) {
+		t.Fatal("arp entry of router1 is found on router2")
+	}
+	// 同じMACアドレスの別のアドレスもエントリにする
+	addArpTableEntry(dev1, 0xc0a80004, [6]uint8{0x02, 0, 0, 0, 0, 0x03})
+	if len(router1.arpTable) != 2 {
+		t.Fatalf("arp table of router1 is %+v", router1.arpTable)
+	}
+	if router2.getnetDeviceByName("eth0") != dev2 {
+		t.Fatal("device of router2 is not found by name")
+	}
+}
+
+/*
+CloseはNATのエントリを削除するゴルーチンを全て止めてから戻る
+*/
+func TestRouterCloseStopsGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	router := NewRouter("ch2")
+	router.addDevice(&netDevice{name: "router1-br0", ipdev: ipDevice{address: 0xc0a80101, netmask: 0xffffff00, broadcast: 0xc0a801ff}})
+	router.addDevice(&netDevice{name: "router1-router2", ipdev: ipDevice{address: 0xc0a80001, netmask: 0xffffff00, broadcast: 0xc0a800ff}})
+	// 設定し直しても前のゴルーチンは残らない
+	for i := 0; i < 2; i++ {
+		if err := router.ConfigureNat("router1-br0", "router1-router2", NatOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := router.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines are left after close", after-before)
+	}
+}
+
+/*
+ctxをキャンセルするとRunがnilを返し、その後でCloseできる
+*/
+func TestRouterRunStopsOnCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	router := NewRouter("ch2")
+	router.addDevice(&netDevice{name: "router1-br0", ipdev: ipDevice{address: 0xc0a80101, netmask: 0xffffff00, broadcast: 0xc0a801ff}})
+	router.addDevice(&netDevice{name: "router1-router2", ipdev: ipDevice{address: 0xc0a80001, netmask: 0xffffff00, broadcast: 0xc0a800ff}})
+	if err := router.ConfigureNat("router1-br0", "router1-router2", NatOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- router.Run(ctx)
+	}()
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run is not stopped by cancel")
+	}
+	if err := router.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines are left after run and close", after-before)
+	}
+}
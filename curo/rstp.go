@@ -0,0 +1,610 @@
+package curo
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const (
+	RSTP_PROTOCOL_VERSION        uint8  = 2
+	RSTP_BPDU_TYPE_CONFIG        uint8  = 0x00
+	RSTP_BPDU_TYPE_TCN           uint8  = 0x80
+	RSTP_BPDU_TYPE_RST           uint8  = 0x02
+	RSTP_BPDU_LEN                       = 36
+	RSTP_CONFIG_BPDU_LEN                = 35
+	RSTP_DEFAULT_BRIDGE_PRIORITY uint16 = 32768
+	RSTP_DEFAULT_PORT_PRIORITY   uint16 = 128
+	RSTP_DEFAULT_PATH_COST       uint32 = 20000 // 1Gbpsのリンクのコスト
+	RSTP_HELLO_TIME                     = 2 * time.Second
+	RSTP_MAX_AGE                        = 20 * time.Second
+	RSTP_FORWARD_DELAY                  = 15 * time.Second
+	RSTP_EDGE_DELAY                     = 3 * time.Second // BPDUが届かなければエッジポートとみなすまでの時間
+)
+
+// BPDUの宛先のMACアドレスとLLCヘッダ
+var RSTP_BPDU_MAC_ADDRESS = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x00}
+var LLC_HEADER_STP = []byte{0x42, 0x42, 0x03}
+
+// RST BPDUのフラグ
+const (
+	RSTP_FLAG_TC         uint8 = 0x01
+	RSTP_FLAG_PROPOSAL   uint8 = 0x02
+	RSTP_FLAG_ROLE_MASK  uint8 = 0x0c
+	RSTP_FLAG_LEARNING   uint8 = 0x10
+	RSTP_FLAG_FORWARDING uint8 = 0x20
+	RSTP_FLAG_AGREEMENT  uint8 = 0x40
+	RSTP_FLAG_TCA        uint8 = 0x80
+)
+
+// BPDUのフラグに入れるポートの役割
+const (
+	RSTP_BPDU_ROLE_ALTERNATE_BACKUP uint8 = 1
+	RSTP_BPDU_ROLE_ROOT             uint8 = 2
+	RSTP_BPDU_ROLE_DESIGNATED       uint8 = 3
+)
+
+type rstpPortRole uint8
+
+const (
+	rstpRoleDisabled rstpPortRole = iota
+	rstpRoleRoot
+	rstpRoleDesignated
+	rstpRoleAlternate
+	rstpRoleBackup
+)
+
+type rstpPortState uint8
+
+const (
+	rstpDiscarding rstpPortState = iota
+	rstpLearning
+	rstpForwarding
+)
+
+// 優先度ベクトル, 小さい方が優れている
+type rstpPriorityVector struct {
+	rootId             uint64
+	rootPathCost       uint32
+	designatedBridgeId uint64
+	designatedPortId   uint16
+}
+
+type rstpBpdu struct {
+	version      uint8
+	bpduType     uint8
+	flags        uint8
+	vector       rstpPriorityVector
+	messageAge   uint16 // 以下の時間は1/256秒単位
+	maxAge       uint16
+	helloTime    uint16
+	forwardDelay uint16
+}
+
+type rstpPort struct {
+	netdev        *netDevice
+	portId        uint16
+	pathCost      uint32
+	role          rstpPortRole
+	state         rstpPortState
+	infoValid     bool               // ポートで受信した情報が有効か
+	portVector    rstpPriorityVector // ポートで受信した指定ブリッジの優先度ベクトル
+	messageAge    uint16
+	rcvdInfoWhile time.Time // 受信した情報の有効期限
+	operEdge      bool      // ホストだけがつながるエッジポートか
+	upSince       time.Time
+	lastBpdu      time.Time
+	proposing     bool
+	agreed        bool
+	fdWhile       time.Time // 指定ポートの状態を次に進める時刻
+	tcWhile       time.Time // この時刻までTCフラグを立ててBPDUを送る
+}
+
+// ブリッジのRSTPの状態
+type rstpBridge struct {
+	bridge         *bridgeDomain
+	bridgeId       uint64
+	ports          []*rstpPort
+	rootVector     rstpPriorityVector
+	rootPort       *rstpPort
+	rootMessageAge uint16
+	lastHello      time.Time
+}
+
+func (role rstpPortRole) String() string {
+	switch role {
+	case rstpRoleRoot:
+		return "root"
+	case rstpRoleDesignated:
+		return "designated"
+	case rstpRoleAlternate:
+		return "alternate"
+	case rstpRoleBackup:
+		return "backup"
+	}
+	return "disabled"
+}
+
+func (state rstpPortState) String() string {
+	switch state {
+	case rstpLearning:
+		return "learning"
+	case rstpForwarding:
+		return "forwarding"
+	}
+	return "discarding"
+}
+
+/*
+優先度ベクトルを比べて優れているか判断する
+ルートブリッジID, ルートパスコスト, 指定ブリッジID, 指定ポートIDの順に比べる
+*/
+func (vector rstpPriorityVector) betterThan(other rstpPriorityVector) bool {
+	if vector.rootId != other.rootId {
+		return vector.rootId < other.rootId
+	}
+	if vector.rootPathCost != other.rootPathCost {
+		return vector.rootPathCost < other.rootPathCost
+	}
+	if vector.designatedBridgeId != other.designatedBridgeId {
+		return vector.designatedBridgeId < other.designatedBridgeId
+	}
+	return vector.designatedPortId < other.designatedPortId
+}
+
+/*
+優先度とMACアドレスからブリッジIDを作る
+*/
+func rstpBridgeId(priority uint16, macaddr [6]uint8) uint64 {
+	id := uint64(priority) << 48
+	for i, v := range macaddr {
+		id |= uint64(v) << (8 * (5 - i))
+	}
+	return id
+}
+
+func durationToBpduTime(d time.Duration) uint16 {
+	return uint16(d * 256 / time.Second)
+}
+
+/*
+LLCヘッダとBPDUのバイト列にする
+*/
+func (bpdu rstpBpdu) ToPacket() []byte {
+	var b bytes.Buffer
+	b.Write(LLC_HEADER_STP)
+	b.Write([]byte{0x00, 0x00}) // プロトコルID
+	b.Write([]byte{bpdu.version, bpdu.bpduType, bpdu.flags})
+	b.Write(uint32ToByte(uint32(bpdu.vector.rootId >> 32)))
+	b.Write(uint32ToByte(uint32(bpdu.vector.rootId)))
+	b.Write(uint32ToByte(bpdu.vector.rootPathCost))
+	b.Write(uint32ToByte(uint32(bpdu.vector.designatedBridgeId >> 32)))
+	b.Write(uint32ToByte(uint32(bpdu.vector.designatedBridgeId)))
+	b.Write(uint16ToByte(bpdu.vector.designatedPortId))
+	b.Write(uint16ToByte(bpdu.messageAge))
+	b.Write(uint16ToByte(bpdu.maxAge))
+	b.Write(uint16ToByte(bpdu.helloTime))
+	b.Write(uint16ToByte(bpdu.forwardDelay))
+	b.Write([]byte{0x00}) // Version 1 Length
+	return b.Bytes()
+}
+
+/*
+LLCヘッダのついたBPDUをパースする
+STPのConfiguration BPDUとTCN BPDUも受け付ける
+*/
+func parseRstpBpdu(packet []byte) (rstpBpdu, error) {
+	if len(packet) < 3+4 || !bytes.Equal(packet[0:3], LLC_HEADER_STP) {
+		return rstpBpdu{}, fmt.Errorf("not stp llc frame")
+	}
+	packet = packet[3:]
+	if byteToUint16(packet[0:2]) != 0 {
+		return rstpBpdu{}, fmt.Errorf("unknown stp protocol id %d", byteToUint16(packet[0:2]))
+	}
+	bpdu := rstpBpdu{version: packet[2], bpduType: packet[3]}
+	switch bpdu.bpduType {
+	case RSTP_BPDU_TYPE_TCN:
+		return bpdu, nil
+	case RSTP_BPDU_TYPE_CONFIG:
+		if len(packet) < RSTP_CONFIG_BPDU_LEN {
+			return rstpBpdu{}, fmt.Errorf("config bpdu is too short")
+		}
+	case RSTP_BPDU_TYPE_RST:
+		if len(packet) < RSTP_BPDU_LEN {
+			return rstpBpdu{}, fmt.Errorf("rst bpdu is too short")
+		}
+	default:
+		return rstpBpdu{}, fmt.Errorf("unknown bpdu type %d", bpdu.bpduType)
+	}
+	bpdu.flags = packet[4]
+	bpdu.vector = rstpPriorityVector{
+		rootId:             uint64(byteToUint32(packet[5:9]))<<32 | uint64(byteToUint32(packet[9:13])),
+		rootPathCost:       byteToUint32(packet[13:17]),
+		designatedBridgeId: uint64(byteToUint32(packet[17:21]))<<32 | uint64(byteToUint32(packet[21:25])),
+		designatedPortId:   byteToUint16(packet[25:27]),
+	}
+	bpdu.messageAge = byteToUint16(packet[27:29])
+	bpdu.maxAge = byteToUint16(packet[29:31])
+	bpdu.helloTime = byteToUint16(packet[31:33])
+	bpdu.forwardDelay = byteToUint16(packet[33:35])
+	// STPのBPDUは指定ポートから送られたものとして扱う
+	if bpdu.bpduType == RSTP_BPDU_TYPE_CONFIG {
+		bpdu.flags = bpdu.flags&(RSTP_FLAG_TC|RSTP_FLAG_TCA) | RSTP_BPDU_ROLE_DESIGNATED<<2
+	}
+	return bpdu, nil
+}
+
+/*
+ブリッジでRSTPを動かす
+ブリッジIDにはポートの中で一番小さいMACアドレスを使う
+*/
+func newRstpBridge(bridge *bridgeDomain, priority uint16) *rstpBridge {
+	macaddr := bridge.members[0].macaddr
+	for _, member := range bridge.members {
+		if bytes.Compare(member.macaddr[:], macaddr[:]) < 0 {
+			macaddr = member.macaddr
+		}
+	}
+	rstp := &rstpBridge{
+		bridge:   bridge,
+		bridgeId: rstpBridgeId(priority, macaddr),
+	}
+	now := time.Now()
+	for i, member := range bridge.members {
+		rstp.ports = append(rstp.ports, &rstpPort{
+			netdev:   member,
+			portId:   RSTP_DEFAULT_PORT_PRIORITY<<8 | uint16(i+1),
+			pathCost: RSTP_DEFAULT_PATH_COST,
+			state:    rstpDiscarding,
+			upSince:  now,
+			fdWhile:  now.Add(RSTP_FORWARD_DELAY),
+		})
+	}
+	bridge.rstp = rstp
+	rstp.updateRoles(now)
+	return rstp
+}
+
+/*
+デバイスに対応するポートを探す
+*/
+func (rstp *rstpBridge) port(netdev *netDevice) *rstpPort {
+	for _, port := range rstp.ports {
+		if port.netdev == netdev {
+			return port
+		}
+	}
+	return nil
+}
+
+/*
+ポートの状態を返す, RSTPを使っていなければ常にフォワーディング
+*/
+func (bridge *bridgeDomain) portState(netdev *netDevice) rstpPortState {
+	if bridge.rstp == nil {
+		return rstpForwarding
+	}
+	port := bridge.rstp.port(netdev)
+	if port == nil {
+		return rstpDiscarding
+	}
+	return port.state
+}
+
+/*
+ポートから送る指定ブリッジとしての優先度ベクトル
+*/
+func (rstp *rstpBridge) designatedVector(port *rstpPort) rstpPriorityVector {
+	return rstpPriorityVector{
+		rootId:             rstp.rootVector.rootId,
+		rootPathCost:       rstp.rootVector.rootPathCost,
+		designatedBridgeId: rstp.bridgeId,
+		designatedPortId:   port.portId,
+	}
+}
+
+/*
+受信した情報からルートブリッジとポートの役割を決め直す
+*/
+func (rstp *rstpBridge) updateRoles(now time.Time) {
+	// 自分がルートブリッジの場合の優先度ベクトルから始めて、最も優れた情報を受信したポートをルートポートにする
+	best := rstpPriorityVector{rootId: rstp.bridgeId, designatedBridgeId: rstp.bridgeId}
+	var bestPortId uint16
+	var rootPort *rstpPort
+	for _, port := range rstp.ports {
+		// 自分の送ったBPDUが別のポートから戻ってきた場合はルートポートにしない
+		if !port.infoValid || port.portVector.designatedBridgeId == rstp.bridgeId {
+			continue
+		}
+		candidate := port.portVector
+		candidate.rootPathCost += port.pathCost
+		if candidate.betterThan(best) || (rootPort != nil && candidate == best && port.portId < bestPortId) {
+			best = candidate
+			bestPortId = port.portId
+			rootPort = port
+		}
+	}
+	rstp.rootVector = best
+	rstp.rootMessageAge = 0
+	if rootPort != nil {
+		rstp.rootMessageAge = rootPort.messageAge + durationToBpduTime(time.Second)
+	}
+	rootChanged := rootPort != rstp.rootPort
+	rstp.rootPort = rootPort
+
+	for _, port := range rstp.ports {
+		var role rstpPortRole
+		switch {
+		case port == rootPort:
+			role = rstpRoleRoot
+		case !port.infoValid || rstp.designatedVector(port).betterThan(port.portVector):
+			role = rstpRoleDesignated
+		case port.portVector.designatedBridgeId == rstp.bridgeId:
+			// 同じブリッジの別のポートが指定ポートになっている
+			role = rstpRoleBackup
+		default:
+			role = rstpRoleAlternate
+		}
+		if role == port.role {
+			continue
+		}
+		fmt.Printf("rstp %s: port %s role %s -> %s\n", rstp.bridge.name, port.netdev.name, port.role, role)
+		port.role = role
+		port.proposing = false
+		port.agreed = false
+		switch role {
+		case rstpRoleDesignated:
+			port.fdWhile = now.Add(RSTP_FORWARD_DELAY)
+		case rstpRoleAlternate, rstpRoleBackup:
+			rstp.setState(port, rstpDiscarding, now)
+		}
+	}
+	// ルートポートが変わったら指定ポートを同期し直してループを防ぐ
+	if rootChanged {
+		rstp.sync(now)
+	}
+	rstp.updateStates(now)
+}
+
+/*
+エッジポート以外の指定ポートを破棄状態に戻して、提案と合意からやり直す
+*/
+func (rstp *rstpBridge) sync(now time.Time) {
+	for _, port := range rstp.ports {
+		if port.role != rstpRoleDesignated || port.operEdge {
+			continue
+		}
+		port.proposing = false
+		port.agreed = false
+		port.fdWhile = now.Add(RSTP_FORWARD_DELAY)
+		rstp.setState(port, rstpDiscarding, now)
+	}
+}
+
+/*
+ポートの役割に応じて状態を進める
+*/
+func (rstp *rstpBridge) updateStates(now time.Time) {
+	for _, port := range rstp.ports {
+		switch port.role {
+		case rstpRoleRoot:
+			rstp.setState(port, rstpForwarding, now)
+		case rstpRoleDesignated:
+			if port.operEdge || port.agreed {
+				rstp.setState(port, rstpForwarding, now)
+				continue
+			}
+			if port.state == rstpForwarding {
+				continue
+			}
+			// 合意が得られなければフォワーディング遅延ごとに状態を進める
+			if !now.Before(port.fdWhile) {
+				rstp.setState(port, port.state+1, now)
+				port.fdWhile = now.Add(RSTP_FORWARD_DELAY)
+			}
+			// 対向のブリッジにすぐにフォワーディングにしていいか提案する
+			if !port.proposing && port.state != rstpForwarding {
+				port.proposing = true
+				rstp.sendBpdu(port, RSTP_FLAG_PROPOSAL, now)
+			}
+		default:
+			rstp.setState(port, rstpDiscarding, now)
+		}
+	}
+}
+
+/*
+ポートの状態を変える
+エッジポート以外がフォワーディングになったらトポロジーの変更として扱う
+*/
+func (rstp *rstpBridge) setState(port *rstpPort, state rstpPortState, now time.Time) {
+	if port.state == state {
+		return
+	}
+	fmt.Printf("rstp %s: port %s state %s -> %s\n", rstp.bridge.name, port.netdev.name, port.state, state)
+	port.state = state
+	if state == rstpDiscarding {
+		// 破棄状態になったポートで学習したアドレスは使えない
+		rstp.bridge.flushFdb(port.netdev, true)
+	}
+	if state == rstpForwarding && !port.operEdge {
+		rstp.topologyChange(port, port, now)
+	}
+}
+
+/*
+トポロジーの変更を処理する
+変更を検出または受信したポート以外で学習したアドレスを消し、TCフラグをつけたBPDUで他のブリッジに知らせる
+*/
+func (rstp *rstpBridge) topologyChange(from *rstpPort, notify *rstpPort, now time.Time) {
+	rstp.bridge.flushFdb(from.netdev, false)
+	for _, port := range rstp.ports {
+		if port.operEdge || (port.role != rstpRoleRoot && port.role != rstpRoleDesignated) {
+			continue
+		}
+		// 受信したポートには送り返さない, 自分で検出したポートには送る
+		if port == from && port != notify {
+			continue
+		}
+		port.tcWhile = now.Add(2 * RSTP_HELLO_TIME)
+		rstp.sendBpdu(port, 0, now)
+	}
+}
+
+/*
+ポートからBPDUを送信する
+ポートの状態に関係なく送る
+*/
+func (rstp *rstpBridge) sendBpdu(port *rstpPort, flags uint8, now time.Time) {
+	switch port.role {
+	case rstpRoleRoot:
+		flags |= RSTP_BPDU_ROLE_ROOT << 2
+	case rstpRoleDesignated:
+		flags |= RSTP_BPDU_ROLE_DESIGNATED << 2
+		// フォワーディングになるまではHelloでも提案を続ける
+		if port.proposing && port.state != rstpForwarding {
+			flags |= RSTP_FLAG_PROPOSAL
+		}
+	default:
+		flags |= RSTP_BPDU_ROLE_ALTERNATE_BACKUP << 2
+	}
+	switch port.state {
+	case rstpLearning:
+		flags |= RSTP_FLAG_LEARNING
+	case rstpForwarding:
+		flags |= RSTP_FLAG_LEARNING | RSTP_FLAG_FORWARDING
+	}
+	if now.Before(port.tcWhile) {
+		flags |= RSTP_FLAG_TC
+	}
+	bpdu := rstpBpdu{
+		version:      RSTP_PROTOCOL_VERSION,
+		bpduType:     RSTP_BPDU_TYPE_RST,
+		flags:        flags,
+		vector:       rstp.designatedVector(port),
+		messageAge:   rstp.rootMessageAge,
+		maxAge:       durationToBpduTime(RSTP_MAX_AGE),
+		helloTime:    durationToBpduTime(RSTP_HELLO_TIME),
+		forwardDelay: durationToBpduTime(RSTP_FORWARD_DELAY),
+	}.ToPacket()
+
+	// BPDUはイーサネットIIではなく長さを入れた802.3のフレームで送る
+	frame := ethernetHeader{
+		destAddr:  RSTP_BPDU_MAC_ADDRESS,
+		srcAddr:   port.netdev.macaddr,
+		etherType: uint16(len(bpdu)),
+	}.ToPacket()
+	frame = append(frame, bpdu...)
+	// 最小のフレーム長まで0で埋める
+	for len(frame) < 60 {
+		frame = append(frame, 0)
+	}
+	if err := port.netdev.netDeviceTransmit(frame); err != nil {
+		fmt.Printf("rstp %s: send bpdu to %s err : %s\n", rstp.bridge.name, port.netdev.name, err)
+	}
+}
+
+/*
+ポートでBPDUを受信したときの処理
+*/
+func (rstp *rstpBridge) rstpInput(inport *netDevice, packet []byte, now time.Time) {
+	port := rstp.port(inport)
+	if port == nil {
+		return
+	}
+	bpdu, err := parseRstpBpdu(packet)
+	if err != nil {
+		fmt.Printf("rstp %s: invalid bpdu from %s : %s\n", rstp.bridge.name, inport.name, err)
+		return
+	}
+	// BPDUが届くポートの先にはブリッジがいる
+	port.operEdge = false
+	port.lastBpdu = now
+
+	if bpdu.bpduType == RSTP_BPDU_TYPE_TCN {
+		rstp.topologyChange(port, nil, now)
+		return
+	}
+
+	role := (bpdu.flags & RSTP_FLAG_ROLE_MASK) >> 2
+	switch role {
+	case RSTP_BPDU_ROLE_DESIGNATED:
+		// 自分が送ったBPDUが同じポートに戻ってきたら無視する
+		if bpdu.vector.designatedBridgeId == rstp.bridgeId && bpdu.vector.designatedPortId == port.portId {
+			return
+		}
+		if bpdu.messageAge >= bpdu.maxAge {
+			return
+		}
+		port.portVector = bpdu.vector
+		port.messageAge = bpdu.messageAge
+		port.infoValid = true
+		helloTime := time.Duration(bpdu.helloTime) * time.Second / 256
+		if helloTime == 0 {
+			helloTime = RSTP_HELLO_TIME
+		}
+		port.rcvdInfoWhile = now.Add(3 * helloTime)
+	case RSTP_BPDU_ROLE_ROOT:
+		// 対向のルートポートから提案への合意が届いた
+		if bpdu.flags&RSTP_FLAG_AGREEMENT != 0 && port.role == rstpRoleDesignated &&
+			bpdu.vector.rootId == rstp.rootVector.rootId {
+			port.agreed = true
+		}
+	}
+	if bpdu.flags&RSTP_FLAG_TC != 0 {
+		rstp.topologyChange(port, nil, now)
+	}
+
+	rstp.updateRoles(now)
+
+	if role != RSTP_BPDU_ROLE_DESIGNATED {
+		return
+	}
+	switch port.role {
+	case rstpRoleRoot:
+		// ルートポートで提案を受けたら指定ポートを同期して合意を返す
+		if bpdu.flags&RSTP_FLAG_PROPOSAL != 0 {
+			rstp.sync(now)
+			rstp.sendBpdu(port, RSTP_FLAG_AGREEMENT, now)
+			rstp.updateStates(now)
+		}
+	case rstpRoleDesignated:
+		// 劣った情報を送ってきたブリッジにはすぐに自分の情報を返す
+		rstp.sendBpdu(port, 0, now)
+	}
+}
+
+/*
+RSTPのタイマーを進める
+受信した情報の期限切れとエッジポートの検出, Helloの送信を行う
+*/
+func (rstp *rstpBridge) rstpTick(now time.Time) {
+	changed := false
+	for _, port := range rstp.ports {
+		if port.infoValid && now.After(port.rcvdInfoWhile) {
+			fmt.Printf("rstp %s: info on port %s is aged out\n", rstp.bridge.name, port.netdev.name)
+			port.infoValid = false
+			changed = true
+		}
+		// 一度もBPDUが届かないポートはホストだけがつながるエッジポートとみなす
+		if !port.operEdge && port.lastBpdu.IsZero() && now.Sub(port.upSince) >= RSTP_EDGE_DELAY {
+			port.operEdge = true
+			changed = true
+		}
+	}
+	if changed {
+		rstp.updateRoles(now)
+	} else {
+		rstp.updateStates(now)
+	}
+
+	if now.Sub(rstp.lastHello) < RSTP_HELLO_TIME {
+		return
+	}
+	rstp.lastHello = now
+	for _, port := range rstp.ports {
+		if port.role == rstpRoleDesignated || (port.role == rstpRoleRoot && now.Before(port.tcWhile)) {
+			rstp.sendBpdu(port, 0, now)
+		}
+	}
+}
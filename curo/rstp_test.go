@@ -0,0 +1,213 @@
+package curo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRstpBpduPacket(t *testing.T) {
+	bpdu := rstpBpdu{
+		version:  RSTP_PROTOCOL_VERSION,
+		bpduType: RSTP_BPDU_TYPE_RST,
+		flags:    RSTP_FLAG_PROPOSAL | RSTP_BPDU_ROLE_DESIGNATED<<2,
+		vector: rstpPriorityVector{
+			rootId:             rstpBridgeId(4096, [6]uint8{0x02, 0, 0, 0, 0, 0x01}),
+			rootPathCost:       20000,
+			designatedBridgeId: rstpBridgeId(32768, [6]uint8{0x02, 0, 0, 0, 0, 0x02}),
+			designatedPortId:   0x8002,
+		},
+		messageAge:   durationToBpduTime(time.Second),
+		maxAge:       durationToBpduTime(RSTP_MAX_AGE),
+		helloTime:    durationToBpduTime(RSTP_HELLO_TIME),
+		forwardDelay: durationToBpduTime(RSTP_FORWARD_DELAY),
+	}
+	packet := bpdu.ToPacket()
+	if len(packet) != 3+RSTP_BPDU_LEN {
+		t.Fatalf("bpdu length is %d", len(packet))
+	}
+	parsed, err := parseRstpBpdu(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != bpdu {
+		t.Fatalf("parsed bpdu is %+v, want %+v", parsed, bpdu)
+	}
+	if parsed.vector.rootId>>48 != 4096 || parsed.helloTime != 2*256 {
+		t.Fatalf("bridge id or timer is wrong %+v", parsed)
+	}
+	if _, err := parseRstpBpdu(packet[:20]); err == nil {
+		t.Fatal("short bpdu is parsed")
+	}
+	if _, err := parseRstpBpdu(append([]byte{0xaa, 0xaa, 0x03}, packet[3:]...)); err == nil {
+		t.Fatal("snap frame is parsed as bpdu")
+	}
+}
+
+func TestRstpPriorityVector(t *testing.T) {
+	root := rstpPriorityVector{rootId: 1, rootPathCost: 100, designatedBridgeId: 5, designatedPortId: 0x8001}
+	for _, worse := range []rstpPriorityVector{
+		{rootId: 2},
+		{rootId: 1, rootPathCost: 200},
+		{rootId: 1, rootPathCost: 100, designatedBridgeId: 6},
+		{rootId: 1, rootPathCost: 100, designatedBridgeId: 5, designatedPortId: 0x8002},
+	} {
+		if !root.betterThan(worse) || worse.betterThan(root) {
+			t.Errorf("%+v is not better than %+v", root, worse)
+		}
+	}
+	if root.betterThan(root) {
+		t.Error("vector is better than itself")
+	}
+}
+
+/*
+2台のブリッジを2本のリンクでループさせた構成を作る
+BPDUの送信はドライバがないので失敗するが、受信側には作ったBPDUを直接渡す
+*/
+func newRstpTestBridge(name string, priority uint16, mac uint8) *rstpBridge {
+	members := []*netDevice{
+		{name: name + "-port1", macaddr: [6]uint8{0x02, 0, 0, 0, mac, 0x01}},
+		{name: name + "-port2", macaddr: [6]uint8{0x02, 0, 0, 0, mac, 0x02}},
+	}
+	bridge, _ := newBridgeDomain(bridgeConfig{name: name, rstp: true, rstpPriority: priority}, members)
+	return bridge.rstp
+}
+
+func testBpdu(rstp *rstpBridge, port *rstpPort, flags uint8) []byte {
+	switch port.role {
+	case rstpRoleRoot:
+		flags |= RSTP_BPDU_ROLE_ROOT << 2
+	case rstpRoleDesignated:
+		flags |= RSTP_BPDU_ROLE_DESIGNATED << 2
+	default:
+		flags |= RSTP_BPDU_ROLE_ALTERNATE_BACKUP << 2
+	}
+	return rstpBpdu{
+		version:      RSTP_PROTOCOL_VERSION,
+		bpduType:     RSTP_BPDU_TYPE_RST,
+		flags:        flags,
+		vector:       rstp.designatedVector(port),
+		messageAge:   rstp.rootMessageAge,
+		maxAge:       durationToBpduTime(RSTP_MAX_AGE),
+		helloTime:    durationToBpduTime(RSTP_HELLO_TIME),
+		forwardDelay: durationToBpduTime(RSTP_FORWARD_DELAY),
+	}.ToPacket()
+}
+
+func TestRstpRoles(t *testing.T) {
+	now := time.Now()
+	rootBridge := newRstpTestBridge("br-a", 4096, 0x0a)
+	bridge := newRstpTestBridge("br-b", RSTP_DEFAULT_BRIDGE_PRIORITY, 0x0b)
+	for _, rstp := range []*rstpBridge{rootBridge, bridge} {
+		for _, port := range rstp.ports {
+			if port.role != rstpRoleDesignated || port.state != rstpDiscarding || !port.proposing {
+				t.Fatalf("initial port %s is %s %s", port.netdev.name, port.role, port.state)
+			}
+		}
+	}
+
+	// 優先度の高いブリッジからの提案をport1で受け取るとルートポートになり、すぐにフォワーディングになる
+	port1, port2 := bridge.ports[0], bridge.ports[1]
+	bridge.rstpInput(port1.netdev, testBpdu(rootBridge, rootBridge.ports[0], RSTP_FLAG_PROPOSAL), now)
+	if bridge.rootPort != port1 || port1.role != rstpRoleRoot || port1.state != rstpForwarding {
+		t.Fatalf("port1 is %s %s", port1.role, port1.state)
+	}
+	if bridge.rootVector.rootId != rootBridge.bridgeId || bridge.rootVector.rootPathCost != RSTP_DEFAULT_PATH_COST {
+		t.Fatalf("root vector is %+v", bridge.rootVector)
+	}
+	// ループの反対側のport2は代替ポートになって破棄する
+	bridge.rstpInput(port2.netdev, testBpdu(rootBridge, rootBridge.ports[1], RSTP_FLAG_PROPOSAL), now)
+	if port2.role != rstpRoleAlternate || port2.state != rstpDiscarding {
+		t.Fatalf("port2 is %s %s", port2.role, port2.state)
+	}
+	if bridge.bridge.portState(port2.netdev) != rstpDiscarding {
+		t.Fatal("port state of bridge is not enforced")
+	}
+
+	// ルートブリッジは自分より劣ったBPDUを受けても指定ポートのまま, 合意を受けるとフォワーディングになる
+	rootPort1 := rootBridge.ports[0]
+	rootBridge.rstpInput(rootPort1.netdev, testBpdu(bridge, port1, RSTP_FLAG_AGREEMENT), now)
+	if rootBridge.rootPort != nil || rootPort1.role != rstpRoleDesignated || rootPort1.state != rstpForwarding {
+		t.Fatalf("root bridge port1 is %s %s", rootPort1.role, rootPort1.state)
+	}
+	// 合意のないport2はフォワーディング遅延ごとに学習, フォワーディングと進む
+	rootPort2 := rootBridge.ports[1]
+	rootBridge.rstpInput(rootPort2.netdev, testBpdu(bridge, port2, 0), now)
+	rootBridge.rstpTick(now.Add(RSTP_EDGE_DELAY))
+	if rootPort2.operEdge || rootPort2.state != rstpDiscarding {
+		t.Fatalf("root bridge port2 is edge %v, %s", rootPort2.operEdge, rootPort2.state)
+	}
+	rootBridge.rstpTick(now.Add(RSTP_FORWARD_DELAY + time.Second))
+	if rootPort2.state != rstpLearning {
+		t.Fatalf("root bridge port2 is %s", rootPort2.state)
+	}
+	rootBridge.rstpTick(now.Add(2*RSTP_FORWARD_DELAY + 2*time.Second))
+	if rootPort2.state != rstpForwarding {
+		t.Fatalf("root bridge port2 is %s", rootPort2.state)
+	}
+
+	// ルートポートの情報が届かなくなったら代替ポートがルートポートになる
+	port2.rcvdInfoWhile = now.Add(time.Hour)
+	bridge.rstpTick(now.Add(3*RSTP_HELLO_TIME + time.Second))
+	if bridge.rootPort != port2 || port2.state != rstpForwarding || port1.role != rstpRoleDesignated {
+		t.Fatalf("port1 is %s %s, port2 is %s %s", port1.role, port1.state, port2.role, port2.state)
+	}
+}
+
+func TestRstpEdgePort(t *testing.T) {
+	rstp := newRstpTestBridge("br-edge", RSTP_DEFAULT_BRIDGE_PRIORITY, 0x0e)
+	port := rstp.ports[0]
+	rstp.rstpTick(port.upSince.Add(time.Second))
+	if port.operEdge || port.state != rstpDiscarding {
+		t.Fatalf("port is edge %v, %s", port.operEdge, port.state)
+	}
+	// BPDUが届かないポートはエッジポートになってすぐにフォワーディングになる
+	rstp.rstpTick(port.upSince.Add(RSTP_EDGE_DELAY))
+	if !port.operEdge || port.state != rstpForwarding {
+		t.Fatalf("port is edge %v, %s", port.operEdge, port.state)
+	}
+}
+
+func TestRstpTopologyChange(t *testing.T) {
+	now := time.Now()
+	rootBridge := newRstpTestBridge("br-a", 4096, 0x0a)
+	rstp := newRstpTestBridge("br-b", RSTP_DEFAULT_BRIDGE_PRIORITY, 0x0b)
+	bridge := rstp.bridge
+	port1, port2 := rstp.ports[0], rstp.ports[1]
+	rstp.rstpInput(port1.netdev, testBpdu(rootBridge, rootBridge.ports[0], 0), now)
+	rstp.rstpTick(port2.upSince.Add(RSTP_EDGE_DELAY))
+	if port2.state != rstpForwarding {
+		t.Fatalf("port2 is %s", port2.state)
+	}
+
+	host1 := [6]uint8{0x02, 0, 0, 0, 0, 0x11}
+	host2 := [6]uint8{0x02, 0, 0, 0, 0, 0x12}
+	bridge.learn(port1.netdev, host1)
+	bridge.learn(port2.netdev, host2)
+	// TCフラグのついたBPDUを受信したポート以外で学習したアドレスを消す
+	rstp.rstpInput(port1.netdev, testBpdu(rootBridge, rootBridge.ports[0], RSTP_FLAG_TC), now)
+	if bridge.lookupFdb(host1) != port1.netdev || bridge.lookupFdb(host2) != nil {
+		t.Fatalf("fdb after topology change is %v", bridge.fdb)
+	}
+}
+
+func TestBridgeInputDiscarding(t *testing.T) {
+	rstp := newRstpTestBridge("br-d", RSTP_DEFAULT_BRIDGE_PRIORITY, 0x0d)
+	bridge := rstp.bridge
+	frame := ethernetHeader{
+		destAddr:  ETHERNET_ADDRESS_BROADCAST,
+		srcAddr:   [6]uint8{0x02, 0, 0, 0, 0, 0x21},
+		etherType: ETHER_TYPE_ARP,
+	}.ToPacket()
+	frame = append(frame, make([]byte, 46)...)
+	// 破棄状態のポートでは学習しない
+	bridgeInput(rstp.ports[0].netdev, frame)
+	if len(bridge.fdb) != 0 {
+		t.Fatal("mac addr is learned on discarding port")
+	}
+	rstp.ports[0].state = rstpLearning
+	bridgeInput(rstp.ports[0].netdev, frame)
+	if bridge.lookupFdb(setMacAddr(frame[6:12])) != rstp.ports[0].netdev {
+		t.Fatal("mac addr is not learned on learning port")
+	}
+}
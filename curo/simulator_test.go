@@ -0,0 +1,716 @@
+package curo
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// シミュレータのリンクの受信キューの長さ
+const SIM_LINK_QUEUE_LEN = 256
+
+// フレームのやり取りが収まらない時に諦めるまでの回数, ループしている時に止める
+const SIM_MAX_ROUNDS = 10000
+
+// pingを送り直す回数, 経路上のルータがそれぞれARPを解決するまでパケットが捨てられる
+const SIM_PING_COUNT = 5
+
+/*
+メモリ上の仮想ネットワーク
+ルータ, ホスト, スイッチをchanDriverのリンクでつなぎ、netns無しでルータを動かす
+*/
+type simulator struct {
+	nodes  []simNode
+	macSeq uint32
+}
+
+// シミュレータの上で受信したフレームを処理するもの
+type simNode interface {
+	// 受信したフレームを全て処理する, 何か処理したらtrueを返す
+	step() bool
+}
+
+// リンクをつなげるもの
+type simEndpoint interface {
+	attach(driver *chanDriver)
+}
+
+// シミュレータの上のgo-curoのルータ
+type simRouter struct {
+	sim    *simulator
+	name   string
+	router *Router
+}
+
+// シミュレータの上の最小限のIPv4のホスト, ARPとpingには自分で応答する
+type simHost struct {
+	name     string
+	macaddr  [6]uint8
+	address  uint32
+	netmask  uint32
+	gateway  uint32
+	driver   *chanDriver
+	arpTable map[uint32][6]uint8
+	waiting  map[uint32][][]byte // ARPの解決を待っているIPパケット
+	identify uint16
+	received []simPacket
+}
+
+// MACアドレスを学習してフレームを転送するスイッチ, Linuxのbridgeの代わり
+type simSwitch struct {
+	name  string
+	ports []*chanDriver
+	fdb   map[[6]uint8]*chanDriver
+}
+
+// ホストが受信したIPパケット
+type simPacket struct {
+	srcAddr  uint32
+	destAddr uint32
+	protocol uint8
+	ttl      uint8
+	srcPort  uint16 // TCP, UDPのポートかICMPのエコーのID
+	destPort uint16
+	icmpType uint8
+	sequence uint16 // ICMPのエコーのシーケンス番号
+	tcpflag  uint8
+	seq      uint32
+	ackseq   uint32
+	payload  []byte
+	valid    bool // IPヘッダと上位プロトコルのチェックサムが正しいか
+}
+
+func newSimulator() *simulator {
+	return &simulator{}
+}
+
+// ローカルに管理されたユニキャストのMACアドレスを順番に割り当てる
+func (sim *simulator) nextMacAddr() [6]uint8 {
+	sim.macSeq++
+	return [6]uint8{0x02, 0x00, uint8(sim.macSeq >> 24), uint8(sim.macSeq >> 16), uint8(sim.macSeq >> 8), uint8(sim.macSeq)}
+}
+
+/*
+CIDRの表記のアドレスをパースする, 空の文字列ならアドレスなしにする
+*/
+func parseSimAddr(cidr string) (uint32, uint32) {
+	if cidr == "" {
+		return 0, 0
+	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		panic(fmt.Sprintf("invalid simulator addr %q", cidr))
+	}
+	return byteToUint32(ip.To4()), byteToUint32(ipnet.Mask)
+}
+
+func parseSimIPAddr(addr string) uint32 {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil {
+		panic(fmt.Sprintf("invalid simulator ip addr %q", addr))
+	}
+	return byteToUint32(ip)
+}
+
+func (sim *simulator) addRouter(name string) *simRouter {
+	router := &simRouter{sim: sim, name: name, router: NewRouter("ch2")}
+	sim.nodes = append(sim.nodes, router)
+	return router
+}
+
+/*
+ホストを作る, gatewayが空ならデフォルトゲートウェイなし
+*/
+func (sim *simulator) addHost(name, cidr, gateway string) *simHost {
+	address, netmask := parseSimAddr(cidr)
+	host := &simHost{
+		name:     name,
+		macaddr:  sim.nextMacAddr(),
+		address:  address,
+		netmask:  netmask,
+		arpTable: make(map[uint32][6]uint8),
+		waiting:  make(map[uint32][][]byte),
+	}
+	if gateway != "" {
+		host.gateway = parseSimIPAddr(gateway)
+	}
+	sim.nodes = append(sim.nodes, host)
+	return host
+}
+
+func (sim *simulator) addSwitch(name string) *simSwitch {
+	sw := &simSwitch{name: name, fdb: make(map[[6]uint8]*chanDriver)}
+	sim.nodes = append(sim.nodes, sw)
+	return sw
+}
+
+/*
+2つのものをリンクでつなぐ
+リンクを切るテストのために両端のドライバを返す
+*/
+func (sim *simulator) link(a, b simEndpoint) (*chanDriver, *chanDriver) {
+	driverA, driverB := newChanDriverPair(SIM_LINK_QUEUE_LEN)
+	a.attach(driverA)
+	b.attach(driverB)
+	return driverA, driverB
+}
+
+/*
+全てのキューが空になるまでフレームを処理する
+収まらなければfalseを返す
+*/
+func (sim *simulator) run() bool {
+	for i := 0; i < SIM_MAX_ROUNDS; i++ {
+		busy := false
+		for _, node := range sim.nodes {
+			if node.step() {
+				busy = true
+			}
+		}
+		if !busy {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+pingを送ってエコーリプライが返ってくるか確認する
+ルータは宛先のARPを解決する間にパケットを捨てるので、SIM_PING_COUNT回まで送り直す
+*/
+func (sim *simulator) ping(host *simHost, dest string) bool {
+	destAddr := parseSimIPAddr(dest)
+	for i := 0; i < SIM_PING_COUNT; i++ {
+		host.identify++
+		sequence := host.identify
+		host.ping(destAddr, 0x4355, sequence)
+		sim.run()
+		for _, packet := range host.received {
+			if packet.protocol == IP_PROTOCOL_NUM_ICMP && packet.icmpType == ICMP_TYPE_ECHO_REPLY &&
+				packet.srcAddr == destAddr && packet.sequence == sequence {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ルータにデバイスを追加する
+アドレスがあれば直接接続の経路も登録する
+*/
+func (router *simRouter) addDevice(name, cidr string) *netDevice {
+	netdev := &netDevice{
+		name:    name,
+		macaddr: router.sim.nextMacAddr(),
+	}
+	if address, netmask := parseSimAddr(cidr); address != 0 {
+		netdev.ipdev = ipDevice{
+			address:   address,
+			netmask:   netmask,
+			broadcast: address | ^netmask,
+		}
+	}
+	router.router.addDevice(netdev)
+	return netdev
+}
+
+// ネクストホップへの経路を追加する
+func (router *simRouter) addRoute(prefix, nexthop string) {
+	if err := router.router.AddRoute(prefix, nexthop); err != nil {
+		panic(err)
+	}
+}
+
+// insideのデバイスに、outsideのデバイスのアドレスを外側のアドレスとするNATを設定する
+func (router *simRouter) configureNat(inside, outside string, opts NatOptions) {
+	if err := router.router.ConfigureNat(inside, outside, opts); err != nil {
+		panic(err)
+	}
+}
+
+// ARPテーブルからアドレスのMACアドレスを探す
+func (router *simRouter) arpEntry(addr string) [6]uint8 {
+	macaddr, _ := router.router.searchArpTableEntry(parseSimIPAddr(addr))
+	return macaddr
+}
+
+// 宛先アドレスへの経路を探す
+func (router *simRouter) lookupRoute(addr string) ipRouteEntry {
+	return router.router.route.radixTreeSearch(parseSimIPAddr(addr))
+}
+
+// insideのデバイスのNATエントリを探す
+func (router *simRouter) natEntry(inside string, proto natProtocolType, globalIpAddr uint32, globalPort uint16) *natEntry {
+	natdevice := router.router.getnetDeviceByName(inside).ipdev.natdev
+	if natdevice == (natDevice{}) {
+		return nil
+	}
+	natdevice.natEntry.mutex.Lock()
+	defer natdevice.natEntry.mutex.Unlock()
+	return natdevice.natEntry.getNatEntryByGlobal(proto, globalIpAddr, globalPort)
+}
+
+// デバイスにためているフレームを受信して処理する
+func (router *simRouter) step() bool {
+	busy := false
+	for _, netdev := range router.router.devices {
+		driver, ok := netdev.driver.(bufferedDriver)
+		if !ok || !driver.buffered() {
+			continue
+		}
+		busy = true
+		if err := netdev.netDeviceDrain(router.router.mode); err != nil {
+			fmt.Printf("simulator router %s drain err : %s\n", router.name, err)
+		}
+	}
+	return busy
+}
+
+func (netdev *netDevice) attach(driver *chanDriver) {
+	netdev.driver = driver
+}
+
+func (host *simHost) attach(driver *chanDriver) {
+	host.driver = driver
+}
+
+func (sw *simSwitch) attach(driver *chanDriver) {
+	sw.ports = append(sw.ports, driver)
+}
+
+/*
+受信したフレームを学習したポートに転送する
+宛先を学習していなければ受信したポート以外に転送する
+*/
+func (sw *simSwitch) step() bool {
+	busy := false
+	for _, inport := range sw.ports {
+		for inport.buffered() {
+			busy = true
+			frame, _ := inport.receive()
+			if len(frame) < 14 {
+				continue
+			}
+			sw.fdb[setMacAddr(frame[6:12])] = inport
+			if outport, ok := sw.fdb[setMacAddr(frame[0:6])]; ok {
+				if outport != inport {
+					outport.transmit(frame)
+				}
+				continue
+			}
+			for _, outport := range sw.ports {
+				if outport != inport {
+					outport.transmit(frame)
+				}
+			}
+		}
+	}
+	return busy
+}
+
+func (host *simHost) step() bool {
+	if host.driver == nil {
+		return false
+	}
+	busy := false
+	for host.driver.buffered() {
+		busy = true
+		frame, _ := host.driver.receive()
+		host.input(frame)
+	}
+	return busy
+}
+
+/*
+受信したフレームの処理
+ARPとpingには応答し、自分宛てのIPパケットはreceivedにためる
+*/
+func (host *simHost) input(frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+	destAddr := setMacAddr(frame[0:6])
+	if destAddr != host.macaddr && destAddr != ETHERNET_ADDRESS_BROADCAST {
+		return
+	}
+	packet := frame[14:]
+	switch byteToUint16(frame[12:14]) {
+	case ETHER_TYPE_ARP:
+		if len(packet) < 28 || byteToUint32(packet[24:28]) != host.address {
+			return
+		}
+		senderAddr := byteToUint32(packet[14:18])
+		host.arpTable[senderAddr] = setMacAddr(packet[8:14])
+		if byteToUint16(packet[6:8]) == ARP_OPERATION_CODE_REQUEST {
+			host.sendArp(ARP_OPERATION_CODE_REPLY, setMacAddr(packet[8:14]), senderAddr)
+		}
+		// ARPの解決を待っていたパケットを送る
+		for _, waiting := range host.waiting[senderAddr] {
+			host.output(senderAddr, waiting)
+		}
+		delete(host.waiting, senderAddr)
+	case ETHER_TYPE_IP:
+		received, ok := parseSimPacket(packet)
+		if !ok || received.destAddr != host.address {
+			return
+		}
+		host.received = append(host.received, received)
+		if received.protocol == IP_PROTOCOL_NUM_ICMP && received.icmpType == ICMP_TYPE_ECHO_REQUEST {
+			reply := append([]byte{}, packet[20:]...)
+			reply[0] = ICMP_TYPE_ECHO_REPLY
+			reply[2], reply[3] = 0, 0
+			checksum := calcChecksum(reply)
+			reply[2], reply[3] = checksum[0], checksum[1]
+			host.sendIP(received.srcAddr, IP_PROTOCOL_NUM_ICMP, reply)
+		}
+	}
+}
+
+/*
+受信したIPパケットをパースする
+*/
+func parseSimPacket(packet []byte) (simPacket, bool) {
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return simPacket{}, false
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	totalLen := int(byteToUint16(packet[2:4]))
+	if totalLen < headerLen || len(packet) < totalLen {
+		return simPacket{}, false
+	}
+	received := simPacket{
+		srcAddr:  byteToUint32(packet[12:16]),
+		destAddr: byteToUint32(packet[16:20]),
+		protocol: packet[9],
+		ttl:      packet[8],
+	}
+	zero := []byte{0, 0}
+	received.valid = string(calcChecksum(packet[:headerLen])) == string(zero)
+	payload := packet[headerLen:totalLen]
+	switch received.protocol {
+	case IP_PROTOCOL_NUM_ICMP:
+		if len(payload) < 8 {
+			return simPacket{}, false
+		}
+		received.icmpType = payload[0]
+		received.srcPort = byteToUint16(payload[4:6])
+		received.sequence = byteToUint16(payload[6:8])
+		received.payload = payload[8:]
+		received.valid = received.valid && string(calcChecksum(payload)) == string(zero)
+	case IP_PROTOCOL_NUM_UDP:
+		if len(payload) < 8 {
+			return simPacket{}, false
+		}
+		received.srcPort = byteToUint16(payload[0:2])
+		received.destPort = byteToUint16(payload[2:4])
+		received.payload = payload[8:]
+		if byteToUint16(payload[6:8]) != 0 {
+			received.valid = received.valid &&
+				calcTransportChecksum(received.srcAddr, received.destAddr, received.protocol, payload) == 0
+		}
+	case IP_PROTOCOL_NUM_TCP:
+		if len(payload) < 20 || len(payload) < int(payload[12]>>4)*4 {
+			return simPacket{}, false
+		}
+		received.srcPort = byteToUint16(payload[0:2])
+		received.destPort = byteToUint16(payload[2:4])
+		received.seq = byteToUint32(payload[4:8])
+		received.ackseq = byteToUint32(payload[8:12])
+		received.tcpflag = payload[13]
+		received.payload = payload[int(payload[12]>>4)*4:]
+		received.valid = received.valid &&
+			calcTransportChecksum(received.srcAddr, received.destAddr, received.protocol, payload) == 0
+	}
+	return received, true
+}
+
+func (host *simHost) sendArp(opcode uint16, destMacAddr [6]uint8, targetAddr uint32) {
+	arp := arpIPToEthernet{
+		hardwareType:        ARP_HTYPE_ETHERNET,
+		protocolType:        ETHER_TYPE_IP,
+		hardwareLen:         ETHERNET_ADDRES_LEN,
+		protocolLen:         IP_ADDRESS_LEN,
+		opcode:              opcode,
+		senderHardwareAddr:  host.macaddr,
+		senderIPAddr:        host.address,
+		targetHardwareAddrr: destMacAddr,
+		targetIPAddr:        targetAddr,
+	}.ToPacket()
+	if opcode == ARP_OPERATION_CODE_REQUEST {
+		destMacAddr = ETHERNET_ADDRESS_BROADCAST
+	}
+	frame := ethernetHeader{
+		destAddr:  destMacAddr,
+		srcAddr:   host.macaddr,
+		etherType: ETHER_TYPE_ARP,
+	}.ToPacket()
+	host.driver.transmit(append(frame, arp...))
+}
+
+/*
+IPパケットを作って送信する
+同じネットワークなら宛先に、そうでなければゲートウェイに送る
+*/
+func (host *simHost) sendIP(destAddr uint32, protocol uint8, payload []byte) {
+	host.identify++
+	ipheader := ipHeader{
+		version:   4,
+		headerLen: 20 / 4,
+		totalLen:  uint16(20 + len(payload)),
+		identify:  host.identify,
+		ttl:       64,
+		protocol:  protocol,
+		srcAddr:   host.address,
+		destAddr:  destAddr,
+	}
+	packet := append(ipheader.ToPacket(true), payload...)
+	nexthop := destAddr
+	if destAddr&host.netmask != host.address&host.netmask {
+		nexthop = host.gateway
+	}
+	if _, ok := host.arpTable[nexthop]; !ok {
+		// ARPを解決してから送る
+		host.waiting[nexthop] = append(host.waiting[nexthop], packet)
+		host.sendArp(ARP_OPERATION_CODE_REQUEST, [6]uint8{}, nexthop)
+		return
+	}
+	host.output(nexthop, packet)
+}
+
+func (host *simHost) output(nexthop uint32, packet []byte) {
+	frame := ethernetHeader{
+		destAddr:  host.arpTable[nexthop],
+		srcAddr:   host.macaddr,
+		etherType: ETHER_TYPE_IP,
+	}.ToPacket()
+	host.driver.transmit(append(frame, packet...))
+}
+
+// ICMPのエコーリクエストを送る
+func (host *simHost) ping(destAddr uint32, identify, sequence uint16) {
+	icmpPacket := []byte{ICMP_TYPE_ECHO_REQUEST, 0, 0, 0}
+	icmpPacket = append(icmpPacket, uint16ToByte(identify)...)
+	icmpPacket = append(icmpPacket, uint16ToByte(sequence)...)
+	// go-curoはエコーの後ろの8byteをタイムスタンプとして扱う
+	icmpPacket = append(icmpPacket, []byte("go-curo simulator")...)
+	checksum := calcChecksum(icmpPacket)
+	icmpPacket[2], icmpPacket[3] = checksum[0], checksum[1]
+	host.sendIP(destAddr, IP_PROTOCOL_NUM_ICMP, icmpPacket)
+}
+
+func (host *simHost) sendUdp(destAddr uint32, srcPort, destPort uint16, payload []byte) {
+	udpheader := udpHeader{
+		srcPort:  srcPort,
+		destPort: destPort,
+		length:   uint16(8 + len(payload)),
+	}
+	packet := append(udpheader.ToPacket(), payload...)
+	checksum := calcTransportChecksum(host.address, destAddr, IP_PROTOCOL_NUM_UDP, packet)
+	packet[6], packet[7] = uint8(checksum>>8), uint8(checksum)
+	host.sendIP(destAddr, IP_PROTOCOL_NUM_UDP, packet)
+}
+
+func (host *simHost) sendTcp(destAddr uint32, srcPort, destPort uint16, seq, ackseq uint32, tcpflag uint8, payload []byte) {
+	tcpheader := tcpHeader{
+		srcPort:  srcPort,
+		destPort: destPort,
+		seq:      seq,
+		ackseq:   ackseq,
+		offset:   20 / 4 << 4,
+		tcpflag:  tcpflag,
+		window:   0xffff,
+		tcpdata:  payload,
+	}
+	packet := tcpheader.ToPacket()
+	checksum := calcTransportChecksum(host.address, destAddr, IP_PROTOCOL_NUM_TCP, packet)
+	packet[16], packet[17] = uint8(checksum>>8), uint8(checksum)
+	host.sendIP(destAddr, IP_PROTOCOL_NUM_TCP, packet)
+}
+
+// 受信したパケットのうち条件に合うものを返す
+func (host *simHost) receivedPackets(match func(packet simPacket) bool) []simPacket {
+	var packets []simPacket
+	for _, packet := range host.received {
+		if match(packet) {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+/*
+chapter5-netns.shと同じ構成をメモリ上に作る
+host0, host1 -- switch -- router1 -- router2 -- host2
+router2もgo-curoで動かす
+*/
+func newChapter5Simulator(natOptions *NatOptions) (*simulator, *simRouter, *simRouter, []*simHost) {
+	sim := newSimulator()
+	br0 := sim.addSwitch("br0")
+	host0 := sim.addHost("host0", "192.168.1.3/24", "192.168.1.1")
+	host1 := sim.addHost("host1", "192.168.1.2/24", "192.168.1.1")
+	host2 := sim.addHost("host2", "192.168.2.2/24", "192.168.2.1")
+
+	router1 := sim.addRouter("router1")
+	router1Br0 := router1.addDevice("router1-br0", "192.168.1.1/24")
+	router1Router2 := router1.addDevice("router1-router2", "192.168.0.1/24")
+	router1.addRoute("192.168.2.0/24", "192.168.0.2")
+
+	router2 := sim.addRouter("router2")
+	router2Router1 := router2.addDevice("router2-router1", "192.168.0.2/24")
+	router2Host2 := router2.addDevice("router2-host2", "192.168.2.1/24")
+	router2.addRoute("192.168.1.0/24", "192.168.0.1")
+
+	sim.link(host0, br0)
+	sim.link(host1, br0)
+	sim.link(router1Br0, br0)
+	sim.link(router1Router2, router2Router1)
+	sim.link(router2Host2, host2)
+
+	if natOptions != nil {
+		router1.configureNat("router1-br0", "router1-router2", *natOptions)
+	}
+	return sim, router1, router2, []*simHost{host0, host1, host2}
+}
+
+func TestSimulatorRouting(t *testing.T) {
+	sim, router1, router2, hosts := newChapter5Simulator(nil)
+	host0, host2 := hosts[0], hosts[2]
+
+	// ルータ自身と2つ先のホストにpingが届く
+	if !sim.ping(host0, "192.168.1.1") {
+		t.Fatal("ping from host0 to router1 failed")
+	}
+	if !sim.ping(host0, "192.168.2.2") {
+		t.Fatal("ping from host0 to host2 failed")
+	}
+	reply := host0.received[len(host0.received)-1]
+	if !reply.valid || reply.ttl != 62 {
+		t.Fatalf("echo reply from host2 is %+v", reply)
+	}
+
+	// 経路とARPテーブルを確認する
+	if route := router1.lookupRoute("192.168.2.2"); route.iptype != network || route.nexthop != 0xc0a80002 {
+		t.Fatalf("route to host2 on router1 is %+v", route)
+	}
+	if route := router2.lookupRoute("192.168.2.2"); route.iptype != connected || route.netdev.name != "router2-host2" {
+		t.Fatalf("route to host2 on router2 is %+v", route)
+	}
+	if router1.arpEntry("192.168.0.2") == ([6]uint8{}) || router2.arpEntry("192.168.2.2") != host2.macaddr {
+		t.Fatal("arp entries of routers are not resolved")
+	}
+	// ルータごとにARPテーブルが分かれている, router1からはhost2はrouter2の先にいる
+	if router1.arpEntry("192.168.2.2") != router1.arpEntry("192.168.0.2") {
+		t.Fatal("router1 does not see host2 behind router2")
+	}
+
+	// 経路のない宛先には届かない
+	if sim.ping(host0, "10.0.0.1") {
+		t.Fatal("ping to unreachable addr succeeded")
+	}
+	if !sim.run() {
+		t.Fatal("simulator did not settle")
+	}
+}
+
+func TestSimulatorNatUdp(t *testing.T) {
+	sim, router1, _, hosts := newChapter5Simulator(&NatOptions{})
+	host1, host2 := hosts[1], hosts[2]
+	host2Addr := parseSimIPAddr("192.168.2.2")
+
+	// 最初のパケットはルータがARPを解決する間に捨てられるので送り直す
+	var received []simPacket
+	for i := 0; i < 3 && len(received) == 0; i++ {
+		host1.sendUdp(host2Addr, 40000, 53, []byte("query"))
+		sim.run()
+		received = host2.receivedPackets(func(packet simPacket) bool {
+			return packet.protocol == IP_PROTOCOL_NUM_UDP && packet.destPort == 53
+		})
+	}
+	if len(received) == 0 {
+		t.Fatal("udp packet is not delivered to host2")
+	}
+	request := received[0]
+	if request.srcAddr != 0xc0a80001 || request.srcPort < NAT_GLOBAL_PORT_MIN || request.srcPort > NAT_GLOBAL_PORT_MAX ||
+		!request.valid || !bytes.Equal(request.payload, []byte("query")) {
+		t.Fatalf("udp packet on host2 is %+v", request)
+	}
+
+	// NATのエントリが作られている
+	entry := router1.natEntry("router1-br0", udp, 0xc0a80001, request.srcPort)
+	if entry == nil || entry.localIpAddr != 0xc0a80102 || entry.localPort != 40000 {
+		t.Fatalf("nat entry is %+v", entry)
+	}
+
+	// 戻りのパケットは元のアドレスとポートに戻る
+	host2.sendUdp(request.srcAddr, 53, request.srcPort, []byte("answer"))
+	sim.run()
+	answers := host1.receivedPackets(func(packet simPacket) bool {
+		return packet.protocol == IP_PROTOCOL_NUM_UDP && packet.srcPort == 53
+	})
+	if len(answers) != 1 || answers[0].srcAddr != host2Addr || answers[0].destPort != 40000 ||
+		!answers[0].valid || !bytes.Equal(answers[0].payload, []byte("answer")) {
+		t.Fatalf("udp answers on host1 are %+v", answers)
+	}
+}
+
+func TestSimulatorNatTcp(t *testing.T) {
+	sim, router1, _, hosts := newChapter5Simulator(&NatOptions{})
+	host0, host2 := hosts[0], hosts[2]
+	host2Addr := parseSimIPAddr("192.168.2.2")
+	// 先にpingで経路上のARPを解決しておく
+	if !sim.ping(host0, "192.168.2.2") {
+		t.Fatal("ping from host0 to host2 through nat failed")
+	}
+
+	// 3ウェイハンドシェイク
+	host0.sendTcp(host2Addr, 50000, 80, 1000, 0, TCP_FLAG_SYN, nil)
+	sim.run()
+	syns := host2.receivedPackets(func(packet simPacket) bool { return packet.tcpflag == TCP_FLAG_SYN })
+	if len(syns) != 1 || syns[0].srcAddr != 0xc0a80001 || !syns[0].valid {
+		t.Fatalf("syn on host2 is %+v", syns)
+	}
+	globalPort := syns[0].srcPort
+	host2.sendTcp(syns[0].srcAddr, 80, globalPort, 5000, 1001, TCP_FLAG_SYN|TCP_FLAG_ACK, nil)
+	sim.run()
+	synAcks := host0.receivedPackets(func(packet simPacket) bool { return packet.tcpflag == TCP_FLAG_SYN|TCP_FLAG_ACK })
+	if len(synAcks) != 1 || synAcks[0].destPort != 50000 || synAcks[0].ackseq != 1001 || !synAcks[0].valid {
+		t.Fatalf("syn ack on host0 is %+v", synAcks)
+	}
+	host0.sendTcp(host2Addr, 50000, 80, 1001, 5001, TCP_FLAG_ACK|TCP_FLAG_PSH, []byte("GET / HTTP/1.0\r\n\r\n"))
+	sim.run()
+	data := host2.receivedPackets(func(packet simPacket) bool {
+		return packet.protocol == IP_PROTOCOL_NUM_TCP && len(packet.payload) != 0
+	})
+	if len(data) != 1 || data[0].srcPort != globalPort || !data[0].valid {
+		t.Fatalf("tcp data on host2 is %+v", data)
+	}
+
+	if entry := router1.natEntry("router1-br0", tcp, 0xc0a80001, globalPort); entry == nil || entry.tcpState != natTcpEstablished {
+		t.Fatalf("tcp nat entry is %+v", entry)
+	}
+
+	// NATの外側からの新しい接続は通らない
+	host2.sendTcp(0xc0a80001, 80, 8080, 9000, 0, TCP_FLAG_SYN, nil)
+	sim.run()
+	if len(host0.receivedPackets(func(packet simPacket) bool { return packet.srcPort == 80 && packet.destPort == 8080 })) != 0 {
+		t.Fatal("unsolicited syn is delivered through nat")
+	}
+}
+
+func TestSimulatorLinkDown(t *testing.T) {
+	sim := newSimulator()
+	host0 := sim.addHost("host0", "192.168.1.2/24", "192.168.1.1")
+	host1 := sim.addHost("host1", "192.168.2.2/24", "192.168.2.1")
+	router := sim.addRouter("router1")
+	sim.link(host0, router.addDevice("router1-host0", "192.168.1.1/24"))
+	_, link := sim.link(router.addDevice("router1-host1", "192.168.2.1/24"), host1)
+	if !sim.ping(host0, "192.168.2.2") {
+		t.Fatal("ping from host0 to host1 failed")
+	}
+	link.close()
+	if sim.ping(host0, "192.168.2.2") {
+		t.Fatal("ping over down link succeeded")
+	}
+}
@@ -1,27 +1,16 @@
-package main
+package curo
 
 import (
 	"encoding/binary"
 	"fmt"
 	"strings"
-)
 
-func sumByteArr(packet []byte) (sum uint) {
-	for i, _ := range packet {
-		if i%2 == 0 {
-			sum += uint(byteToUint16(packet[i:]))
-		}
-	}
-	return sum
-}
+	"github.com/sat0ken/go-curo/checksum"
+)
 
+// チェックサムの計算はchecksumパッケージで行い、byteにして返す
 func calcChecksum(packet []byte) []byte {
-	// まず16ビット毎に足す
-	sum := sumByteArr(packet)
-	// あふれた桁を足す
-	sum = (sum & 0xffff) + sum>>16
-	// 論理否定を取った値をbyteにして返す
-	return uint16ToByte(uint16(sum ^ 0xffff))
+	return uint16ToByte(checksum.Checksum(packet))
 }
 
 func printMacAddr(macddr [6]uint8) string {
@@ -0,0 +1,103 @@
+package curo
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const ETHER_TYPE_VLAN uint16 = 0x8100
+const VLAN_TAG_LEN = 4
+const VLAN_ID_MAX uint16 = 4094
+
+// VLANのサブインターフェイスの設定
+type vlanConfig struct {
+	name    string // router1-br0.10 のような親のインターフェイス名.VLAN ID
+	parent  string
+	vlanId  uint16
+	address uint32
+	netmask uint32
+}
+
+/*
+VLANのサブインターフェイスの設定をパースする
+"router1-br0.10=192.168.10.1/24" の形で指定する
+*/
+func parseVlanConfig(rule string) (vlanConfig, error) {
+	fields := strings.Split(rule, "=")
+	if len(fields) != 2 {
+		return vlanConfig{}, fmt.Errorf("invalid vlan rule %q, format is ifname.vid=addr/prefix", rule)
+	}
+	dot := strings.LastIndex(fields[0], ".")
+	if dot <= 0 {
+		return vlanConfig{}, fmt.Errorf("invalid vlan interface name %q", fields[0])
+	}
+	vlanId, err := strconv.ParseUint(fields[0][dot+1:], 10, 16)
+	if err != nil || vlanId == 0 || uint16(vlanId) > VLAN_ID_MAX {
+		return vlanConfig{}, fmt.Errorf("invalid vlan id in %q", fields[0])
+	}
+	ip, ipnet, err := net.ParseCIDR(fields[1])
+	if err != nil || ip.To4() == nil {
+		return vlanConfig{}, fmt.Errorf("invalid vlan ip addr %q", fields[1])
+	}
+	return vlanConfig{
+		name:    fields[0],
+		parent:  fields[0][:dot],
+		vlanId:  uint16(vlanId),
+		address: byteToUint32(ip.To4()),
+		netmask: byteToUint32(ipnet.Mask),
+	}, nil
+}
+
+/*
+親のデバイスの上にVLANのサブインターフェイスを作る
+サブインターフェイスは親とMACアドレスを共有し、送受信は親のソケットで行う
+*/
+func newVlanDevice(parent *netDevice, conf vlanConfig) *netDevice {
+	return &netDevice{
+		name:    conf.name,
+		macaddr: parent.macaddr,
+		vlanId:  conf.vlanId,
+		parent:  parent,
+		ipdev: ipDevice{
+			address:   conf.address,
+			netmask:   conf.netmask,
+			broadcast: conf.address | ^conf.netmask,
+		},
+	}
+}
+
+/*
+VLAN IDに対応する親のデバイスのサブインターフェイスを探す
+*/
+func (netdev *netDevice) vlanDevice(vlanId uint16) *netDevice {
+	for _, dev := range netdev.router.devices {
+		if dev.parent == netdev && dev.vlanId == vlanId {
+			return dev
+		}
+	}
+	return nil
+}
+
+/*
+イーサネットのヘッダの送信元MACアドレスの後ろに802.1Qのタグを挿入する
+*/
+func vlanTag(frame []byte, vlanId uint16) []byte {
+	tagged := make([]byte, 0, len(frame)+VLAN_TAG_LEN)
+	tagged = append(tagged, frame[0:12]...)
+	tagged = append(tagged, uint16ToByte(ETHER_TYPE_VLAN)...)
+	// PCPとDEIは0にする
+	tagged = append(tagged, uint16ToByte(vlanId&0x0fff)...)
+	return append(tagged, frame[12:]...)
+}
+
+/*
+802.1Qのタグを外してVLAN IDとタグなしのフレームを返す
+*/
+func vlanUntag(frame []byte) (uint16, []byte) {
+	vlanId := byteToUint16(frame[14:16]) & 0x0fff
+	untagged := make([]byte, 0, len(frame)-VLAN_TAG_LEN)
+	untagged = append(untagged, frame[0:12]...)
+	return vlanId, append(untagged, frame[16:]...)
+}
@@ -0,0 +1,68 @@
+package curo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseVlanConfig(t *testing.T) {
+	vlan, err := parseVlanConfig("router1-br0.10=192.168.10.1/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vlan.name != "router1-br0.10" || vlan.parent != "router1-br0" || vlan.vlanId != 10 ||
+		vlan.address != 0xc0a80a01 || vlan.netmask != 0xffffff00 {
+		t.Fatalf("vlan config is %+v", vlan)
+	}
+	for _, invalid := range []string{"router1-br0=192.168.10.1/24", "router1-br0.0=192.168.10.1/24",
+		"router1-br0.4095=192.168.10.1/24", "router1-br0.10=192.168.10.1", "router1-br0.10=2001:db8::1/64"} {
+		if _, err := parseVlanConfig(invalid); err == nil {
+			t.Errorf("parseVlanConfig(%q) succeeded", invalid)
+		}
+	}
+}
+
+func TestVlanTagUntag(t *testing.T) {
+	frame := ethernetHeader{
+		destAddr:  ETHERNET_ADDRESS_BROADCAST,
+		srcAddr:   [6]uint8{0x02, 0, 0, 0, 0, 0x01},
+		etherType: ETHER_TYPE_ARP,
+	}.ToPacket()
+	frame = append(frame, []byte("payload")...)
+
+	tagged := vlanTag(frame, 20)
+	if len(tagged) != len(frame)+VLAN_TAG_LEN || byteToUint16(tagged[12:14]) != ETHER_TYPE_VLAN ||
+		byteToUint16(tagged[14:16]) != 20 || byteToUint16(tagged[16:18]) != ETHER_TYPE_ARP {
+		t.Fatalf("tagged frame is %x", tagged)
+	}
+	vlanId, untagged := vlanUntag(tagged)
+	if vlanId != 20 || !bytes.Equal(untagged, frame) {
+		t.Fatalf("untagged vlan %d frame is %x", vlanId, untagged)
+	}
+}
+
+func TestParseVlanAuxdata(t *testing.T) {
+	// struct tpacket_auxdata
+	auxdata := make([]byte, 20)
+	binary.LittleEndian.PutUint32(auxdata[0:4], TP_STATUS_VLAN_VALID)
+	binary.LittleEndian.PutUint16(auxdata[16:18], 30)
+	oob := make([]byte, syscall.CmsgSpace(len(auxdata)))
+	header := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = syscall.SOL_PACKET
+	header.Type = PACKET_AUXDATA
+	header.SetLen(syscall.CmsgLen(len(auxdata)))
+	copy(oob[syscall.CmsgLen(0):], auxdata)
+
+	vlanId, ok := parseVlanAuxdata(oob)
+	if !ok || vlanId != 30 {
+		t.Fatalf("vlan id in auxdata is %d, %v", vlanId, ok)
+	}
+	// タグのないフレームのauxdata
+	binary.LittleEndian.PutUint32(oob[syscall.CmsgLen(0):], 0)
+	if _, ok := parseVlanAuxdata(oob); ok {
+		t.Fatal("vlan id is found in auxdata without vlan")
+	}
+}
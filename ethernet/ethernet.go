@@ -0,0 +1,55 @@
+/*
+Package ethernet はイーサネットのヘッダをパースしたりバイト列にしたりする
+*/
+package ethernet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const HEADER_LEN = 14
+const ADDRESS_LEN = 6
+
+const (
+	TYPE_IPV4 uint16 = 0x0800
+	TYPE_ARP  uint16 = 0x0806
+	TYPE_VLAN uint16 = 0x8100
+	TYPE_IPV6 uint16 = 0x86dd
+	TYPE_LACP uint16 = 0x8809
+	TYPE_LLDP uint16 = 0x88cc
+)
+
+var BROADCAST = [6]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+type Header struct {
+	Dest [6]uint8 // 宛先MACアドレス
+	Src  [6]uint8 // 送信元MACアドレス
+	Type uint16   // イーサタイプ
+}
+
+/*
+フレームをヘッダとペイロードに分ける
+ペイロードはフレームのスライスなのでコピーしない
+*/
+func Parse(frame []byte) (Header, []byte, error) {
+	if len(frame) < HEADER_LEN {
+		return Header{}, nil, fmt.Errorf("ethernet frame length %d is shorter than header length %d", len(frame), HEADER_LEN)
+	}
+	var header Header
+	copy(header.Dest[:], frame[0:6])
+	copy(header.Src[:], frame[6:12])
+	header.Type = binary.BigEndian.Uint16(frame[12:14])
+	return header, frame[HEADER_LEN:], nil
+}
+
+/*
+ヘッダにペイロードをつなげたフレームを作る
+*/
+func (header Header) Marshal(payload []byte) ([]byte, error) {
+	frame := make([]byte, HEADER_LEN, HEADER_LEN+len(payload))
+	copy(frame[0:6], header.Dest[:])
+	copy(frame[6:12], header.Src[:])
+	binary.BigEndian.PutUint16(frame[12:14], header.Type)
+	return append(frame, payload...), nil
+}
@@ -0,0 +1,57 @@
+package ethernet
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	header := Header{
+		Dest: BROADCAST,
+		Src:  [6]uint8{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+		Type: TYPE_ARP,
+	}
+	payload := []byte{0x01, 0x02, 0x03}
+	frame, err := header.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02, 0x00, 0x00, 0x00, 0x00, 0x01, 0x08, 0x06, 0x01, 0x02, 0x03}
+	if !bytes.Equal(frame, want) {
+		t.Fatalf("marshaled frame is %x, want %x", frame, want)
+	}
+	parsed, parsedPayload, err := Parse(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != header || !bytes.Equal(parsedPayload, payload) {
+		t.Fatalf("parsed %+v %x, want %+v %x", parsed, parsedPayload, header, payload)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	for n := 0; n < HEADER_LEN; n++ {
+		if _, _, err := Parse(make([]byte, n)); err == nil {
+			t.Fatalf("parse %d bytes frame is not err", n)
+		}
+	}
+	if _, payload, err := Parse(make([]byte, HEADER_LEN)); err != nil || len(payload) != 0 {
+		t.Fatalf("parse header only frame is %x, %v", payload, err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	frame, _ := Header{Dest: BROADCAST, Type: TYPE_ARP}.Marshal([]byte{0x00, 0x01})
+	f.Add(frame)
+	f.Add(frame[:HEADER_LEN-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := Parse(data)
+		if err != nil {
+			return
+		}
+		frame, err := header.Marshal(payload)
+		if err != nil || !bytes.Equal(frame, data) {
+			t.Fatalf("frame %x is marshaled to %x, %v", data, frame, err)
+		}
+	})
+}
@@ -1,3 +1,3 @@
-module main
+module github.com/sat0ken/go-curo
 
 go 1.19
@@ -0,0 +1,74 @@
+/*
+Package icmp はICMPのメッセージをパースしたりバイト列にしたりする
+*/
+package icmp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+const HEADER_LEN = 8
+
+const (
+	TYPE_ECHO_REPLY              uint8 = 0
+	TYPE_DESTINATION_UNREACHABLE uint8 = 3
+	TYPE_ECHO_REQUEST            uint8 = 8
+	TYPE_TIME_EXCEEDED           uint8 = 11
+	TYPE_PARAMETER_PROBLEM       uint8 = 12
+)
+
+/*
+ICMPのヘッダ
+タイプとコード, チェックサムの後ろの4byteはエコーなら識別番号とシーケンス番号で、
+Destination UnreachableやTime Exceededなら未使用やMTUのフィールドになる
+*/
+type Header struct {
+	Type     uint8
+	Code     uint8
+	Checksum uint16
+	Identify uint16
+	Sequence uint16
+}
+
+/*
+メッセージをヘッダとデータに分ける
+*/
+func Parse(message []byte) (Header, []byte, error) {
+	if len(message) < HEADER_LEN {
+		return Header{}, nil, fmt.Errorf("icmp message length %d is shorter than header length %d", len(message), HEADER_LEN)
+	}
+	return Header{
+		Type:     message[0],
+		Code:     message[1],
+		Checksum: binary.BigEndian.Uint16(message[2:4]),
+		Identify: binary.BigEndian.Uint16(message[4:6]),
+		Sequence: binary.BigEndian.Uint16(message[6:8]),
+	}, message[HEADER_LEN:], nil
+}
+
+/*
+ヘッダにデータをつなげたメッセージを作る
+チェックサムはそのまま書くので、計算するならMessageChecksumを使う
+*/
+func (header Header) Marshal(data []byte) ([]byte, error) {
+	message := make([]byte, HEADER_LEN, HEADER_LEN+len(data))
+	message[0] = header.Type
+	message[1] = header.Code
+	binary.BigEndian.PutUint16(message[2:4], header.Checksum)
+	binary.BigEndian.PutUint16(message[4:6], header.Identify)
+	binary.BigEndian.PutUint16(message[6:8], header.Sequence)
+	return append(message, data...), nil
+}
+
+/*
+データを含めたメッセージ全体のチェックサムを計算する
+Checksumのフィールドは0として計算するので、結果をそのままセットできる
+*/
+func (header Header) MessageChecksum(data []byte) uint16 {
+	header.Checksum = 0
+	message, _ := header.Marshal(data)
+	return checksum.Checksum(message)
+}
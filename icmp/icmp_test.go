@@ -0,0 +1,60 @@
+package icmp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte("abcdefghijklmnopqrstuvwabcdefghi")
+	header := Header{
+		Type:     TYPE_ECHO_REQUEST,
+		Identify: 0x1234,
+		Sequence: 1,
+	}
+	header.Checksum = header.MessageChecksum(data)
+	message, err := header.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum.Checksum(message) != 0 {
+		t.Fatalf("checksum of %x is wrong", message)
+	}
+	parsed, parsedData, err := Parse(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != header || !bytes.Equal(parsedData, data) {
+		t.Fatalf("parsed %+v %x, want %+v %x", parsed, parsedData, header, data)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	message, _ := Header{Type: TYPE_ECHO_REPLY}.Marshal(nil)
+	for n := 0; n < len(message); n++ {
+		if _, _, err := Parse(message[:n]); err == nil {
+			t.Fatalf("parse %d bytes message is not err", n)
+		}
+	}
+	if _, data, err := Parse(message); err != nil || len(data) != 0 {
+		t.Fatalf("parse header only message is %x, %v", data, err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	message, _ := Header{Type: TYPE_ECHO_REQUEST, Identify: 1, Sequence: 1}.Marshal([]byte("ping"))
+	f.Add(message)
+	f.Add(message[:HEADER_LEN-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := Parse(data)
+		if err != nil {
+			return
+		}
+		message, err := header.Marshal(payload)
+		if err != nil || !bytes.Equal(message, data) {
+			t.Fatalf("message %x is marshaled to %x, %v", data, message, err)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+/*
+Package ipv4 はIPv4のヘッダをパースしたりバイト列にしたりする
+*/
+package ipv4
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+const VERSION = 4
+const HEADER_LEN = 20
+const HEADER_LEN_MAX = 60
+const ADDRESS_LEN = 4
+
+const (
+	PROTOCOL_ICMP uint8 = 0x01
+	PROTOCOL_TCP  uint8 = 0x06
+	PROTOCOL_UDP  uint8 = 0x11
+)
+
+// フラグメントのフィールドの上位3bitのフラグ
+const (
+	FLAG_DONT_FRAGMENT  uint16 = 0x4000
+	FLAG_MORE_FRAGMENTS uint16 = 0x2000
+)
+
+type Header struct {
+	Version    uint8  // バージョン
+	HeaderLen  uint8  // ヘッダ長, 4byte単位
+	Tos        uint8  // Type of Service
+	TotalLen   uint16 // Totalのパケット長
+	Identify   uint16 // 識別番号
+	FragOffset uint16 // フラグとフラグメントオフセット
+	Ttl        uint8  // Time To Live
+	Protocol   uint8  // 上位のプロトコル番号
+	Checksum   uint16 // ヘッダのチェックサム
+	SrcAddr    uint32 // 送信元IPアドレス
+	DestAddr   uint32 // 送信先IPアドレス
+	Options    []byte // IPオプション, なければnil
+}
+
+/*
+パケットをヘッダとペイロードに分ける
+ペイロードはトータル長までなので、イーサネットのパディングは含まない
+*/
+func Parse(packet []byte) (Header, []byte, error) {
+	if len(packet) < HEADER_LEN {
+		return Header{}, nil, fmt.Errorf("ipv4 packet length %d is shorter than header length %d", len(packet), HEADER_LEN)
+	}
+	header := Header{
+		Version:    packet[0] >> 4,
+		HeaderLen:  packet[0] & 0x0f,
+		Tos:        packet[1],
+		TotalLen:   binary.BigEndian.Uint16(packet[2:4]),
+		Identify:   binary.BigEndian.Uint16(packet[4:6]),
+		FragOffset: binary.BigEndian.Uint16(packet[6:8]),
+		Ttl:        packet[8],
+		Protocol:   packet[9],
+		Checksum:   binary.BigEndian.Uint16(packet[10:12]),
+		SrcAddr:    binary.BigEndian.Uint32(packet[12:16]),
+		DestAddr:   binary.BigEndian.Uint32(packet[16:20]),
+	}
+	if header.Version != VERSION {
+		return Header{}, nil, fmt.Errorf("ip version %d is not ipv4", header.Version)
+	}
+	headerLen := int(header.HeaderLen) * 4
+	if headerLen < HEADER_LEN || len(packet) < headerLen {
+		return Header{}, nil, fmt.Errorf("ipv4 header length %d is invalid for packet length %d", headerLen, len(packet))
+	}
+	if int(header.TotalLen) < headerLen || len(packet) < int(header.TotalLen) {
+		return Header{}, nil, fmt.Errorf("ipv4 total length %d is invalid for packet length %d", header.TotalLen, len(packet))
+	}
+	if HEADER_LEN < headerLen {
+		header.Options = packet[HEADER_LEN:headerLen]
+	}
+	return header, packet[headerLen:header.TotalLen], nil
+}
+
+/*
+ヘッダにペイロードをつなげたパケットを作る
+バージョンとヘッダ長, トータル長が0なら計算した値をセットし、0でなければ実際の長さと合っているか確かめる
+チェックサムはそのまま書くので、計算するならHeaderChecksumを使う
+*/
+func (header Header) Marshal(payload []byte) ([]byte, error) {
+	headerLen := HEADER_LEN + len(header.Options)
+	if 0xffff < headerLen+len(payload) {
+		return nil, fmt.Errorf("ipv4 packet length %d is too long", headerLen+len(payload))
+	}
+	if header.TotalLen == 0 {
+		header.TotalLen = uint16(headerLen + len(payload))
+	}
+	if int(header.TotalLen) != headerLen+len(payload) {
+		return nil, fmt.Errorf("ipv4 total length %d does not match packet length %d", header.TotalLen, headerLen+len(payload))
+	}
+	packet, err := header.MarshalHeader()
+	if err != nil {
+		return nil, err
+	}
+	return append(packet, payload...), nil
+}
+
+/*
+ヘッダのチェックサムを計算する
+Checksumのフィールドは0として計算するので、結果をそのままセットできる
+トータル長は計算しないので、セットしてから呼ぶ
+*/
+func (header Header) HeaderChecksum() (uint16, error) {
+	header.Checksum = 0
+	packet, err := header.MarshalHeader()
+	if err != nil {
+		return 0, err
+	}
+	return checksum.Checksum(packet), nil
+}
+
+/*
+ペイロードをつなげずにヘッダだけをバイト列にする
+トータル長はそのまま書くので、転送するパケットのように後からペイロードをつなげるときに使う
+*/
+func (header Header) MarshalHeader() ([]byte, error) {
+	if header.Version == 0 {
+		header.Version = VERSION
+	}
+	if header.Version != VERSION {
+		return nil, fmt.Errorf("ip version %d is not ipv4", header.Version)
+	}
+	if len(header.Options)%4 != 0 || HEADER_LEN_MAX < HEADER_LEN+len(header.Options) {
+		return nil, fmt.Errorf("ipv4 options length %d is invalid", len(header.Options))
+	}
+	headerLen := HEADER_LEN + len(header.Options)
+	if header.HeaderLen == 0 {
+		header.HeaderLen = uint8(headerLen / 4)
+	}
+	if int(header.HeaderLen)*4 != headerLen {
+		return nil, fmt.Errorf("ipv4 header length %d does not match options length %d", header.HeaderLen, len(header.Options))
+	}
+	packet := make([]byte, headerLen, headerLen+int(header.TotalLen))
+	packet[0] = header.Version<<4 | header.HeaderLen
+	packet[1] = header.Tos
+	binary.BigEndian.PutUint16(packet[2:4], header.TotalLen)
+	binary.BigEndian.PutUint16(packet[4:6], header.Identify)
+	binary.BigEndian.PutUint16(packet[6:8], header.FragOffset)
+	packet[8] = header.Ttl
+	packet[9] = header.Protocol
+	binary.BigEndian.PutUint16(packet[10:12], header.Checksum)
+	binary.BigEndian.PutUint32(packet[12:16], header.SrcAddr)
+	binary.BigEndian.PutUint32(packet[16:20], header.DestAddr)
+	copy(packet[HEADER_LEN:], header.Options)
+	return packet, nil
+}
@@ -0,0 +1,135 @@
+package ipv4
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+func testHeader() Header {
+	return Header{
+		Ttl:      64,
+		Protocol: PROTOCOL_UDP,
+		SrcAddr:  0xc0a80101,
+		DestAddr: 0xc0a80201,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []byte
+		payload []byte
+	}{
+		{name: "no options", payload: []byte("hello")},
+		{name: "options", options: []byte{0x01, 0x01, 0x01, 0x00}, payload: []byte("hello")},
+		{name: "empty payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := testHeader()
+			header.Options = tt.options
+			var err error
+			header.TotalLen = uint16(HEADER_LEN + len(tt.options) + len(tt.payload))
+			header.Checksum, err = header.HeaderChecksum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet, err := header.Marshal(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checksum.Checksum(packet[:HEADER_LEN+len(tt.options)]) != 0 {
+				t.Fatalf("header checksum of %x is wrong", packet)
+			}
+			parsed, payload, err := Parse(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 0にしていたバージョンとヘッダ長は計算した値になる
+			header.Version = VERSION
+			header.HeaderLen = uint8((HEADER_LEN + len(tt.options)) / 4)
+			if !reflect.DeepEqual(parsed, header) || !bytes.Equal(payload, tt.payload) {
+				t.Fatalf("parsed %+v %x, want %+v %x", parsed, payload, header, tt.payload)
+			}
+			again, err := parsed.Marshal(payload)
+			if err != nil || !bytes.Equal(again, packet) {
+				t.Fatalf("marshal parsed header is %x, %v, want %x", again, err, packet)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	packet, err := testHeader().Marshal([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(packet); n++ {
+		if _, _, err := Parse(packet[:n]); err == nil {
+			t.Fatalf("parse %d bytes packet is not err", n)
+		}
+	}
+	// トータル長より後ろのパディングはペイロードに含めない
+	_, payload, err := Parse(append(append([]byte{}, packet...), 0, 0, 0))
+	if err != nil || string(payload) != "hello" {
+		t.Fatalf("parse padded packet is %q, %v", payload, err)
+	}
+	tests := []struct {
+		name   string
+		modify func(b []byte)
+	}{
+		{name: "ipv6 version", modify: func(b []byte) { b[0] = 0x65 }},
+		{name: "header length 4", modify: func(b []byte) { b[0] = 0x44 }},
+		{name: "header length beyond packet", modify: func(b []byte) { b[0] = 0x4f }},
+		{name: "total length shorter than header", modify: func(b []byte) { b[2], b[3] = 0, 19 }},
+	}
+	for _, tt := range tests {
+		b := append([]byte{}, packet...)
+		tt.modify(b)
+		if _, _, err := Parse(b); err == nil {
+			t.Errorf("parse packet with %s is not err", tt.name)
+		}
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(h *Header)
+	}{
+		{name: "version 6", modify: func(h *Header) { h.Version = 6 }},
+		{name: "options not aligned", modify: func(h *Header) { h.Options = []byte{1, 1, 0} }},
+		{name: "options too long", modify: func(h *Header) { h.Options = make([]byte, 44) }},
+		{name: "header length mismatch", modify: func(h *Header) { h.HeaderLen = 6 }},
+		{name: "total length mismatch", modify: func(h *Header) { h.TotalLen = 100 }},
+	}
+	for _, tt := range tests {
+		header := testHeader()
+		tt.modify(&header)
+		if _, err := header.Marshal([]byte("hello")); err == nil {
+			t.Errorf("marshal header with %s is not err", tt.name)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	header := testHeader()
+	header.Options = []byte{0x01, 0x01, 0x01, 0x00}
+	packet, _ := header.Marshal([]byte("hello"))
+	f.Add(packet)
+	f.Add(packet[:HEADER_LEN])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := Parse(data)
+		if err != nil {
+			return
+		}
+		// トータル長より後ろを除いて元のパケットに戻る
+		packet, err := header.Marshal(payload)
+		if err != nil || !bytes.Equal(packet, data[:header.TotalLen]) {
+			t.Fatalf("packet %x is marshaled to %x, %v", data, packet, err)
+		}
+	})
+}
@@ -1,17 +1,105 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/sat0ken/go-curo/curo"
 )
 
+// カンマ区切りの引数を分ける, 空なら何も返さない
+func splitRules(rules string) []string {
+	if rules == "" {
+		return nil
+	}
+	return strings.Split(rules, ",")
+}
+
+/*
+SIGINTかSIGTERMを受け取るまでルータを動かし、止まったらCloseでNATのログやキャプチャを書き出して閉じる
+*/
+func runRouter(router *curo.Router) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err := router.Run(ctx)
+	if closeErr := router.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	var mode string
+	var forwards, statics string
+	var natOptions curo.NatOptions
+	var conf chapter2Config
+	var vlanRules, bridgeRules, bondRules string
+	var tapRules, tunRules string
+	var rstpPriority uint
+	var captureRotate int64
+	var replayInput, replayOutput, replayMode string
+	var driverRules string
 	flag.StringVar(&mode, "mode", "ch1", "set run router mode")
+	flag.StringVar(&forwards, "forward", "", "set nat port forward rules (ch5), e.g. tcp:8080:192.168.1.3:80,udp:5353:192.168.1.3:53")
+	flag.StringVar(&natOptions.Mapping, "nat-mapping", "eim", "set nat mapping behavior (ch5), eim, adm or apdm")
+	flag.StringVar(&natOptions.Filtering, "nat-filtering", "eif", "set nat filtering behavior (ch5), eif, adf or apdf")
+	flag.StringVar(&natOptions.Pool, "nat-pool", "", "set nat outside addr pool (ch5), e.g. 192.168.0.10-192.168.0.20")
+	flag.UintVar(&natOptions.PortBlockSize, "nat-port-block", 0, "set nat port block size per inside host (ch5), 0 is disabled")
+	flag.StringVar(&statics, "nat-static", "", "set 1:1 static nat rules (ch5), e.g. 192.168.1.3=192.168.0.100")
+	flag.BoolVar(&natOptions.Nat64, "nat64", false, "enable nat64 from ipv6 inside hosts (ch5)")
+	flag.StringVar(&natOptions.Nat64Prefix, "nat64-prefix", curo.NAT64_WELL_KNOWN_PREFIX, "set nat64 /96 prefix (ch5)")
+	flag.StringVar(&natOptions.Log, "nat-log", "", "append nat session events to the file as json lines (ch5)")
+	flag.StringVar(&natOptions.Ipfix, "nat-ipfix", "", "export nat session events as ipfix to the udp collector (ch5), e.g. 192.168.0.2:4739")
+	flag.StringVar(&vlanRules, "vlan", "", "set 802.1q vlan sub-interfaces (ch2, ch5), e.g. router1-br0.10=192.168.10.1/24")
+	flag.StringVar(&bridgeRules, "bridge", "", "set learning bridges (ch2, ch5), e.g. router1-br0=router1-host0+router1-host1@192.168.1.1/24")
+	flag.StringVar(&bondRules, "bond", "", "bond interfaces with lacp (ch2, ch5), e.g. router1-bond0=router1-r2a+router1-r2b@192.168.0.1/24")
+	flag.StringVar(&tapRules, "tap", "", "create tap devices for the router (ch2, ch5), e.g. router1-tap0=192.168.100.1/24")
+	flag.StringVar(&tunRules, "tun", "", "create tun devices for the router (ch2, ch5), e.g. router1-tun0=192.168.101.1/24")
+	flag.BoolVar(&conf.rstp, "rstp", false, "run rapid spanning tree protocol on the bridges (ch2, ch5)")
+	flag.UintVar(&rstpPriority, "rstp-priority", uint(curo.RSTP_DEFAULT_BRIDGE_PRIORITY), "set rstp bridge priority, a multiple of 4096")
+	flag.BoolVar(&conf.lldp, "lldp", false, "advertise interfaces and discover neighbors with lldp (ch2, ch5)")
+	flag.StringVar(&conf.lldpSystemName, "lldp-system-name", "", "set lldp system name, default is the hostname")
+	flag.StringVar(&conf.lldpNeighbors, "lldp-neighbors", "", "write the lldp neighbor table to the file as json, e.g. /tmp/router1-lldp.json")
+	flag.StringVar(&conf.capture.Path, "capture", "", "write frames the router sends and receives to the file, or to the dir with -capture-per-interface")
+	flag.StringVar(&conf.capture.Format, "capture-format", "pcapng", "set capture file format, pcap or pcapng")
+	flag.BoolVar(&conf.capture.PerInterface, "capture-per-interface", false, "write a capture file per interface")
+	flag.StringVar(&conf.capture.Filter, "capture-filter", "", "capture only frames matching the filter, e.g. 'icmp or tcp port 80'")
+	flag.Int64Var(&captureRotate, "capture-rotate", 0, "rotate capture files larger than the size in MB, 0 is disabled")
+	flag.StringVar(&replayInput, "replay", "", "read frames to replay from the pcapng file (replay)")
+	flag.StringVar(&replayOutput, "replay-output", "", "write frames the router sends during replay to the file, pcapng if the extension is .pcapng (replay)")
+	flag.StringVar(&replayMode, "replay-as", "ch2", "set router mode to replay the frames with, ch1, ch2 or ch5 (replay)")
+	flag.StringVar(&driverRules, "driver", "", "set interface drivers, packet, mmap or xdp, for all or per interface, e.g. mmap or router1-br0=xdp,router1-router2=packet")
 	flag.Parse()
 
-	if mode == "ch1" {
-		runChapter1()
+	// NATの設定は5章のモードでルータを作る時にパースする
+	natOptions.Forwards = splitRules(forwards)
+	natOptions.Statics = splitRules(statics)
+	conf.nat = natOptions
+
+	if rstpPriority > 61440 || rstpPriority%4096 != 0 {
+		log.Fatalf("rstp priority must be a multiple of 4096 up to 61440")
+	}
+	conf.rstpPriority = uint16(rstpPriority)
+	conf.vlans = splitRules(vlanRules)
+	conf.bridges = splitRules(bridgeRules)
+	conf.bonds = splitRules(bondRules)
+	conf.taps = splitRules(tapRules)
+	conf.tuns = splitRules(tunRules)
+	conf.capture.RotateSize = captureRotate * 1000000
+	conf.drivers = splitRules(driverRules)
+
+	if mode == "replay" {
+		runReplay(replayMode, replayInput, replayOutput, conf)
+	} else if mode == "ch1" {
+		runChapter1(conf.drivers, conf.capture)
 	} else {
-		runChapter2(mode)
+		runChapter2(mode, conf)
 	}
 }
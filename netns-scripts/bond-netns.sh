@@ -0,0 +1,68 @@
+#!/bin/bash
+
+# rootユーザーが必要
+if [ $UID -ne 0 ]; then
+  echo "Root privileges are required"
+  exit 1;
+fi
+
+# 全てのnetnsを削除
+ip -all netns delete
+
+# router1とrouter2を2本のリンクでつなぎ、LACPで1つのbondにまとめる
+# router2はbondとhost2をブリッジでつなぐスイッチとして動作する
+# ルータは以下で起動する
+# sudo ip netns exec router1 ./go-curo -mode ch2 -bond router1-bond0=router1-r2a+router1-r2b@192.168.0.1/24
+# sudo ip netns exec router2 ./go-curo -mode ch2 -bond router2-bond0=router2-r1a+router2-r1b -bridge router2-br0=router2-bond0+router2-host2
+
+# 4つのnetnsを作成
+ip netns add host1
+ip netns add router1
+ip netns add router2
+ip netns add host2
+
+# リンクの作成
+ip link add name host1-router1 type veth peer name router1-host1 # host1とrouter1のリンク
+ip link add name router1-r2a type veth peer name router2-r1a # router1とrouter2の1本目のリンク
+ip link add name router1-r2b type veth peer name router2-r1b # router1とrouter2の2本目のリンク
+ip link add name router2-host2 type veth peer name host2-router2 # router2とhost2のリンク
+
+# リンクの割り当て
+ip link set host1-router1 netns host1
+ip link set router1-host1 netns router1
+ip link set router1-r2a netns router1
+ip link set router1-r2b netns router1
+ip link set router2-r1a netns router2
+ip link set router2-r1b netns router2
+ip link set router2-host2 netns router2
+ip link set host2-router2 netns host2
+
+# host1のリンクの設定
+ip netns exec host1 ip addr add 192.168.1.2/24 dev host1-router1
+ip netns exec host1 ip link set host1-router1 up
+ip netns exec host1 ethtool -K host1-router1 rx off tx off
+ip netns exec host1 ip route add default via 192.168.1.1
+
+# router1のリンクの設定
+# bondのメンバーにはアドレスをつけない
+ip netns exec router1 ip addr add 192.168.1.1/24 dev router1-host1
+ip netns exec router1 ip link set router1-host1 up
+ip netns exec router1 ethtool -K router1-host1 rx off tx off
+for dev in router1-r2a router1-r2b; do
+  ip netns exec router1 ip link set $dev up
+  ip netns exec router1 ethtool -K $dev rx off tx off
+done
+ip netns exec router1 sysctl -w net.ipv4.ip_forward=0
+
+# router2のリンクの設定
+# ブリッジのポートにはアドレスをつけない
+for dev in router2-r1a router2-r1b router2-host2; do
+  ip netns exec router2 ip link set $dev up
+  ip netns exec router2 ethtool -K $dev rx off tx off
+done
+
+# host2のリンクの設定
+ip netns exec host2 ip addr add 192.168.0.3/24 dev host2-router2
+ip netns exec host2 ip link set host2-router2 up
+ip netns exec host2 ethtool -K host2-router2 rx off tx off
+ip netns exec host2 ip route add default via 192.168.0.1
@@ -56,16 +56,21 @@ ip netns exec host1 ip addr add 192.168.1.2/24 dev host1-br0
 ip netns exec host1 ip link set host1-br0 up
 ip netns exec host1 ethtool -K host1-br0 rx off tx off
 ip netns exec host1 ip route add default via 192.168.1.1
+# NAT64の確認用にIPv6のアドレスとNAT64のプレフィックスへの経路を設定
+ip netns exec host1 ip addr add 2001:db8:1::2/64 dev host1-br0 nodad
+ip netns exec host1 ip route add 64:ff9b::/96 via 2001:db8:1::1
 
 # router1のリンクの設定
 ip netns exec router1 ip addr add 192.168.1.1/24 dev router1-br0
 ip netns exec router1 ip link set router1-br0 up
 ip netns exec router1 ethtool -K router1-br0 rx off tx off
+ip netns exec router1 ip addr add 2001:db8:1::1/64 dev router1-br0 nodad
 ip netns exec router1 ip addr add 192.168.0.1/24 dev router1-router2
 ip netns exec router1 ip link set router1-router2 up
 ip netns exec router1 ethtool -K router1-router2 rx off tx off
 # ip netns exec router1 ip route add 192.168.2.0/24 via 192.168.0.2
 ip netns exec router1 sysctl -w net.ipv4.ip_forward=0
+ip netns exec router1 sysctl -w net.ipv6.conf.all.forwarding=0
 
 # router2のリンクの設定
 ip netns exec router2 ip addr add 192.168.0.2/24 dev router2-router1
@@ -0,0 +1,60 @@
+#!/bin/bash
+
+# rootユーザーが必要
+if [ $UID -ne 0 ]; then
+  echo "Root privileges are required"
+  exit 1;
+fi
+
+# 全てのnetnsを削除
+ip -all netns delete
+
+# switch1とswitch2を2本のリンクでつないでループを作り、RSTPでどちらかのポートを止める
+# ブリッジは以下で起動する
+# sudo ip netns exec switch1 ./go-curo -mode ch2 -bridge sw1-br0=sw1-host1+sw1-sw2a+sw1-sw2b -rstp -rstp-priority 4096
+# sudo ip netns exec switch2 ./go-curo -mode ch2 -bridge sw2-br0=sw2-host2+sw2-sw1a+sw2-sw1b -rstp
+
+# 4つのnetnsを作成
+ip netns add host1
+ip netns add switch1
+ip netns add switch2
+ip netns add host2
+
+# リンクの作成
+ip link add name host1-sw1 type veth peer name sw1-host1 # host1とswitch1のリンク
+ip link add name sw1-sw2a type veth peer name sw2-sw1a # switch1とswitch2の1本目のリンク
+ip link add name sw1-sw2b type veth peer name sw2-sw1b # switch1とswitch2の2本目のリンク
+ip link add name sw2-host2 type veth peer name host2-sw2 # switch2とhost2のリンク
+
+# リンクの割り当て
+ip link set host1-sw1 netns host1
+ip link set sw1-host1 netns switch1
+ip link set sw1-sw2a netns switch1
+ip link set sw1-sw2b netns switch1
+ip link set sw2-sw1a netns switch2
+ip link set sw2-sw1b netns switch2
+ip link set sw2-host2 netns switch2
+ip link set host2-sw2 netns host2
+
+# host1のリンクの設定
+ip netns exec host1 ip addr add 192.168.1.2/24 dev host1-sw1
+ip netns exec host1 ip link set host1-sw1 up
+ip netns exec host1 ethtool -K host1-sw1 rx off tx off
+
+# switch1のリンクの設定
+# ブリッジのポートにはアドレスをつけない
+for dev in sw1-host1 sw1-sw2a sw1-sw2b; do
+  ip netns exec switch1 ip link set $dev up
+  ip netns exec switch1 ethtool -K $dev rx off tx off
+done
+
+# switch2のリンクの設定
+for dev in sw2-host2 sw2-sw1a sw2-sw1b; do
+  ip netns exec switch2 ip link set $dev up
+  ip netns exec switch2 ethtool -K $dev rx off tx off
+done
+
+# host2のリンクの設定
+ip netns exec host2 ip addr add 192.168.1.3/24 dev host2-sw2
+ip netns exec host2 ip link set host2-sw2 up
+ip netns exec host2 ethtool -K host2-sw2 rx off tx off
@@ -0,0 +1,52 @@
+#!/bin/bash
+
+# rootユーザーが必要
+if [ $UID -ne 0 ]; then
+  echo "Root privileges are required"
+  exit 1;
+fi
+
+# 全てのnetnsを削除
+ip -all netns delete
+
+# router1と2つのVLANのホストのnetnsを作成
+# switch1はトランクのVLANを振り分けるスイッチの代わり
+ip netns add router1
+ip netns add switch1
+ip netns add host10
+ip netns add host20
+
+# router1とswitch1をトランクでつなぐ
+ip link add name router1-trunk type veth peer name trunk-router1
+ip link set router1-trunk netns router1
+ip link set trunk-router1 netns switch1
+
+# switch1でVLAN 10と20のインターフェイスを作りホストに渡す
+ip netns exec switch1 ip link set trunk-router1 up
+ip netns exec switch1 ethtool -K trunk-router1 rx off tx off
+ip netns exec switch1 ip link add link trunk-router1 name trunk.10 type vlan id 10
+ip netns exec switch1 ip link add link trunk-router1 name trunk.20 type vlan id 20
+ip netns exec switch1 ip link set trunk.10 netns host10
+ip netns exec switch1 ip link set trunk.20 netns host20
+
+# host10のリンクの設定
+ip netns exec host10 ip addr add 192.168.10.2/24 dev trunk.10
+ip netns exec host10 ip link set trunk.10 up
+ip netns exec host10 ethtool -K trunk.10 rx off tx off
+ip netns exec host10 ip route add default via 192.168.10.1
+
+# host20のリンクの設定
+ip netns exec host20 ip addr add 192.168.20.2/24 dev trunk.20
+ip netns exec host20 ip link set trunk.20 up
+ip netns exec host20 ethtool -K trunk.20 rx off tx off
+ip netns exec host20 ip route add default via 192.168.20.1
+
+# router1のリンクの設定
+# タグなしのフレームはトランクのインターフェイス自身で受け取る
+ip netns exec router1 ip addr add 192.168.100.1/24 dev router1-trunk
+ip netns exec router1 ip link set router1-trunk up
+ip netns exec router1 ethtool -K router1-trunk rx off tx off
+ip netns exec router1 sysctl -w net.ipv4.ip_forward=0
+
+# ルータは以下で起動する
+# sudo ip netns exec router1 ./go-curo -mode ch2 -vlan router1-trunk.10=192.168.10.1/24,router1-trunk.20=192.168.20.1/24
@@ -0,0 +1,114 @@
+/*
+Package tcp はTCPのヘッダをパースしたりバイト列にしたりする
+*/
+package tcp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+const HEADER_LEN = 20
+const HEADER_LEN_MAX = 60
+const PROTOCOL_NUM uint8 = 0x06
+
+// TCPのフラグ
+const (
+	FLAG_FIN uint8 = 0x01
+	FLAG_SYN uint8 = 0x02
+	FLAG_RST uint8 = 0x04
+	FLAG_PSH uint8 = 0x08
+	FLAG_ACK uint8 = 0x10
+	FLAG_URG uint8 = 0x20
+)
+
+type Header struct {
+	SrcPort    uint16
+	DestPort   uint16
+	Seq        uint32
+	Ack        uint32
+	DataOffset uint8 // ヘッダ長, 4byte単位
+	Reserved   uint8 // ヘッダ長の後ろの4bit, ECNで使うこともあるのでそのまま残す
+	Flags      uint8
+	Window     uint16
+	Checksum   uint16
+	UrgPointer uint16
+	Options    []byte // TCPオプション, なければnil
+}
+
+/*
+セグメントをヘッダとデータに分ける
+*/
+func Parse(segment []byte) (Header, []byte, error) {
+	if len(segment) < HEADER_LEN {
+		return Header{}, nil, fmt.Errorf("tcp segment length %d is shorter than header length %d", len(segment), HEADER_LEN)
+	}
+	header := Header{
+		SrcPort:    binary.BigEndian.Uint16(segment[0:2]),
+		DestPort:   binary.BigEndian.Uint16(segment[2:4]),
+		Seq:        binary.BigEndian.Uint32(segment[4:8]),
+		Ack:        binary.BigEndian.Uint32(segment[8:12]),
+		DataOffset: segment[12] >> 4,
+		Reserved:   segment[12] & 0x0f,
+		Flags:      segment[13],
+		Window:     binary.BigEndian.Uint16(segment[14:16]),
+		Checksum:   binary.BigEndian.Uint16(segment[16:18]),
+		UrgPointer: binary.BigEndian.Uint16(segment[18:20]),
+	}
+	headerLen := int(header.DataOffset) * 4
+	if headerLen < HEADER_LEN || len(segment) < headerLen {
+		return Header{}, nil, fmt.Errorf("tcp header length %d is invalid for segment length %d", headerLen, len(segment))
+	}
+	if HEADER_LEN < headerLen {
+		header.Options = segment[HEADER_LEN:headerLen]
+	}
+	return header, segment[headerLen:], nil
+}
+
+/*
+ヘッダにデータをつなげたセグメントを作る
+ヘッダ長が0なら計算した値をセットし、0でなければオプションの長さと合っているか確かめる
+チェックサムはそのまま書くので、計算するならSegmentChecksumを使う
+*/
+func (header Header) Marshal(data []byte) ([]byte, error) {
+	if 0x0f < header.Reserved {
+		return nil, fmt.Errorf("tcp reserved bits %x are longer than 4bit", header.Reserved)
+	}
+	if len(header.Options)%4 != 0 || HEADER_LEN_MAX < HEADER_LEN+len(header.Options) {
+		return nil, fmt.Errorf("tcp options length %d is invalid", len(header.Options))
+	}
+	headerLen := HEADER_LEN + len(header.Options)
+	if header.DataOffset == 0 {
+		header.DataOffset = uint8(headerLen / 4)
+	}
+	if int(header.DataOffset)*4 != headerLen {
+		return nil, fmt.Errorf("tcp data offset %d does not match options length %d", header.DataOffset, len(header.Options))
+	}
+	segment := make([]byte, headerLen, headerLen+len(data))
+	binary.BigEndian.PutUint16(segment[0:2], header.SrcPort)
+	binary.BigEndian.PutUint16(segment[2:4], header.DestPort)
+	binary.BigEndian.PutUint32(segment[4:8], header.Seq)
+	binary.BigEndian.PutUint32(segment[8:12], header.Ack)
+	segment[12] = header.DataOffset<<4 | header.Reserved
+	segment[13] = header.Flags
+	binary.BigEndian.PutUint16(segment[14:16], header.Window)
+	binary.BigEndian.PutUint16(segment[16:18], header.Checksum)
+	binary.BigEndian.PutUint16(segment[18:20], header.UrgPointer)
+	copy(segment[HEADER_LEN:], header.Options)
+	return append(segment, data...), nil
+}
+
+/*
+IPv4の疑似ヘッダを含めてチェックサムを計算する
+Checksumのフィールドは0として計算するので、結果をそのままセットできる
+*/
+func (header Header) SegmentChecksum(srcAddr, destAddr uint32, data []byte) (uint16, error) {
+	header.Checksum = 0
+	segment, err := header.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	return checksum.Transport(srcAddr, destAddr, PROTOCOL_NUM, segment), nil
+}
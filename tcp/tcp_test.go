@@ -0,0 +1,93 @@
+package tcp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []byte
+		data    []byte
+	}{
+		{name: "syn with mss", options: []byte{0x02, 0x04, 0x05, 0xb4}},
+		{name: "data", data: []byte("GET / HTTP/1.0\r\n\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := Header{
+				SrcPort:  40000,
+				DestPort: 80,
+				Seq:      100,
+				Ack:      200,
+				Flags:    FLAG_SYN | FLAG_ACK,
+				Window:   65535,
+				Options:  tt.options,
+			}
+			var err error
+			header.Checksum, err = header.SegmentChecksum(0xc0a80101, 0xc0a80201, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segment, err := header.Marshal(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checksum.Transport(0xc0a80101, 0xc0a80201, PROTOCOL_NUM, segment) != 0 {
+				t.Fatalf("checksum of %x is wrong", segment)
+			}
+			parsed, data, err := Parse(segment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 0にしていたヘッダ長は計算した値になる
+			header.DataOffset = uint8((HEADER_LEN + len(tt.options)) / 4)
+			if !reflect.DeepEqual(parsed, header) || !bytes.Equal(data, tt.data) {
+				t.Fatalf("parsed %+v %x, want %+v %x", parsed, data, header, tt.data)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	segment, _ := Header{Options: []byte{0x01, 0x01, 0x01, 0x01}}.Marshal(nil)
+	for n := 0; n < len(segment); n++ {
+		if _, _, err := Parse(segment[:n]); err == nil {
+			t.Fatalf("parse %d bytes segment is not err", n)
+		}
+	}
+	segment[12] = 0x40
+	if _, _, err := Parse(segment); err == nil {
+		t.Fatal("parse segment with data offset 4 is not err")
+	}
+	for _, header := range []Header{
+		{Options: []byte{0x01, 0x01}},
+		{Options: make([]byte, 44)},
+		{DataOffset: 6},
+		{Reserved: 0x10},
+	} {
+		if _, err := header.Marshal(nil); err == nil {
+			t.Errorf("marshal %+v is not err", header)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	segment, _ := Header{SrcPort: 40000, DestPort: 80, Flags: FLAG_SYN, Options: []byte{0x02, 0x04, 0x05, 0xb4}}.Marshal(nil)
+	f.Add(segment)
+	f.Add(segment[:HEADER_LEN-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := Parse(data)
+		if err != nil {
+			return
+		}
+		segment, err := header.Marshal(payload)
+		if err != nil || !bytes.Equal(segment, data) {
+			t.Fatalf("segment %x is marshaled to %x, %v", data, segment, err)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+/*
+Package udp はUDPのヘッダをパースしたりバイト列にしたりする
+*/
+package udp
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+const HEADER_LEN = 8
+const PROTOCOL_NUM uint8 = 0x11
+
+type Header struct {
+	SrcPort  uint16
+	DestPort uint16
+	Length   uint16 // ヘッダを含めたUDPの長さ
+	Checksum uint16 // 0ならチェックサムを使っていない
+}
+
+/*
+セグメントをヘッダとデータに分ける
+データはヘッダの長さまでなので、後ろについているものは含まない
+*/
+func Parse(segment []byte) (Header, []byte, error) {
+	if len(segment) < HEADER_LEN {
+		return Header{}, nil, fmt.Errorf("udp segment length %d is shorter than header length %d", len(segment), HEADER_LEN)
+	}
+	header := Header{
+		SrcPort:  binary.BigEndian.Uint16(segment[0:2]),
+		DestPort: binary.BigEndian.Uint16(segment[2:4]),
+		Length:   binary.BigEndian.Uint16(segment[4:6]),
+		Checksum: binary.BigEndian.Uint16(segment[6:8]),
+	}
+	if header.Length < HEADER_LEN || len(segment) < int(header.Length) {
+		return Header{}, nil, fmt.Errorf("udp length %d is invalid for segment length %d", header.Length, len(segment))
+	}
+	return header, segment[HEADER_LEN:header.Length], nil
+}
+
+/*
+ヘッダにデータをつなげたセグメントを作る
+長さが0なら計算した値をセットし、0でなければ実際の長さと合っているか確かめる
+チェックサムはそのまま書くので、計算するならSegmentChecksumを使う
+*/
+func (header Header) Marshal(data []byte) ([]byte, error) {
+	length := HEADER_LEN + len(data)
+	if 0xffff < length {
+		return nil, fmt.Errorf("udp segment length %d is too long", length)
+	}
+	if header.Length == 0 {
+		header.Length = uint16(length)
+	}
+	if int(header.Length) != length {
+		return nil, fmt.Errorf("udp length %d does not match segment length %d", header.Length, length)
+	}
+	return append(header.MarshalHeader(), data...), nil
+}
+
+/*
+データをつなげずにヘッダだけをバイト列にする
+長さはそのまま書くので、NATで書き換えたセグメントのように後からデータをつなげるときに使う
+*/
+func (header Header) MarshalHeader() []byte {
+	segment := make([]byte, HEADER_LEN, HEADER_LEN+int(header.Length))
+	binary.BigEndian.PutUint16(segment[0:2], header.SrcPort)
+	binary.BigEndian.PutUint16(segment[2:4], header.DestPort)
+	binary.BigEndian.PutUint16(segment[4:6], header.Length)
+	binary.BigEndian.PutUint16(segment[6:8], header.Checksum)
+	return segment
+}
+
+/*
+IPv4の疑似ヘッダを含めてチェックサムを計算する
+0はチェックサムを使っていないという意味なので、計算結果が0なら0xffffにする
+*/
+func (header Header) SegmentChecksum(srcAddr, destAddr uint32, data []byte) (uint16, error) {
+	header.Checksum = 0
+	segment, err := header.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	sum := checksum.Transport(srcAddr, destAddr, PROTOCOL_NUM, segment)
+	if sum == 0 {
+		return 0xffff, nil
+	}
+	return sum, nil
+}
@@ -0,0 +1,73 @@
+package udp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sat0ken/go-curo/checksum"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte("hello")
+	header := Header{SrcPort: 1234, DestPort: 53}
+	var err error
+	header.Checksum, err = header.SegmentChecksum(0xc0a80101, 0xc0a80201, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, err := header.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum.Transport(0xc0a80101, 0xc0a80201, PROTOCOL_NUM, segment) != 0 {
+		t.Fatalf("checksum of %x is wrong", segment)
+	}
+	parsed, parsedData, err := Parse(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0にしていた長さは計算した値になる
+	header.Length = HEADER_LEN + uint16(len(data))
+	if parsed != header || !bytes.Equal(parsedData, data) {
+		t.Fatalf("parsed %+v %x, want %+v %x", parsed, parsedData, header, data)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	segment, _ := Header{SrcPort: 1234, DestPort: 53}.Marshal([]byte("hello"))
+	for n := 0; n < len(segment); n++ {
+		if _, _, err := Parse(segment[:n]); err == nil {
+			t.Fatalf("parse %d bytes segment is not err", n)
+		}
+	}
+	short := append([]byte{}, segment...)
+	short[5] = 7
+	if _, _, err := Parse(short); err == nil {
+		t.Fatal("parse segment with length 7 is not err")
+	}
+	// 長さより後ろはデータに含めない
+	_, data, err := Parse(append(append([]byte{}, segment...), 0, 0))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("parse padded segment is %q, %v", data, err)
+	}
+	if _, err := (Header{Length: 9}).Marshal([]byte("hello")); err == nil {
+		t.Fatal("marshal header with wrong length is not err")
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	segment, _ := Header{SrcPort: 1234, DestPort: 53}.Marshal([]byte("hello"))
+	f.Add(segment)
+	f.Add(segment[:HEADER_LEN-1])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := Parse(data)
+		if err != nil {
+			return
+		}
+		// 長さより後ろを除いて元のセグメントに戻る
+		segment, err := header.Marshal(payload)
+		if err != nil || !bytes.Equal(segment, data[:header.Length]) {
+			t.Fatalf("segment %x is marshaled to %x, %v", data, segment, err)
+		}
+	})
+}